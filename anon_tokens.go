@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"z2api/internal/signature"
+)
+
+// AnonTokenPoolConfig 匿名 token 池配置
+type AnonTokenPoolConfig struct {
+	Size              int           // 预先获取并保持空闲的 token 数
+	TTL               time.Duration // 每个 token 自获取起的有效期（JWT 更早过期时以 JWT 为准）
+	MaxUses           int           // 每个 token 最多服务的请求数，0 表示不限制
+	RefillConcurrency int           // 后台补充 token 的最大并发数，同时限制同步获取
+	BackoffBase       time.Duration // 获取失败后退避的基础延迟
+	BackoffMax        time.Duration // 获取失败后退避的上限
+}
+
+// DefaultAnonTokenPoolConfig 返回默认的匿名 token 池配置
+func DefaultAnonTokenPoolConfig() AnonTokenPoolConfig {
+	return AnonTokenPoolConfig{
+		Size:              4,
+		TTL:               5 * time.Minute,
+		MaxUses:           20,
+		RefillConcurrency: 2,
+		BackoffBase:       time.Second,
+		BackoffMax:        2 * time.Minute,
+	}
+}
+
+// anonToken 池中的一个匿名 token
+type anonToken struct {
+	token     string
+	expiresAt time.Time
+	uses      int
+}
+
+// usable 判断 token 是否还能服务新的请求
+func (t *anonToken) usable(now time.Time, maxUses int) bool {
+	return now.Before(t.expiresAt) && (maxUses <= 0 || t.uses < maxUses)
+}
+
+// AnonTokenPool 预先获取的匿名 token 池
+// 每个会话绑定一个独立的 token，避免不同对话在上游共享记忆；token 过期或达到使用次数上限后，
+// 会话换用新的 token。空闲 token 在后台以有限并发补充，获取失败时指数退避，避免频繁请求 /api/v1/auths/
+type AnonTokenPool struct {
+	mu           sync.Mutex
+	cfg          AnonTokenPoolConfig
+	fetch        func() (string, error)
+	now          func() time.Time
+	idle         []*anonToken
+	sessions     map[string]*anonToken
+	refilling    int           // 正在后台获取的 token 数
+	sem          chan struct{} // 限制同时请求 /api/v1/auths/ 的数量
+	failures     int
+	backoffUntil time.Time
+}
+
+// NewAnonTokenPool 创建匿名 token 池，fetch 用于获取一个新的匿名 token
+func NewAnonTokenPool(cfg AnonTokenPoolConfig, fetch func() (string, error)) *AnonTokenPool {
+	cfg.RefillConcurrency = max(cfg.RefillConcurrency, 1)
+	return &AnonTokenPool{
+		cfg:      cfg,
+		fetch:    fetch,
+		now:      time.Now,
+		sessions: make(map[string]*anonToken),
+		sem:      make(chan struct{}, cfg.RefillConcurrency),
+	}
+}
+
+// GetToken 返回会话绑定的匿名 token；会话尚未绑定或绑定的 token 不可用时，取一个空闲 token 绑定，
+// 没有空闲 token 时同步获取，等待获取名额时 ctx 结束则返回其错误。处于获取失败的退避期内时直接返回错误
+func (p *AnonTokenPool) GetToken(ctx context.Context, sessionID string) (string, error) {
+	p.mu.Lock()
+	now := p.now()
+	if t, ok := p.sessions[sessionID]; ok {
+		if t.usable(now, p.cfg.MaxUses) {
+			t.uses++
+			p.mu.Unlock()
+			tokenCacheHits.Add(1)
+			return t.token, nil
+		}
+		delete(p.sessions, sessionID)
+	}
+
+	t := p.takeIdleLocked(now)
+	p.mu.Unlock()
+	p.Refill()
+
+	if t != nil {
+		debugLog("会话绑定预先获取的匿名token")
+		tokenCacheHits.Add(1)
+	} else {
+		tokenCacheMisses.Add(1)
+		token, err := p.fetchToken(ctx)
+		if err != nil {
+			return "", err
+		}
+		t = p.newToken(token)
+		debugLog("匿名token池为空，同步获取新的匿名token")
+	}
+
+	p.mu.Lock()
+	t.uses++
+	p.sessions[sessionID] = t
+	p.mu.Unlock()
+	return t.token, nil
+}
+
+// takeIdleLocked 取出一个可用的空闲 token，并丢弃已过期的空闲 token
+func (p *AnonTokenPool) takeIdleLocked(now time.Time) *anonToken {
+	for len(p.idle) > 0 {
+		t := p.idle[0]
+		p.idle = p.idle[1:]
+		if t.usable(now, p.cfg.MaxUses) {
+			return t
+		}
+	}
+	return nil
+}
+
+// newToken 记录新获取的 token，有效期取配置的 TTL 与 JWT 过期时间中较早者
+func (p *AnonTokenPool) newToken(token string) *anonToken {
+	expiresAt := p.now().Add(p.cfg.TTL)
+	if payload, err := signature.DecodeJWT(token); err == nil && payload.Exp > 0 {
+		if exp := time.Unix(payload.Exp, 0); exp.Before(expiresAt) {
+			expiresAt = exp
+		}
+	}
+	return &anonToken{token: token, expiresAt: expiresAt}
+}
+
+// fetchToken 在并发限制内获取一个新的 token，失败时进入退避，成功时清除退避；
+// 等待获取名额时 ctx 结束则返回其错误，不计入失败
+func (p *AnonTokenPool) fetchToken(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	if wait := p.backoffUntil.Sub(p.now()); wait > 0 {
+		p.mu.Unlock()
+		return "", fmt.Errorf("获取匿名token连续失败 %d 次，%v 后重试", p.failures, wait.Round(time.Millisecond))
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	token, err := p.fetch()
+	<-p.sem
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		delay := calculateBackoffDelay(min(p.failures, 16), p.cfg.BackoffBase, p.cfg.BackoffMax)
+		p.failures++
+		p.backoffUntil = p.now().Add(delay)
+		debugLog("获取匿名token失败 (连续 %d 次)，%v 内不再获取: %v", p.failures, delay, err)
+		return "", err
+	}
+	p.failures = 0
+	p.backoffUntil = time.Time{}
+	return token, nil
+}
+
+// Refill 在后台补充空闲 token 至配置的数量，同时清理已不可用的会话绑定；退避期内不补充
+func (p *AnonTokenPool) Refill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	for sessionID, t := range p.sessions {
+		if !t.usable(now, p.cfg.MaxUses) {
+			delete(p.sessions, sessionID)
+		}
+	}
+	if now.Before(p.backoffUntil) {
+		return
+	}
+	need := p.cfg.Size - len(p.idle) - p.refilling
+	for range min(need, p.cfg.RefillConcurrency-p.refilling) {
+		p.refilling++
+		go p.refillOne()
+	}
+}
+
+// refillOne 获取一个 token 放入空闲列表，成功后继续补充
+func (p *AnonTokenPool) refillOne() {
+	token, err := p.fetchToken(context.Background())
+
+	p.mu.Lock()
+	p.refilling--
+	if err == nil {
+		p.idle = append(p.idle, p.newToken(token))
+	}
+	p.mu.Unlock()
+
+	if err == nil {
+		p.Refill()
+	}
+}
+
+// InvalidateToken 上游拒绝 token（如 401）时将其移出池与所有会话绑定，该 token 上传的文件随之失效
+func (p *AnonTokenPool) InvalidateToken(token string) {
+	p.mu.Lock()
+	for sessionID, t := range p.sessions {
+		if t.token == token {
+			delete(p.sessions, sessionID)
+		}
+	}
+	p.idle = slices.DeleteFunc(p.idle, func(t *anonToken) bool { return t.token == token })
+	p.mu.Unlock()
+
+	if uploadCache != nil {
+		uploadCache.EvictToken(token)
+	}
+	debugLog("匿名token已标记为失效，会话下次请求将换用新token")
+}
+
+// AnonTokenPoolStats 匿名 token 池状态
+type AnonTokenPoolStats struct {
+	Idle         int       `json:"idle"`
+	Sessions     int       `json:"sessions"`
+	Refilling    int       `json:"refilling"`
+	Failures     int       `json:"failures"`
+	BackoffUntil time.Time `json:"backoff_until,omitzero"`
+}
+
+// Stats 返回匿名 token 池的状态
+func (p *AnonTokenPool) Stats() AnonTokenPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := AnonTokenPoolStats{Idle: len(p.idle), Sessions: len(p.sessions), Refilling: p.refilling, Failures: p.failures}
+	if p.now().Before(p.backoffUntil) {
+		stats.BackoffUntil = p.backoffUntil
+	}
+	return stats
+}
+
+// anonTokenStats 返回匿名 token 池的状态，未启用匿名 token 时返回 nil
+func anonTokenStats() *AnonTokenPoolStats {
+	if anonTokens == nil || !appConfig.AnonTokenEnabled {
+		return nil
+	}
+	stats := anonTokens.Stats()
+	return &stats
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAnonFetcher 测试用的匿名 token 获取函数，依次返回 anon-1、anon-2……
+type fakeAnonFetcher struct {
+	mu    sync.Mutex
+	calls int
+	fail  bool
+}
+
+func (f *fakeAnonFetcher) fetch() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.fail {
+		return "", errors.New("anon token status=429")
+	}
+	return fmt.Sprintf("anon-%d", f.calls), nil
+}
+
+// newTestAnonTokenPool 创建不预先获取 token、使用测试时钟的匿名 token 池
+func newTestAnonTokenPool(cfg AnonTokenPoolConfig, fetcher *fakeAnonFetcher, now *time.Time) *AnonTokenPool {
+	p := NewAnonTokenPool(cfg, fetcher.fetch)
+	p.now = func() time.Time { return *now }
+	return p
+}
+
+// TestAnonTokenPoolSessions 测试每个会话绑定独立的 token，达到使用次数上限或过期后换用新 token
+func TestAnonTokenPoolSessions(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	fetcher := &fakeAnonFetcher{}
+	p := newTestAnonTokenPool(AnonTokenPoolConfig{TTL: time.Minute, MaxUses: 2}, fetcher, &now)
+
+	a1, _ := p.GetToken(context.Background(), "alice")
+	b1, _ := p.GetToken(context.Background(), "bob")
+	a2, _ := p.GetToken(context.Background(), "alice")
+	if a1 == b1 || a1 != a2 {
+		t.Fatalf("不同会话应使用不同 token，同一会话应复用: alice %s/%s, bob %s", a1, a2, b1)
+	}
+
+	if a3, _ := p.GetToken(context.Background(), "alice"); a3 == a1 {
+		t.Errorf("达到使用次数上限后应换用新 token, 实际仍为 %s", a3)
+	}
+
+	now = now.Add(time.Minute)
+	b2, _ := p.GetToken(context.Background(), "bob")
+	if b2 == b1 {
+		t.Errorf("过期后应换用新 token, 实际仍为 %s", b2)
+	}
+
+	p.InvalidateToken(b2)
+	if b3, _ := p.GetToken(context.Background(), "bob"); b3 == b2 {
+		t.Errorf("失效后应换用新 token, 实际仍为 %s", b3)
+	}
+	if stats := p.Stats(); stats.Sessions != 1 {
+		t.Errorf("过期的会话绑定应被清理, 会话数 = %d, 期望 1", stats.Sessions)
+	}
+}
+
+// TestAnonTokenPoolBackoff 测试获取失败后在退避期内不再请求上游，退避结束后恢复
+func TestAnonTokenPoolBackoff(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	fetcher := &fakeAnonFetcher{fail: true}
+	p := newTestAnonTokenPool(AnonTokenPoolConfig{TTL: time.Minute, BackoffBase: time.Second, BackoffMax: time.Second}, fetcher, &now)
+
+	if _, err := p.GetToken(context.Background(), "alice"); err == nil {
+		t.Fatal("获取失败时应返回错误")
+	}
+	if _, err := p.GetToken(context.Background(), "alice"); err == nil || fetcher.calls != 1 {
+		t.Fatalf("退避期内应直接返回错误而不请求上游, 请求次数 %d", fetcher.calls)
+	}
+	if stats := p.Stats(); stats.Failures != 1 || stats.BackoffUntil.IsZero() {
+		t.Errorf("状态 = %+v, 期望记录 1 次失败与退避时间", stats)
+	}
+
+	now = now.Add(time.Second)
+	fetcher.fail = false
+	if token, err := p.GetToken(context.Background(), "alice"); err != nil || token == "" {
+		t.Fatalf("退避结束后应恢复获取, 错误: %v", err)
+	}
+	if stats := p.Stats(); stats.Failures != 0 || !stats.BackoffUntil.IsZero() {
+		t.Errorf("获取成功后应清除退避, 实际 %+v", stats)
+	}
+}
+
+// TestAnonTokenPoolRefill 测试后台预先获取 token 至配置的数量，并发不超过上限
+func TestAnonTokenPoolRefill(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, peak, calls := 0, 0, 0
+	fetch := func() (string, error) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		calls++
+		token := fmt.Sprintf("anon-%d", calls)
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return token, nil
+	}
+
+	p := NewAnonTokenPool(AnonTokenPoolConfig{Size: 5, TTL: time.Minute, RefillConcurrency: 2}, fetch)
+	p.Refill()
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Stats().Idle < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if stats := p.Stats(); stats.Idle != 5 || stats.Refilling != 0 {
+		t.Fatalf("状态 = %+v, 期望预先获取 5 个 token", stats)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if peak > 2 || calls != 5 {
+		t.Errorf("并发峰值 %d, 获取次数 %d, 期望并发不超过 2 且恰好获取 5 次", peak, calls)
+	}
+}
+
+// TestAnonTokenPoolFetchCanceled 测试获取名额已满时同步获取随请求的 ctx 结束返回，不计入失败
+func TestAnonTokenPoolFetchCanceled(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	fetch := func() (string, error) {
+		close(started)
+		<-release
+		return "anon-1", nil
+	}
+	p := NewAnonTokenPool(AnonTokenPoolConfig{TTL: time.Minute, RefillConcurrency: 1}, fetch)
+
+	// 第一个会话占用唯一的获取名额
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.GetToken(context.Background(), "alice")
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := p.GetToken(ctx, "bob")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ctx 结束时应返回其错误, 实际 %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("等待获取名额未随 ctx 结束: %v", elapsed)
+	}
+	if stats := p.Stats(); stats.Failures != 0 || !stats.BackoffUntil.IsZero() {
+		t.Errorf("ctx 结束不应计入失败, 实际 %+v", stats)
+	}
+
+	close(release)
+	<-done
+}
@@ -0,0 +1,762 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"z2api/errors"
+	"z2api/types"
+	"z2api/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// GinHandleAnthropicMessages Anthropic Messages API (/v1/messages)
+// 将 Anthropic 请求转换为 OpenAI 请求后复用同一条上游管线
+func GinHandleAnthropicMessages(c *gin.Context) {
+	startTime := time.Now()
+
+	// 使用 context 超时控制
+	ctx := c.Request.Context()
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	c.Set("start_time", startTime)
+	c.Set("user_agent", c.GetHeader("User-Agent"))
+	c.Set("debug_mode", appConfig.DebugMode)
+
+	// 更新监控指标
+	totalRequests.Add(1)
+	currentConcurrency.Add(1)
+	defer currentConcurrency.Add(-1)
+
+	// API Key 验证 - Anthropic SDK 使用 x-api-key，同时兼容 Bearer
+	if extractAPIKey(c) != appConfig.DefaultKey {
+		anthropicErrorResponse(c, errors.ErrInvalidAPIKey)
+		recordError(c, startTime, errors.ErrInvalidAPIKey.StatusCode, "invalid_api_key")
+		return
+	}
+
+	var req types.AnthropicRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok && len(validationErrors) > 0 {
+			e := validationErrors[0]
+			anthropicErrorResponse(c, errors.NewValidationErrorWithParam(getValidationErrorMessage(e), e.Field()))
+			recordError(c, startTime, http.StatusBadRequest, "validation_error")
+			return
+		}
+
+		anthropicErrorResponse(c, errors.ErrInvalidJSON.WithDetails(err.Error()))
+		recordError(c, startTime, http.StatusBadRequest, "invalid_request_error")
+		return
+	}
+
+	debugLog("Anthropic 请求解析成功 - 模型: %s, 流式: %v, 消息数: %d", req.Model, req.Stream, len(req.Messages))
+
+	openAIReq, err := convertAnthropicRequest(req)
+	if err != nil {
+		anthropicErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusBadRequest, "validation_error")
+		return
+	}
+
+	modelConfig, err := resolveModelConfig(openAIReq.Model)
+	if err != nil {
+		anthropicErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusNotFound, "model_not_found")
+		return
+	}
+	c.Set("model_name", modelConfig.Name)
+
+	setDefaultParams(&openAIReq, modelConfig)
+
+	if err := validateBusinessRules(&openAIReq); err != nil {
+		anthropicErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusBadRequest, "validation_error")
+		return
+	}
+
+	// 生成会话ID
+	sessionID := openAIReq.User
+	if sessionID == "" {
+		sessionID = c.ClientIP()
+	}
+	c.Set("session_id", sessionID)
+
+	chatID := utils.GenerateChatID()
+	msgID := utils.GenerateMessageID()
+
+	authToken, err := getRequestAuthToken(timeoutCtx, sessionID, openAIReq.Messages)
+	if err != nil {
+		apiErr := errors.WrapError(err)
+		setPoolRetryAfter(c, apiErr)
+		anthropicErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+
+	upstreamReq, err := buildUpstreamRequest(timeoutCtx, openAIReq, chatID, msgID, modelConfig, authToken)
+	if err != nil {
+		apiErr := errors.WrapError(err)
+		anthropicErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+
+	// 显式的 thinking 配置优先于默认的特性推断
+	if req.Thinking != nil {
+		upstreamReq.Features["enable_thinking"] = req.Thinking.Type == "enabled" && modelConfig.Capabilities.Thinking
+	}
+
+	if req.Stream {
+		handleAnthropicStreamResponse(timeoutCtx, c, upstreamReq, chatID, authToken, modelConfig.Name, sessionID)
+	} else {
+		handleAnthropicNonStreamResponse(timeoutCtx, c, upstreamReq, chatID, authToken, modelConfig.Name, sessionID)
+	}
+}
+
+// handleAnthropicStreamResponse 以 Anthropic SSE 事件格式输出流式响应
+func handleAnthropicStreamResponse(ctx context.Context, c *gin.Context, upstreamReq types.UpstreamRequest, chatID string, authToken string, modelName string, sessionID string) {
+	startTime := c.GetTime("start_time")
+	debugLog("开始处理 Anthropic 流式响应 (chat_id=%s, model=%s)", chatID, upstreamReq.Model)
+
+	body, cancel, err := openValidatedStream(ctx, c, upstreamReq, chatID, authToken, sessionID)
+	if err != nil {
+		apiErr := errors.WrapError(err)
+		anthropicErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+	defer func() {
+		cancel()
+		body.Close()
+	}()
+
+	SetSSEHeaders(c)
+
+	handler := NewAnthropicStreamHandler(c, modelName)
+	handler.Start()
+
+	if err := streamUpstreamPhases(ctx, c, body, withOutputHandling(handler, upstreamReq, cancel)); err != nil {
+		debugLog("Anthropic 流式响应处理错误: %v", err)
+		apiErr := errors.WrapError(err)
+		handler.FailStream(apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+
+	recordUsage(c, handler.usage)
+	recordSuccess(c, startTime, modelName, true)
+	debugLog("Anthropic 流式响应处理完成")
+}
+
+// handleAnthropicNonStreamResponse 聚合上游响应并返回 Anthropic Message 对象
+func handleAnthropicNonStreamResponse(ctx context.Context, c *gin.Context, upstreamReq types.UpstreamRequest, chatID string, authToken string, modelName string, sessionID string) {
+	startTime := c.GetTime("start_time")
+	debugLog("开始处理 Anthropic 非流式响应 (chat_id=%s, model=%s)", chatID, upstreamReq.Model)
+
+	aggregator, err := collectUpstreamResponse(ctx, c, upstreamReq, chatID, authToken, sessionID)
+	if err != nil {
+		if apiErr, ok := err.(errors.APIError); ok {
+			anthropicErrorResponse(c, apiErr)
+			recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		}
+		return
+	}
+
+	content, reasoningContent, toolCalls, usage := aggregator.GetResult()
+	recordUsage(c, usage)
+	resp := buildAnthropicResponse(content, reasoningContent, toolCalls, usage, modelName)
+	if aggregator.StopSequence != "" && len(toolCalls) == 0 {
+		resp.StopReason = "stop_sequence"
+		resp.StopSequence = &aggregator.StopSequence
+	} else if aggregator.Truncated && len(toolCalls) == 0 {
+		resp.StopReason = anthropicStopReason("length")
+	}
+	c.JSON(http.StatusOK, resp)
+
+	recordSuccess(c, startTime, modelName, false)
+	debugLog("Anthropic 非流式响应完成")
+}
+
+// convertAnthropicRequest 将 Anthropic 请求转换为内部使用的 OpenAI 请求
+func convertAnthropicRequest(req types.AnthropicRequest) (types.OpenAIRequest, error) {
+	openAIReq := types.OpenAIRequest{
+		Model:       req.Model,
+		Stream:      req.Stream,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		TopK:        req.TopK,
+		MaxTokens:   types.IntPtr(req.MaxTokens),
+	}
+
+	if len(req.StopSequences) > 0 {
+		openAIReq.Stop = req.StopSequences
+	}
+	if req.Metadata != nil {
+		openAIReq.User = req.Metadata.UserID
+	}
+
+	// system 可以是字符串或文本块数组
+	if req.System != nil {
+		blocks, err := decodeAnthropicBlocks(req.System)
+		if err != nil {
+			return openAIReq, errors.NewValidationErrorWithParam("system 格式无效: "+err.Error(), "system")
+		}
+		if text := anthropicBlocksText(blocks); text != "" {
+			openAIReq.Messages = append(openAIReq.Messages, types.Message{Role: "system", Content: text})
+		}
+	}
+
+	for i, msg := range req.Messages {
+		blocks, err := decodeAnthropicBlocks(msg.Content)
+		if err != nil {
+			return openAIReq, errors.NewValidationErrorWithParam(fmt.Sprintf("messages[%d].content 格式无效: %v", i, err), "messages")
+		}
+
+		if msg.Role == "assistant" {
+			openAIReq.Messages = append(openAIReq.Messages, convertAnthropicAssistantBlocks(blocks))
+			continue
+		}
+
+		openAIReq.Messages = append(openAIReq.Messages, convertAnthropicUserBlocks(blocks)...)
+	}
+
+	if len(openAIReq.Messages) == 0 {
+		return openAIReq, errors.NewValidationErrorWithParam("messages不能为空", "messages")
+	}
+
+	for _, tool := range req.Tools {
+		openAIReq.Tools = append(openAIReq.Tools, types.Tool{
+			Type: "function",
+			Function: types.ToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+
+	if req.ToolChoice != nil {
+		switch req.ToolChoice.Type {
+		case "auto", "none":
+			openAIReq.ToolChoice = req.ToolChoice.Type
+		case "any":
+			openAIReq.ToolChoice = "required"
+		case "tool":
+			openAIReq.ToolChoice = map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": req.ToolChoice.Name},
+			}
+		}
+	}
+
+	return openAIReq, nil
+}
+
+// convertAnthropicAssistantBlocks 转换助手消息：text 合并为内容，thinking 作为推理内容，tool_use 转为工具调用
+func convertAnthropicAssistantBlocks(blocks []types.AnthropicContentBlock) types.Message {
+	msg := types.Message{Role: "assistant"}
+
+	var text strings.Builder
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "thinking":
+			msg.ReasoningContent += block.Thinking
+		case "tool_use":
+			arguments := "{}"
+			if block.Input != nil {
+				if encoded, err := sonicInternal.Marshal(block.Input); err == nil {
+					arguments = string(encoded)
+				}
+			}
+			msg.ToolCalls = append(msg.ToolCalls, types.ToolCall{
+				Index: len(msg.ToolCalls),
+				ID:    block.ID,
+				Type:  "function",
+				Function: types.ToolCallFunction{
+					Name:      block.Name,
+					Arguments: arguments,
+				},
+			})
+		}
+	}
+	msg.Content = text.String()
+
+	return msg
+}
+
+// convertAnthropicUserBlocks 转换用户消息：tool_result 拆分为 tool 角色消息，其余内容保留为用户消息
+func convertAnthropicUserBlocks(blocks []types.AnthropicContentBlock) []types.Message {
+	var messages []types.Message
+	var parts []types.ContentPart
+	hasImage := false
+
+	for _, block := range blocks {
+		switch block.Type {
+		case "tool_result":
+			messages = append(messages, types.Message{
+				Role:       "tool",
+				Content:    anthropicToolResultText(block),
+				ToolCallID: block.ToolUseID,
+			})
+		case "text":
+			parts = append(parts, types.ContentPart{Type: "text", Text: block.Text})
+		case "image":
+			if url := anthropicImageURL(block.Source); url != "" {
+				parts = append(parts, types.ContentPart{Type: "image_url", ImageURL: &types.ImageURL{URL: url}})
+				hasImage = true
+			}
+		default:
+			debugLog("忽略不支持的 Anthropic 内容块类型: %s", block.Type)
+		}
+	}
+
+	if len(parts) == 0 {
+		return messages
+	}
+
+	userMsg := types.Message{Role: "user"}
+	if hasImage {
+		userMsg.Content = parts
+	} else {
+		texts := make([]string, 0, len(parts))
+		for _, part := range parts {
+			texts = append(texts, part.Text)
+		}
+		userMsg.Content = strings.Join(texts, "\n")
+	}
+
+	return append(messages, userMsg)
+}
+
+// decodeAnthropicBlocks 将 string 或通用数组形式的内容解码为内容块
+func decodeAnthropicBlocks(content interface{}) ([]types.AnthropicContentBlock, error) {
+	switch v := content.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []types.AnthropicContentBlock{{Type: "text", Text: v}}, nil
+	default:
+		raw, err := sonicInternal.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var blocks []types.AnthropicContentBlock
+		if err := sonicInternal.Unmarshal(raw, &blocks); err != nil {
+			return nil, err
+		}
+		return blocks, nil
+	}
+}
+
+// anthropicBlocksText 拼接所有文本块
+func anthropicBlocksText(blocks []types.AnthropicContentBlock) string {
+	texts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if block.Type == "text" && block.Text != "" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// anthropicToolResultText 提取 tool_result 的文本内容
+func anthropicToolResultText(block types.AnthropicContentBlock) string {
+	blocks, err := decodeAnthropicBlocks(block.Content)
+	if err != nil {
+		debugLog("解析 tool_result 内容失败: %v", err)
+		return ""
+	}
+	return anthropicBlocksText(blocks)
+}
+
+// anthropicImageURL 将图片来源转换为 image_url 可用的 URL（base64 转为 data URL）
+func anthropicImageURL(source *types.AnthropicImageSource) string {
+	if source == nil {
+		return ""
+	}
+	switch source.Type {
+	case "base64":
+		if source.Data == "" {
+			return ""
+		}
+		mediaType := source.MediaType
+		if mediaType == "" {
+			mediaType = "image/jpeg"
+		}
+		return "data:" + mediaType + ";base64," + source.Data
+	case "url":
+		return source.URL
+	}
+	return ""
+}
+
+// anthropicStopReason 将 OpenAI 的 finish_reason 映射为 Anthropic 的 stop_reason
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "tool_calls":
+		return "tool_use"
+	case "length":
+		return "max_tokens"
+	default:
+		return "end_turn"
+	}
+}
+
+// generateAnthropicMessageID 生成 Anthropic 风格的消息ID
+func generateAnthropicMessageID() string {
+	return "msg_" + strings.ReplaceAll(utils.GenerateUUID(), "-", "")
+}
+
+// buildAnthropicResponse 构建非流式 Anthropic 响应
+func buildAnthropicResponse(content, reasoningContent string, toolCalls []types.ToolCall, usage *types.Usage, modelName string) types.AnthropicResponse {
+	blocks := make([]types.AnthropicContentBlock, 0, 2+len(toolCalls))
+
+	if thinking := strings.TrimSpace(stripThinkingMarkup(reasoningContent)); thinking != "" {
+		blocks = append(blocks, types.AnthropicContentBlock{Type: "thinking", Thinking: thinking})
+	}
+	if content != "" {
+		blocks = append(blocks, types.AnthropicContentBlock{Type: "text", Text: content})
+	}
+
+	finishReason := "stop"
+	for _, call := range normalizeToolCalls(toolCalls) {
+		finishReason = "tool_calls"
+		input := map[string]interface{}{}
+		if err := sonicInternal.UnmarshalFromString(call.Function.Arguments, &input); err != nil {
+			debugLog("解析工具参数失败: %v", err)
+		}
+		blocks = append(blocks, types.AnthropicContentBlock{
+			Type:  "tool_use",
+			ID:    call.ID,
+			Name:  call.Function.Name,
+			Input: input,
+		})
+	}
+
+	resp := types.AnthropicResponse{
+		ID:         generateAnthropicMessageID(),
+		Type:       "message",
+		Role:       "assistant",
+		Model:      modelName,
+		Content:    blocks,
+		StopReason: anthropicStopReason(finishReason),
+	}
+	if usage != nil {
+		resp.Usage = types.AnthropicUsage{
+			InputTokens:  usage.PromptTokens,
+			OutputTokens: usage.CompletionTokens,
+		}
+	}
+
+	return resp
+}
+
+// anthropicErrorResponse 以 Anthropic 错误格式输出错误
+func anthropicErrorResponse(c *gin.Context, err errors.APIError) {
+	c.AbortWithStatusJSON(err.StatusCode, anthropicErrorBody(err))
+}
+
+// anthropicErrorBody 构造 Anthropic 格式的错误响应体
+func anthropicErrorBody(err errors.APIError) gin.H {
+	errType := "api_error"
+	switch err.StatusCode {
+	case http.StatusBadRequest:
+		errType = "invalid_request_error"
+	case http.StatusUnauthorized:
+		errType = "authentication_error"
+	case http.StatusForbidden:
+		errType = "permission_error"
+	case http.StatusNotFound:
+		errType = "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		errType = "request_too_large"
+	case http.StatusTooManyRequests:
+		errType = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		errType = "overloaded_error"
+	}
+
+	message := err.Message
+	if err.Details != "" {
+		message = message + ": " + err.Details
+	}
+
+	return gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    errType,
+			"message": message,
+		},
+	}
+}
+
+// AnthropicStreamHandler 将上游阶段转换为 Anthropic SSE 事件
+type AnthropicStreamHandler struct {
+	ctx        *gin.Context
+	model      string
+	messageID  string
+	tools      *StreamToolCollector // 工具调用在结束时作为 tool_use 块输出
+	usage      *types.Usage
+	blockIndex int    // 下一个内容块的索引
+	openBlock  string // 当前打开的内容块类型：thinking、text，空表示无
+	stopSeq    string // 匹配到的停止序列
+	truncated  bool   // 输出因 max_tokens 被截断
+	tracker    *usageTracker
+	sentFinish bool
+}
+
+// NewAnthropicStreamHandler 创建 Anthropic 流式处理器
+func NewAnthropicStreamHandler(c *gin.Context, model string) *AnthropicStreamHandler {
+	messageID := generateAnthropicMessageID()
+	return &AnthropicStreamHandler{
+		ctx:       c,
+		model:     model,
+		messageID: messageID,
+		tools:     NewStreamToolCollector(messageID, model),
+	}
+}
+
+// Start 发送 message_start 事件
+func (h *AnthropicStreamHandler) Start() {
+	h.writeEvent("message_start", gin.H{
+		"type": "message_start",
+		"message": gin.H{
+			"id":            h.messageID,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         h.model,
+			"content":       []interface{}{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         gin.H{"input_tokens": 0, "output_tokens": 0},
+		},
+	})
+	h.writeEvent("ping", gin.H{"type": "ping"})
+}
+
+// writeEvent 写入一个带事件名的 SSE 事件
+func (h *AnthropicStreamHandler) writeEvent(event string, payload interface{}) {
+	data, err := sonicStream.Marshal(payload)
+	if err != nil {
+		debugLog("序列化 Anthropic 事件失败: %v", err)
+		return
+	}
+	h.ctx.Writer.WriteString("event: " + event + "\ndata: " + string(data) + "\n\n")
+	h.ctx.Writer.Flush()
+}
+
+// ensureBlock 确保指定类型的内容块处于打开状态，必要时关闭上一个块
+func (h *AnthropicStreamHandler) ensureBlock(blockType string) {
+	if h.openBlock == blockType {
+		return
+	}
+	h.closeBlock()
+
+	contentBlock := gin.H{"type": blockType}
+	if blockType == "thinking" {
+		contentBlock["thinking"] = ""
+	} else {
+		contentBlock["text"] = ""
+	}
+	h.writeEvent("content_block_start", gin.H{
+		"type":          "content_block_start",
+		"index":         h.blockIndex,
+		"content_block": contentBlock,
+	})
+	h.openBlock = blockType
+}
+
+// closeBlock 关闭当前打开的内容块
+func (h *AnthropicStreamHandler) closeBlock() {
+	if h.openBlock == "" {
+		return
+	}
+	h.writeEvent("content_block_stop", gin.H{
+		"type":  "content_block_stop",
+		"index": h.blockIndex,
+	})
+	h.blockIndex++
+	h.openBlock = ""
+}
+
+// writeDelta 在指定类型的内容块中写入增量
+func (h *AnthropicStreamHandler) writeDelta(blockType string, text string) {
+	if text == "" {
+		return
+	}
+	h.ensureBlock(blockType)
+
+	delta := gin.H{"type": "text_delta", "text": text}
+	if blockType == "thinking" {
+		delta = gin.H{"type": "thinking_delta", "thinking": text}
+	}
+	h.writeEvent("content_block_delta", gin.H{
+		"type":  "content_block_delta",
+		"index": h.blockIndex,
+		"delta": delta,
+	})
+}
+
+// ProcessThinkingPhase 处理思考阶段，输出 thinking_delta
+func (h *AnthropicStreamHandler) ProcessThinkingPhase(data *types.UpstreamData) {
+	h.writeDelta("thinking", stripThinkingMarkup(data.Data.DeltaContent))
+}
+
+// ProcessAnswerPhase 处理回答阶段，输出 text_delta
+func (h *AnthropicStreamHandler) ProcessAnswerPhase(data *types.UpstreamData) {
+	content := data.Data.DeltaContent
+	if data.Data.EditContent != "" {
+		content = processAnswerContent(data.Data.DeltaContent, data.Data.EditContent)
+	}
+	h.writeDelta("text", content)
+}
+
+// ProcessToolCallPhase 处理工具调用阶段，工具调用在结束时统一输出为 tool_use 块
+func (h *AnthropicStreamHandler) ProcessToolCallPhase(data *types.UpstreamData) {
+	h.tools.ProcessToolCallPhase(data)
+}
+
+// SetToolValidator 设置输出 tool_use 块前使用的参数校验器
+func (h *AnthropicStreamHandler) SetToolValidator(v *toolArgsValidator) {
+	h.tools.SetToolValidator(v)
+}
+
+// EmitToolCalls 记录模拟解析出的工具调用，在结束时输出为 tool_use 块
+func (h *AnthropicStreamHandler) EmitToolCalls(calls []types.ToolCall) {
+	h.tools.AddCalls(calls)
+}
+
+// ProcessOtherPhase 处理其他阶段（工具调用结束、用量等）
+func (h *AnthropicStreamHandler) ProcessOtherPhase(data *types.UpstreamData) {
+	if data.Data.Usage.TotalTokens > 0 {
+		usage := data.Data.Usage
+		h.usage = &usage
+	}
+
+	handled, finished := h.tools.ProcessOtherPhase(data)
+	if finished {
+		h.finish("tool_calls")
+		return
+	}
+	if handled {
+		return
+	}
+
+	h.writeDelta("text", data.Data.DeltaContent)
+
+	if data.Data.Phase == "done" || data.Data.Done {
+		h.ProcessDonePhase(data)
+	}
+}
+
+// ProcessDonePhase 处理完成阶段
+func (h *AnthropicStreamHandler) ProcessDonePhase(data *types.UpstreamData) {
+	if h.sentFinish {
+		return
+	}
+	if data != nil && data.Data.Usage.TotalTokens > 0 {
+		usage := data.Data.Usage
+		h.usage = &usage
+	}
+
+	finishReason := "stop"
+	if h.tools.HasCalls() {
+		finishReason = "tool_calls"
+	} else if h.truncated {
+		finishReason = "length"
+	}
+	h.finish(finishReason)
+}
+
+// SetStopSequence 记录匹配到的停止序列，结束时以 stop_sequence 报告
+func (h *AnthropicStreamHandler) SetStopSequence(sequence string) {
+	h.stopSeq = sequence
+}
+
+// MarkTruncated 标记输出因 max_tokens 被截断，结束时以 max_tokens 报告
+func (h *AnthropicStreamHandler) MarkTruncated() {
+	h.truncated = true
+}
+
+// SetUsageTracker 设置用量统计，结束时以其结果报告 usage
+func (h *AnthropicStreamHandler) SetUsageTracker(tracker *usageTracker) {
+	h.tracker = tracker
+}
+
+// IsFinished 是否已发送结束事件
+func (h *AnthropicStreamHandler) IsFinished() bool {
+	return h.sentFinish
+}
+
+// FailStream 以 error 事件结束流式响应，用于已开始输出后发生的错误
+func (h *AnthropicStreamHandler) FailStream(apiErr errors.APIError) {
+	if h.sentFinish {
+		return
+	}
+	h.writeEvent("error", anthropicErrorBody(apiErr))
+	h.sentFinish = true
+}
+
+// finish 关闭内容块、输出 tool_use 块并发送 message_delta / message_stop
+func (h *AnthropicStreamHandler) finish(finishReason string) {
+	if h.sentFinish {
+		return
+	}
+	h.closeBlock()
+
+	calls, err := h.tools.ValidatedCalls()
+	if err != nil {
+		debugLog("Anthropic 流式响应工具调用校验失败: %v", err)
+		h.FailStream(errors.WrapError(err))
+		return
+	}
+	for _, call := range calls {
+		h.writeEvent("content_block_start", gin.H{
+			"type":  "content_block_start",
+			"index": h.blockIndex,
+			"content_block": gin.H{
+				"type":  "tool_use",
+				"id":    call.ID,
+				"name":  call.Function.Name,
+				"input": gin.H{},
+			},
+		})
+		h.writeEvent("content_block_delta", gin.H{
+			"type":  "content_block_delta",
+			"index": h.blockIndex,
+			"delta": gin.H{"type": "input_json_delta", "partial_json": call.Function.Arguments},
+		})
+		h.writeEvent("content_block_stop", gin.H{
+			"type":  "content_block_stop",
+			"index": h.blockIndex,
+		})
+		h.blockIndex++
+	}
+
+	if h.tracker != nil {
+		h.usage = h.tracker.Usage()
+	}
+	inputTokens, outputTokens := 0, 0
+	if h.usage != nil {
+		inputTokens, outputTokens = h.usage.PromptTokens, h.usage.CompletionTokens
+	}
+	delta := gin.H{"stop_reason": anthropicStopReason(finishReason), "stop_sequence": nil}
+	if h.stopSeq != "" && finishReason == "stop" {
+		delta = gin.H{"stop_reason": "stop_sequence", "stop_sequence": h.stopSeq}
+	}
+	h.writeEvent("message_delta", gin.H{
+		"type":  "message_delta",
+		"delta": delta,
+		"usage": gin.H{"input_tokens": inputTokens, "output_tokens": outputTokens},
+	})
+	h.writeEvent("message_stop", gin.H{"type": "message_stop"})
+	h.sentFinish = true
+}
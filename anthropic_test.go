@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestConvertAnthropicRequest 测试 Anthropic 请求到 OpenAI 请求的转换
+func TestConvertAnthropicRequest(t *testing.T) {
+	req := types.AnthropicRequest{
+		Model:     "glm-4.5",
+		MaxTokens: 1024,
+		System:    "你是一个助手",
+		Messages: []types.AnthropicMessage{
+			{Role: "user", Content: "北京天气如何？"},
+			{Role: "assistant", Content: []interface{}{
+				map[string]interface{}{"type": "text", "text": "我来查询一下"},
+				map[string]interface{}{"type": "tool_use", "id": "call_1", "name": "get_weather", "input": map[string]interface{}{"city": "北京"}},
+			}},
+			{Role: "user", Content: []interface{}{
+				map[string]interface{}{"type": "tool_result", "tool_use_id": "call_1", "content": "晴，25度"},
+				map[string]interface{}{"type": "text", "text": "谢谢"},
+			}},
+		},
+		StopSequences: []string{"END"},
+		ToolChoice:    &types.AnthropicToolChoice{Type: "any"},
+		Tools: []types.AnthropicTool{
+			{Name: "get_weather", InputSchema: map[string]interface{}{"type": "object"}},
+		},
+	}
+
+	got, err := convertAnthropicRequest(req)
+	if err != nil {
+		t.Fatalf("转换失败: %v", err)
+	}
+
+	wantRoles := []string{"system", "user", "assistant", "tool", "user"}
+	if len(got.Messages) != len(wantRoles) {
+		t.Fatalf("期望 %d 条消息, 实际 %d 条", len(wantRoles), len(got.Messages))
+	}
+	for i, role := range wantRoles {
+		if got.Messages[i].Role != role {
+			t.Errorf("消息 %d 期望角色 %s, 实际 %s", i, role, got.Messages[i].Role)
+		}
+	}
+
+	assistant := got.Messages[2]
+	if len(assistant.ToolCalls) != 1 || assistant.ToolCalls[0].Function.Arguments != `{"city":"北京"}` {
+		t.Errorf("助手工具调用转换错误: %+v", assistant.ToolCalls)
+	}
+	if got.Messages[3].Content != "晴，25度" || got.Messages[3].ToolCallID != "call_1" {
+		t.Errorf("tool_result 转换错误: %+v", got.Messages[3])
+	}
+	if got.ToolChoice != "required" {
+		t.Errorf("期望 tool_choice 为 required, 实际 %v", got.ToolChoice)
+	}
+	if got.MaxTokens == nil || *got.MaxTokens != 1024 {
+		t.Errorf("max_tokens 转换错误: %v", got.MaxTokens)
+	}
+	if len(got.Tools) != 1 || got.Tools[0].Function.Name != "get_weather" {
+		t.Errorf("工具定义转换错误: %+v", got.Tools)
+	}
+}
+
+// TestAnthropicStreamHandlerEvents 测试流式事件顺序
+func TestAnthropicStreamHandlerEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	handler := NewAnthropicStreamHandler(c, "glm-4.5")
+	handler.Start()
+
+	data := &types.UpstreamData{}
+	data.Data.Phase = "answer"
+	data.Data.DeltaContent = "你好"
+	dispatchUpstreamPhase(handler, data)
+
+	done := &types.UpstreamData{}
+	done.Data.Phase = "done"
+	done.Data.Done = true
+	dispatchUpstreamPhase(handler, done)
+
+	if !handler.IsFinished() {
+		t.Fatal("处理器应已结束")
+	}
+
+	body := w.Body.String()
+	events := []string{
+		"event: message_start",
+		"event: content_block_start",
+		"event: content_block_delta",
+		"event: content_block_stop",
+		"event: message_delta",
+		"event: message_stop",
+	}
+	last := -1
+	for _, event := range events {
+		idx := strings.Index(body, event)
+		if idx <= last {
+			t.Fatalf("事件 %q 缺失或顺序错误:\n%s", event, body)
+		}
+		last = idx
+	}
+	if !strings.Contains(body, `"stop_reason":"end_turn"`) {
+		t.Errorf("期望 stop_reason 为 end_turn:\n%s", body)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"z2api/errors"
+	"z2api/types"
+	"z2api/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// GinHandleCompletions 旧版文本补全接口 (/v1/completions)
+// 将 prompt 包装为用户消息后复用聊天补全的处理流程，再把输出改写为 text_completion 格式
+func GinHandleCompletions(c *gin.Context) {
+	startTime := time.Now()
+
+	// 使用 context 超时控制
+	ctx := c.Request.Context()
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	c.Set("start_time", startTime)
+	c.Set("user_agent", c.GetHeader("User-Agent"))
+	c.Set("debug_mode", appConfig.DebugMode)
+
+	// 更新监控指标
+	totalRequests.Add(1)
+	currentConcurrency.Add(1)
+	defer currentConcurrency.Add(-1)
+
+	if extractAPIKey(c) != appConfig.DefaultKey {
+		utils.ErrorResponse(c, errors.ErrInvalidAPIKey.WithParam("api_key"))
+		recordError(c, startTime, errors.ErrInvalidAPIKey.StatusCode, "invalid_api_key")
+		return
+	}
+
+	var req types.CompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok && len(validationErrors) > 0 {
+			e := validationErrors[0]
+			utils.ValidationErrorWithParam(c, getValidationErrorMessage(e), e.Field())
+			recordError(c, startTime, http.StatusBadRequest, "validation_error")
+			return
+		}
+
+		utils.ErrorResponse(c, errors.ErrInvalidJSON.WithDetails(err.Error()))
+		recordError(c, startTime, http.StatusBadRequest, "invalid_request_error")
+		return
+	}
+
+	prompt, err := completionPromptText(req.Prompt)
+	if err != nil {
+		utils.ErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusBadRequest, "validation_error")
+		return
+	}
+
+	debugLog("Completions 请求解析成功 - 模型: %s, 流式: %v, echo: %v", req.Model, req.Stream, req.Echo)
+
+	openAIReq := types.OpenAIRequest{
+		Model:            req.Model,
+		Messages:         []types.Message{{Role: "user", Content: completionUpstreamPrompt(prompt, req.Suffix)}},
+		Stream:           req.Stream,
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		MaxTokens:        req.MaxTokens,
+		Stop:             req.Stop,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		Seed:             req.Seed,
+		User:             req.User,
+	}
+
+	modelConfig, err := resolveModelConfig(openAIReq.Model)
+	if err != nil {
+		utils.ErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusNotFound, "model_not_found")
+		return
+	}
+	c.Set("model_name", modelConfig.Name)
+
+	setDefaultParams(&openAIReq, modelConfig)
+
+	if err := validateBusinessRules(&openAIReq); err != nil {
+		utils.ErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusBadRequest, "validation_error")
+		return
+	}
+
+	// 生成会话ID
+	sessionID := openAIReq.User
+	if sessionID == "" {
+		sessionID = c.ClientIP()
+	}
+	c.Set("session_id", sessionID)
+
+	chatID := utils.GenerateChatID()
+	msgID := utils.GenerateMessageID()
+
+	authToken, err := getAuthToken(timeoutCtx, sessionID)
+	if err != nil {
+		apiErr := errors.WrapError(err)
+		setPoolRetryAfter(c, apiErr)
+		utils.ErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+
+	upstreamReq, err := buildUpstreamRequest(timeoutCtx, openAIReq, chatID, msgID, modelConfig, authToken)
+	if err != nil {
+		apiErr := errors.WrapError(err)
+		utils.ErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+
+	// 替换响应写入器，将聊天补全输出改写为 text_completion
+	writer := newCompletionsResponseWriter(c.Writer, prompt, req.Echo)
+	c.Writer = writer
+
+	if req.Stream {
+		handleStreamResponseGin(timeoutCtx, c, upstreamReq, chatID, authToken, modelConfig.Name, sessionID)
+	} else {
+		handleNonStreamResponseGin(timeoutCtx, c, upstreamReq, chatID, authToken, modelConfig.Name, sessionID)
+	}
+
+	writer.Close()
+}
+
+// completionPromptText 将 string 或 []string 形式的 prompt 转换为文本
+func completionPromptText(prompt interface{}) (string, error) {
+	switch v := prompt.(type) {
+	case string:
+		return v, nil
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			text, ok := item.(string)
+			if !ok {
+				return "", errors.NewValidationErrorWithParam("prompt 仅支持字符串或字符串数组", "prompt")
+			}
+			parts = append(parts, text)
+		}
+		return strings.Join(parts, "\n"), nil
+	}
+	return "", errors.NewValidationErrorWithParam("prompt 仅支持字符串或字符串数组", "prompt")
+}
+
+// completionUpstreamPrompt 构造发送给上游的提示词
+// 指定 suffix 时要求模型生成位于 prompt 与 suffix 之间的文本，suffix 只作为插入位置的上下文，不出现在输出中
+func completionUpstreamPrompt(prompt, suffix string) string {
+	if suffix == "" {
+		return prompt
+	}
+	var b strings.Builder
+	b.WriteString("请续写下面的文本，使续写内容能够与给定的后文自然衔接。只输出插入在前文与后文之间的内容，不要重复前文或后文。\n\n")
+	b.WriteString("<prefix>\n")
+	b.WriteString(prompt)
+	b.WriteString("\n</prefix>\n\n<suffix>\n")
+	b.WriteString(suffix)
+	b.WriteString("\n</suffix>")
+	return b.String()
+}
+
+// completionFinishReason 将聊天补全的 finish_reason 映射为文本补全的 finish_reason
+func completionFinishReason(finishReason string) string {
+	if finishReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+// completionsResponseWriter 将聊天补全格式的响应改写为 text_completion 格式
+// 流式响应按 SSE 事件逐个改写，非流式响应缓冲后在 Close 时改写；非 200 响应原样透传
+type completionsResponseWriter struct {
+	gin.ResponseWriter
+	id      string
+	prompt  string
+	echo    bool
+	buffer  bytes.Buffer
+	started bool // 是否已输出第一个文本块（用于 echo）
+}
+
+// newCompletionsResponseWriter 创建文本补全响应写入器
+func newCompletionsResponseWriter(w gin.ResponseWriter, prompt string, echo bool) *completionsResponseWriter {
+	return &completionsResponseWriter{
+		ResponseWriter: w,
+		id:             utils.GenerateCompletionID(),
+		prompt:         prompt,
+		echo:           echo,
+	}
+}
+
+// Write 拦截写入的数据
+func (w *completionsResponseWriter) Write(data []byte) (int, error) {
+	if w.Status() != http.StatusOK {
+		return w.ResponseWriter.Write(data)
+	}
+
+	w.buffer.Write(data)
+	if w.isStream() {
+		w.flushEvents()
+	}
+	return len(data), nil
+}
+
+// WriteString 拦截写入的字符串
+func (w *completionsResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// isStream 是否为 SSE 流式响应
+func (w *completionsResponseWriter) isStream() bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+}
+
+// flushEvents 改写缓冲区中所有完整的 SSE 事件
+func (w *completionsResponseWriter) flushEvents() {
+	for {
+		idx := bytes.Index(w.buffer.Bytes(), []byte("\n\n"))
+		if idx < 0 {
+			return
+		}
+		event := string(w.buffer.Next(idx + 2))
+		if converted := w.convertEvent(strings.TrimSuffix(event, "\n\n")); converted != "" {
+			w.ResponseWriter.WriteString(converted)
+		}
+	}
+}
+
+// convertEvent 将一个聊天补全块改写为文本补全块，无法识别的事件原样输出
+func (w *completionsResponseWriter) convertEvent(event string) string {
+	var payload string
+	for _, line := range strings.Split(event, "\n") {
+		if strings.HasPrefix(line, "data:") {
+			payload = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+
+	var chunk types.OpenAIResponse
+	if payload == "" || payload == "[DONE]" ||
+		sonicStream.UnmarshalFromString(payload, &chunk) != nil || chunk.Object != "chat.completion.chunk" {
+		return event + "\n\n"
+	}
+
+	var text strings.Builder
+	finishReason := ""
+	for _, choice := range chunk.Choices {
+		text.WriteString(choice.Delta.Content)
+		if choice.FinishReason != "" {
+			finishReason = completionFinishReason(choice.FinishReason)
+		}
+	}
+
+	result := text.String()
+	if !w.started && (result != "" || finishReason != "" || w.echo) {
+		w.started = true
+		if w.echo {
+			result = w.prompt + result
+		}
+	}
+	if result == "" && finishReason == "" && chunk.Usage == nil {
+		return ""
+	}
+
+	data, err := sonicStream.Marshal(types.CompletionResponse{
+		ID:      w.id,
+		Object:  "text_completion",
+		Created: chunk.Created,
+		Model:   chunk.Model,
+		Choices: []types.CompletionChoice{{
+			Text:         result,
+			Index:        0,
+			FinishReason: finishReason,
+		}},
+		Usage: chunk.Usage,
+	})
+	if err != nil {
+		debugLog("序列化文本补全块失败: %v", err)
+		return ""
+	}
+	return "data: " + string(data) + "\n\n"
+}
+
+// Close 输出缓冲的非流式响应
+func (w *completionsResponseWriter) Close() {
+	if w.isStream() || w.buffer.Len() == 0 {
+		return
+	}
+
+	var resp types.OpenAIResponse
+	if err := sonicDefault.Unmarshal(w.buffer.Bytes(), &resp); err != nil || resp.Object != "chat.completion" {
+		w.ResponseWriter.Write(w.buffer.Bytes())
+		return
+	}
+
+	choices := make([]types.CompletionChoice, 0, len(resp.Choices))
+	for _, choice := range resp.Choices {
+		text := ""
+		if choice.Message != nil {
+			text, _ = choice.Message.Content.(string)
+		}
+		if w.echo {
+			text = w.prompt + text
+		}
+		choices = append(choices, types.CompletionChoice{
+			Text:         text,
+			Index:        choice.Index,
+			FinishReason: completionFinishReason(choice.FinishReason),
+		})
+	}
+
+	data, err := sonicDefault.Marshal(types.CompletionResponse{
+		ID:      w.id,
+		Object:  "text_completion",
+		Created: resp.Created,
+		Model:   resp.Model,
+		Choices: choices,
+		Usage:   resp.Usage,
+	})
+	if err != nil {
+		debugLog("序列化文本补全响应失败: %v", err)
+		w.ResponseWriter.Write(w.buffer.Bytes())
+		return
+	}
+	w.ResponseWriter.Write(data)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestCompletionsResponseWriterStream 测试流式响应改写（含 echo）
+func TestCompletionsResponseWriterStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	writer := newCompletionsResponseWriter(c.Writer, "前缀", true)
+	c.Writer = writer
+	SetSSEHeaders(c)
+
+	// 块被拆分写入时也应正确识别
+	c.Writer.WriteString(`data: {"id":"x","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"role":"assistant"}}]}` + "\n\n")
+	c.Writer.WriteString(`data: {"id":"x","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{"content":"你好"}}]}`)
+	c.Writer.WriteString("\n\n")
+	c.Writer.WriteString(`data: {"id":"x","object":"chat.completion.chunk","created":1,"model":"m","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}` + "\n\n")
+	c.Writer.WriteString("data: [DONE]\n\n")
+	writer.Close()
+
+	body := w.Body.String()
+	for _, want := range []string{`"text":"前缀"`, `"text":"你好"`, `"object":"text_completion"`, "data: [DONE]"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("期望输出包含 %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "chat.completion.chunk") {
+		t.Errorf("输出不应包含聊天补全块:\n%s", body)
+	}
+}
+
+// TestCompletionsResponseWriterNonStream 测试非流式响应改写与错误透传
+func TestCompletionsResponseWriterNonStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	writer := newCompletionsResponseWriter(c.Writer, "1+1=", true)
+	c.Writer = writer
+	c.JSON(http.StatusOK, buildNonStreamResponse("2", "", nil, nil, "m"))
+	writer.Close()
+
+	var resp types.CompletionResponse
+	if err := sonicDefault.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("解析响应失败: %v\n%s", err, w.Body.String())
+	}
+	if resp.Object != "text_completion" || len(resp.Choices) != 1 || resp.Choices[0].Text != "1+1=2" {
+		t.Errorf("响应改写错误: %+v", resp)
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	writer = newCompletionsResponseWriter(c.Writer, "", false)
+	c.Writer = writer
+	c.JSON(http.StatusBadRequest, gin.H{"error": "bad"})
+	writer.Close()
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "bad") {
+		t.Errorf("错误响应应原样透传: %d %s", w.Code, w.Body.String())
+	}
+}
+
+// TestCompletionUpstreamPrompt 测试 suffix 作为插入位置的上下文发送给上游
+func TestCompletionUpstreamPrompt(t *testing.T) {
+	if got := completionUpstreamPrompt("def add(a, b):", ""); got != "def add(a, b):" {
+		t.Errorf("未指定 suffix 时应原样发送 prompt, 实际 %q", got)
+	}
+
+	got := completionUpstreamPrompt("def add(a, b):", "\nprint(add(1, 2))")
+	for _, want := range []string{"<prefix>\ndef add(a, b):\n</prefix>", "<suffix>\n\nprint(add(1, 2))\n</suffix>"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("期望提示词包含 %q:\n%s", want, got)
+		}
+	}
+}
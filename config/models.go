@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/bytedance/sonic"
@@ -13,6 +14,23 @@ type ModelCapabilities struct {
 	Vision   bool `json:"vision"`
 	Tools    bool `json:"tools"`
 	Thinking bool `json:"thinking"`
+	Search   bool `json:"search"`
+}
+
+// ModelFeatures 定义了发送给上游的特性开关
+type ModelFeatures struct {
+	WebSearch       bool     `json:"web_search"`
+	AutoWebSearch   bool     `json:"auto_web_search"`
+	PreviewMode     bool     `json:"preview_mode"`
+	ImageGeneration bool     `json:"image_generation"`
+	MCPServers      []string `json:"mcp_servers,omitempty"`
+}
+
+// ModelLimits 定义了模型的限制，0 表示不限制/未知
+type ModelLimits struct {
+	ContextLength     int `json:"context_length"`      // 上下文窗口长度（token数）
+	MaxOutputTokens   int `json:"max_output_tokens"`   // 单次输出的最大token数
+	ImageMaxDimension int `json:"image_max_dimension"` // 上传图片长边的最大像素数
 }
 
 // ModelConfig 定义了单个模型的完整配置
@@ -20,14 +38,25 @@ type ModelConfig struct {
 	ID           string            `json:"id"`
 	Name         string            `json:"name"`
 	UpstreamID   string            `json:"upstream_id"`
+	Aliases      []string          `json:"aliases,omitempty"`
 	Capabilities ModelCapabilities `json:"capabilities"`
+	Features     ModelFeatures     `json:"features"`
+	Limits       ModelLimits       `json:"limits"`
+}
+
+// ModelAlias 模型别名及其指向的模型ID
+type ModelAlias struct {
+	Alias   string
+	ModelID string
 }
 
 // ModelsData 包含从 models.json 加载的所有数据
 type ModelsData struct {
-	DefaultModelID string            `json:"default_model_id"`
-	Mappings       map[string]string `json:"model_mappings"`
-	Models         []ModelConfig     `json:"models"`
+	DefaultModelID string `json:"default_model_id"`
+	// Mappings 别名到模型ID的映射，由各模型的 aliases 生成；
+	// 仍兼容直接在 models.json 中配置的 model_mappings
+	Mappings map[string]string `json:"model_mappings"`
+	Models   []ModelConfig     `json:"models"`
 	// 为了快速查找，我们创建一个map
 	modelMap map[string]ModelConfig
 }
@@ -54,27 +83,78 @@ func LoadModels(path string) error {
 	// 将模型列表转换为map以便快速查找
 	data.modelMap = make(map[string]ModelConfig)
 	for _, model := range data.Models {
-		data.modelMap[strings.ToLower(model.ID)] = model
+		id := strings.ToLower(strings.TrimSpace(model.ID))
+		if id == "" {
+			return fmt.Errorf("model id must not be empty")
+		}
+		if model.UpstreamID == "" {
+			return fmt.Errorf("model %q has no upstream_id", model.ID)
+		}
+		if _, exists := data.modelMap[id]; exists {
+			return fmt.Errorf("duplicate model id %q", model.ID)
+		}
+		data.modelMap[id] = model
+	}
+
+	// 合并模型别名与旧的 model_mappings，统一为小写
+	mappings := make(map[string]string, len(data.Mappings))
+	addAlias := func(alias, target string) error {
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		target = strings.ToLower(strings.TrimSpace(target))
+		if _, ok := data.modelMap[target]; !ok {
+			return fmt.Errorf("alias %q points to unknown model %q", alias, target)
+		}
+		if _, isModel := data.modelMap[alias]; isModel && alias != target {
+			return fmt.Errorf("alias %q conflicts with a model id", alias)
+		}
+		if existing, ok := mappings[alias]; ok && existing != target {
+			return fmt.Errorf("alias %q is mapped to both %q and %q", alias, existing, target)
+		}
+		mappings[alias] = target
+		return nil
+	}
+	for alias, target := range data.Mappings {
+		if err := addAlias(alias, target); err != nil {
+			return err
+		}
+	}
+	for _, model := range data.Models {
+		for _, alias := range model.Aliases {
+			if err := addAlias(alias, model.ID); err != nil {
+				return err
+			}
+		}
+	}
+	data.Mappings = mappings
+
+	if data.DefaultModelID != "" {
+		if _, ok := data.modelMap[normalizeWith(data.Mappings, data.DefaultModelID)]; !ok {
+			return fmt.Errorf("default_model_id %q is not a configured model", data.DefaultModelID)
+		}
 	}
 
 	modelData = &data
 	return nil
 }
 
+// normalizeWith 使用给定的映射标准化模型ID
+func normalizeWith(mappings map[string]string, id string) string {
+	normalizedID := strings.ToLower(strings.TrimSpace(id))
+	if mappedID, ok := mappings[normalizedID]; ok {
+		return mappedID
+	}
+	return normalizedID // 如果没有匹配的映射，返回标准化的原ID
+}
+
 // normalizeModelID 将客户端传入的模型ID标准化
 func normalizeModelID(id string) string {
 	if modelData == nil || modelData.Mappings == nil {
 		return strings.ToLower(strings.TrimSpace(id)) // 如果配置未加载，返回标准化的原ID
 	}
-
-	normalizedID := strings.ToLower(strings.TrimSpace(id))
-	if mappedID, ok := modelData.Mappings[normalizedID]; ok {
-		return mappedID
-	}
-	return normalizedID // 如果没有匹配的映射，返回标准化的原ID
+	return normalizeWith(modelData.Mappings, id)
 }
 
-// GetModelConfig 根据模型ID获取配置
+// GetModelConfig 根据模型ID或别名获取配置
 func GetModelConfig(id string) (ModelConfig, bool) {
 	if modelData == nil || modelData.modelMap == nil {
 		return ModelConfig{}, false // 配置未加载
@@ -94,13 +174,12 @@ func GetDefaultModel() (ModelConfig, bool) {
 
 	// 如果设置了 DefaultModelID，使用它来查找模型
 	if modelData.DefaultModelID != "" {
-		normalizedID := strings.ToLower(modelData.DefaultModelID)
-		if config, ok := modelData.modelMap[normalizedID]; ok {
+		if config, ok := GetModelConfig(modelData.DefaultModelID); ok {
 			return config, true
 		}
 	}
 
-	// 如果找不到指定的默认模型，回退到第一个模型
+	// 未设置默认模型时回退到第一个模型
 	return modelData.Models[0], true
 }
 
@@ -111,3 +190,24 @@ func GetAllModels() []ModelConfig {
 	}
 	return modelData.Models
 }
+
+// GetModelAliases 返回所有指向已配置模型的别名（不含与模型ID相同的映射），按别名排序
+func GetModelAliases() []ModelAlias {
+	if modelData == nil || modelData.modelMap == nil {
+		return nil
+	}
+
+	aliases := make([]ModelAlias, 0, len(modelData.Mappings))
+	for alias, target := range modelData.Mappings {
+		model, ok := modelData.modelMap[target]
+		if !ok || strings.EqualFold(alias, model.ID) {
+			continue
+		}
+		aliases = append(aliases, ModelAlias{Alias: alias, ModelID: model.ID})
+	}
+
+	sort.Slice(aliases, func(i, j int) bool {
+		return aliases[i].Alias < aliases[j].Alias
+	})
+	return aliases
+}
@@ -44,10 +44,8 @@ func TestGetDefaultModel(t *testing.T) {
 	}
 
 	// 验证默认模型的ID是否与配置的DefaultModelID匹配
-	// 注意：由于我们的DefaultModelID设置为"claude-3-opus-20240229"，但这个模型不存在于models列表中
-	// 所以根据我们的实现，应该返回第一个模型作为默认值
-	if defaultModel.ID != modelData.Models[0].ID {
-		t.Errorf("默认模型ID不匹配，期望 %s，实际 %s", modelData.Models[0].ID, defaultModel.ID)
+	if defaultModel.ID != modelData.DefaultModelID {
+		t.Errorf("默认模型ID不匹配，期望 %s，实际 %s", modelData.DefaultModelID, defaultModel.ID)
 	}
 }
 
@@ -128,3 +126,80 @@ func TestLoadModelsErrorHandling(t *testing.T) {
 		t.Error("加载无效JSON应该返回错误")
 	}
 }
+
+func TestGetModelAliases(t *testing.T) {
+	// 确保模型已加载
+	if err := LoadModels("../assets/models.json"); err != nil {
+		t.Fatalf("加载模型配置失败: %v", err)
+	}
+
+	aliases := GetModelAliases()
+	if len(aliases) == 0 {
+		t.Fatal("应该至少有一个别名")
+	}
+
+	found := false
+	for _, alias := range aliases {
+		// 与模型ID相同的映射不应作为别名返回
+		if alias.Alias == alias.ModelID {
+			t.Errorf("别名 %s 不应指向同名模型", alias.Alias)
+		}
+		if alias.Alias == "gpt-4" {
+			found = true
+			if alias.ModelID != "glm-4.5" {
+				t.Errorf("gpt-4 应指向 glm-4.5，实际 %s", alias.ModelID)
+			}
+		}
+	}
+	if !found {
+		t.Error("应该包含 gpt-4 别名")
+	}
+}
+
+func TestLoadModelsRejectsInconsistentRegistry(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name:    "默认模型不存在",
+			content: `{"default_model_id": "missing", "models": [{"id": "a", "upstream_id": "A"}]}`,
+		},
+		{
+			name:    "别名指向不存在的模型",
+			content: `{"model_mappings": {"x": "missing"}, "models": [{"id": "a", "upstream_id": "A"}]}`,
+		},
+		{
+			name:    "别名与模型ID冲突",
+			content: `{"models": [{"id": "a", "upstream_id": "A"}, {"id": "b", "upstream_id": "B", "aliases": ["a"]}]}`,
+		},
+		{
+			name:    "缺少上游ID",
+			content: `{"models": [{"id": "a"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpFile, err := os.CreateTemp("", "models-*.json")
+			if err != nil {
+				t.Fatalf("创建临时文件失败: %v", err)
+			}
+			defer os.Remove(tmpFile.Name())
+
+			if _, err := tmpFile.Write([]byte(tt.content)); err != nil {
+				t.Fatalf("写入临时文件失败: %v", err)
+			}
+			tmpFile.Close()
+
+			if err := LoadModels(tmpFile.Name()); err == nil {
+				t.Error("应该返回错误")
+			}
+		})
+	}
+
+	// 恢复正常配置，避免影响其他测试
+	if err := LoadModels("../assets/models.json"); err != nil {
+		t.Fatalf("加载模型配置失败: %v", err)
+	}
+}
@@ -158,6 +158,86 @@ var (
 		StatusCode: http.StatusBadRequest,
 	}
 
+	ErrToolChoiceNotSatisfied = APIError{
+		Type:       "upstream_error",
+		Message:    "Model output did not satisfy tool_choice",
+		Code:       http.StatusBadGateway,
+		StatusCode: http.StatusBadGateway,
+		Param:      "tool_choice",
+	}
+
+	ErrToolArgumentsInvalid = APIError{
+		Type:       "upstream_error",
+		Message:    "Tool call arguments do not match the declared schema",
+		Code:       http.StatusBadGateway,
+		StatusCode: http.StatusBadGateway,
+		Param:      "tools",
+	}
+
+	ErrStructuredOutputInvalid = APIError{
+		Type:       "upstream_error",
+		Message:    "Model output does not match the requested response_format",
+		Code:       http.StatusBadGateway,
+		StatusCode: http.StatusBadGateway,
+		Param:      "response_format",
+	}
+
+	// 文件相关错误
+	ErrInvalidFile = APIError{
+		Type:       "invalid_request_error",
+		Message:    "Invalid file data",
+		Code:       http.StatusBadRequest,
+		StatusCode: http.StatusBadRequest,
+		Param:      "messages",
+	}
+
+	ErrFileFetchFailed = APIError{
+		Type:       "invalid_request_error",
+		Message:    "Failed to download file from URL",
+		Code:       http.StatusBadRequest,
+		StatusCode: http.StatusBadRequest,
+		Param:      "messages",
+	}
+
+	ErrURLBlocked = APIError{
+		Type:       "invalid_request_error",
+		Message:    "URL is not allowed",
+		Code:       http.StatusBadRequest,
+		StatusCode: http.StatusBadRequest,
+		Param:      "messages",
+	}
+
+	ErrTooManyRedirects = APIError{
+		Type:       "invalid_request_error",
+		Message:    "Too many redirects",
+		Code:       http.StatusBadRequest,
+		StatusCode: http.StatusBadRequest,
+		Param:      "messages",
+	}
+
+	ErrFileTooLarge = APIError{
+		Type:       "invalid_request_error",
+		Message:    "File too large",
+		Code:       http.StatusRequestEntityTooLarge,
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Param:      "messages",
+	}
+
+	ErrUnsupportedFileType = APIError{
+		Type:       "invalid_request_error",
+		Message:    "Unsupported file type",
+		Code:       http.StatusUnsupportedMediaType,
+		StatusCode: http.StatusUnsupportedMediaType,
+		Param:      "messages",
+	}
+
+	ErrFileUploadFailed = APIError{
+		Type:       "upstream_error",
+		Message:    "Failed to upload file to upstream",
+		Code:       http.StatusBadGateway,
+		StatusCode: http.StatusBadGateway,
+	}
+
 	// 上游相关错误
 	ErrUpstreamError = APIError{
 		Type:       "upstream_error",
@@ -180,6 +260,14 @@ var (
 		StatusCode: http.StatusServiceUnavailable,
 	}
 
+	// 上游流在首个事件前、事件之间或思考阶段停滞超过限制
+	ErrUpstreamStalled = APIError{
+		Type:       "upstream_timeout",
+		Message:    "Upstream stream stalled",
+		Code:       http.StatusGatewayTimeout,
+		StatusCode: http.StatusGatewayTimeout,
+	}
+
 	// 系统相关错误
 	ErrInternalError = APIError{
 		Type:       "internal_error",
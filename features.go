@@ -1,7 +1,6 @@
 package main
 
 import (
-	"strings"
 	"z2api/config"
 	"z2api/types"
 	"z2api/utils"
@@ -27,19 +26,24 @@ type FeatureConfig struct {
 	Variables       map[string]string `json:"variables"`
 }
 
-// getModelFeatures 根据模型ID和流式模式动态返回特性配置
-// 参考 Python 版本的 getfeatures 函数，提供更细粒度的特性控制
-func getModelFeatures(modelID string, streaming bool) FeatureConfig {
+// getModelFeatures 根据 models.json 中的模型配置和流式模式返回特性配置
+// 搜索、MCP 服务器等特性开关以及思考、视觉能力均来自模型注册表
+func getModelFeatures(modelConfig config.ModelConfig, streaming bool) FeatureConfig {
+	mcpServers := modelConfig.Features.MCPServers
+	if mcpServers == nil {
+		mcpServers = []string{}
+	}
+
 	config := FeatureConfig{
 		Features: Features{
-			ImageGeneration: false,
-			WebSearch:       false,
-			AutoWebSearch:   false,
-			PreviewMode:     false,
-			EnableThinking:  streaming, // 流式模式默认启用思考
-			Vision:          false,
+			ImageGeneration: modelConfig.Features.ImageGeneration,
+			WebSearch:       modelConfig.Features.WebSearch,
+			AutoWebSearch:   modelConfig.Features.AutoWebSearch,
+			PreviewMode:     modelConfig.Features.PreviewMode,
+			EnableThinking:  streaming && modelConfig.Capabilities.Thinking, // 仅在流式模式下启用思考
+			Vision:          modelConfig.Capabilities.Vision,
 			Flags:           []string{},
-			MCPServers:      []string{},
+			MCPServers:      mcpServers,
 		},
 		BackgroundTasks: map[string]bool{
 			"title_generation": false,
@@ -55,64 +59,8 @@ func getModelFeatures(modelID string, streaming bool) FeatureConfig {
 		},
 	}
 
-	// 根据模型ID设置特定功能
-	modelLower := strings.ToLower(modelID)
-
-	// 搜索模型配置 - 参考 Python 版本的逻辑
-	switch {
-	case strings.Contains(modelLower, "glm-4.6-advanced-search"):
-		config.Features.WebSearch = true
-		config.Features.AutoWebSearch = true
-		config.Features.PreviewMode = true
-		config.Features.MCPServers = []string{"advanced-search"}
-
-	case strings.Contains(modelLower, "glm-4.6-search"):
-		config.Features.WebSearch = true
-		config.Features.AutoWebSearch = true
-		config.Features.PreviewMode = true
-		config.Features.MCPServers = []string{"deep-web-search"}
-
-	case strings.Contains(modelLower, "search"):
-		// 通用搜索模型
-		config.Features.WebSearch = true
-		config.Features.AutoWebSearch = true
-		config.Features.PreviewMode = true
-		config.Features.MCPServers = []string{"deep-web-search"}
-	}
-
-	// 思考模式配置 - 参考 Python 版本
-	switch {
-	case strings.Contains(modelLower, "glm-4.6-nothinking"):
-		config.Features.EnableThinking = false
-
-	case strings.Contains(modelLower, "nothinking") || strings.Contains(modelLower, "no-thinking"):
-		config.Features.EnableThinking = false
-
-	case strings.Contains(modelLower, "glm-4.6"):
-		// GLM-4.6 系列模型在流式模式下默认启用思考
-		if streaming {
-			config.Features.EnableThinking = true
-		}
-	}
-
-	// 视觉模型配置
-	switch {
-	case strings.Contains(modelLower, "glm-4.5v"):
-		config.Features.Vision = true
-		// GLM-4.5v 支持全方位多模态
-
-	case strings.Contains(modelLower, "vision") || strings.Contains(modelLower, "4v"):
-		config.Features.Vision = true
-	}
-
-	// 图像生成模型
-	if strings.Contains(modelLower, "dall-e") || strings.Contains(modelLower, "image-gen") {
-		config.Features.ImageGeneration = true
-	}
-
 	// 非流式模式调整 - 参考 Python 版本的逻辑
 	if !streaming {
-		config.Features.EnableThinking = false // 非流式模式禁用思考
 		// 非流式模式下禁用 MCP 服务器（如 Python 版本）
 		config.Features.MCPServers = []string{}
 	}
@@ -134,48 +82,24 @@ func (f Features) ToMap() map[string]interface{} {
 	}
 }
 
-// mergeWithModelConfig 将动态特性与models.json配置合并
-func mergeWithModelConfig(dynamic FeatureConfig, modelConfig config.ModelConfig) FeatureConfig {
-	// 如果models.json中有配置，优先使用
-	if modelConfig.Capabilities.Vision {
-		dynamic.Features.Vision = true
-	}
-
-	if modelConfig.Capabilities.Thinking {
-		// 仅在流式模式下启用thinking
-		if dynamic.Features.EnableThinking {
-			dynamic.Features.EnableThinking = modelConfig.Capabilities.Thinking
-		}
-	}
-
-	// 注意：config.ModelCapabilities 没有 Search 字段，这里保留为 false
-	// 如果需要搜索功能，应该根据模型ID判断
-
-	return dynamic
-}
-
 // ConvertedMessages 转换后的消息结构
 type ConvertedMessages struct {
-	Messages  []types.UpstreamMessage
-	ImageURLs []string
-	Files     []File
-}
-
-// File 文件结构
-type File struct {
-	Type string `json:"type"`
-	ID   string `json:"id"`
+	Messages []types.UpstreamMessage
+	Pending  []utils.ProcessedFile // 待上传的文件（data URL 或 http(s) URL）
+	Files    []types.UpstreamFile  // 已有上游文件ID的文件引用
 }
 
 // convertMultimodalMessages 转换多模态消息（使用统一的多模态处理器）
 func convertMultimodalMessages(messages []types.Message) ConvertedMessages {
 	result := ConvertedMessages{
-		Messages:  make([]types.UpstreamMessage, 0),
-		ImageURLs: make([]string, 0),
-		Files:     make([]File, 0),
+		Messages: make([]types.UpstreamMessage, 0),
+		Pending:  make([]utils.ProcessedFile, 0),
+		Files:    make([]types.UpstreamFile, 0),
 	}
 
 	processor := utils.NewMultimodalProcessor("")
+	processor.FileResolver = fileStore.ResolveUpstream
+	callNames := make(map[string]string)
 
 	for _, msg := range messages {
 		// 使用统一处理器处理内容
@@ -189,27 +113,19 @@ func convertMultimodalMessages(messages []types.Message) ConvertedMessages {
 		if err == nil {
 			upstreamMsg.Content = processResult.Text
 
-			// 收集图片URL
-			result.ImageURLs = append(result.ImageURLs, processResult.Images...)
-
-			// 转换文件信息
+			// 已有上游文件ID的文件直接引用，其余文件由上传步骤处理
 			for _, file := range processResult.Files {
-				fileID := file.FileID
-				if fileID == "" {
-					// 如果没有FileID，使用占位符（实际使用时需要上传）
-					if strings.HasPrefix(file.URL, "data:image/") {
-						fileID = "base64_image"
-					} else if strings.HasPrefix(file.URL, "http") {
-						fileID = "url_image"
-					} else {
-						fileID = "unknown"
-					}
+				if file.FileID != "" {
+					result.Files = append(result.Files, types.UpstreamFile{
+						Type:     file.Type,
+						ID:       file.FileID,
+						Name:     file.Name,
+						MimeType: file.MimeType,
+						Size:     file.Size,
+					})
+				} else {
+					result.Pending = append(result.Pending, file)
 				}
-
-				result.Files = append(result.Files, File{
-					Type: file.Type,
-					ID:   fileID,
-				})
 			}
 		} else {
 			// 如果处理失败，尝试将内容转换为字符串
@@ -224,12 +140,33 @@ func convertMultimodalMessages(messages []types.Message) ConvertedMessages {
 		if msg.ReasoningContent != "" {
 			upstreamMsg.ReasoningContent = msg.ReasoningContent
 		}
+		attachToolHistory(&upstreamMsg, msg, callNames)
 
-		// 如果有内容或工具调用，添加消息
-		if upstreamMsg.Content != "" || len(msg.ToolCalls) > 0 || msg.Content == nil {
+		// 如果有内容或工具调用，添加消息；工具结果即使为空也需保留以对应调用
+		if upstreamMsg.Content != "" || len(msg.ToolCalls) > 0 || msg.Content == nil || msg.Role == "tool" {
 			result.Messages = append(result.Messages, upstreamMsg)
 		}
 	}
 
 	return result
 }
+
+// attachToolHistory 将助手消息的工具调用与 tool 消息的调用ID、函数名写入上游消息，保持调用ID不变。
+// callNames 记录已出现的调用ID到函数名的映射，用于补全未携带 name 的 tool 消息
+func attachToolHistory(upstreamMsg *types.UpstreamMessage, msg types.Message, callNames map[string]string) {
+	if len(msg.ToolCalls) > 0 {
+		upstreamMsg.ToolCalls = normalizeToolCalls(msg.ToolCalls)
+		for i := range upstreamMsg.ToolCalls {
+			upstreamMsg.ToolCalls[i].Index = i
+			callNames[upstreamMsg.ToolCalls[i].ID] = upstreamMsg.ToolCalls[i].Function.Name
+		}
+	}
+
+	if msg.Role == "tool" {
+		upstreamMsg.ToolCallID = msg.ToolCallID
+		upstreamMsg.Name = msg.Name
+		if upstreamMsg.Name == "" {
+			upstreamMsg.Name = callNames[msg.ToolCallID]
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"z2api/errors"
+	"z2api/types"
+	"z2api/utils"
+)
+
+// StoredFile 本地文件索引条目，记录文件元数据及对应的上游文件
+type StoredFile struct {
+	types.FileObject
+	Upstream   types.UpstreamFile
+	ownerToken string // 上传该文件时使用的上游 token
+}
+
+// FileStore 通过 /v1/files 上传的文件的本地元数据索引
+type FileStore struct {
+	mu    sync.RWMutex
+	files map[string]StoredFile
+}
+
+// NewFileStore 创建新的文件索引
+func NewFileStore() *FileStore {
+	return &FileStore{files: make(map[string]StoredFile)}
+}
+
+// fileStore 全局文件索引
+var fileStore = NewFileStore()
+
+// Add 添加文件索引条目
+func (s *FileStore) Add(file StoredFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[file.ID] = file
+}
+
+// Get 根据文件ID获取索引条目
+func (s *FileStore) Get(id string) (StoredFile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.files[id]
+	return file, ok
+}
+
+// List 按创建时间倒序列出文件，purpose 为空时列出全部
+func (s *FileStore) List(purpose string) []types.FileObject {
+	s.mu.RLock()
+	files := make([]types.FileObject, 0, len(s.files))
+	for _, file := range s.files {
+		if purpose == "" || file.Purpose == purpose {
+			files = append(files, file.FileObject)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].CreatedAt != files[j].CreatedAt {
+			return files[i].CreatedAt > files[j].CreatedAt
+		}
+		return files[i].ID < files[j].ID
+	})
+	return files
+}
+
+// Delete 删除索引条目，返回被删除的条目
+func (s *FileStore) Delete(id string) (StoredFile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, ok := s.files[id]
+	if ok {
+		delete(s.files, id)
+	}
+	return file, ok
+}
+
+// Resolve 将本地文件ID解析为上游文件引用与上传该文件时使用的上游 token
+func (s *FileStore) Resolve(id string) (types.UpstreamFile, string, bool) {
+	file, ok := s.Get(id)
+	if !ok {
+		return types.UpstreamFile{}, "", false
+	}
+	return file.Upstream, file.ownerToken, true
+}
+
+// ResolveUpstream 将本地文件ID解析为上游文件引用，供多模态处理器使用
+func (s *FileStore) ResolveUpstream(id string) (types.UpstreamFile, bool) {
+	upstream, _, ok := s.Resolve(id)
+	return upstream, ok
+}
+
+// isLocalFileID 判断文件ID是否为 /v1/files 生成的本地格式（file- 前缀）
+func isLocalFileID(id string) bool {
+	return strings.HasPrefix(id, "file-")
+}
+
+// fileOwnerToken 返回消息通过 file_id 引用的已上传文件的上游 token，未引用已上传文件时返回空字符串。
+// 上游文件只能由上传时使用的 token 访问，因此引用了文件的请求必须使用该 token；
+// 本地格式的文件ID不存在（或已删除）时返回 404，引用的文件由不同 token 上传时返回 400
+func fileOwnerToken(messages []types.Message) (string, error) {
+	processor := utils.NewMultimodalProcessor("")
+	owner := ""
+	for _, msg := range messages {
+		result, err := processor.ProcessContent(msg.Content)
+		if err != nil {
+			continue
+		}
+		for _, file := range result.Files {
+			if !isLocalFileID(file.FileID) {
+				continue
+			}
+			_, token, ok := fileStore.Resolve(file.FileID)
+			if !ok {
+				return "", fileNotFoundError(file.FileID)
+			}
+			if owner != "" && token != owner {
+				return "", errors.NewInvalidRequestErrorWithParam("引用的文件由不同的上游账号上传，无法在同一请求中使用", "file_id")
+			}
+			owner = token
+		}
+	}
+	return owner, nil
+}
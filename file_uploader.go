@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"z2api/errors"
+	"z2api/types"
+	"z2api/utils"
+)
+
+// 各类型文件的大小上限（字节）
+var fileSizeLimits = map[string]int64{
+	"image":    10 << 20,
+	"audio":    25 << 20,
+	"video":    100 << 20,
+	"document": 50 << 20,
+}
+
+// preferredExtensions 常见MIME类型对应的文件扩展名（mime 包返回的扩展名顺序不固定）
+var preferredExtensions = map[string]string{
+	"image/jpeg":         ".jpg",
+	"image/png":          ".png",
+	"image/gif":          ".gif",
+	"image/webp":         ".webp",
+	"application/pdf":    ".pdf",
+	"text/plain":         ".txt",
+	"text/markdown":      ".md",
+	"text/csv":           ".csv",
+	"application/json":   ".json",
+	"audio/mpeg":         ".mp3",
+	"audio/wave":         ".wav",
+	"audio/wav":          ".wav",
+	"audio/ogg":          ".ogg",
+	"application/ogg":    ".ogg",
+	"video/mp4":          ".mp4",
+	"video/webm":         ".webm",
+	"application/msword": ".doc",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": ".docx",
+}
+
+// FileUploader 文件上传服务，负责获取文件内容、识别类型、校验大小并上传到上游文件接口
+type FileUploader struct {
+	authToken  string
+	httpClient *http.Client
+	uploadURL  string
+	cache      *UploadCache // 为 nil 时不使用缓存
+	fetcher    *SafeFetcher // 获取远程文件
+
+	normalizeImages   bool // 上传前规范化图片
+	maxImageDimension int  // 图片长边上限，0 使用默认值
+}
+
+// NewFileUploader 创建新的文件上传服务
+func NewFileUploader(authToken string) *FileUploader {
+	return &FileUploader{
+		authToken: authToken,
+		httpClient: &http.Client{
+			Timeout: 60 * time.Second,
+		},
+		uploadURL:       upstreamFilesURL(),
+		cache:           uploadCache,
+		fetcher:         remoteFetcher,
+		normalizeImages: appConfig != nil && appConfig.ImageNormalize,
+	}
+}
+
+// upstreamFilesURL 根据 UPSTREAM_URL 推导上游文件上传接口地址
+func upstreamFilesURL() string {
+	const fallback = "https://chat.z.ai/api/v1/files/"
+	if appConfig == nil {
+		return fallback
+	}
+	parsed, err := url.Parse(appConfig.UpstreamUrl)
+	if err != nil || parsed.Host == "" {
+		return fallback
+	}
+	return fmt.Sprintf("%s://%s/api/v1/files/", parsed.Scheme, parsed.Host)
+}
+
+// FileUploadResponse 上游文件上传响应结构
+type FileUploadResponse struct {
+	ID      string `json:"id"`
+	FileID  string `json:"file_id,omitempty"` // 兼容旧的上传接口
+	Detail  string `json:"detail,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// fileContent 已获取的文件内容
+type fileContent struct {
+	data         []byte
+	name         string
+	declaredMIME string // 来自 data URL、响应头或客户端声明的MIME类型
+	sourceURL    string // 远程文件的来源URL
+	detail       string // 图片内容部分的 detail 级别
+	etag         string
+	lastModified string
+	notModified  bool // 条件请求返回 304，可复用缓存的上游文件
+}
+
+// Upload 获取并上传一个待处理文件，返回带类型的上游文件引用
+func (fu *FileUploader) Upload(ctx context.Context, file utils.ProcessedFile) (types.UpstreamFile, error) {
+	if file.Size > 0 {
+		if limit := sourceSizeLimit(file.Type); file.Size > limit {
+			return types.UpstreamFile{}, fileTooLargeError(file.Type, file.Size, limit)
+		}
+	}
+
+	// 来源URL有缓存时使用条件请求重新验证
+	var cached *cachedUpload
+	if fu.cache != nil && isHTTPURL(file.URL) {
+		if hit, ok := fu.cache.GetURL(fu.authToken, file.URL); ok {
+			cached = &hit
+		}
+	}
+
+	content, err := fu.fetch(ctx, file, cached)
+	if err != nil {
+		return types.UpstreamFile{}, err
+	}
+	if content.notModified {
+		if file.Type != "file" && file.Type != cached.File.Type {
+			return types.UpstreamFile{}, errors.ErrUnsupportedFileType.WithDetails(
+				fmt.Sprintf("%s 内容部分的实际类型为 %s", file.Type, cached.File.MimeType))
+		}
+		debugLog("远程文件未变化，复用上游文件 %s: %s", cached.File.ID, file.URL)
+		return cached.File, nil
+	}
+	if file.MimeType != "" {
+		content.declaredMIME = file.MimeType
+	}
+	content.detail = file.Detail
+	return fu.uploadContent(ctx, file.Type, content)
+}
+
+// UploadBytes 上传已读取的文件内容，按内容自动识别类型
+func (fu *FileUploader) UploadBytes(ctx context.Context, data []byte, name, declaredMIME string) (types.UpstreamFile, error) {
+	return fu.uploadContent(ctx, "file", &fileContent{data: data, name: name, declaredMIME: declaredMIME})
+}
+
+// uploadContent 识别类型、校验大小后上传文件内容；fileType 为 file 时不校验内容部分类型。
+// 启用图片规范化时，图片先按 detail 与模型的尺寸上限缩小并重新编码，再校验规范化后的大小
+func (fu *FileUploader) uploadContent(ctx context.Context, fileType string, content *fileContent) (types.UpstreamFile, error) {
+	if len(content.data) == 0 {
+		return types.UpstreamFile{}, errors.ErrInvalidFile.WithDetails("文件内容为空")
+	}
+
+	mimeType := detectMIMEType(content.data, content.declaredMIME, content.name)
+	category := mediaCategory(mimeType)
+	if fileType != "file" && fileType != category {
+		return types.UpstreamFile{}, errors.ErrUnsupportedFileType.WithDetails(
+			fmt.Sprintf("%s 内容部分的实际类型为 %s", fileType, mimeType))
+	}
+	normalize := fu.normalizeImages && category == "image"
+	if limit := fu.sizeLimit(category, normalize); int64(len(content.data)) > limit {
+		return types.UpstreamFile{}, fileTooLargeError(category, int64(len(content.data)), limit)
+	}
+
+	// 相同内容已上传过时直接复用上游文件；图片按规范化选项分别缓存
+	imageOpts := ImageOptions{Detail: content.detail, MaxDimension: fu.maxImageDimension}
+	var hash string
+	if fu.cache != nil {
+		hash = contentHash(content.data)
+		if normalize {
+			hash += ":" + imageOpts.cacheKey()
+		}
+		if cachedFile, ok := fu.cache.GetContent(fu.authToken, hash); ok && cachedFile.Type == category {
+			debugLog("文件内容命中上传缓存，复用上游文件 %s", cachedFile.ID)
+			fu.cacheURL(content, cachedFile)
+			return cachedFile, nil
+		}
+	}
+
+	data, name := content.data, content.name
+	if normalize {
+		normalized, err := normalizeImage(data, mimeType, imageOpts)
+		if err != nil {
+			return types.UpstreamFile{}, err
+		}
+		if normalized.mimeType != mimeType && name != "" {
+			name = strings.TrimSuffix(name, path.Ext(name)) + extensionForMIME(normalized.mimeType)
+		}
+		data, mimeType = normalized.data, normalized.mimeType
+		if limit := fileSizeLimits[category]; int64(len(data)) > limit {
+			return types.UpstreamFile{}, fileTooLargeError(category, int64(len(data)), limit)
+		}
+	}
+
+	if name == "" || path.Ext(name) == "" {
+		name = fmt.Sprintf("%s_%s%s", category, utils.GenerateUUID(), extensionForMIME(mimeType))
+	}
+
+	fileID, err := fu.uploadData(ctx, data, name, mimeType)
+	if err != nil {
+		return types.UpstreamFile{}, err
+	}
+
+	uploaded := types.UpstreamFile{
+		Type:     category,
+		ID:       fileID,
+		Name:     name,
+		MimeType: mimeType,
+		Size:     int64(len(data)),
+	}
+	if fu.cache != nil {
+		fu.cache.PutContent(fu.authToken, hash, uploaded)
+		fu.cacheURL(content, uploaded)
+	}
+	return uploaded, nil
+}
+
+// cacheURL 缓存远程文件来源URL到上游文件的映射
+func (fu *FileUploader) cacheURL(content *fileContent, file types.UpstreamFile) {
+	if content.sourceURL == "" {
+		return
+	}
+	fu.cache.PutURL(fu.authToken, content.sourceURL, cachedUpload{
+		File:         file,
+		ETag:         content.etag,
+		LastModified: content.lastModified,
+	})
+}
+
+// Delete 删除上游文件
+func (fu *FileUploader) Delete(ctx context.Context, fileID string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fu.uploadURL+url.PathEscape(fileID), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", fu.authToken))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := fu.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("删除上游文件失败，状态码: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// isHTTPURL 是否为 http(s) URL
+func isHTTPURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// fetch 读取 data URL 或下载 http(s) URL 的文件内容，cached 非空时对远程文件发起条件请求
+func (fu *FileUploader) fetch(ctx context.Context, file utils.ProcessedFile, cached *cachedUpload) (*fileContent, error) {
+	limit := sourceSizeLimit(file.Type)
+
+	switch {
+	case strings.HasPrefix(file.URL, "data:"):
+		return decodeDataURL(file, limit)
+	case isHTTPURL(file.URL):
+		return fu.download(ctx, file, limit, cached)
+	}
+	return nil, errors.ErrInvalidFile.WithDetails("不支持的文件URL格式，仅支持 data URL 与 http(s) URL")
+}
+
+// decodeDataURL 解码 data:<mime>;base64,<data> 格式的内联文件
+func decodeDataURL(file utils.ProcessedFile, limit int64) (*fileContent, error) {
+	header, payload, ok := strings.Cut(strings.TrimPrefix(file.URL, "data:"), ",")
+	if !ok || !strings.HasSuffix(header, ";base64") {
+		return nil, errors.ErrInvalidFile.WithDetails("data URL 必须使用 base64 编码")
+	}
+	if size := int64(base64.StdEncoding.DecodedLen(len(payload))); size > limit+2 {
+		return nil, fileTooLargeError(file.Type, size, limit)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		debugLog("解码 base64 文件失败: %v", err)
+		return nil, errors.ErrInvalidFile.WithDetails(fmt.Sprintf("解码 base64 文件失败: %v", err))
+	}
+
+	return &fileContent{
+		data:         data,
+		name:         file.Name,
+		declaredMIME: strings.TrimSuffix(header, ";base64"),
+	}, nil
+}
+
+// download 通过防 SSRF 获取器下载远程文件，读取量不超过 limit；图片内容部分要求内容必须是图片
+func (fu *FileUploader) download(ctx context.Context, file utils.ProcessedFile, limit int64, cached *cachedUpload) (*fileContent, error) {
+	header := make(http.Header)
+	if cached != nil {
+		if cached.ETag != "" {
+			header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	result, err := fu.fetcher.Fetch(ctx, file.URL, header, limit, file.Type == "image")
+	if err != nil {
+		return nil, err
+	}
+	if result.StatusCode == http.StatusNotModified {
+		if cached == nil {
+			return nil, errors.ErrFileFetchFailed.WithDetails("远程服务器返回了意外的 304 响应")
+		}
+		return &fileContent{notModified: true}, nil
+	}
+
+	name := file.Name
+	if name == "" {
+		name = path.Base(result.FinalURL.Path)
+		if name == "/" || name == "." {
+			name = ""
+		}
+	}
+
+	return &fileContent{
+		data:         result.Data,
+		name:         name,
+		declaredMIME: result.Header.Get("Content-Type"),
+		sourceURL:    file.URL,
+		etag:         result.Header.Get("ETag"),
+		lastModified: result.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// uploadData 以 multipart 表单上传文件数据到上游文件接口
+func (fu *FileUploader) uploadData(ctx context.Context, data []byte, name, mimeType string) (string, error) {
+	// 构建 multipart 请求体
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	partHeader := make(textproto.MIMEHeader)
+	partHeader.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": "file", "filename": name}))
+	partHeader.Set("Content-Type", mimeType)
+	part, err := form.CreatePart(partHeader)
+	if err != nil {
+		return "", errors.ErrInternalError.WithDetails(fmt.Sprintf("构建上传请求失败: %v", err))
+	}
+	part.Write(data)
+	if err := form.Close(); err != nil {
+		return "", errors.ErrInternalError.WithDetails(fmt.Sprintf("构建上传请求失败: %v", err))
+	}
+
+	// 创建 HTTP 请求
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fu.uploadURL, &body)
+	if err != nil {
+		return "", errors.ErrInternalError.WithDetails(fmt.Sprintf("创建上传请求失败: %v", err))
+	}
+
+	// 设置请求头
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", fu.authToken))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+
+	// 发送请求
+	resp, err := fu.httpClient.Do(req)
+	if err != nil {
+		debugLog("发送上传请求失败: %v", err)
+		return "", errors.ErrFileUploadFailed.WithDetails(fmt.Sprintf("发送上传请求失败: %v", err))
+	}
+	defer resp.Body.Close()
+
+	// 读取响应
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.ErrFileUploadFailed.WithDetails(fmt.Sprintf("读取上传响应失败: %v", err))
+	}
+
+	// 解析响应
+	var uploadResp FileUploadResponse
+	if err := sonic.Unmarshal(respBody, &uploadResp); err != nil {
+		debugLog("解析上传响应失败: %v, 原始响应: %s", err, string(respBody))
+		return "", errors.ErrFileUploadFailed.WithDetails(fmt.Sprintf("上游返回了无法解析的响应 (状态码: %d)", resp.StatusCode))
+	}
+
+	fileID := uploadResp.ID
+	if fileID == "" {
+		fileID = uploadResp.FileID
+	}
+	if resp.StatusCode != http.StatusOK || fileID == "" {
+		reason := uploadResp.Detail
+		if reason == "" {
+			reason = uploadResp.Message
+		}
+		return "", errors.ErrFileUploadFailed.WithDetails(fmt.Sprintf("文件上传失败 (状态码: %d): %s", resp.StatusCode, reason))
+	}
+
+	debugLog("文件上传成功: %s (%s, %d 字节)，文件ID: %s", name, mimeType, len(data), fileID)
+	return fileID, nil
+}
+
+// detectMIMEType 根据文件内容识别MIME类型；内容嗅探只能得到通用类型时，采用声明的类型或扩展名推断的类型
+func detectMIMEType(data []byte, declared, name string) string {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	switch sniffed {
+	case "application/octet-stream", "application/zip", "text/plain":
+	default:
+		return sniffed
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(declared); err == nil && mediaType != "application/octet-stream" {
+		return mediaType
+	}
+	if ext := path.Ext(name); ext != "" {
+		if byExt, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil {
+			return byExt
+		}
+	}
+	return sniffed
+}
+
+// mediaCategory 将MIME类型归类为 image、audio、video 或 document
+func mediaCategory(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "image"
+	case strings.HasPrefix(mimeType, "audio/"), mimeType == "application/ogg":
+		return "audio"
+	case strings.HasPrefix(mimeType, "video/"):
+		return "video"
+	}
+	return "document"
+}
+
+// extensionForMIME 返回MIME类型对应的文件扩展名
+func extensionForMIME(mimeType string) string {
+	if ext, ok := preferredExtensions[mimeType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mimeType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// sizeLimit 返回规范化前文件内容的大小上限，图片规范化后还需满足 fileSizeLimits 中的上限
+func (fu *FileUploader) sizeLimit(category string, normalize bool) int64 {
+	if normalize {
+		return imageSourceSizeLimit
+	}
+	return fileSizeLimits[category]
+}
+
+// sourceSizeLimit 返回获取文件时允许读取的大小上限；图片会在上传前规范化，因此允许更大的原图
+func sourceSizeLimit(fileType string) int64 {
+	switch limit, ok := fileSizeLimits[fileType]; {
+	case fileType == "image":
+		return max(limit, imageSourceSizeLimit)
+	case ok:
+		return limit
+	}
+	return maxFileSizeLimit()
+}
+
+// maxFileSizeLimit 返回所有类型中最大的大小上限，用于类型未知的文件
+func maxFileSizeLimit() int64 {
+	var maxLimit int64
+	for _, limit := range fileSizeLimits {
+		if limit > maxLimit {
+			maxLimit = limit
+		}
+	}
+	return maxLimit
+}
+
+// fileTooLargeError 构建文件超限错误
+func fileTooLargeError(fileType string, size, limit int64) errors.APIError {
+	return errors.ErrFileTooLarge.WithDetails(fmt.Sprintf("%s 文件大小 %.1f MB 超过上限 %.1f MB",
+		fileType, float64(size)/(1<<20), float64(limit)/(1<<20)))
+}
+
+// uploadMessageFiles 上传消息中的全部待处理文件，返回可附加到上游请求的文件引用；
+// maxImageDimension 为模型的图片长边上限，0 使用全局默认值
+// 任意一个文件失败都会返回错误，不会静默丢弃
+func uploadMessageFiles(ctx context.Context, authToken string, pending []utils.ProcessedFile, maxImageDimension int) ([]types.UpstreamFile, error) {
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	uploader := NewFileUploader(authToken)
+	uploader.maxImageDimension = maxImageDimension
+	files := make([]types.UpstreamFile, 0, len(pending))
+	for i, file := range pending {
+		uploaded, err := uploader.Upload(ctx, file)
+		if err != nil {
+			debugLog("上传第 %d 个文件失败 (%s): %v", i+1, file.Type, err)
+			return nil, err
+		}
+		files = append(files, uploaded)
+	}
+
+	debugLog("已上传 %d 个文件", len(files))
+	return files, nil
+}
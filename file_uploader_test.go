@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"z2api/errors"
+	"z2api/utils"
+)
+
+// newTestUploader 创建指向测试服务器的文件上传服务
+func newTestUploader(t *testing.T, handler http.HandlerFunc) *FileUploader {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	uploader := NewFileUploader("test-token")
+	uploader.uploadURL = server.URL + "/api/v1/files/"
+	return uploader
+}
+
+// dataURL 构建 base64 data URL
+func dataURL(mimeType string, data []byte) string {
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+var testPDF = []byte("%PDF-1.4\n1 0 obj\n<<>>\nendobj\n")
+
+// TestFileUploaderUpload 测试文件以 multipart 表单上传，并按内容识别类型
+func TestFileUploaderUpload(t *testing.T) {
+	var gotName, gotType string
+	uploader := newTestUploader(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+			t.Errorf("Authorization = %q", got)
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			t.Fatalf("缺少 file 字段: %v", err)
+		}
+		data, _ := io.ReadAll(file)
+		if string(data) != string(testPDF) {
+			t.Errorf("上传内容 = %q", data)
+		}
+		gotName, gotType = header.Filename, header.Header.Get("Content-Type")
+		w.Write([]byte(`{"id":"file-123","filename":"report.pdf"}`))
+	})
+
+	// 声明为通用类型的 PDF 也应识别为文档
+	file := utils.ProcessedFile{Type: "file", URL: dataURL("application/octet-stream", testPDF), Name: "report.pdf"}
+	uploaded, err := uploader.Upload(context.Background(), file)
+	if err != nil {
+		t.Fatalf("上传失败: %v", err)
+	}
+	if uploaded.ID != "file-123" || uploaded.Type != "document" || uploaded.MimeType != "application/pdf" {
+		t.Errorf("uploaded = %+v", uploaded)
+	}
+	if gotName != "report.pdf" || gotType != "application/pdf" {
+		t.Errorf("filename = %q, content-type = %q", gotName, gotType)
+	}
+}
+
+// TestFileUploaderErrors 测试失败时返回带状态码的 APIError
+func TestFileUploaderErrors(t *testing.T) {
+	uploader := newTestUploader(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"detail":"Not authenticated"}`))
+	})
+
+	tests := []struct {
+		name   string
+		file   utils.ProcessedFile
+		status int
+	}{
+		{"无效的base64", utils.ProcessedFile{Type: "image", URL: "data:image/png;base64,!!!"}, http.StatusBadRequest},
+		{"不支持的格式", utils.ProcessedFile{Type: "image", URL: "ftp://example.com/a.png"}, http.StatusBadRequest},
+		{"类型不符", utils.ProcessedFile{Type: "image", URL: dataURL("image/png", testPDF)}, http.StatusUnsupportedMediaType},
+		{"声明大小超限", utils.ProcessedFile{Type: "image", URL: dataURL("image/png", testPDF), Size: 21 << 20}, http.StatusRequestEntityTooLarge},
+		{"上游拒绝", utils.ProcessedFile{Type: "document", URL: dataURL("application/pdf", testPDF)}, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := uploader.Upload(context.Background(), tt.file)
+			apiErr, ok := err.(errors.APIError)
+			if !ok {
+				t.Fatalf("期望 APIError, 实际 %T: %v", err, err)
+			}
+			if apiErr.StatusCode != tt.status {
+				t.Errorf("StatusCode = %d, want %d (%v)", apiErr.StatusCode, tt.status, apiErr.Details)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"z2api/errors"
+	"z2api/types"
+	"z2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultFilePurpose 未指定 purpose 时使用的默认值
+const defaultFilePurpose = "user_data"
+
+// GinHandleFileUpload 上传文件 (POST /v1/files)
+// 文件通过上游文件接口存储，本地仅保留元数据索引，聊天消息可通过 file_id 引用
+func GinHandleFileUpload(c *gin.Context) {
+	startTime := time.Now()
+	c.Set("start_time", startTime)
+	c.Set("user_agent", c.GetHeader("User-Agent"))
+	c.Set("debug_mode", appConfig.DebugMode)
+
+	if !authorizeFilesRequest(c, startTime) {
+		return
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		utils.ErrorResponse(c, errors.ErrMissingRequiredField.WithDetails("缺少 file 字段").WithParam("file"))
+		recordError(c, startTime, http.StatusBadRequest, "validation_error")
+		return
+	}
+	purpose := c.PostForm("purpose")
+	if purpose == "" {
+		purpose = defaultFilePurpose
+	}
+
+	limit := maxFileSizeLimit()
+	if header.Size > limit {
+		apiErr := fileTooLargeError("file", header.Size, limit).WithParam("file")
+		utils.ErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+
+	src, err := header.Open()
+	if err != nil {
+		utils.ErrorResponse(c, errors.ErrInvalidFile.WithDetails(err.Error()).WithParam("file"))
+		recordError(c, startTime, http.StatusBadRequest, "invalid_request_error")
+		return
+	}
+	defer src.Close()
+
+	data, err := io.ReadAll(io.LimitReader(src, limit+1))
+	if err != nil {
+		utils.ErrorResponse(c, errors.ErrInvalidFile.WithDetails(err.Error()).WithParam("file"))
+		recordError(c, startTime, http.StatusBadRequest, "invalid_request_error")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Minute)
+	defer cancel()
+
+	// 文件接口没有 user 字段，按客户端 IP 绑定匿名 token，与未传 user 的对话请求一致
+	authToken, err := getAuthToken(ctx, c.ClientIP())
+	if err != nil {
+		apiErr := errors.WrapError(err)
+		setPoolRetryAfter(c, apiErr)
+		utils.ErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+	upstream, err := NewFileUploader(authToken).UploadBytes(ctx, data, header.Filename, header.Header.Get("Content-Type"))
+	if err != nil {
+		apiErr := errors.WrapError(err).WithParam("file")
+		utils.ErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+
+	filename := header.Filename
+	if filename == "" {
+		filename = upstream.Name
+	}
+
+	file := StoredFile{
+		FileObject: types.FileObject{
+			ID:        utils.GenerateFileID(),
+			Object:    "file",
+			Bytes:     upstream.Size,
+			CreatedAt: time.Now().Unix(),
+			Filename:  filename,
+			Purpose:   purpose,
+			Status:    "processed",
+			MimeType:  upstream.MimeType,
+		},
+		Upstream:   upstream,
+		ownerToken: authToken,
+	}
+	fileStore.Add(file)
+
+	debugLog("文件已上传: %s -> 上游文件 %s (%s, %d 字节)", file.ID, upstream.ID, upstream.MimeType, upstream.Size)
+	c.JSON(http.StatusOK, file.FileObject)
+}
+
+// GinHandleListFiles 列出已上传的文件 (GET /v1/files)
+func GinHandleListFiles(c *gin.Context) {
+	startTime := time.Now()
+	if !authorizeFilesRequest(c, startTime) {
+		return
+	}
+
+	c.JSON(http.StatusOK, types.FileListResponse{
+		Object:  "list",
+		Data:    fileStore.List(c.Query("purpose")),
+		HasMore: false,
+	})
+}
+
+// GinHandleRetrieveFile 获取单个文件信息 (GET /v1/files/:id)
+func GinHandleRetrieveFile(c *gin.Context) {
+	startTime := time.Now()
+	if !authorizeFilesRequest(c, startTime) {
+		return
+	}
+
+	file, ok := fileStore.Get(c.Param("id"))
+	if !ok {
+		utils.ErrorResponse(c, fileNotFoundError(c.Param("id")))
+		return
+	}
+	c.JSON(http.StatusOK, file.FileObject)
+}
+
+// GinHandleDeleteFile 删除文件 (DELETE /v1/files/:id)
+// 本地索引立即删除，上游文件尽力删除，失败仅记录日志
+func GinHandleDeleteFile(c *gin.Context) {
+	startTime := time.Now()
+	if !authorizeFilesRequest(c, startTime) {
+		return
+	}
+
+	file, ok := fileStore.Delete(c.Param("id"))
+	if !ok {
+		utils.ErrorResponse(c, fileNotFoundError(c.Param("id")))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	if err := NewFileUploader(file.ownerToken).Delete(ctx, file.Upstream.ID); err != nil {
+		debugLog("删除上游文件 %s 失败: %v", file.Upstream.ID, err)
+	}
+
+	c.JSON(http.StatusOK, types.FileDeleteResponse{
+		ID:      file.ID,
+		Object:  "file",
+		Deleted: true,
+	})
+}
+
+// authorizeFilesRequest 校验 Files API 的 API Key，失败时写入错误响应
+func authorizeFilesRequest(c *gin.Context, startTime time.Time) bool {
+	if extractAPIKey(c) != appConfig.DefaultKey {
+		utils.ErrorResponse(c, errors.ErrInvalidAPIKey.WithParam("api_key"))
+		recordError(c, startTime, errors.ErrInvalidAPIKey.StatusCode, "invalid_api_key")
+		return false
+	}
+	return true
+}
+
+// fileNotFoundError 构建文件不存在错误
+func fileNotFoundError(id string) errors.APIError {
+	err := errors.NewInvalidRequestErrorWithParam(fmt.Sprintf("No such file: '%s'", id), "file_id")
+	err.Code = http.StatusNotFound
+	err.StatusCode = http.StatusNotFound
+	return err
+}
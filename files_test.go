@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	apierrors "z2api/errors"
+	"z2api/internal/tokenpool"
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestFilesAPI 测试 /v1/files 上传、列出、获取、删除，以及聊天消息通过 file_id 引用
+func TestFilesAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var deleted string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			w.Write([]byte(`{"id":"upstream-file-1"}`))
+		case http.MethodDelete:
+			deleted = r.URL.Path
+			w.Write([]byte(`true`))
+		}
+	}))
+	defer upstream.Close()
+
+	oldConfig := appConfig
+	appConfig = &types.Config{DefaultKey: "sk-test", UpstreamToken: "upstream-token", UpstreamUrl: upstream.URL + "/api/chat/completions"}
+	defer func() { appConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/files", GinHandleFileUpload)
+	router.GET("/v1/files", GinHandleListFiles)
+	router.GET("/v1/files/:id", GinHandleRetrieveFile)
+	router.DELETE("/v1/files/:id", GinHandleDeleteFile)
+
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		req.Header.Set("Authorization", "Bearer sk-test")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 上传
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("purpose", "assistants")
+	part, _ := form.CreateFormFile("file", "report.pdf")
+	part.Write(testPDF)
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/v1/files", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := do(req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("上传失败: %d %s", w.Code, w.Body.String())
+	}
+	var file types.FileObject
+	if err := sonicDefault.Unmarshal(w.Body.Bytes(), &file); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	if file.Object != "file" || file.Filename != "report.pdf" || file.Purpose != "assistants" || file.Bytes != int64(len(testPDF)) {
+		t.Errorf("file = %+v", file)
+	}
+
+	// 列出与获取
+	if w := do(httptest.NewRequest(http.MethodGet, "/v1/files?purpose=assistants", nil)); !bytes.Contains(w.Body.Bytes(), []byte(file.ID)) {
+		t.Errorf("列表中缺少文件: %s", w.Body.String())
+	}
+	if w := do(httptest.NewRequest(http.MethodGet, "/v1/files/"+file.ID, nil)); w.Code != http.StatusOK {
+		t.Errorf("获取文件失败: %d", w.Code)
+	}
+
+	// 聊天消息中的 file_id 解析为上游文件
+	converted := convertMultimodalMessages([]types.Message{{
+		Role: "user",
+		Content: []interface{}{
+			map[string]interface{}{"type": "text", "text": "总结这份文件"},
+			map[string]interface{}{"type": "file", "file": map[string]interface{}{"file_id": file.ID}},
+		},
+	}})
+	if len(converted.Pending) != 0 || len(converted.Files) != 1 {
+		t.Fatalf("converted = %+v", converted)
+	}
+	if got := converted.Files[0]; got.ID != "upstream-file-1" || got.Type != "document" || got.MimeType != "application/pdf" {
+		t.Errorf("解析的上游文件 = %+v", got)
+	}
+
+	// 删除
+	if w := do(httptest.NewRequest(http.MethodDelete, "/v1/files/"+file.ID, nil)); w.Code != http.StatusOK {
+		t.Errorf("删除文件失败: %d", w.Code)
+	}
+	if deleted != "/api/v1/files/upstream-file-1" {
+		t.Errorf("上游删除路径 = %q", deleted)
+	}
+	if w := do(httptest.NewRequest(http.MethodGet, "/v1/files/"+file.ID, nil)); w.Code != http.StatusNotFound {
+		t.Errorf("删除后获取文件应返回 404，实际 %d", w.Code)
+	}
+}
+
+// TestFileOwnerTokenPinning 测试 token 池轮换时，引用已上传文件的请求固定使用上传该文件的 token；
+// 本地文件ID不存在时返回 404，引用的文件由不同 token 上传时返回 400
+func TestFileOwnerTokenPinning(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var uploaders []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploaders = append(uploaders, r.Header.Get("Authorization"))
+		w.Write([]byte(`{"id":"upstream-file-` + strconv.Itoa(len(uploaders)) + `"}`))
+	}))
+	defer upstream.Close()
+
+	oldConfig, oldPool := appConfig, upstreamTokenPool
+	appConfig = &types.Config{DefaultKey: "sk-test", UpstreamUrl: upstream.URL + "/api/chat/completions"}
+	upstreamTokenPool = tokenpool.New([]string{"token-a", "token-b"}, tokenpool.RoundRobin, time.Minute)
+	defer func() { appConfig, upstreamTokenPool = oldConfig, oldPool }()
+
+	router := gin.New()
+	router.POST("/v1/files", GinHandleFileUpload)
+	upload := func() string {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "report.pdf")
+		part.Write(testPDF)
+		form.Close()
+		req := httptest.NewRequest(http.MethodPost, "/v1/files", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer sk-test")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var file types.FileObject
+		if err := sonicDefault.Unmarshal(w.Body.Bytes(), &file); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("上传失败: %d %s", w.Code, w.Body.String())
+		}
+		return file.ID
+	}
+	messages := func(ids ...string) []types.Message {
+		content := []interface{}{map[string]interface{}{"type": "text", "text": "总结这些文件"}}
+		for _, id := range ids {
+			content = append(content, map[string]interface{}{"type": "file", "file": map[string]interface{}{"file_id": id}})
+		}
+		return []types.Message{{Role: "user", Content: content}}
+	}
+
+	fileA := upload() // 轮换到 token-a
+	fileB := upload() // 轮换到 token-b
+	if len(uploaders) != 2 || uploaders[0] != "Bearer token-a" || uploaders[1] != "Bearer token-b" {
+		t.Fatalf("上传使用的 token = %v", uploaders)
+	}
+
+	tests := []struct {
+		name       string
+		messages   []types.Message
+		wantToken  string
+		wantStatus int
+	}{
+		{"引用文件时固定使用上传的 token", messages(fileA), "token-a", 0},
+		{"再次引用仍使用上传的 token", messages(fileA), "token-a", 0},
+		{"未引用文件时按池选择", messages(), "token-a", 0},
+		{"本地文件不存在", messages("file-0123456789abcdef0123456789abcdef"), "", http.StatusNotFound},
+		{"文件由不同 token 上传", messages(fileA, fileB), "", http.StatusBadRequest},
+		{"上游文件ID原样转发", messages("upstream-file-9"), "token-b", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := getRequestAuthToken(context.Background(), "user-1", tt.messages)
+			if tt.wantStatus != 0 {
+				apiErr, ok := err.(apierrors.APIError)
+				if !ok || apiErr.StatusCode != tt.wantStatus || apiErr.Type != "invalid_request_error" {
+					t.Errorf("期望 %d invalid_request_error, 实际 %q, %v", tt.wantStatus, token, err)
+				}
+				return
+			}
+			if err != nil || token != tt.wantToken {
+				t.Errorf("getRequestAuthToken() = %q, %v, 期望 %q", token, err, tt.wantToken)
+			}
+		})
+	}
+}
@@ -6,6 +6,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"z2api/errors"
+	"z2api/internal/breaker"
+	"z2api/internal/tokenpool"
 	"z2api/types"
 	"z2api/utils"
 )
@@ -46,6 +48,9 @@ func GinHandleDashboardStats(c *gin.Context) {
 		"streamingRequests":    stats.StreamingRequests,
 		"nonStreamingRequests": stats.NonStreamingRequests,
 		"totalTokensUsed":      stats.TotalTokensUsed,
+		"upstreamRetries":      stats.UpstreamRetries,
+		"upstreamBreakers":     upstreamBreakerStatuses(),
+		"upstreamTokens":       upstreamTokenStats(),
 		"startTime":            stats.StartTime,
 		"fastestResponse":      stats.FastestResponse,
 		"slowestResponse":      stats.SlowestResponse,
@@ -111,6 +116,9 @@ type StatsResponse struct {
 	StreamingRequests    int64                `json:"streamingRequests"`
 	NonStreamingRequests int64                `json:"nonStreamingRequests"`
 	TotalTokensUsed      int64                `json:"totalTokensUsed"`
+	UpstreamRetries      int64                `json:"upstreamRetries"`
+	UpstreamBreakers     []breaker.Status     `json:"upstreamBreakers"`
+	UpstreamTokens       []tokenpool.Stats    `json:"upstreamTokens"`
 	StartTime            time.Time            `json:"startTime"`
 	FastestResponse      float64              `json:"fastestResponse"`
 	SlowestResponse      float64              `json:"slowestResponse"`
@@ -11,7 +11,6 @@ import (
 
 	"z2api/config"
 	"z2api/errors"
-	"z2api/internal/mapper"
 	"z2api/types"
 	"z2api/utils"
 
@@ -75,8 +74,17 @@ func GinHandleChatCompletions(c *gin.Context) {
 
 	debugLog("请求解析成功 - 模型: %s, 流式: %v, 消息数: %d", req.Model, req.Stream, len(req.Messages))
 
+	// 从模型注册表解析模型，未配置的模型直接拒绝
+	modelConfig, err := resolveModelConfig(req.Model)
+	if err != nil {
+		utils.ErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusNotFound, "model_not_found")
+		return
+	}
+	c.Set("model_name", modelConfig.Name)
+
 	// 设置默认参数（如果需要）
-	setDefaultParams(&req)
+	setDefaultParams(&req, modelConfig)
 
 	// 验证输入（额外的业务逻辑验证）
 	if err := validateBusinessRules(&req); err != nil {
@@ -98,15 +106,24 @@ func GinHandleChatCompletions(c *gin.Context) {
 	chatID := utils.GenerateChatID()
 	msgID := utils.GenerateMessageID()
 
-	// 获取模型配置
-	modelConfig := mapper.GetSimpleModelConfig(req.Model)
-	c.Set("model_name", modelConfig.Name)
-
-	// 构造上游请求
-	upstreamReq := buildUpstreamRequest(req, chatID, msgID, modelConfig)
-
 	// 获取认证token
-	authToken := getAuthToken()
+	authToken, err := getRequestAuthToken(timeoutCtx, sessionID, req.Messages)
+	if err != nil {
+		apiErr := errors.WrapError(err)
+		setPoolRetryAfter(c, apiErr)
+		utils.ErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+
+	// 构造上游请求（包含图片上传）
+	upstreamReq, err := buildUpstreamRequest(timeoutCtx, req, chatID, msgID, modelConfig, authToken)
+	if err != nil {
+		apiErr := errors.WrapError(err)
+		utils.ErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
 
 	// 根据请求类型调用不同的处理函数
 	if req.Stream {
@@ -122,25 +139,18 @@ func handleStreamResponseGin(ctx context.Context, c *gin.Context, upstreamReq ty
 	debugLog("开始处理流式响应 (Gin版) (chat_id=%s, model=%s)", chatID, upstreamReq.Model)
 
 	// 调用上游API，传递context
-	resp, cancel, err := callUpstreamWithContext(ctx, upstreamReq, chatID, authToken, sessionID)
+	body, cancel, err := openValidatedStream(ctx, c, upstreamReq, chatID, authToken, sessionID)
 	if err != nil {
-		utils.ErrorResponse(c, errors.NewUpstreamError(err.Error()))
-		recordError(c, startTime, http.StatusBadGateway, "upstream_error")
+		apiErr := errors.WrapError(err)
+		utils.ErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
 		return
 	}
 	defer func() {
 		cancel()
-		resp.Body.Close()
+		body.Close()
 	}()
 
-	// 检查响应状态
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		utils.ErrorResponse(c, errors.NewUpstreamError(fmt.Sprintf("状态: %d, 响应: %s", resp.StatusCode, string(body))))
-		recordError(c, startTime, http.StatusBadGateway, "upstream_error")
-		return
-	}
-
 	// 发送初始块
 	firstChunk := types.OpenAIResponse{
 		ID:      utils.GenerateChatCompletionID(),
@@ -163,11 +173,18 @@ func handleStreamResponseGin(ctx context.Context, c *gin.Context, upstreamReq ty
 	}
 
 	// 使用新的 Gin 流式处理器，传递context
-	if err := HandleGinStreamResponseWithContext(ctx, c, &resp.Body, modelName); err != nil {
+	handler := NewGinStreamHandler(c, modelName)
+	handler.SetIncludeUsage(upstreamReq.IncludeUsage)
+	if err := streamUpstreamPhases(ctx, c, body, withOutputHandling(handler, upstreamReq, cancel)); err != nil {
 		debugLog("流式响应处理错误: %v", err)
+		apiErr := errors.WrapError(err)
+		handler.FailStream(apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
 	}
 
 	// 记录统计
+	recordUsage(c, handler.Usage())
 	recordSuccess(c, startTime, modelName, true)
 	debugLog("流式响应处理完成")
 }
@@ -177,30 +194,119 @@ func handleNonStreamResponseGin(ctx context.Context, c *gin.Context, upstreamReq
 	startTime := c.GetTime("start_time")
 	debugLog("开始处理非流式响应 (Gin版) (chat_id=%s, model=%s)", chatID, upstreamReq.Model)
 
+	aggregator, err := collectUpstreamResponse(ctx, c, upstreamReq, chatID, authToken, sessionID)
+	if err != nil {
+		if apiErr, ok := err.(errors.APIError); ok {
+			utils.ErrorResponse(c, apiErr)
+			recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		}
+		return
+	}
+
+	// 获取聚合结果
+	content, reasoningContent, toolCalls, usage := aggregator.GetResult()
+	recordUsage(c, usage)
+
+	// 构建响应
+	openAIResp := buildNonStreamResponse(content, reasoningContent, toolCalls, usage, modelName)
+	if aggregator.Truncated && len(toolCalls) == 0 {
+		openAIResp.Choices[0].FinishReason = "length"
+	}
+
+	// 使用 Gin 的 JSON 方法发送响应
+	c.JSON(http.StatusOK, openAIResp)
+
+	// 记录统计
+	recordSuccess(c, startTime, modelName, false)
+	debugLog("非流式响应完成")
+}
+
+// openUpstreamStream 按重试策略调用上游并校验响应状态，调用次数计入响应头与统计；
+// 重试中换用的 token 记录在上下文中，同一请求后续的纠正重试沿用该 token 而不是已进入冷却的 token；
+// 返回的响应体受看门狗监视，上游停滞时读取返回 errors.ErrUpstreamStalled
+// 失败时返回 errors.APIError，调用方负责按各自协议格式输出错误
+func openUpstreamStream(ctx context.Context, c *gin.Context, upstreamReq types.UpstreamRequest, chatID, authToken, sessionID string) (*http.Response, context.CancelFunc, error) {
+	resp, cancel, attempts, authToken, err := callUpstreamWithRetry(ctx, upstreamRetryPolicy, upstreamReq, chatID, currentUpstreamToken(c, authToken), sessionID)
+	recordUpstreamAttempts(c, attempts)
+	recordUpstreamToken(c, authToken)
+	if err != nil {
+		if errors.IsAPIError(err) {
+			return nil, nil, err
+		}
+		return nil, nil, errors.NewUpstreamError(err.Error())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+		return nil, nil, errors.NewUpstreamError(fmt.Sprintf("状态: %d, 响应: %s", resp.StatusCode, string(body)))
+	}
+
+	// 上游停滞时由看门狗提前取消请求
+	resp.Body = watchUpstreamBody(resp.Body, upstreamStreamTimeouts, cancel)
+	return resp, cancel, nil
+}
+
+// collectUpstreamResponse 强制以流式方式请求上游，并将SSE聚合为完整结果
+// 工具调用按 tool_choice 与参数 schema 校验：none 时丢弃，required 或指定函数时不满足则重试，参数按需修复；
+// 设置了 response_format 时回答替换为提取出的 JSON，strict 时不符合 schema 则重试；
+// 上游未返回 usage 时按聚合结果估算
+// 返回 errors.APIError 表示需要向客户端报告的错误；返回其他错误表示客户端已断开或上下文已取消
+func collectUpstreamResponse(ctx context.Context, c *gin.Context, upstreamReq types.UpstreamRequest, chatID, authToken, sessionID string) (*GinStreamAggregator, error) {
+	var aggregator *GinStreamAggregator
+	content, err := enforceStructuredOutput(c, upstreamReq, func(req types.UpstreamRequest) (string, bool, error) {
+		calls, err := enforceToolOutput(c, req, func(req types.UpstreamRequest) ([]types.ToolCall, error) {
+			var err error
+			aggregator, err = collectUpstreamAttempt(ctx, c, req, chatID, authToken, sessionID)
+			if err != nil {
+				return nil, err
+			}
+			if toolChoiceForbidsCall(req.ToolChoiceObject) && aggregator.ToolCallMgr.HasCalls() {
+				debugLog("tool_choice=none，丢弃上游返回的工具调用")
+				aggregator.ToolCallMgr.Clear()
+			}
+			return aggregator.ToolCallMgr.GetSortedCalls(), nil
+		})
+		if err != nil {
+			return "", false, err
+		}
+
+		// 使用校验修复后的工具调用
+		aggregator.ToolCallMgr.Clear()
+		aggregator.ToolCallMgr.AddToolCalls(calls)
+		return aggregator.Content.String(), len(calls) > 0, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	aggregator.Content.Reset()
+	aggregator.Content.WriteString(content)
+	aggregator.Usage = aggregatedUsage(upstreamReq, aggregator)
+	return aggregator, nil
+}
+
+// collectUpstreamAttempt 请求一次上游并聚合SSE
+func collectUpstreamAttempt(ctx context.Context, c *gin.Context, upstreamReq types.UpstreamRequest, chatID, authToken, sessionID string) (*GinStreamAggregator, error) {
 	// 强制使用流式从上游获取
 	upstreamReq.Stream = true
 
-	resp, cancel, err := callUpstreamWithContext(ctx, upstreamReq, chatID, authToken, sessionID)
+	resp, cancel, err := openUpstreamStream(ctx, c, upstreamReq, chatID, authToken, sessionID)
 	if err != nil {
-		utils.ErrorResponse(c, errors.NewUpstreamError(err.Error()))
-		recordError(c, startTime, http.StatusBadGateway, "upstream_error")
-		return
+		return nil, err
 	}
 	defer func() {
 		cancel()
 		resp.Body.Close()
 	}()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		utils.ErrorResponse(c, errors.NewUpstreamError(fmt.Sprintf("状态: %d, 响应: %s", resp.StatusCode, string(body))))
-		recordError(c, startTime, http.StatusBadGateway, "upstream_error")
-		return
-	}
-
 	// 聚合流式响应，传递context
 	aggregator := NewGinStreamAggregator()
+	aggregator.SetStopSequences(upstreamReq.StopSequences)
+	aggregator.SetTokenLimit(upstreamReq.Model, upstreamReq.MaxTokens, countReasoningTokens())
 	bufReader := bufio.NewReader(resp.Body)
+	watchdog := bodyWatchdog(resp.Body)
 
 	debugLog("开始聚合流式响应为非流式格式 (Gin版)")
 
@@ -212,10 +318,10 @@ func handleNonStreamResponseGin(ctx context.Context, c *gin.Context, upstreamReq
 		select {
 		case <-ctx.Done():
 			debugLog("context取消或超时，停止处理: %v", ctx.Err())
-			return
+			return nil, ctx.Err()
 		case <-c.Request.Context().Done():
 			debugLog("客户端断开连接，停止处理")
-			return
+			return nil, c.Request.Context().Err()
 		default:
 		}
 
@@ -227,6 +333,9 @@ func handleNonStreamResponseGin(ctx context.Context, c *gin.Context, upstreamReq
 				break
 			}
 			debugLog("读取SSE行失败: %v", err)
+			if errors.IsAPIError(err) {
+				return nil, err
+			}
 			break
 		}
 
@@ -236,68 +345,89 @@ func handleNonStreamResponseGin(ctx context.Context, c *gin.Context, upstreamReq
 		// 检查大小限制
 		if totalSize > MaxResponseSize {
 			debugLog("响应大小超出限制")
-			utils.ErrorResponse(c, errors.ErrContentTooLong)
-			return
+			return nil, errors.ErrContentTooLong
 		}
 
 		// 处理行数据
 		if !aggregator.ProcessLine(line) {
 			break
 		}
+		if watchdog != nil {
+			watchdog.Phase(aggregator.Phase)
+		}
 	}
 
 	// 检查错误
 	if aggregator.Error != nil {
-		utils.ErrorResponse(c, errors.NewValidationError(aggregator.ErrorDetail))
-		recordError(c, startTime, http.StatusInternalServerError, "aggregation_error")
-		return
+		return nil, errors.NewValidationError(aggregator.ErrorDetail)
+	}
+	aggregator.Finish()
+	if len(upstreamReq.EmulatedTools) > 0 {
+		aggregator.ApplyToolEmulation(upstreamReq.EmulatedTools)
 	}
 
-	// 获取聚合结果
-	content, reasoningContent, toolCalls, usage := aggregator.GetResult()
-
-	// 构建响应
-	openAIResp := buildNonStreamResponse(content, reasoningContent, toolCalls, usage, modelName)
-
-	// 使用 Gin 的 JSON 方法发送响应
-	c.JSON(http.StatusOK, openAIResp)
-
-	// 记录统计
-	recordSuccess(c, startTime, modelName, false)
-	debugLog("非流式响应完成，处理了 %d 行SSE数据", lineCount)
+	debugLog("聚合完成，处理了 %d 行SSE数据", lineCount)
+	return aggregator, nil
 }
 
 // GinHandleModels 模型列表 (Gin 原生实现)
 func GinHandleModels(c *gin.Context) {
-	models := []gin.H{
-		{
-			"id":       "glm-4.5",
-			"object":   "model",
-			"created":  1686935002,
-			"owned_by": "openai",
-		},
-		{
-			"id":       "glm-4.5-air",
-			"object":   "model",
-			"created":  1686935002,
-			"owned_by": "openai",
-		},
-		{
-			"id":       "glm-4.6",
-			"object":   "model",
-			"created":  1686935002,
-			"owned_by": "openai",
-		},
+	models := make([]types.Model, 0, len(config.GetAllModels()))
+	for _, model := range config.GetAllModels() {
+		models = append(models, buildModelObject(model.ID, model))
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"object": "list",
-		"data":   models,
+	// 别名同样列出，root 指向实际模型
+	for _, alias := range config.GetModelAliases() {
+		if model, ok := config.GetModelConfig(alias.Alias); ok {
+			models = append(models, buildModelObject(alias.Alias, model))
+		}
+	}
+
+	c.JSON(http.StatusOK, types.ModelsResponse{
+		Object: "list",
+		Data:   models,
 	})
 }
 
+// GinHandleModel 获取单个模型信息，支持模型ID与别名
+func GinHandleModel(c *gin.Context) {
+	id := c.Param("id")
+
+	model, err := resolveModelConfig(id)
+	if err != nil {
+		utils.ErrorResponse(c, errors.WrapError(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, buildModelObject(id, model))
+}
+
+// buildModelObject 构建模型对象，id 与模型ID不同时视为别名
+func buildModelObject(id string, model config.ModelConfig) types.Model {
+	obj := types.Model{
+		ID:      id,
+		Object:  "model",
+		Created: 1686935002,
+		OwnedBy: "z.ai",
+		Name:    model.Name,
+		Capabilities: &types.ModelCapabilities{
+			Vision:        model.Capabilities.Vision,
+			Tools:         model.Capabilities.Tools,
+			Thinking:      model.Capabilities.Thinking,
+			Search:        model.Capabilities.Search,
+			ContextLength: model.Limits.ContextLength,
+		},
+	}
+	if !strings.EqualFold(id, model.ID) {
+		obj.Root = model.ID
+	}
+	return obj
+}
+
 // GinHandleHealth 健康检查 (Gin 原生实现)
 func GinHandleHealth(c *gin.Context) {
+	breakers := upstreamBreakerStatuses()
 	c.JSON(http.StatusOK, gin.H{
 		"status":    "healthy",
 		"timestamp": time.Now().Unix(),
@@ -308,28 +438,60 @@ func GinHandleHealth(c *gin.Context) {
 			"anon_token_enabled":      appConfig.AnonTokenEnabled,
 			"max_concurrent_requests": appConfig.MaxConcurrentRequests,
 		},
+		"upstream": gin.H{
+			"status":      upstreamAvailability(breakers),
+			"breakers":    breakers,
+			"anon_tokens": anonTokenStats(),
+		},
 	})
 }
 
 // 辅助函数
 
-func setDefaultParams(req *types.OpenAIRequest) {
+func setDefaultParams(req *types.OpenAIRequest, modelConfig config.ModelConfig) {
 	if req.Temperature == nil {
 		req.Temperature = types.Float64Ptr(0.7)
 	}
 	if req.TopP == nil {
 		req.TopP = types.Float64Ptr(0.9)
 	}
-	if req.MaxTokens == nil {
-		req.MaxTokens = types.IntPtr(120000)
+
+	// 未指定或超过模型上限时使用模型的最大输出token数
+	maxTokens := 120000
+	if modelConfig.Limits.MaxOutputTokens > 0 {
+		maxTokens = modelConfig.Limits.MaxOutputTokens
+	}
+	if req.MaxTokens == nil || *req.MaxTokens > maxTokens {
+		req.MaxTokens = types.IntPtr(maxTokens)
 	}
 }
 
-func buildUpstreamRequest(req types.OpenAIRequest, chatID, msgID string, modelConfig config.ModelConfig) types.UpstreamRequest {
-	featureConfig := getModelFeatures(modelConfig.ID, req.Stream)
-	featureConfig = mergeWithModelConfig(featureConfig, modelConfig)
+// resolveModelConfig 从模型注册表解析模型ID或别名，未配置的模型返回 ErrModelNotFound
+func resolveModelConfig(model string) (config.ModelConfig, error) {
+	modelConfig, ok := config.GetModelConfig(model)
+	if !ok {
+		return config.ModelConfig{}, errors.ErrModelNotFound.WithDetails(fmt.Sprintf("模型 '%s' 不存在", model))
+	}
+	return modelConfig, nil
+}
+
+// buildUpstreamRequest 构造上游请求，消息中的图片、文档、音视频会先上传到上游文件接口并以文件ID引用
+func buildUpstreamRequest(ctx context.Context, req types.OpenAIRequest, chatID, msgID string, modelConfig config.ModelConfig, authToken string) (types.UpstreamRequest, error) {
+	featureConfig := getModelFeatures(modelConfig, req.Stream)
+	responseFormat, err := parseResponseFormat(req.ResponseFormat)
+	if err != nil {
+		return types.UpstreamRequest{}, err
+	}
+	stopSequences, err := parseStopSequences(req.Stop)
+	if err != nil {
+		return types.UpstreamRequest{}, err
+	}
 
 	converted := convertMultimodalMessages(req.Messages)
+	uploaded, err := uploadMessageFiles(ctx, authToken, converted.Pending, imageMaxDimension(modelConfig))
+	if err != nil {
+		return types.UpstreamRequest{}, err
+	}
 	req.ToolChoiceObject = parseToolChoice(req.ToolChoice)
 
 	upstreamReq := types.UpstreamRequest{
@@ -351,31 +513,85 @@ func buildUpstreamRequest(req types.OpenAIRequest, chatID, msgID string, modelCo
 			Name:    modelConfig.Name,
 			OwnedBy: "openai",
 		},
-		ToolServers: featureConfig.ToolServers,
-		Variables:   featureConfig.Variables,
+		ToolServers:   featureConfig.ToolServers,
+		Variables:     featureConfig.Variables,
+		StopSequences: stopSequences,
+		MaxTokens:     outputTokenLimit(req),
+		IncludeUsage:  req.Stream && req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+	}
+
+	if needsToolEmulation(req, modelConfig) {
+		// 模型不支持原生工具调用，改为在提示词中描述工具并从回答中解析调用
+		upstreamReq.Messages = applyToolEmulation(upstreamReq.Messages, req.Tools, req.ToolChoiceObject)
+		if req.ToolChoiceObject == nil || req.ToolChoiceObject.Type != "none" {
+			upstreamReq.EmulatedTools = req.Tools
+		}
+	} else {
+		if len(req.Tools) > 0 {
+			upstreamReq.Tools = req.Tools
+		}
+		if req.ToolChoiceObject != nil {
+			upstreamReq.ToolChoice = req.ToolChoiceObject
+		}
 	}
-
 	if len(req.Tools) > 0 {
-		upstreamReq.Tools = req.Tools
-	}
-	if req.ToolChoiceObject != nil {
-		upstreamReq.ToolChoice = req.ToolChoiceObject
+		upstreamReq.ToolChoiceObject = req.ToolChoiceObject
+	}
+	if responseFormat != nil {
+		// 上游不保证遵守 response_format，在提示词中要求输出 JSON 并在输出侧提取与校验
+		upstreamReq.Messages = applyResponseFormat(upstreamReq.Messages, responseFormat)
+		upstreamReq.ResponseFormat = responseFormat
+	}
+	if files := append(converted.Files, uploaded...); len(files) > 0 {
+		upstreamReq.Files = files
+		for _, file := range files {
+			switch {
+			case file.MimeType == "application/pdf":
+				upstreamReq.Features["pdf"] = true
+			case file.Type == "audio":
+				upstreamReq.Features["audio"] = true
+			}
+		}
 	}
 
-	return upstreamReq
+	return upstreamReq, nil
 }
 
-func getAuthToken() string {
+// getAuthToken 返回本次请求使用的上游 token：优先从 token 池中选择，
+// 未配置 token 池或池中没有可用的 token 时使用 UPSTREAM_TOKEN 或会话绑定的匿名 token；
+// 池中没有可用的 token 且未配置这两种回退时返回 errors.ErrUpstreamUnavailable，不再以空 token 请求上游；
+// ctx 用于在同步获取匿名 token 排队时随请求结束
+func getAuthToken(ctx context.Context, sessionID string) (string, error) {
+	if token, ok := pickPoolToken(); ok {
+		return token, nil
+	}
+	if upstreamTokenPool != nil && appConfig.UpstreamToken == "" && !appConfig.AnonTokenEnabled {
+		return "", errors.ErrUpstreamUnavailable.WithDetails("上游 token 池中的 token 全部处于冷却或已过期，请稍后重试")
+	}
 	authToken := appConfig.UpstreamToken
 	if appConfig.AnonTokenEnabled {
-		token, err := tokenCache.GetToken()
+		token, err := getAnonymousToken(ctx, sessionID)
 		if err != nil {
 			debugLog("获取认证token失败: %v", err)
 		} else {
 			authToken = token
 		}
 	}
-	return authToken
+	return authToken, nil
+}
+
+// getRequestAuthToken 返回请求使用的上游 token：消息引用了通过 /v1/files 上传的文件时固定使用上传该文件的 token，
+// 否则按 getAuthToken 选择
+func getRequestAuthToken(ctx context.Context, sessionID string, messages []types.Message) (string, error) {
+	owner, err := fileOwnerToken(messages)
+	if err != nil {
+		return "", err
+	}
+	if owner != "" {
+		debugLog("请求引用了已上传的文件，使用上传该文件的上游 token")
+		return owner, nil
+	}
+	return getAuthToken(ctx, sessionID)
 }
 
 func buildNonStreamResponse(content, reasoningContent string, toolCalls []types.ToolCall, usage *types.Usage, modelName string) types.OpenAIResponse {
@@ -419,7 +635,7 @@ func buildNonStreamResponse(content, reasoningContent string, toolCalls []types.
 func recordError(c *gin.Context, startTime time.Time, statusCode int, errorType string) {
 	duration := float64(time.Since(startTime)) / float64(time.Millisecond)
 	userAgent := c.GetString("user_agent")
-	recordRequestStats(startTime, c.Request.URL.Path, statusCode, 0, "", false)
+	recordRequestStats(startTime, c.Request.URL.Path, statusCode, 0, "", false, int64(c.GetInt(upstreamRetriesKey)))
 	addLiveRequest(c.Request.Method, c.Request.URL.Path, statusCode, duration, userAgent, "")
 	requestErrors.Add(errorType, 1)
 }
@@ -427,10 +643,18 @@ func recordError(c *gin.Context, startTime time.Time, statusCode int, errorType
 func recordSuccess(c *gin.Context, startTime time.Time, modelName string, isStream bool) {
 	duration := float64(time.Since(startTime)) / float64(time.Millisecond)
 	userAgent := c.GetString("user_agent")
-	recordRequestStats(startTime, c.Request.URL.Path, http.StatusOK, 0, modelName, isStream)
+	recordRequestStats(startTime, c.Request.URL.Path, http.StatusOK, int64(c.GetInt(usageTokensKey)), modelName, isStream, int64(c.GetInt(upstreamRetriesKey)))
 	addLiveRequest(c.Request.Method, c.Request.URL.Path, http.StatusOK, duration, userAgent, modelName)
 }
 
+// extractAPIKey 从请求头中提取客户端API密钥，支持 Authorization: Bearer 与 x-api-key 两种方式
+func extractAPIKey(c *gin.Context) string {
+	if authHeader := c.GetHeader("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	return c.GetHeader("x-api-key")
+}
+
 // getValidationErrorMessage 转换验证错误为用户友好的消息
 func getValidationErrorMessage(e validator.FieldError) string {
 	switch e.Tag() {
@@ -459,11 +683,16 @@ func getValidationErrorMessage(e validator.FieldError) string {
 func validateBusinessRules(req *types.OpenAIRequest) error {
 	// 检查消息内容长度
 	totalContentLength := 0
-	for _, msg := range req.Messages {
+	for i, msg := range req.Messages {
 		if contentStr, ok := msg.Content.(string); ok {
 			totalContentLength += len(contentStr)
 		}
 		// 可以在这里添加对复杂内容的长度检查
+
+		// 工具结果必须通过 tool_call_id 对应到助手消息中的工具调用
+		if msg.Role == "tool" && msg.ToolCallID == "" {
+			return errors.NewValidationErrorWithParam("tool 消息缺少 tool_call_id", fmt.Sprintf("messages[%d].tool_call_id", i))
+		}
 	}
 
 	if totalContentLength > 1000000 { // 1MB 总限制
@@ -485,11 +714,6 @@ func validateBusinessRules(req *types.OpenAIRequest) error {
 	return nil
 }
 
-// callUpstreamWithContext 带context的上游调用
-func callUpstreamWithContext(ctx context.Context, upstreamReq types.UpstreamRequest, chatID, authToken, sessionID string) (*http.Response, context.CancelFunc, error) {
-	return callUpstreamWithHeaders(ctx, upstreamReq, chatID, authToken, sessionID)
-}
-
 // HandleGinStreamResponseWithContext 带context的流式响应处理
 func HandleGinStreamResponseWithContext(ctx context.Context, c *gin.Context, resp *io.ReadCloser, model string) error {
 	// 设置 SSE 响应头
@@ -498,11 +722,20 @@ func HandleGinStreamResponseWithContext(ctx context.Context, c *gin.Context, res
 	// 创建流处理器
 	handler := NewGinStreamHandler(c, model)
 
-	// 创建缓冲读取器
-	bufReader := bufio.NewReader(*resp)
-
 	debugLog("开始处理流式响应 (Gin版)，模型：%s", model)
 
+	return streamUpstreamPhases(ctx, c, *resp, handler)
+}
+
+// streamUpstreamPhases 逐行读取上游SSE并交给阶段处理器
+// 所有下游协议共用此循环，保证结束信号、断开检测等行为一致；
+// 上游停滞被看门狗取消时返回 errors.ErrUpstreamStalled，由调用方按各自协议输出错误
+func streamUpstreamPhases(ctx context.Context, c *gin.Context, body io.Reader, handler upstreamPhaseHandler) error {
+	// 创建缓冲读取器
+	bufReader := bufio.NewReader(body)
+	handler = withStreamWatchdog(handler, body)
+	var streamErr error
+
 	// 使用 Gin 的 Stream 方法处理流式数据，传递context
 	c.Stream(func(w io.Writer) bool {
 		// 检查context是否取消
@@ -521,55 +754,63 @@ func HandleGinStreamResponseWithContext(ctx context.Context, c *gin.Context, res
 		if err != nil {
 			if err == io.EOF {
 				debugLog("到达流末尾")
-				if !handler.sentFinish {
+				if !handler.IsFinished() {
 					handler.ProcessDonePhase(nil)
 				}
 				return false
 			}
 			debugLog("读取SSE行失败: %v", err)
+			if errors.IsAPIError(err) {
+				streamErr = err
+			}
 			return false
 		}
 
-		line = strings.TrimSpace(line)
-		if line == "" {
-			return true // 继续处理
-		}
+		return processUpstreamLine(handler, line)
+	})
 
-		// 处理SSE数据行
-		if strings.HasPrefix(line, "data: ") {
-			dataStr := strings.TrimPrefix(line, "data: ")
+	return streamErr
+}
 
-			// 检查是否为结束标记
-			if dataStr == "[DONE]" {
-				debugLog("收到[DONE]标记")
-				if !handler.sentFinish {
-					handler.ProcessDonePhase(nil)
-				}
-				return false
-			}
+// processUpstreamLine 解析一行上游SSE并交给阶段处理器，返回 false 表示流已结束
+func processUpstreamLine(handler upstreamPhaseHandler, line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return true // 继续处理
+	}
+
+	// 处理SSE数据行
+	if strings.HasPrefix(line, "data: ") {
+		dataStr := strings.TrimPrefix(line, "data: ")
 
-			// 解析JSON数据
-			var upstreamData types.UpstreamData
-			if err := sonicStream.UnmarshalFromString(dataStr, &upstreamData); err != nil {
-				debugLog("解析上游数据失败: %v", err)
-				return true // 继续处理
+		// 检查是否为结束标记
+		if dataStr == "[DONE]" {
+			debugLog("收到[DONE]标记")
+			if !handler.IsFinished() {
+				handler.ProcessDonePhase(nil)
 			}
+			return false
+		}
 
-			// 处理数据
-			handler.ProcessPhase(&upstreamData)
+		// 解析JSON数据
+		var upstreamData types.UpstreamData
+		if err := sonicStream.UnmarshalFromString(dataStr, &upstreamData); err != nil {
+			debugLog("解析上游数据失败: %v", err)
+			return true // 继续处理
+		}
 
-			// 检查是否完成
-			if upstreamData.Data.Done || upstreamData.Data.Phase == "done" {
-				debugLog("收到完成信号")
-				if !handler.sentFinish {
-					handler.ProcessDonePhase(&upstreamData)
-				}
-				return false
+		// 处理数据
+		dispatchUpstreamPhase(handler, &upstreamData)
+
+		// 检查是否完成
+		if upstreamData.Data.Done || upstreamData.Data.Phase == "done" {
+			debugLog("收到完成信号")
+			if !handler.IsFinished() {
+				handler.ProcessDonePhase(&upstreamData)
 			}
+			return false
 		}
+	}
 
-		return true // 继续处理
-	})
-
-	return nil
+	return true // 继续处理
 }
@@ -10,6 +10,7 @@ require (
 	github.com/gin-gonic/gin v1.11.0
 	github.com/go-playground/validator/v10 v10.28.0
 	github.com/google/uuid v1.6.0
+	golang.org/x/image v0.25.0
 	golang.org/x/sync v0.17.0
 )
 
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+	"z2api/config"
+	"z2api/errors"
+)
+
+const (
+	// defaultImageMaxDimension 模型未配置时图片长边的默认上限（像素）
+	defaultImageMaxDimension = 2048
+	// lowDetailMaxDimension detail=low 时图片长边的上限（像素）
+	lowDetailMaxDimension = 512
+	// imageSourceSizeLimit 规范化前原始图片的大小上限，规范化后仍需满足 fileSizeLimits 中的图片上限
+	imageSourceSizeLimit = 20 << 20
+	// maxImagePixels 允许解码的最大像素数，防止解压炸弹
+	maxImagePixels = 50_000_000
+	// normalizedJPEGQuality 重新编码为 JPEG 时的质量
+	normalizedJPEGQuality = 85
+)
+
+// imageDecoders 支持规范化的图片格式
+var imageDecoders = map[string]func([]byte) (image.Image, error){
+	"image/jpeg": func(data []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(data)) },
+	"image/png":  func(data []byte) (image.Image, error) { return png.Decode(bytes.NewReader(data)) },
+	"image/gif":  func(data []byte) (image.Image, error) { return gif.Decode(bytes.NewReader(data)) },
+	"image/webp": func(data []byte) (image.Image, error) { return webp.Decode(bytes.NewReader(data)) },
+}
+
+// imageConfigDecoders 仅读取图片尺寸的解码器，用于解码前的像素数检查
+var imageConfigDecoders = map[string]func([]byte) (image.Config, error){
+	"image/jpeg": func(data []byte) (image.Config, error) { return jpeg.DecodeConfig(bytes.NewReader(data)) },
+	"image/png":  func(data []byte) (image.Config, error) { return png.DecodeConfig(bytes.NewReader(data)) },
+	"image/gif":  func(data []byte) (image.Config, error) { return gif.DecodeConfig(bytes.NewReader(data)) },
+	"image/webp": func(data []byte) (image.Config, error) { return webp.DecodeConfig(bytes.NewReader(data)) },
+}
+
+// ImageOptions 图片规范化选项
+type ImageOptions struct {
+	Detail       string // low、high 或 auto（空值视为 auto）
+	MaxDimension int    // 长边上限，0 使用默认值
+}
+
+// maxDimension 根据 detail 返回长边上限
+func (o ImageOptions) maxDimension() int {
+	maxDim := o.MaxDimension
+	if maxDim <= 0 {
+		maxDim = defaultImageMaxDimension
+	}
+	if o.Detail == "low" && maxDim > lowDetailMaxDimension {
+		maxDim = lowDetailMaxDimension
+	}
+	return maxDim
+}
+
+// imageMaxDimension 返回模型的图片长边上限，模型未配置时使用 IMAGE_MAX_DIMENSION
+func imageMaxDimension(modelConfig config.ModelConfig) int {
+	if modelConfig.Limits.ImageMaxDimension > 0 {
+		return modelConfig.Limits.ImageMaxDimension
+	}
+	if appConfig != nil {
+		return appConfig.ImageMaxDimension
+	}
+	return 0
+}
+
+// cacheKey 返回规范化选项的缓存键后缀，不同选项的结果分别缓存
+func (o ImageOptions) cacheKey() string {
+	return fmt.Sprintf("img%d", o.maxDimension())
+}
+
+// normalizedImage 规范化后的图片
+type normalizedImage struct {
+	data     []byte
+	mimeType string
+	width    int
+	height   int
+}
+
+// normalizeImage 规范化图片：按 EXIF 方向旋转、按长边上限缩小、去除 EXIF 与文本元数据并重新编码为 JPEG（不透明）或 PNG（含透明）。
+// 无需处理的 JPEG/PNG 原样返回；不支持的格式原样返回，由上游决定是否接受
+func normalizeImage(data []byte, mimeType string, opts ImageOptions) (*normalizedImage, error) {
+	decode, ok := imageDecoders[mimeType]
+	if !ok {
+		return &normalizedImage{data: data, mimeType: mimeType}, nil
+	}
+
+	cfg, err := imageConfigDecoders[mimeType](data)
+	if err != nil {
+		return nil, errors.ErrInvalidFile.WithDetails(fmt.Sprintf("图片解码失败: %v", err))
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return nil, errors.ErrFileTooLarge.WithDetails(fmt.Sprintf("图片尺寸 %dx%d 超过上限 %d 像素", cfg.Width, cfg.Height, maxImagePixels))
+	}
+
+	orientation := 1
+	if mimeType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	maxDim := opts.maxDimension()
+	needsResize := cfg.Width > maxDim || cfg.Height > maxDim
+	hasMetadata := mimeType == "image/jpeg" && hasJPEGMetadata(data) || mimeType == "image/png" && hasPNGMetadata(data)
+
+	// 已是 JPEG/PNG、尺寸合规、无元数据且大小合规时无需重新编码
+	if !needsResize && !hasMetadata && (mimeType == "image/jpeg" || mimeType == "image/png") &&
+		int64(len(data)) <= fileSizeLimits["image"] {
+		return &normalizedImage{data: data, mimeType: mimeType, width: cfg.Width, height: cfg.Height}, nil
+	}
+
+	img, err := decode(data)
+	if err != nil {
+		return nil, errors.ErrInvalidFile.WithDetails(fmt.Sprintf("图片解码失败: %v", err))
+	}
+	// 长边上限与方向无关，先缩小再旋转以减少逐像素处理量
+	img = resizeToFit(img, maxDim)
+	img = applyOrientation(img, orientation)
+
+	var buf bytes.Buffer
+	outMIME := "image/jpeg"
+	if isOpaque(img) {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: normalizedJPEGQuality})
+	} else {
+		outMIME = "image/png"
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, errors.ErrInternalError.WithDetails(fmt.Sprintf("图片编码失败: %v", err))
+	}
+
+	bounds := img.Bounds()
+	debugLog("图片已规范化: %s %dx%d (%d 字节) -> %s %dx%d (%d 字节)",
+		mimeType, cfg.Width, cfg.Height, len(data), outMIME, bounds.Dx(), bounds.Dy(), buf.Len())
+	return &normalizedImage{data: buf.Bytes(), mimeType: outMIME, width: bounds.Dx(), height: bounds.Dy()}, nil
+}
+
+// resizeToFit 等比缩小图片使长边不超过 maxDim，未超出时原样返回
+func resizeToFit(img image.Image, maxDim int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxDim && h <= maxDim {
+		return img
+	}
+
+	if w >= h {
+		h = max(1, h*maxDim/w)
+		w = maxDim
+	} else {
+		w = max(1, w*maxDim/h)
+		h = maxDim
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// isOpaque 判断图片是否不含透明像素
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// applyOrientation 按 EXIF 方向值（1-8）旋转或翻转图片
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // 水平翻转
+				dx, dy = w-1-x, y
+			case 3: // 旋转 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // 垂直翻转
+				dx, dy = x, h-1-y
+			case 5: // 沿主对角线翻转
+				dx, dy = y, x
+			case 6: // 顺时针旋转 90°
+				dx, dy = h-1-y, x
+			case 7: // 沿副对角线翻转
+				dx, dy = h-1-y, w-1-x
+			case 8: // 逆时针旋转 90°
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// jpegSegments 遍历 JPEG 图像数据之前的标记段，fn 返回 false 时停止
+func jpegSegments(data []byte, fn func(marker byte, payload []byte) bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 { // 图像数据开始或结束
+			return
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return
+		}
+		if !fn(marker, data[i+4:i+2+length]) {
+			return
+		}
+		i += 2 + length
+	}
+}
+
+// hasJPEGMetadata 判断 JPEG 是否包含 EXIF/XMP（APP1）等元数据段
+func hasJPEGMetadata(data []byte) bool {
+	found := false
+	jpegSegments(data, func(marker byte, _ []byte) bool {
+		found = marker == 0xE1
+		return !found
+	})
+	return found
+}
+
+// pngMetadataChunks 可能携带 EXIF 或文本元数据的 PNG 块
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "iTXt": true, "zTXt": true}
+
+// hasPNGMetadata 判断 PNG 是否包含 EXIF（eXIf）或文本（tEXt、iTXt、zTXt）块
+func hasPNGMetadata(data []byte) bool {
+	if len(data) < 8 || string(data[:8]) != "\x89PNG\r\n\x1a\n" {
+		return false
+	}
+	for i := 8; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		chunkType := string(data[i+4 : i+8])
+		if pngMetadataChunks[chunkType] {
+			return true
+		}
+		if chunkType == "IEND" || i+12+length > len(data) {
+			return false
+		}
+		i += 12 + length
+	}
+	return false
+}
+
+// jpegOrientation 读取 JPEG 的 EXIF 方向值，缺失或无法解析时返回 1
+func jpegOrientation(data []byte) int {
+	orientation := 1
+	jpegSegments(data, func(marker byte, payload []byte) bool {
+		if marker != 0xE1 || !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return true
+		}
+		orientation = exifOrientation(payload[6:])
+		return false
+	})
+	return orientation
+}
+
+// exifOrientation 从 TIFF 结构的 IFD0 中读取方向标签（0x0112）
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			value := int(order.Uint16(tiff[entry+8:]))
+			if value >= 1 && value <= 8 {
+				return value
+			}
+			return 1
+		}
+	}
+	return 1
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"z2api/utils"
+)
+
+// testImage 生成指定尺寸的图片，alpha 为 false 时完全不透明
+func testImage(w, h int, alpha bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			a := uint8(255)
+			if alpha && x < w/2 {
+				a = 128
+			}
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: a})
+		}
+	}
+	return img
+}
+
+// withEXIFOrientation 在 JPEG 的 SOI 之后插入仅包含方向标签的 EXIF 段
+func withEXIFOrientation(jpg []byte, orientation byte) []byte {
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08" + // TIFF 头（大端）
+		"\x00\x01" + // IFD0 条目数
+		"\x01\x12\x00\x03\x00\x00\x00\x01\x00" + string([]byte{orientation}) + "\x00\x00" +
+		"\x00\x00\x00\x00") // 无后续 IFD
+	segment := append([]byte{0xFF, 0xE1, 0, byte(len(exif) + 2)}, exif...)
+	return append(append(append([]byte{}, jpg[:2]...), segment...), jpg[2:]...)
+}
+
+// withPNGChunk 在 PNG 的 IHDR 块之后插入一个辅助块
+func withPNGChunk(data []byte, chunkType, payload string) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, chunkType+payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE([]byte(chunkType+payload)))
+	const ihdrEnd = 8 + 12 + 13 // 文件签名 + IHDR 块
+	return append(append(append([]byte{}, data[:ihdrEnd]...), chunk...), data[ihdrEnd:]...)
+}
+
+// TestNormalizeImage 测试按 detail 与尺寸上限缩小、EXIF 方向处理与去除、透明图片保留为 PNG
+func TestNormalizeImage(t *testing.T) {
+	var screenshot, transparent, small, photo bytes.Buffer
+	png.Encode(&screenshot, testImage(3000, 1500, false))
+	png.Encode(&transparent, testImage(1200, 600, true))
+	png.Encode(&small, testImage(300, 200, false))
+	jpeg.Encode(&photo, testImage(400, 200, false), nil)
+	rotated := withEXIFOrientation(photo.Bytes(), 6)
+	annotated := withPNGChunk(small.Bytes(), "tEXt", "Software\x00iOS 17.0")
+
+	tests := []struct {
+		name          string
+		data          []byte
+		mimeType      string
+		opts          ImageOptions
+		wantMIME      string
+		wantW, wantH  int
+		wantUnchanged bool
+	}{
+		{"默认上限缩小并转为 JPEG", screenshot.Bytes(), "image/png", ImageOptions{}, "image/jpeg", 2048, 1024, false},
+		{"模型上限", screenshot.Bytes(), "image/png", ImageOptions{MaxDimension: 1000}, "image/jpeg", 1000, 500, false},
+		{"detail=low", screenshot.Bytes(), "image/png", ImageOptions{Detail: "low"}, "image/jpeg", 512, 256, false},
+		{"透明图片保留 PNG", transparent.Bytes(), "image/png", ImageOptions{Detail: "low"}, "image/png", 512, 256, false},
+		{"EXIF 方向旋转", rotated, "image/jpeg", ImageOptions{}, "image/jpeg", 200, 400, false},
+		{"无需处理时原样返回", small.Bytes(), "image/png", ImageOptions{}, "image/png", 300, 200, true},
+		{"PNG 元数据去除", annotated, "image/png", ImageOptions{}, "image/jpeg", 300, 200, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeImage(tt.data, tt.mimeType, tt.opts)
+			if err != nil {
+				t.Fatalf("规范化失败: %v", err)
+			}
+			if got.mimeType != tt.wantMIME || got.width != tt.wantW || got.height != tt.wantH {
+				t.Errorf("got %s %dx%d, want %s %dx%d", got.mimeType, got.width, got.height, tt.wantMIME, tt.wantW, tt.wantH)
+			}
+			if unchanged := bytes.Equal(got.data, tt.data); unchanged != tt.wantUnchanged {
+				t.Errorf("原样返回 = %v, want %v", unchanged, tt.wantUnchanged)
+			}
+			if hasJPEGMetadata(got.data) || hasPNGMetadata(got.data) {
+				t.Error("规范化后仍包含 EXIF")
+			}
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(got.data))
+			if err != nil || "image/"+format != tt.wantMIME || cfg.Width != tt.wantW || cfg.Height != tt.wantH {
+				t.Errorf("输出图片 %s %dx%d (%v)", format, cfg.Width, cfg.Height, err)
+			}
+		})
+	}
+}
+
+// TestFileUploaderNormalizesImages 测试上传路径对图片规范化，并按 detail 分别缓存
+func TestFileUploaderNormalizesImages(t *testing.T) {
+	var screenshot bytes.Buffer
+	png.Encode(&screenshot, testImage(3000, 1500, false))
+
+	var uploads []string
+	uploader := newTestUploader(t, func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			t.Fatalf("缺少 file 字段: %v", err)
+		}
+		data, _ := io.ReadAll(file)
+		cfg, _, _ := image.DecodeConfig(bytes.NewReader(data))
+		uploads = append(uploads, header.Filename)
+		if header.Header.Get("Content-Type") != "image/jpeg" || cfg.Width != 1024 && cfg.Width != 512 {
+			t.Errorf("上传了 %s %dx%d", header.Header.Get("Content-Type"), cfg.Width, cfg.Height)
+		}
+		w.Write([]byte(`{"id":"file-img"}`))
+	})
+	uploader.normalizeImages = true
+	uploader.maxImageDimension = 1024
+	uploader.cache = NewUploadCache(time.Hour, 1<<20)
+
+	url := dataURL("image/png", screenshot.Bytes())
+	for _, detail := range []string{"high", "auto", "low"} {
+		uploaded, err := uploader.Upload(context.Background(), utils.ProcessedFile{Type: "image", URL: url, Name: "shot.png", Detail: detail})
+		if err != nil {
+			t.Fatalf("上传失败: %v", err)
+		}
+		if uploaded.MimeType != "image/jpeg" || uploaded.Name != "shot.jpg" {
+			t.Errorf("uploaded = %+v", uploaded)
+		}
+	}
+	if len(uploads) != 2 {
+		t.Errorf("上游上传次数 = %d, want 2（high/auto 共用缓存，low 单独上传）", len(uploads))
+	}
+}
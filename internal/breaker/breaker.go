@@ -0,0 +1,316 @@
+// Package breaker 实现带滚动窗口的熔断器
+//
+// 熔断器有三种状态：closed 时正常放行并在滚动窗口内统计失败与慢调用；
+// 窗口内请求数达到下限且失败率或慢调用比例超过阈值时进入 open，直接拒绝请求；
+// open 持续一段时间后进入 half-open，只放行有限个探测请求，全部成功则恢复 closed，任一失败则重新 open
+package breaker
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// State 熔断器状态
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+// String 返回状态名称
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// bucketCount 滚动窗口划分的桶数
+const bucketCount = 10
+
+// Config 熔断器配置
+type Config struct {
+	Window         time.Duration // 统计失败率的滚动窗口长度
+	MinRequests    int           // 窗口内请求数达到该值后才判断是否熔断
+	ErrorRate      float64       // 失败率阈值（0-1）
+	SlowCall       time.Duration // 慢调用的耗时阈值，0 表示不按耗时熔断
+	SlowRate       float64       // 慢调用比例阈值（0-1）
+	OpenTimeout    time.Duration // open 状态持续多久后进入 half-open
+	HalfOpenProbes int           // half-open 状态放行的探测请求数
+}
+
+// DefaultConfig 返回默认配置
+func DefaultConfig() Config {
+	return Config{
+		Window:         time.Minute,
+		MinRequests:    10,
+		ErrorRate:      0.5,
+		SlowCall:       5 * time.Minute,
+		SlowRate:       0.8,
+		OpenTimeout:    30 * time.Second,
+		HalfOpenProbes: 3,
+	}
+}
+
+// bucket 滚动窗口中一段时间的统计
+type bucket struct {
+	start    time.Time
+	requests int
+	failures int
+	slow     int
+}
+
+// Breaker 熔断器，可并发使用
+type Breaker struct {
+	mu       sync.Mutex
+	cfg      Config
+	now      func() time.Time
+	state    State
+	openedAt time.Time
+	buckets  [bucketCount]bucket
+	probes   int // half-open 状态已放行且尚未结束的探测请求数
+	passed   int // half-open 状态成功的探测请求数
+	lastUsed time.Time
+}
+
+// New 创建熔断器
+func New(cfg Config) *Breaker {
+	return newBreaker(cfg, time.Now)
+}
+
+// newBreaker 使用指定的时钟创建熔断器
+func newBreaker(cfg Config, now func() time.Time) *Breaker {
+	cfg.HalfOpenProbes = max(cfg.HalfOpenProbes, 1)
+	return &Breaker{cfg: cfg, now: now, lastUsed: now()}
+}
+
+// Allow 判断是否放行一次请求。放行后调用方必须以 Done 或 Abort 结束该请求
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.lastUsed = now
+	if b.state == Open && now.Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		b.state = HalfOpen
+		b.probes, b.passed = 0, 0
+	}
+
+	switch b.state {
+	case Open:
+		return false
+	case HalfOpen:
+		if b.probes+b.passed >= b.cfg.HalfOpenProbes {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// Done 记录一次已放行请求的结果与耗时
+func (b *Breaker) Done(success bool, latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	slow := b.cfg.SlowCall > 0 && latency >= b.cfg.SlowCall
+	now := b.now()
+
+	switch b.state {
+	case HalfOpen:
+		b.probes = max(b.probes-1, 0)
+		if !success || slow {
+			b.trip(now)
+			return
+		}
+		b.passed++
+		if b.passed >= b.cfg.HalfOpenProbes {
+			b.state = Closed
+			b.buckets = [bucketCount]bucket{}
+		}
+	case Closed:
+		bk := b.current(now)
+		bk.requests++
+		if !success {
+			bk.failures++
+		}
+		if slow {
+			bk.slow++
+		}
+		if b.shouldTrip(now) {
+			b.trip(now)
+		}
+	}
+}
+
+// Abort 结束一次已放行但无法判断结果的请求（如客户端取消），不计入统计
+func (b *Breaker) Abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen {
+		b.probes = max(b.probes-1, 0)
+	}
+}
+
+// trip 进入 open 状态
+func (b *Breaker) trip(now time.Time) {
+	b.state = Open
+	b.openedAt = now
+	b.probes, b.passed = 0, 0
+	b.buckets = [bucketCount]bucket{}
+}
+
+// bucketWidth 每个桶覆盖的时间
+func (b *Breaker) bucketWidth() time.Duration {
+	return max(b.cfg.Window/bucketCount, time.Millisecond)
+}
+
+// current 返回当前时间所在的桶，桶已过期时重置
+func (b *Breaker) current(now time.Time) *bucket {
+	width := b.bucketWidth()
+	start := now.Truncate(width)
+	bk := &b.buckets[(start.UnixNano()/int64(width))%bucketCount]
+	if !bk.start.Equal(start) {
+		*bk = bucket{start: start}
+	}
+	return bk
+}
+
+// totals 汇总滚动窗口内的统计
+func (b *Breaker) totals(now time.Time) (requests, failures, slow int) {
+	for _, bk := range b.buckets {
+		if bk.requests > 0 && now.Sub(bk.start) < b.cfg.Window {
+			requests += bk.requests
+			failures += bk.failures
+			slow += bk.slow
+		}
+	}
+	return requests, failures, slow
+}
+
+// shouldTrip 判断窗口内的失败率或慢调用比例是否超过阈值
+func (b *Breaker) shouldTrip(now time.Time) bool {
+	requests, failures, slow := b.totals(now)
+	if requests == 0 || requests < b.cfg.MinRequests {
+		return false
+	}
+	if b.cfg.ErrorRate > 0 && float64(failures)/float64(requests) >= b.cfg.ErrorRate {
+		return true
+	}
+	return b.cfg.SlowCall > 0 && b.cfg.SlowRate > 0 && float64(slow)/float64(requests) >= b.cfg.SlowRate
+}
+
+// Status 熔断器状态快照
+type Status struct {
+	Key       string    `json:"key"`
+	State     string    `json:"state"`
+	Requests  int       `json:"requests"`          // 滚动窗口内的请求数
+	Failures  int       `json:"failures"`          // 滚动窗口内的失败数
+	Slow      int       `json:"slow"`              // 滚动窗口内的慢调用数
+	ErrorRate float64   `json:"error_rate"`        // 滚动窗口内的失败率
+	RetryAt   time.Time `json:"retry_at,omitzero"` // open 状态下进入 half-open 的时间
+}
+
+// Status 返回熔断器当前的状态快照
+func (b *Breaker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	state := b.state
+	if state == Open && now.Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		state = HalfOpen
+	}
+	requests, failures, slow := b.totals(now)
+	status := Status{State: state.String(), Requests: requests, Failures: failures, Slow: slow}
+	if requests > 0 {
+		status.ErrorRate = float64(failures) / float64(requests)
+	}
+	if state == Open {
+		status.RetryAt = b.openedAt.Add(b.cfg.OpenTimeout)
+	}
+	return status
+}
+
+// State 返回熔断器当前状态
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// Group 按键（如上游地址与凭证）维护的一组熔断器，可并发使用
+type Group struct {
+	mu       sync.Mutex
+	cfg      Config
+	now      func() time.Time
+	breakers map[string]*Breaker
+}
+
+// maxIdleBreakers 熔断器数量超过该值时清理空闲且处于 closed 状态的熔断器
+const maxIdleBreakers = 256
+
+// NewGroup 创建熔断器组
+func NewGroup(cfg Config) *Group {
+	return &Group{cfg: cfg, now: time.Now, breakers: make(map[string]*Breaker)}
+}
+
+// Get 返回键对应的熔断器，不存在时创建
+func (g *Group) Get(key string) *Breaker {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if b, ok := g.breakers[key]; ok {
+		return b
+	}
+	if len(g.breakers) >= maxIdleBreakers {
+		g.pruneLocked()
+	}
+	b := newBreaker(g.cfg, g.now)
+	g.breakers[key] = b
+	return b
+}
+
+// pruneLocked 移除超过一个窗口未使用且处于 closed 状态的熔断器
+func (g *Group) pruneLocked() {
+	now := g.now()
+	for key, b := range g.breakers {
+		b.mu.Lock()
+		idle := b.state == Closed && now.Sub(b.lastUsed) > g.cfg.Window
+		b.mu.Unlock()
+		if idle {
+			delete(g.breakers, key)
+		}
+	}
+}
+
+// Statuses 返回所有熔断器的状态快照，按键排序
+func (g *Group) Statuses() []Status {
+	g.mu.Lock()
+	keys := make([]string, 0, len(g.breakers))
+	breakers := make(map[string]*Breaker, len(g.breakers))
+	for key, b := range g.breakers {
+		keys = append(keys, key)
+		breakers[key] = b
+	}
+	g.mu.Unlock()
+
+	sort.Strings(keys)
+	statuses := make([]Status, 0, len(keys))
+	for _, key := range keys {
+		status := breakers[key].Status()
+		status.Key = key
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,83 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock 测试用的可控时钟
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// TestBreakerTransitions 测试按失败率熔断、open 时拒绝、half-open 探测后恢复或重新熔断
+func TestBreakerTransitions(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cfg := Config{Window: 10 * time.Second, MinRequests: 4, ErrorRate: 0.5, OpenTimeout: 5 * time.Second, HalfOpenProbes: 2}
+	b := newBreaker(cfg, clock.now)
+
+	for _, success := range []bool{true, false, true} {
+		if !b.Allow() {
+			t.Fatal("closed 状态应放行请求")
+		}
+		b.Done(success, time.Millisecond)
+	}
+	if b.State() != Closed {
+		t.Fatalf("请求数未达到下限时不应熔断, 状态 %v", b.State())
+	}
+
+	b.Allow()
+	b.Done(false, time.Millisecond)
+	if b.State() != Open || b.Allow() {
+		t.Fatalf("失败率达到 50%% 后应熔断并拒绝请求, 状态 %v", b.State())
+	}
+
+	clock.advance(5 * time.Second)
+	if !b.Allow() || !b.Allow() || b.Allow() {
+		t.Fatal("half-open 状态应只放行 2 个探测请求")
+	}
+	b.Done(true, time.Millisecond)
+	b.Done(false, time.Millisecond)
+	if b.State() != Open {
+		t.Fatalf("探测请求失败后应重新熔断, 状态 %v", b.State())
+	}
+
+	clock.advance(5 * time.Second)
+	b.Allow()
+	b.Abort()
+	for range 2 {
+		if !b.Allow() {
+			t.Fatal("取消的探测请求不应占用名额")
+		}
+		b.Done(true, time.Millisecond)
+	}
+	if status := b.Status(); status.State != "closed" || status.Requests != 0 {
+		t.Fatalf("探测请求全部成功后应恢复 closed 并清空统计, 实际 %+v", status)
+	}
+}
+
+// TestBreakerSlowCalls 测试按慢调用比例熔断，以及滚动窗口外的统计不再计入
+func TestBreakerSlowCalls(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cfg := Config{Window: 10 * time.Second, MinRequests: 2, ErrorRate: 0.5, SlowCall: time.Second, SlowRate: 1, OpenTimeout: time.Second}
+	b := newBreaker(cfg, clock.now)
+
+	b.Allow()
+	b.Done(true, 2*time.Second)
+	clock.advance(11 * time.Second)
+	b.Allow()
+	b.Done(true, 2*time.Second)
+	if b.State() != Closed {
+		t.Fatal("滚动窗口外的慢调用不应计入")
+	}
+
+	b.Allow()
+	b.Done(true, 3*time.Second)
+	if status := b.Status(); status.State != "open" || status.RetryAt.IsZero() {
+		t.Fatalf("慢调用比例达到阈值后应熔断, 实际 %+v", status)
+	}
+}
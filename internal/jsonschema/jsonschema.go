@@ -0,0 +1,434 @@
+// Package jsonschema 实现 JSON Schema（draft 2020-12）的常用子集，用于校验与修复工具调用参数
+//
+// 支持的关键字：type、enum、const、properties、required、additionalProperties、
+// minProperties、maxProperties、items、prefixItems、minItems、maxItems、uniqueItems、
+// minLength、maxLength、pattern、minimum、maximum、exclusiveMinimum、exclusiveMaximum、
+// multipleOf、allOf、anyOf、oneOf、not，以及指向同一文档的 $ref（#/$defs/...、#/definitions/...）。
+// 其他关键字（format、if/then/else 等）被忽略
+package jsonschema
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxRefDepth $ref 的最大展开深度，防止循环引用
+const maxRefDepth = 32
+
+// Error 校验错误
+type Error struct {
+	Path    string // 出错位置，如 $.items[0].name
+	Message string
+}
+
+// Error 实现 error 接口
+func (e Error) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// Validate 校验 value 是否符合 schema，返回全部错误，符合时返回 nil。
+// value 应为 JSON 解码后的值（map[string]interface{}、[]interface{}、float64、string、bool、nil）
+func Validate(schema map[string]interface{}, value interface{}) []Error {
+	v := &validator{root: schema}
+	v.validate(schema, value, "$", 0)
+	return v.errors
+}
+
+// validator 保存根 schema（用于解析 $ref）与已收集的错误
+type validator struct {
+	root   map[string]interface{}
+	errors []Error
+}
+
+// fail 记录一个错误
+func (v *validator) fail(path, format string, args ...interface{}) {
+	v.errors = append(v.errors, Error{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// validate 按 schema 校验 value
+func (v *validator) validate(schema map[string]interface{}, value interface{}, path string, depth int) {
+	if schema == nil {
+		return
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		if depth >= maxRefDepth {
+			v.fail(path, "$ref 嵌套过深: %s", ref)
+			return
+		}
+		target, err := resolveRef(v.root, ref)
+		if err != nil {
+			v.fail(path, "%v", err)
+			return
+		}
+		v.validate(target, value, path, depth+1)
+	}
+
+	if types := schemaTypes(schema); len(types) > 0 && !matchesAnyType(value, types) {
+		v.fail(path, "类型应为 %s，实际为 %s", strings.Join(types, " 或 "), typeName(value))
+		return
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && !containsValue(enum, value) {
+		v.fail(path, "取值应为 %s 之一", formatValues(enum))
+	}
+	if constant, ok := schema["const"]; ok && !equalValues(constant, value) {
+		v.fail(path, "取值应为 %s", formatValue(constant))
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(schema, val, path, depth)
+	case []interface{}:
+		v.validateArray(schema, val, path, depth)
+	case string:
+		v.validateString(schema, val, path)
+	default:
+		if n, ok := toFloat(value); ok {
+			v.validateNumber(schema, n, path)
+		}
+	}
+
+	v.validateCombinators(schema, value, path, depth)
+}
+
+// validateObject 校验对象相关关键字
+func (v *validator) validateObject(schema map[string]interface{}, obj map[string]interface{}, path string, depth int) {
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, exists := obj[key]; !exists {
+					v.fail(path, "缺少必需属性 %q", key)
+				}
+			}
+		}
+	}
+	if n, ok := toInt(schema["minProperties"]); ok && len(obj) < n {
+		v.fail(path, "属性数不能少于 %d", n)
+	}
+	if n, ok := toInt(schema["maxProperties"]); ok && len(obj) > n {
+		v.fail(path, "属性数不能多于 %d", n)
+	}
+
+	for _, key := range sortedKeys(obj) {
+		childPath := path + "." + key
+		if propSchema, ok := properties[key].(map[string]interface{}); ok {
+			v.validate(propSchema, obj[key], childPath, depth)
+			continue
+		}
+		if _, declared := properties[key]; declared {
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.fail(childPath, "不允许未声明的属性")
+			}
+		case map[string]interface{}:
+			v.validate(additional, obj[key], childPath, depth)
+		}
+	}
+}
+
+// validateArray 校验数组相关关键字
+func (v *validator) validateArray(schema map[string]interface{}, arr []interface{}, path string, depth int) {
+	if n, ok := toInt(schema["minItems"]); ok && len(arr) < n {
+		v.fail(path, "元素数不能少于 %d", n)
+	}
+	if n, ok := toInt(schema["maxItems"]); ok && len(arr) > n {
+		v.fail(path, "元素数不能多于 %d", n)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range arr {
+			for j := 0; j < i; j++ {
+				if equalValues(arr[i], arr[j]) {
+					v.fail(fmt.Sprintf("%s[%d]", path, i), "与第 %d 个元素重复", j)
+				}
+			}
+		}
+	}
+
+	prefixItems, _ := schema["prefixItems"].([]interface{})
+	items, hasItems := schema["items"]
+	for i, item := range arr {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		if i < len(prefixItems) {
+			if itemSchema, ok := prefixItems[i].(map[string]interface{}); ok {
+				v.validate(itemSchema, item, itemPath, depth)
+			}
+			continue
+		}
+		switch itemSchema := items.(type) {
+		case map[string]interface{}:
+			v.validate(itemSchema, item, itemPath, depth)
+		case bool:
+			if hasItems && !itemSchema {
+				v.fail(itemPath, "不允许额外的元素")
+			}
+		}
+	}
+}
+
+// validateString 校验字符串相关关键字
+func (v *validator) validateString(schema map[string]interface{}, s string, path string) {
+	length := utf8.RuneCountInString(s)
+	if n, ok := toInt(schema["minLength"]); ok && length < n {
+		v.fail(path, "长度不能小于 %d", n)
+	}
+	if n, ok := toInt(schema["maxLength"]); ok && length > n {
+		v.fail(path, "长度不能大于 %d", n)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			v.fail(path, "无效的 pattern %q", pattern)
+		} else if !re.MatchString(s) {
+			v.fail(path, "不匹配 pattern %q", pattern)
+		}
+	}
+}
+
+// validateNumber 校验数值相关关键字
+func (v *validator) validateNumber(schema map[string]interface{}, n float64, path string) {
+	if limit, ok := toFloat(schema["minimum"]); ok && n < limit {
+		v.fail(path, "不能小于 %v", limit)
+	}
+	if limit, ok := toFloat(schema["maximum"]); ok && n > limit {
+		v.fail(path, "不能大于 %v", limit)
+	}
+	if limit, ok := toFloat(schema["exclusiveMinimum"]); ok && n <= limit {
+		v.fail(path, "必须大于 %v", limit)
+	}
+	if limit, ok := toFloat(schema["exclusiveMaximum"]); ok && n >= limit {
+		v.fail(path, "必须小于 %v", limit)
+	}
+	if divisor, ok := toFloat(schema["multipleOf"]); ok && divisor > 0 {
+		if q := n / divisor; math.Abs(q-math.Round(q)) > 1e-9 {
+			v.fail(path, "必须是 %v 的倍数", divisor)
+		}
+	}
+}
+
+// validateCombinators 校验 allOf、anyOf、oneOf、not
+func (v *validator) validateCombinators(schema map[string]interface{}, value interface{}, path string, depth int) {
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if subSchema, ok := sub.(map[string]interface{}); ok {
+				v.validate(subSchema, value, path, depth)
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok && v.countMatches(anyOf, value, depth) == 0 {
+		v.fail(path, "不符合 anyOf 中的任何一个 schema")
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		if n := v.countMatches(oneOf, value, depth); n != 1 {
+			v.fail(path, "应恰好符合 oneOf 中的一个 schema，实际符合 %d 个", n)
+		}
+	}
+	if not, ok := schema["not"].(map[string]interface{}); ok && v.matches(not, value, depth) {
+		v.fail(path, "不应符合 not 中的 schema")
+	}
+}
+
+// countMatches 返回 value 符合的子 schema 数量
+func (v *validator) countMatches(schemas []interface{}, value interface{}, depth int) int {
+	n := 0
+	for _, sub := range schemas {
+		if subSchema, ok := sub.(map[string]interface{}); ok && v.matches(subSchema, value, depth) {
+			n++
+		}
+	}
+	return n
+}
+
+// matches 判断 value 是否符合子 schema，不记录错误
+func (v *validator) matches(schema map[string]interface{}, value interface{}, depth int) bool {
+	sub := &validator{root: v.root}
+	sub.validate(schema, value, "$", depth)
+	return len(sub.errors) == 0
+}
+
+// resolveRef 解析指向根 schema 内部的 $ref（JSON Pointer）
+func resolveRef(root map[string]interface{}, ref string) (map[string]interface{}, error) {
+	if ref == "#" {
+		return root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("不支持的 $ref: %s", ref)
+	}
+
+	var node interface{} = root
+	for _, token := range strings.Split(ref[2:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("无法解析 $ref: %s", ref)
+		}
+		if node, ok = obj[token]; !ok {
+			return nil, fmt.Errorf("无法解析 $ref: %s", ref)
+		}
+	}
+	target, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("$ref 未指向 schema: %s", ref)
+	}
+	return target, nil
+}
+
+// schemaTypes 返回 schema 声明的类型列表
+func schemaTypes(schema map[string]interface{}) []string {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		types := make([]string, 0, len(t))
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// matchesAnyType 判断 value 是否属于 types 中的任一类型
+func matchesAnyType(value interface{}, types []string) bool {
+	for _, t := range types {
+		if matchesType(value, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesType 判断 value 是否属于指定的 JSON 类型
+func matchesType(value interface{}, t string) bool {
+	switch t {
+	case "null":
+		return value == nil
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "number":
+		_, ok := toFloat(value)
+		return ok
+	case "integer":
+		n, ok := toFloat(value)
+		return ok && n == math.Trunc(n) && !math.IsInf(n, 0)
+	}
+	return true // 未知类型不做限制
+}
+
+// typeName 返回 value 的 JSON 类型名
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	if _, ok := toFloat(value); ok {
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// toFloat 将 JSON 数值转换为 float64
+func toFloat(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case interface{ Float64() (float64, error) }: // json.Number
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// toInt 将 schema 中的非负整数关键字转换为 int
+func toInt(value interface{}) (int, bool) {
+	n, ok := toFloat(value)
+	if !ok || n < 0 {
+		return 0, false
+	}
+	return int(n), true
+}
+
+// equalValues 按 JSON 语义比较两个值，数值按大小比较
+func equalValues(a, b interface{}) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// containsValue 判断 values 中是否包含 value
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, candidate := range values {
+		if equalValues(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatValue 格式化单个值用于错误信息
+func formatValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(value)
+}
+
+// formatValues 格式化值列表用于错误信息
+func formatValues(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = formatValue(value)
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// sortedKeys 返回排序后的对象键，保证错误顺序稳定
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
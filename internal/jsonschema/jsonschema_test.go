@@ -0,0 +1,138 @@
+package jsonschema
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bytedance/sonic"
+)
+
+// mustParse 解析测试用的 JSON
+func mustParse(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := sonic.UnmarshalString(s, &v); err != nil {
+		t.Fatalf("解析 %s 失败: %v", s, err)
+	}
+	return v
+}
+
+const weatherSchema = `{
+	"type": "object",
+	"properties": {
+		"city": {"type": "string", "minLength": 1},
+		"days": {"type": "integer", "minimum": 1, "maximum": 7, "default": 1},
+		"unit": {"enum": ["celsius", "fahrenheit"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "uniqueItems": true},
+		"location": {"$ref": "#/$defs/point"}
+	},
+	"required": ["city"],
+	"additionalProperties": false,
+	"$defs": {
+		"point": {"type": "object", "properties": {"lat": {"type": "number"}, "lon": {"type": "number"}}, "required": ["lat", "lon"]}
+	}
+}`
+
+// TestValidate 测试常用关键字的校验结果
+func TestValidate(t *testing.T) {
+	schema := mustParse(t, weatherSchema).(map[string]interface{})
+
+	tests := []struct {
+		name      string
+		value     string
+		wantPaths []string
+	}{
+		{"符合", `{"city": "北京", "days": 3, "unit": "celsius", "tags": ["a", "b"]}`, nil},
+		{"缺少必填属性", `{"days": 3}`, []string{"$"}},
+		{"类型错误", `{"city": 1}`, []string{"$.city"}},
+		{"整数与范围", `{"city": "北京", "days": 1.5}`, []string{"$.days"}},
+		{"超出最大值", `{"city": "北京", "days": 8}`, []string{"$.days"}},
+		{"enum", `{"city": "北京", "unit": "kelvin"}`, []string{"$.unit"}},
+		{"未声明的属性", `{"city": "北京", "extra": true}`, []string{"$.extra"}},
+		{"数组元素与唯一性", `{"city": "北京", "tags": ["a", 1, "a"]}`, []string{"$.tags[2]", "$.tags[1]"}},
+		{"$ref", `{"city": "北京", "location": {"lat": 1}}`, []string{"$.location"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := Validate(schema, mustParse(t, tt.value))
+			var paths []string
+			for _, e := range errs {
+				paths = append(paths, e.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.wantPaths) {
+				t.Errorf("错误位置 = %v, 期望 %v (%v)", paths, tt.wantPaths, errs)
+			}
+		})
+	}
+}
+
+// TestValidateCombinators 测试 anyOf、oneOf 与 not
+func TestValidateCombinators(t *testing.T) {
+	schema := mustParse(t, `{
+		"anyOf": [{"type": "string"}, {"type": "integer"}],
+		"oneOf": [{"type": "integer", "minimum": 0}, {"type": "string"}],
+		"not": {"const": "forbidden"}
+	}`).(map[string]interface{})
+
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{`"ok"`, true},
+		{`5`, true},
+		{`-5`, false},
+		{`1.5`, false},
+		{`"forbidden"`, false},
+	}
+	for _, tt := range tests {
+		if got := len(Validate(schema, mustParse(t, tt.value))) == 0; got != tt.valid {
+			t.Errorf("Validate(%s) 通过 = %v, 期望 %v", tt.value, got, tt.valid)
+		}
+	}
+}
+
+// TestRepair 测试修复后的值与修复后能否通过校验
+func TestRepair(t *testing.T) {
+	schema := mustParse(t, weatherSchema).(map[string]interface{})
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"标量类型转换", `{"city": "北京", "days": "3"}`, `{"city": "北京", "days": 3}`},
+		{"填充默认值", `{"city": "北京"}`, `{"city": "北京", "days": 1}`},
+		{"删除未声明的属性", `{"city": "北京", "extra": true}`, `{"city": "北京", "days": 1}`},
+		{"enum 忽略大小写", `{"city": "北京", "unit": "Celsius"}`, `{"city": "北京", "days": 1, "unit": "celsius"}`},
+		{"JSON 字符串转对象", `{"city": "北京", "location": "{\"lat\": \"39.9\", \"lon\": 116.4}"}`, `{"city": "北京", "days": 1, "location": {"lat": 39.9, "lon": 116.4}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := mustParse(t, tt.value)
+			repaired := Repair(schema, value)
+			if !reflect.DeepEqual(repaired, mustParse(t, tt.want)) {
+				t.Errorf("Repair = %v, 期望 %s", repaired, tt.want)
+			}
+			if errs := Validate(schema, repaired); len(errs) > 0 {
+				t.Errorf("修复后仍不符合: %v", errs)
+			}
+			if !reflect.DeepEqual(value, mustParse(t, tt.value)) {
+				t.Errorf("原值被修改: %v", value)
+			}
+		})
+	}
+}
+
+// TestRepairAnyOf 测试不符合 anyOf 时采用第一个修复后符合的分支
+func TestRepairAnyOf(t *testing.T) {
+	schema := mustParse(t, `{"anyOf": [{"type": "null"}, {"type": "integer"}]}`).(map[string]interface{})
+
+	if got := Repair(schema, "42"); got != float64(42) {
+		t.Errorf("Repair(\"42\") = %v, 期望 42", got)
+	}
+	if got := Repair(schema, "abc"); got != "abc" {
+		t.Errorf("无法修复时应返回原值, 实际 %v", got)
+	}
+}
@@ -0,0 +1,227 @@
+package jsonschema
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/bytedance/sonic"
+)
+
+// Repair 尝试修复 value 使其符合 schema，返回修复后的值，不修改原值。修复包括：
+//   - 按声明的类型转换标量（如 "42" -> 42、"true" -> true、1 -> "1"），以及把 JSON 字符串解析为对象或数组
+//   - 为缺失的属性填充 default
+//   - additionalProperties 为 false 时删除未声明的属性
+//   - 忽略大小写匹配 enum 中的字符串
+//
+// 修复结果不保证符合 schema，调用方应再次调用 Validate
+func Repair(schema map[string]interface{}, value interface{}) interface{} {
+	r := &repairer{root: schema}
+	return r.repair(schema, value, 0)
+}
+
+// repairer 保存根 schema，用于解析 $ref
+type repairer struct {
+	root map[string]interface{}
+}
+
+// repair 按 schema 修复 value
+func (r *repairer) repair(schema map[string]interface{}, value interface{}, depth int) interface{} {
+	if schema == nil {
+		return value
+	}
+	if ref, ok := schema["$ref"].(string); ok && depth < maxRefDepth {
+		if target, err := resolveRef(r.root, ref); err == nil {
+			value = r.repair(target, value, depth+1)
+		}
+	}
+
+	if types := schemaTypes(schema); len(types) > 0 && !matchesAnyType(value, types) {
+		for _, t := range types {
+			if coerced, ok := coerce(value, t); ok {
+				value = coerced
+				break
+			}
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		value = matchEnum(enum, value)
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		value = r.repairObject(schema, val, depth)
+	case []interface{}:
+		value = r.repairArray(schema, val, depth)
+	}
+
+	return r.repairCombinators(schema, value, depth)
+}
+
+// repairObject 修复对象的属性：递归修复已声明的属性、填充默认值、按需删除未声明的属性
+func (r *repairer) repairObject(schema map[string]interface{}, obj map[string]interface{}, depth int) map[string]interface{} {
+	properties, _ := schema["properties"].(map[string]interface{})
+	result := make(map[string]interface{}, len(obj))
+
+	for key, val := range obj {
+		if propSchema, ok := properties[key].(map[string]interface{}); ok {
+			result[key] = r.repair(propSchema, val, depth)
+			continue
+		}
+		if _, declared := properties[key]; declared {
+			result[key] = val
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if additional {
+				result[key] = val
+			}
+		case map[string]interface{}:
+			result[key] = r.repair(additional, val, depth)
+		default:
+			result[key] = val
+		}
+	}
+
+	for key, prop := range properties {
+		if _, exists := result[key]; exists {
+			continue
+		}
+		if propSchema, ok := prop.(map[string]interface{}); ok {
+			if def, ok := propSchema["default"]; ok {
+				result[key] = copyValue(def)
+			}
+		}
+	}
+
+	return result
+}
+
+// repairArray 修复数组元素
+func (r *repairer) repairArray(schema map[string]interface{}, arr []interface{}, depth int) []interface{} {
+	prefixItems, _ := schema["prefixItems"].([]interface{})
+	items, _ := schema["items"].(map[string]interface{})
+
+	result := make([]interface{}, len(arr))
+	for i, item := range arr {
+		itemSchema := items
+		if i < len(prefixItems) {
+			itemSchema, _ = prefixItems[i].(map[string]interface{})
+		}
+		result[i] = r.repair(itemSchema, item, depth)
+	}
+	return result
+}
+
+// repairCombinators 依次应用 allOf；不符合 anyOf/oneOf 时采用第一个修复后符合的分支
+func (r *repairer) repairCombinators(schema map[string]interface{}, value interface{}, depth int) interface{} {
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if subSchema, ok := sub.(map[string]interface{}); ok {
+				value = r.repair(subSchema, value, depth)
+			}
+		}
+	}
+
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		branches, ok := schema[keyword].([]interface{})
+		if !ok {
+			continue
+		}
+		v := &validator{root: r.root}
+		if v.countMatches(branches, value, depth) > 0 {
+			continue
+		}
+		for _, branch := range branches {
+			branchSchema, ok := branch.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if repaired := r.repair(branchSchema, value, depth); v.matches(branchSchema, repaired, depth) {
+				value = repaired
+				break
+			}
+		}
+	}
+
+	return value
+}
+
+// coerce 尝试将标量转换为指定的 JSON 类型
+func coerce(value interface{}, t string) (interface{}, bool) {
+	switch val := value.(type) {
+	case string:
+		s := strings.TrimSpace(val)
+		switch t {
+		case "integer", "number":
+			n, err := strconv.ParseFloat(s, 64)
+			if err != nil || (t == "integer" && !matchesType(n, "integer")) {
+				return nil, false
+			}
+			return n, true
+		case "boolean":
+			b, err := strconv.ParseBool(strings.ToLower(s))
+			return b, err == nil
+		case "null":
+			return nil, s == "null" || s == ""
+		case "object", "array":
+			// 模型常把嵌套对象或数组写成 JSON 字符串
+			var parsed interface{}
+			if err := sonic.UnmarshalString(s, &parsed); err != nil || !matchesType(parsed, t) {
+				return nil, false
+			}
+			return parsed, true
+		}
+	case bool:
+		if t == "string" {
+			return strconv.FormatBool(val), true
+		}
+	default:
+		n, ok := toFloat(value)
+		if !ok {
+			return nil, false
+		}
+		switch t {
+		case "string":
+			return strconv.FormatFloat(n, 'f', -1, 64), true
+		case "boolean":
+			if n == 0 || n == 1 {
+				return n == 1, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// matchEnum 值不在 enum 中时，忽略大小写匹配字符串取值
+func matchEnum(enum []interface{}, value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok || containsValue(enum, value) {
+		return value
+	}
+	for _, candidate := range enum {
+		if c, ok := candidate.(string); ok && strings.EqualFold(c, s) {
+			return c
+		}
+	}
+	return value
+}
+
+// copyValue 深拷贝 JSON 值，避免修复结果与 schema 中的默认值共享底层数据
+func copyValue(value interface{}) interface{} {
+	switch val := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			result[k] = copyValue(v)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(val))
+		for i, v := range val {
+			result[i] = copyValue(v)
+		}
+		return result
+	}
+	return value
+}
@@ -12,7 +12,8 @@ import (
 
 // JWTPayload 表示 JWT token 的 payload 部分
 type JWTPayload struct {
-	ID string `json:"id"`
+	ID  string `json:"id"`
+	Exp int64  `json:"exp,omitempty"` // 过期时间（Unix 秒），可能不存在
 }
 
 // SignatureResponse 表示签名生成函数的返回值
@@ -0,0 +1,217 @@
+// Package tokenizer 近似 GLM 分词器，用于在上游未返回 usage 时估算 token 数
+//
+// 分词按 GLM（BPE，约 15 万词表）的常见切分规律近似：英文单词连同前导空格通常为 1 个 token，
+// 过长的单词按固定长度拆分；数字每 3 位 1 个 token；中日韩文字约每 2 个字 1 个 token；
+// 连续的换行与相同的标点合并。估算值按模型用上游返回的真实 usage 校准
+package tokenizer
+
+import (
+	"math"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxWordRunes 单词超过该长度时拆分为多个 token
+	maxWordRunes = 8
+	// wordChunkRunes 过长单词拆分时每个 token 的字符数
+	wordChunkRunes = 6
+	// digitChunk 数字每个 token 的位数
+	digitChunk = 3
+	// cjkChunk 中日韩文字每个 token 的字数
+	cjkChunk = 2
+	// symbolChunk 相同标点合并为一个 token 的最大个数
+	symbolChunk = 4
+
+	// calibrationWeight 每次校准时新观测值的权重
+	calibrationWeight = 0.2
+	// minScale、maxScale 校准系数的范围，防止异常的上游 usage 使估算失真
+	minScale = 0.25
+	maxScale = 4.0
+)
+
+// isCJK 判断字符是否为中日韩文字
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// runeClass 字符类别，同类相邻字符可能合并为一个 token
+type runeClass int
+
+const (
+	classSpace runeClass = iota
+	classNewline
+	classLetter
+	classDigit
+	classCJK
+	classSymbol
+)
+
+// classify 返回字符的类别
+func classify(r rune) runeClass {
+	switch {
+	case r == '\n' || r == '\r':
+		return classNewline
+	case unicode.IsSpace(r):
+		return classSpace
+	case isCJK(r):
+		return classCJK
+	case unicode.IsLetter(r) || unicode.IsMark(r):
+		return classLetter
+	case unicode.IsDigit(r):
+		return classDigit
+	default:
+		return classSymbol
+	}
+}
+
+// Segment 将文本切分为近似的 token 片段，片段拼接后与原文相同
+func Segment(text string) []string {
+	var pieces []string
+	for start := 0; start < len(text); {
+		end := nextPiece(text, start)
+		pieces = append(pieces, text[start:end])
+		start = end
+	}
+	return pieces
+}
+
+// nextPiece 返回从 start 开始的片段的结束位置
+func nextPiece(text string, start int) int {
+	r, size := utf8.DecodeRuneInString(text[start:])
+	class := classify(r)
+	pos := start + size
+
+	// 单个空格与其后的单词合并，与 BPE 的 " word" 一致
+	if r == ' ' && pos < len(text) {
+		next, nextSize := utf8.DecodeRuneInString(text[pos:])
+		if classify(next) == classLetter {
+			return takeRun(text, pos+nextSize, classLetter, maxWordRunes-1, wordChunkRunes-1)
+		}
+	}
+
+	switch class {
+	case classLetter:
+		return takeRun(text, pos, classLetter, maxWordRunes-1, wordChunkRunes-1)
+	case classDigit:
+		return takeRun(text, pos, classDigit, digitChunk-1, digitChunk-1)
+	case classCJK:
+		return takeRun(text, pos, classCJK, cjkChunk-1, cjkChunk-1)
+	case classSymbol:
+		return takeSame(text, pos, r, symbolChunk-1)
+	default:
+		// 连续的空白（或连续的换行）合并为一个 token
+		return takeRun(text, pos, class, math.MaxInt, math.MaxInt)
+	}
+}
+
+// takeRun 从 pos 起继续读取同类字符。剩余字符不超过 whole 个时整体作为一个片段，否则只取 chunk 个
+func takeRun(text string, pos int, class runeClass, whole, chunk int) int {
+	end, cut, count := pos, pos, 0
+	for end < len(text) {
+		r, size := utf8.DecodeRuneInString(text[end:])
+		if classify(r) != class {
+			break
+		}
+		end += size
+		count++
+		if count <= chunk {
+			cut = end
+		}
+		if count > whole {
+			return cut
+		}
+	}
+	return end
+}
+
+// takeSame 从 pos 起继续读取与 first 相同的字符，最多 limit 个
+func takeSame(text string, pos int, first rune, limit int) int {
+	for n := 0; n < limit && pos < len(text); n++ {
+		r, size := utf8.DecodeRuneInString(text[pos:])
+		if r != first {
+			break
+		}
+		pos += size
+	}
+	return pos
+}
+
+// Estimate 返回未经校准的 token 估算值
+func Estimate(text string) int {
+	count := 0
+	for start := 0; start < len(text); count++ {
+		start = nextPiece(text, start)
+	}
+	return count
+}
+
+// Tokenizer 按模型维护校准系数的 token 计数器，可并发使用
+type Tokenizer struct {
+	mu     sync.RWMutex
+	scales map[string]float64
+}
+
+// New 创建 token 计数器
+func New() *Tokenizer {
+	return &Tokenizer{scales: make(map[string]float64)}
+}
+
+// Scale 返回模型的校准系数，尚未校准时为 1
+func (t *Tokenizer) Scale(model string) float64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if scale, ok := t.scales[model]; ok {
+		return scale
+	}
+	return 1
+}
+
+// Apply 将未经校准的估算值按模型的校准系数换算
+func (t *Tokenizer) Apply(model string, estimated int) int {
+	if estimated <= 0 {
+		return 0
+	}
+	return max(1, int(math.Round(float64(estimated)*t.Scale(model))))
+}
+
+// Count 返回按模型校准后的 token 数
+func (t *Tokenizer) Count(model, text string) int {
+	return t.Apply(model, Estimate(text))
+}
+
+// Calibrate 用上游返回的真实 token 数校准模型的估算，estimated 为同一段文本未经校准的估算值
+func (t *Tokenizer) Calibrate(model string, estimated, actual int) {
+	if estimated <= 0 || actual <= 0 {
+		return
+	}
+	observed := math.Min(maxScale, math.Max(minScale, float64(actual)/float64(estimated)))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	scale, ok := t.scales[model]
+	if !ok {
+		t.scales[model] = observed
+		return
+	}
+	t.scales[model] = scale*(1-calibrationWeight) + observed*calibrationWeight
+}
+
+// defaultTokenizer 包级别函数使用的计数器
+var defaultTokenizer = New()
+
+// Count 使用默认计数器返回按模型校准后的 token 数
+func Count(model, text string) int {
+	return defaultTokenizer.Count(model, text)
+}
+
+// Apply 使用默认计数器将未经校准的估算值按模型的校准系数换算
+func Apply(model string, estimated int) int {
+	return defaultTokenizer.Apply(model, estimated)
+}
+
+// Calibrate 使用上游返回的真实 token 数校准默认计数器
+func Calibrate(model string, estimated, actual int) {
+	defaultTokenizer.Calibrate(model, estimated, actual)
+}
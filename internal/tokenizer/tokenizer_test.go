@@ -0,0 +1,60 @@
+package tokenizer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestSegment 测试近似分词的切分
+func TestSegment(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello world", []string{"Hello", " world"}},
+		{"internationalization", []string{"intern", "ationa", "lization"}},
+		{"12345", []string{"123", "45"}},
+		{"你好世界！", []string{"你好", "世界", "！"}},
+		{"a\n\n\nb", []string{"a", "\n\n\n", "b"}},
+		{"====", []string{"===="}},
+		{"x  = 1", []string{"x", "  ", "=", " ", "1"}},
+	}
+	for _, tt := range tests {
+		got := Segment(tt.text)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Segment(%q) = %q, 期望 %q", tt.text, got, tt.want)
+		}
+		if strings.Join(got, "") != tt.text {
+			t.Errorf("Segment(%q) 片段拼接后与原文不同", tt.text)
+		}
+		if Estimate(tt.text) != len(tt.want) {
+			t.Errorf("Estimate(%q) = %d, 期望 %d", tt.text, Estimate(tt.text), len(tt.want))
+		}
+	}
+}
+
+// TestCalibrate 测试按上游 usage 校准估算值
+func TestCalibrate(t *testing.T) {
+	tk := New()
+	if got := tk.Apply("glm", 100); got != 100 {
+		t.Fatalf("未校准时 Apply = %d, 期望 100", got)
+	}
+
+	tk.Calibrate("glm", 100, 150)
+	if got := tk.Apply("glm", 100); got != 150 {
+		t.Errorf("首次校准后 Apply = %d, 期望 150", got)
+	}
+	tk.Calibrate("glm", 100, 100)
+	if got := tk.Apply("glm", 100); got != 140 {
+		t.Errorf("再次校准后 Apply = %d, 期望 140", got)
+	}
+	if got := tk.Apply("other", 100); got != 100 {
+		t.Errorf("校准不应影响其他模型, Apply = %d", got)
+	}
+
+	tk.Calibrate("outlier", 10, 1000)
+	if got := tk.Scale("outlier"); got != maxScale {
+		t.Errorf("异常的 usage 应被限制在 %v, 实际 %v", maxScale, got)
+	}
+}
@@ -0,0 +1,273 @@
+// Package tokenpool 维护多个上游账号 token，按策略选择可用的 token
+//
+// 每个 token 记录进行中的请求数、成功与失败次数和平均延迟；上游返回 401 或 429 时 token 进入冷却，
+// 冷却期间与 JWT 过期后不再被选中
+package tokenpool
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"z2api/internal/signature"
+)
+
+// Strategy token 选择策略
+type Strategy string
+
+const (
+	// RoundRobin 依次轮换可用的 token
+	RoundRobin Strategy = "round-robin"
+	// LeastInFlight 选择进行中请求最少的 token，相同时轮换
+	LeastInFlight Strategy = "least-in-flight"
+)
+
+// ParseStrategy 解析选择策略
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case RoundRobin, LeastInFlight:
+		return Strategy(s), nil
+	}
+	return "", fmt.Errorf("未知的 token 选择策略 %q，可选 %s、%s", s, RoundRobin, LeastInFlight)
+}
+
+// Fingerprint 返回 token 的摘要，用于统计、熔断器键与上传缓存中标识 token 而不暴露原文
+func Fingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ParseList 解析 token 列表：按逗号或换行分隔，忽略空行与 # 开头的注释，去除重复项
+func ParseList(list string) []string {
+	var tokens []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, token := range strings.Split(line, ",") {
+			if token = strings.TrimSpace(token); token != "" && !seen[token] {
+				seen[token] = true
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// LoadFile 从文件读取 token 列表，格式同 ParseList
+func LoadFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseList(string(data)), nil
+}
+
+// entry 池中的一个 token
+type entry struct {
+	token         string
+	expiresAt     time.Time // JWT 的过期时间，无法解析时为零值
+	inFlight      int
+	successes     int64
+	failures      int64
+	totalLatency  time.Duration
+	cooldownUntil time.Time
+	lastStatus    int
+}
+
+// Pool token 池，可并发使用
+type Pool struct {
+	mu       sync.Mutex
+	strategy Strategy
+	cooldown time.Duration
+	now      func() time.Time
+	entries  []*entry
+	index    map[string]*entry
+	next     int
+}
+
+// New 创建 token 池，并从每个 token 的 JWT 中解析过期时间
+func New(tokens []string, strategy Strategy, cooldown time.Duration) *Pool {
+	p := &Pool{
+		strategy: strategy,
+		cooldown: cooldown,
+		now:      time.Now,
+		index:    make(map[string]*entry, len(tokens)),
+	}
+	for _, token := range tokens {
+		if _, ok := p.index[token]; ok {
+			continue
+		}
+		e := &entry{token: token}
+		if payload, err := signature.DecodeJWT(token); err == nil && payload.Exp > 0 {
+			e.expiresAt = time.Unix(payload.Exp, 0)
+		}
+		p.entries = append(p.entries, e)
+		p.index[token] = e
+	}
+	return p
+}
+
+// Len 返回池中 token 的数量
+func (p *Pool) Len() int {
+	return len(p.entries)
+}
+
+// Contains 判断 token 是否属于该池
+func (p *Pool) Contains(token string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.index[token]
+	return ok
+}
+
+// available 判断 token 当前是否可被选中：未过期且不在冷却中
+func (e *entry) available(now time.Time) bool {
+	if !e.expiresAt.IsZero() && !now.Before(e.expiresAt) {
+		return false
+	}
+	return !now.Before(e.cooldownUntil)
+}
+
+// Pick 按策略选择一个可用的 token；没有可用的 token 时第二个返回值为 false
+func (p *Pool) Pick() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	var chosen *entry
+	chosenAt := 0
+	for i := range p.entries {
+		at := (p.next + i) % len(p.entries)
+		e := p.entries[at]
+		if !e.available(now) {
+			continue
+		}
+		if chosen == nil || (p.strategy == LeastInFlight && e.inFlight < chosen.inFlight) {
+			chosen, chosenAt = e, at
+		}
+		if p.strategy != LeastInFlight {
+			break
+		}
+	}
+	if chosen == nil {
+		return "", false
+	}
+	p.next = (chosenAt + 1) % len(p.entries)
+	return chosen.token, true
+}
+
+// NextAvailable 返回池中最早恢复可用的时间：有可用的 token 时返回当前时间，
+// 所有 token 都已过期或会在冷却结束前过期时返回零值
+func (p *Pool) NextAvailable() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	var next time.Time
+	for _, e := range p.entries {
+		if e.available(now) {
+			return now
+		}
+		if !e.expiresAt.IsZero() && !e.cooldownUntil.Before(e.expiresAt) {
+			continue
+		}
+		if next.IsZero() || e.cooldownUntil.Before(next) {
+			next = e.cooldownUntil
+		}
+	}
+	return next
+}
+
+// Begin 记录 token 开始一次上游请求，不属于池的 token 忽略
+func (p *Pool) Begin(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.index[token]; ok {
+		e.inFlight++
+	}
+}
+
+// End 记录 token 的一次上游请求结束
+func (p *Pool) End(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.index[token]; ok && e.inFlight > 0 {
+		e.inFlight--
+	}
+}
+
+// Report 记录一次上游调用的结果与延迟。上游返回 401 或 429 时 token 进入冷却，
+// 冷却时间取配置值与 retryAfter 中较长者
+func (p *Pool) Report(token string, success bool, statusCode int, latency, retryAfter time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.index[token]
+	if !ok {
+		return
+	}
+	e.totalLatency += latency
+	e.lastStatus = statusCode
+	if success {
+		e.successes++
+		return
+	}
+	e.failures++
+	if statusCode == 401 || statusCode == 429 {
+		e.cooldownUntil = p.now().Add(max(p.cooldown, retryAfter))
+	}
+}
+
+// Stats 单个 token 的统计
+type Stats struct {
+	ID            string    `json:"id"`    // token 摘要
+	State         string    `json:"state"` // available、cooldown 或 expired
+	InFlight      int       `json:"in_flight"`
+	Successes     int64     `json:"successes"`
+	Failures      int64     `json:"failures"`
+	AvgLatencyMs  float64   `json:"avg_latency_ms"`
+	LastStatus    int       `json:"last_status,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at,omitzero"`
+	CooldownUntil time.Time `json:"cooldown_until,omitzero"`
+}
+
+// Stats 返回池中每个 token 的统计，顺序与加载顺序一致
+func (p *Pool) Stats() []Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	stats := make([]Stats, 0, len(p.entries))
+	for _, e := range p.entries {
+		s := Stats{
+			ID:         Fingerprint(e.token),
+			State:      "available",
+			InFlight:   e.inFlight,
+			Successes:  e.successes,
+			Failures:   e.failures,
+			LastStatus: e.lastStatus,
+			ExpiresAt:  e.expiresAt,
+		}
+		if calls := e.successes + e.failures; calls > 0 {
+			s.AvgLatencyMs = float64(e.totalLatency) / float64(calls) / float64(time.Millisecond)
+		}
+		switch {
+		case !e.expiresAt.IsZero() && !now.Before(e.expiresAt):
+			s.State = "expired"
+		case now.Before(e.cooldownUntil):
+			s.State = "cooldown"
+			s.CooldownUntil = e.cooldownUntil
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
@@ -0,0 +1,116 @@
+package tokenpool
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeClock 测试用的可控时钟
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// jwtWithExp 构造带过期时间的测试 JWT
+func jwtWithExp(id string, exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, `{"id":%q,"exp":%d}`, id, exp.Unix()))
+	return "header." + payload + ".signature"
+}
+
+// newTestPool 创建使用测试时钟的 token 池
+func newTestPool(tokens []string, strategy Strategy, cooldown time.Duration, clock *fakeClock) *Pool {
+	p := New(tokens, strategy, cooldown)
+	p.now = clock.now
+	return p
+}
+
+// TestParseList 测试解析 token 列表：逗号与换行分隔、注释、空白与重复项
+func TestParseList(t *testing.T) {
+	got := ParseList("a, b\n# 注释\n\n c ,a\nd")
+	want := []string{"a", "b", "c", "d"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ParseList() = %v, 期望 %v", got, want)
+	}
+}
+
+// TestPoolPick 测试两种选择策略
+func TestPoolPick(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	p := newTestPool([]string{"a", "b", "c"}, RoundRobin, time.Minute, clock)
+	var picked []string
+	for range 4 {
+		token, _ := p.Pick()
+		picked = append(picked, token)
+	}
+	if fmt.Sprint(picked) != "[a b c a]" {
+		t.Errorf("round-robin 选择顺序 = %v, 期望 [a b c a]", picked)
+	}
+
+	p = newTestPool([]string{"a", "b", "c"}, LeastInFlight, time.Minute, clock)
+	p.Begin("a")
+	p.Begin("a")
+	p.Begin("b")
+	if token, _ := p.Pick(); token != "c" {
+		t.Errorf("least-in-flight 应选择进行中请求最少的 c, 实际 %s", token)
+	}
+	p.Begin("c")
+	p.Begin("c")
+	p.End("a")
+	p.End("a")
+	if token, _ := p.Pick(); token != "a" {
+		t.Errorf("a 的请求结束后应选择 a, 实际 %s", token)
+	}
+}
+
+// TestPoolCooldownAndExpiry 测试 401、429 后冷却，冷却结束后恢复，以及过期的 token 不被选中
+func TestPoolCooldownAndExpiry(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	expired := jwtWithExp("u1", clock.t.Add(-time.Hour))
+	valid := jwtWithExp("u2", clock.t.Add(time.Hour))
+	p := newTestPool([]string{expired, valid, "plain"}, RoundRobin, time.Minute, clock)
+
+	p.Report(valid, false, 429, 10*time.Millisecond, 2*time.Minute)
+	p.Report("plain", false, 401, 30*time.Millisecond, 0)
+	p.Report("plain", false, 500, 20*time.Millisecond, 0)
+	if token, ok := p.Pick(); ok {
+		t.Fatalf("全部 token 冷却或过期时不应返回 token, 实际 %s", token)
+	}
+	if next := p.NextAvailable(); !next.Equal(clock.t.Add(time.Minute)) {
+		t.Errorf("NextAvailable() = %v, 期望最早结束冷却的 plain 的恢复时间", next)
+	}
+
+	clock.advance(time.Minute)
+	if token, _ := p.Pick(); token != "plain" {
+		t.Errorf("冷却一分钟后应恢复 plain, 实际 %s", token)
+	}
+	if token, _ := p.Pick(); token != "plain" {
+		t.Errorf("Retry-After 更长时 %s 应继续冷却", valid)
+	}
+
+	if next := p.NextAvailable(); !next.Equal(clock.t) {
+		t.Errorf("有可用的 token 时 NextAvailable() = %v, 期望当前时间", next)
+	}
+	if next := newTestPool([]string{expired}, RoundRobin, time.Minute, clock).NextAvailable(); !next.IsZero() {
+		t.Errorf("全部 token 过期时 NextAvailable() = %v, 期望零值", next)
+	}
+
+	stats := p.Stats()
+	if stats[0].State != "expired" || stats[1].State != "cooldown" || stats[2].State != "available" {
+		t.Errorf("状态 = %s、%s、%s, 期望 expired、cooldown、available", stats[0].State, stats[1].State, stats[2].State)
+	}
+	if stats[1].ExpiresAt.IsZero() || !stats[2].ExpiresAt.IsZero() {
+		t.Error("应从 JWT 中解析过期时间，非 JWT 的 token 不设置过期时间")
+	}
+	if stats[2].Failures != 2 || stats[2].AvgLatencyMs != 25 || stats[2].LastStatus != 500 {
+		t.Errorf("plain 的统计 = %+v, 期望 2 次失败、平均 25ms、最后状态 500", stats[2])
+	}
+	if stats[2].ID != Fingerprint("plain") {
+		t.Errorf("统计中应使用 token 摘要而不是原文, 实际 %s", stats[2].ID)
+	}
+}
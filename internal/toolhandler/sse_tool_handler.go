@@ -363,6 +363,11 @@ func (h *SSEToolHandler) createToolFinishChunk() string {
 	return fmt.Sprintf("data: %s", jsonData)
 }
 
+// Usage 返回工具调用期间上游返回的 usage，未返回时为 nil
+func (h *SSEToolHandler) Usage() *types.Usage {
+	return h.toolCallUsage
+}
+
 // log 调试日志
 func (h *SSEToolHandler) log(format string, args ...interface{}) {
 	if h.debugLog != nil {
@@ -28,7 +28,9 @@ import (
 
 	// 内部包
 	"z2api/config"
+	"z2api/internal/breaker"
 	"z2api/internal/signature"
+	"z2api/internal/tokenpool"
 	"z2api/types"
 
 	// 第三方包
@@ -36,7 +38,6 @@ import (
 
 	"github.com/andybalholm/brotli"
 	"golang.org/x/sync/semaphore"
-	"golang.org/x/sync/singleflight"
 )
 
 // 优化的 sonic 配置 - 减少配置数量，提高维护性
@@ -63,14 +64,6 @@ var (
 
 // Config 配置结构体
 
-// TokenCache Token缓存结构体
-type TokenCache struct {
-	token     string
-	expiresAt time.Time
-	mutex     sync.RWMutex
-	sf        singleflight.Group
-}
-
 // getEnv 获取环境变量值，如果不存在则返回默认值
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -97,6 +90,158 @@ func loadConfig() (*types.Config, error) {
 
 	port := ":" + strings.TrimPrefix(getEnv("PORT", DefaultPort), ":")
 
+	uploadCacheTTL, err := time.ParseDuration(getEnv("UPLOAD_CACHE_TTL", "1h"))
+	if err != nil {
+		return nil, fmt.Errorf("UPLOAD_CACHE_TTL 必须是有效的时间间隔（如 30m、1h）: %w", err)
+	}
+	uploadCacheMaxMB, err := strconv.Atoi(getEnv("UPLOAD_CACHE_MAX_MEMORY_MB", "16"))
+	if err != nil || uploadCacheMaxMB <= 0 {
+		return nil, fmt.Errorf("UPLOAD_CACHE_MAX_MEMORY_MB 必须是正整数")
+	}
+
+	// 远程文件获取策略：默认禁止内网网段，FETCH_DENY_CIDRS 追加禁止网段，FETCH_ALLOW_CIDRS 放行指定网段
+	fetchPolicy := DefaultFetchPolicy()
+	fetchAllow, err := parseCIDRList(getEnv("FETCH_ALLOW_CIDRS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("FETCH_ALLOW_CIDRS 配置错误: %w", err)
+	}
+	fetchDeny, err := parseCIDRList(getEnv("FETCH_DENY_CIDRS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("FETCH_DENY_CIDRS 配置错误: %w", err)
+	}
+	fetchMaxRedirects, err := strconv.Atoi(getEnv("FETCH_MAX_REDIRECTS", strconv.Itoa(fetchPolicy.MaxRedirects)))
+	if err != nil || fetchMaxRedirects < 0 {
+		return nil, fmt.Errorf("FETCH_MAX_REDIRECTS 必须是非负整数")
+	}
+	fetchMaxBodyMB, err := strconv.Atoi(getEnv("FETCH_MAX_BODY_MB", strconv.FormatInt(fetchPolicy.MaxBodySize>>20, 10)))
+	if err != nil || fetchMaxBodyMB <= 0 {
+		return nil, fmt.Errorf("FETCH_MAX_BODY_MB 必须是正整数")
+	}
+
+	imageMaxDimension, err := strconv.Atoi(getEnv("IMAGE_MAX_DIMENSION", strconv.Itoa(defaultImageMaxDimension)))
+	if err != nil || imageMaxDimension <= 0 {
+		return nil, fmt.Errorf("IMAGE_MAX_DIMENSION 必须是正整数")
+	}
+
+	// 上游重试策略：默认值见 DefaultRetryPolicy
+	retryPolicy := DefaultRetryPolicy()
+	retryMaxAttempts, err := strconv.Atoi(getEnv("UPSTREAM_RETRY_MAX_ATTEMPTS", strconv.Itoa(retryPolicy.MaxAttempts)))
+	if err != nil || retryMaxAttempts < 1 {
+		return nil, fmt.Errorf("UPSTREAM_RETRY_MAX_ATTEMPTS 必须是正整数")
+	}
+	retryBaseDelay, err := time.ParseDuration(getEnv("UPSTREAM_RETRY_BASE_DELAY", retryPolicy.BaseDelay.String()))
+	if err != nil || retryBaseDelay < 0 {
+		return nil, fmt.Errorf("UPSTREAM_RETRY_BASE_DELAY 必须是有效的时间间隔（如 100ms、1s）")
+	}
+	retryMaxDelay, err := time.ParseDuration(getEnv("UPSTREAM_RETRY_MAX_DELAY", retryPolicy.MaxDelay.String()))
+	if err != nil || retryMaxDelay < retryBaseDelay {
+		return nil, fmt.Errorf("UPSTREAM_RETRY_MAX_DELAY 必须是有效的时间间隔，且不小于 UPSTREAM_RETRY_BASE_DELAY")
+	}
+	retryBudget, err := time.ParseDuration(getEnv("UPSTREAM_RETRY_BUDGET", retryPolicy.Budget.String()))
+	if err != nil || retryBudget < 0 {
+		return nil, fmt.Errorf("UPSTREAM_RETRY_BUDGET 必须是有效的时间间隔（如 30s），0 表示不限制")
+	}
+	retryStatusCodes := retryPolicy.StatusCodes
+	if envVal := getEnv("UPSTREAM_RETRY_STATUS_CODES", ""); envVal != "" {
+		if retryStatusCodes, err = parseStatusCodeList(envVal); err != nil {
+			return nil, fmt.Errorf("UPSTREAM_RETRY_STATUS_CODES 配置错误: %w", err)
+		}
+	}
+	retryBodyPatterns := retryPolicy.BodyPatterns
+	if envVal := getEnv("UPSTREAM_RETRY_BODY_PATTERNS", ""); envVal != "" {
+		retryBodyPatterns = parsePatternList(envVal)
+	}
+
+	// 上游熔断器：默认值见 breaker.DefaultConfig
+	breakerConfig := breaker.DefaultConfig()
+	breakerWindow, err := time.ParseDuration(getEnv("UPSTREAM_BREAKER_WINDOW", breakerConfig.Window.String()))
+	if err != nil || breakerWindow <= 0 {
+		return nil, fmt.Errorf("UPSTREAM_BREAKER_WINDOW 必须是正的时间间隔（如 1m）")
+	}
+	breakerMinRequests, err := strconv.Atoi(getEnv("UPSTREAM_BREAKER_MIN_REQUESTS", strconv.Itoa(breakerConfig.MinRequests)))
+	if err != nil || breakerMinRequests < 1 {
+		return nil, fmt.Errorf("UPSTREAM_BREAKER_MIN_REQUESTS 必须是正整数")
+	}
+	breakerErrorRate, err := strconv.ParseFloat(getEnv("UPSTREAM_BREAKER_ERROR_RATE", strconv.FormatFloat(breakerConfig.ErrorRate, 'g', -1, 64)), 64)
+	if err != nil || breakerErrorRate <= 0 || breakerErrorRate > 1 {
+		return nil, fmt.Errorf("UPSTREAM_BREAKER_ERROR_RATE 必须在 (0, 1] 之间")
+	}
+	breakerSlowCall, err := time.ParseDuration(getEnv("UPSTREAM_BREAKER_SLOW_CALL", breakerConfig.SlowCall.String()))
+	if err != nil || breakerSlowCall < 0 {
+		return nil, fmt.Errorf("UPSTREAM_BREAKER_SLOW_CALL 必须是有效的时间间隔，0 表示不按耗时熔断")
+	}
+	breakerSlowRate, err := strconv.ParseFloat(getEnv("UPSTREAM_BREAKER_SLOW_RATE", strconv.FormatFloat(breakerConfig.SlowRate, 'g', -1, 64)), 64)
+	if err != nil || breakerSlowRate <= 0 || breakerSlowRate > 1 {
+		return nil, fmt.Errorf("UPSTREAM_BREAKER_SLOW_RATE 必须在 (0, 1] 之间")
+	}
+	breakerOpenTimeout, err := time.ParseDuration(getEnv("UPSTREAM_BREAKER_OPEN_TIMEOUT", breakerConfig.OpenTimeout.String()))
+	if err != nil || breakerOpenTimeout <= 0 {
+		return nil, fmt.Errorf("UPSTREAM_BREAKER_OPEN_TIMEOUT 必须是正的时间间隔（如 30s）")
+	}
+	breakerProbes, err := strconv.Atoi(getEnv("UPSTREAM_BREAKER_PROBES", strconv.Itoa(breakerConfig.HalfOpenProbes)))
+	if err != nil || breakerProbes < 1 {
+		return nil, fmt.Errorf("UPSTREAM_BREAKER_PROBES 必须是正整数")
+	}
+
+	// 上游 token 池：UPSTREAM_TOKENS 与 UPSTREAM_TOKENS_FILE 中的 token 合并去重
+	upstreamTokens := tokenpool.ParseList(getEnv("UPSTREAM_TOKENS", ""))
+	if path := getEnv("UPSTREAM_TOKENS_FILE", ""); path != "" {
+		fileTokens, err := tokenpool.LoadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("读取 UPSTREAM_TOKENS_FILE 失败: %w", err)
+		}
+		upstreamTokens = tokenpool.ParseList(strings.Join(append(upstreamTokens, fileTokens...), "\n"))
+	}
+	tokenPoolStrategy, err := tokenpool.ParseStrategy(getEnv("TOKEN_POOL_STRATEGY", string(tokenpool.RoundRobin)))
+	if err != nil {
+		return nil, fmt.Errorf("TOKEN_POOL_STRATEGY 配置错误: %w", err)
+	}
+	tokenCooldown, err := time.ParseDuration(getEnv("TOKEN_POOL_COOLDOWN", "60s"))
+	if err != nil || tokenCooldown < 0 {
+		return nil, fmt.Errorf("TOKEN_POOL_COOLDOWN 必须是有效的时间间隔（如 60s）")
+	}
+
+	// 匿名 token 池：默认值见 DefaultAnonTokenPoolConfig
+	anonTokenConfig := DefaultAnonTokenPoolConfig()
+	anonTokenPoolSize, err := strconv.Atoi(getEnv("ANON_TOKEN_POOL_SIZE", strconv.Itoa(anonTokenConfig.Size)))
+	if err != nil || anonTokenPoolSize < 0 {
+		return nil, fmt.Errorf("ANON_TOKEN_POOL_SIZE 必须是非负整数，0 表示不预先获取")
+	}
+	anonTokenTTL, err := time.ParseDuration(getEnv("ANON_TOKEN_TTL", anonTokenConfig.TTL.String()))
+	if err != nil || anonTokenTTL <= 0 {
+		return nil, fmt.Errorf("ANON_TOKEN_TTL 必须是正的时间间隔（如 5m）")
+	}
+	anonTokenMaxUses, err := strconv.Atoi(getEnv("ANON_TOKEN_MAX_USES", strconv.Itoa(anonTokenConfig.MaxUses)))
+	if err != nil || anonTokenMaxUses < 0 {
+		return nil, fmt.Errorf("ANON_TOKEN_MAX_USES 必须是非负整数，0 表示不限制")
+	}
+	anonTokenConcurrency, err := strconv.Atoi(getEnv("ANON_TOKEN_REFILL_CONCURRENCY", strconv.Itoa(anonTokenConfig.RefillConcurrency)))
+	if err != nil || anonTokenConcurrency < 1 {
+		return nil, fmt.Errorf("ANON_TOKEN_REFILL_CONCURRENCY 必须是正整数")
+	}
+
+	// 上游流超时：默认值见 DefaultStreamTimeouts
+	streamTimeouts := DefaultStreamTimeouts()
+	firstByteTimeout, err := time.ParseDuration(getEnv("UPSTREAM_FIRST_BYTE_TIMEOUT", streamTimeouts.FirstByte.String()))
+	if err != nil || firstByteTimeout < 0 {
+		return nil, fmt.Errorf("UPSTREAM_FIRST_BYTE_TIMEOUT 必须是有效的时间间隔（如 60s），0 表示不限制")
+	}
+	streamIdleTimeout, err := time.ParseDuration(getEnv("UPSTREAM_IDLE_TIMEOUT", streamTimeouts.Idle.String()))
+	if err != nil || streamIdleTimeout < 0 {
+		return nil, fmt.Errorf("UPSTREAM_IDLE_TIMEOUT 必须是有效的时间间隔（如 60s），0 表示不限制")
+	}
+	thinkingTimeout, err := time.ParseDuration(getEnv("UPSTREAM_THINKING_TIMEOUT", streamTimeouts.Thinking.String()))
+	if err != nil || thinkingTimeout < 0 {
+		return nil, fmt.Errorf("UPSTREAM_THINKING_TIMEOUT 必须是有效的时间间隔（如 3m），0 表示不限制")
+	}
+
+	toolArgsInvalidAction := getEnv("TOOL_ARGS_INVALID_ACTION", toolArgsActionError)
+	switch toolArgsInvalidAction {
+	case toolArgsActionError, toolArgsActionReprompt, toolArgsActionIgnore:
+	default:
+		return nil, fmt.Errorf("TOOL_ARGS_INVALID_ACTION 必须是 error、reprompt 或 ignore")
+	}
+
 	config := &types.Config{
 		UpstreamUrl:           getEnv("UPSTREAM_URL", "https://chat.z.ai/api/chat/completions"),
 		DefaultKey:            getEnv("API_KEY", "sk-tbkFoKzk9a531YyUNNF5"),
@@ -106,6 +251,40 @@ func loadConfig() (*types.Config, error) {
 		ThinkTagsMode:         getEnv("THINK_TAGS_MODE", "think"), // strip, think, raw
 		AnonTokenEnabled:      getEnv("ANON_TOKEN_ENABLED", "true") == "true",
 		MaxConcurrentRequests: maxConcurrent,
+		UploadCacheTTL:        uploadCacheTTL,
+		UploadCacheMaxMemory:  int64(uploadCacheMaxMB) << 20,
+		FetchAllowCIDRs:       fetchAllow,
+		FetchDenyCIDRs:        append(fetchPolicy.DenyCIDRs, fetchDeny...),
+		FetchMaxRedirects:     fetchMaxRedirects,
+		FetchMaxBodySize:      int64(fetchMaxBodyMB) << 20,
+		ImageNormalize:        getEnv("IMAGE_NORMALIZE", "true") == "true",
+		ImageMaxDimension:     imageMaxDimension,
+		ToolArgsInvalidAction: toolArgsInvalidAction,
+		CountReasoningTokens:  getEnv("MAX_TOKENS_INCLUDE_REASONING", "false") == "true",
+		RetryMaxAttempts:      retryMaxAttempts,
+		RetryBaseDelay:        retryBaseDelay,
+		RetryMaxDelay:         retryMaxDelay,
+		RetryBudget:           retryBudget,
+		RetryStatusCodes:      retryStatusCodes,
+		RetryBodyPatterns:     retryBodyPatterns,
+		BreakerEnabled:        getEnv("UPSTREAM_BREAKER_ENABLED", "true") == "true",
+		BreakerWindow:         breakerWindow,
+		BreakerMinRequests:    breakerMinRequests,
+		BreakerErrorRate:      breakerErrorRate,
+		BreakerSlowCall:       breakerSlowCall,
+		BreakerSlowRate:       breakerSlowRate,
+		BreakerOpenTimeout:    breakerOpenTimeout,
+		BreakerProbes:         breakerProbes,
+		UpstreamTokens:        upstreamTokens,
+		TokenPoolStrategy:     string(tokenPoolStrategy),
+		TokenCooldown:         tokenCooldown,
+		AnonTokenPoolSize:     anonTokenPoolSize,
+		AnonTokenTTL:          anonTokenTTL,
+		AnonTokenMaxUses:      anonTokenMaxUses,
+		AnonTokenConcurrency:  anonTokenConcurrency,
+		FirstByteTimeout:      firstByteTimeout,
+		StreamIdleTimeout:     streamIdleTimeout,
+		ThinkingTimeout:       thinkingTimeout,
 	}
 
 	// 配置验证
@@ -164,27 +343,22 @@ func validateConfig(c *types.Config) error {
 	}
 
 	// 如果未启用匿名令牌，且没有提供上游令牌，则报错
-	if !c.AnonTokenEnabled && c.UpstreamToken == "" {
-		return fmt.Errorf("当 ANON_TOKEN_ENABLED 为 false 时，UPSTREAM_TOKEN 环境变量是必需的")
+	if !c.AnonTokenEnabled && c.UpstreamToken == "" && len(c.UpstreamTokens) == 0 {
+		return fmt.Errorf("当 ANON_TOKEN_ENABLED 为 false 时，UPSTREAM_TOKEN 或 UPSTREAM_TOKENS 环境变量是必需的")
 	}
 
 	return nil
 }
 
-// 模型常量
 const (
-	DefaultModelName        = "glm-4.5"
-	ThinkingModelName       = "glm-4.5-thinking"
-	SearchModelName         = "glm-4.5-search"
-	GLMAirModelName         = "glm-4.5-air"
-	GLMVision               = "glm-4.5v"
-	MaxResponseSize   int64 = DefaultMaxTokens // 10MB
+	MaxResponseSize int64 = DefaultMaxTokens // 10MB
 )
 
 // 全局配置和缓存实例
 var (
-	appConfig  *types.Config
-	tokenCache *TokenCache
+	appConfig   *types.Config
+	anonTokens  *AnonTokenPool
+	uploadCache *UploadCache
 )
 
 // 监控指标
@@ -746,7 +920,7 @@ func (sc *StatsCollector) processBatch(updates []types.StatsUpdate) {
 
 		// 更新端点统计
 		switch update.Path {
-		case "/v1/chat/completions":
+		case "/v1/chat/completions", "/v1/completions", "/v1/messages", "/v1/responses":
 			stats.ApiCallsCount++
 		case "/v1/models":
 			stats.ModelsCallsCount++
@@ -759,6 +933,9 @@ func (sc *StatsCollector) processBatch(updates []types.StatsUpdate) {
 			stats.TotalTokensUsed += update.Tokens
 		}
 
+		// 更新上游重试统计
+		stats.UpstreamRetries += update.Retries
+
 		// 更新模型使用统计
 		if update.Model != "" {
 			stats.ModelUsage[update.Model]++
@@ -822,7 +999,7 @@ func (sc *StatsCollector) Stop() {
 var statsCollector *StatsCollector
 
 // recordRequestStats 异步记录请求统计信息
-func recordRequestStats(startTime time.Time, path string, status int, tokens int64, model string, isStreaming bool) {
+func recordRequestStats(startTime time.Time, path string, status int, tokens int64, model string, isStreaming bool, retries int64) {
 	duration := float64(time.Since(startTime)) / float64(time.Millisecond)
 
 	if statsCollector != nil {
@@ -834,6 +1011,7 @@ func recordRequestStats(startTime time.Time, path string, status int, tokens int
 			Model:       model,
 			IsStreaming: isStreaming,
 			Duration:    duration,
+			Retries:     retries,
 		})
 	}
 }
@@ -1055,73 +1233,12 @@ func validateAndSanitizeInput(req *types.OpenAIRequest) error {
 
 // ErrorDetail 错误详情
 
-// 获取匿名token（每次对话使用不同token，避免共享记忆）
-// GetToken 从缓存或新获取Token，使用 singleflight 防止缓存击穿
-func (tc *TokenCache) GetToken() (string, error) {
-	// 先读锁检查缓存
-	tc.mutex.RLock()
-	if tc.token != "" && time.Now().Before(tc.expiresAt) {
-		token := tc.token
-		tc.mutex.RUnlock()
-		debugLog("使用缓存的匿名token")
-		tokenCacheHits.Add(1)
-		return token, nil
-	}
-	tc.mutex.RUnlock()
-
-	// 使用 singleflight 确保只有一个 goroutine 获取 token
-	result, err, _ := tc.sf.Do("get_token", func() (interface{}, error) {
-		// 再次检查缓存，可能在等待期间其他 goroutine 已经获取了
-		tc.mutex.RLock()
-		if tc.token != "" && time.Now().Before(tc.expiresAt) {
-			token := tc.token
-			tc.mutex.RUnlock()
-			debugLog("在 singleflight 中使用缓存的匿名token")
-			return token, nil
-		}
-		tc.mutex.RUnlock()
-
-		// 获取新 token
-		newToken, fetchErr := getAnonymousTokenDirect()
-		if fetchErr != nil {
-			debugLog("获取新的匿名token失败: %v", fetchErr)
-			tokenCacheMisses.Add(1)
-			return "", fetchErr
-		}
-
-		// 更新缓存
-		tc.mutex.Lock()
-		tc.token = newToken
-		tc.expiresAt = time.Now().Add(5 * time.Minute) // 5分钟缓存
-		tc.mutex.Unlock()
-
-		debugLog("获取新的匿名token成功，缓存5分钟")
-		tokenCacheMisses.Add(1)
-		return newToken, nil
-	})
-
-	if err != nil {
-		return "", err
+// getAnonymousToken 获取会话绑定的匿名token（每次对话使用不同token，避免共享记忆）
+func getAnonymousToken(ctx context.Context, sessionID string) (string, error) {
+	if anonTokens == nil {
+		return "", fmt.Errorf("anonymous token pool not initialized")
 	}
-
-	return result.(string), nil
-}
-
-// InvalidateToken 立即将当前token标记为失效，强制获取新token
-func (tc *TokenCache) InvalidateToken() {
-	tc.mutex.Lock()
-	defer tc.mutex.Unlock()
-	tc.token = ""
-	tc.expiresAt = time.Now() // 设置为已过期
-	debugLog("匿名token已标记为失效，下次请求将获取新token")
-}
-
-// getAnonymousToken 兼容性方法，使用缓存
-func getAnonymousToken() (string, error) {
-	if tokenCache == nil {
-		return "", fmt.Errorf("token cache not initialized")
-	}
-	return tokenCache.GetToken()
+	return anonTokens.GetToken(ctx, sessionID)
 }
 
 // generateBrowserHeaders generates dynamic and consistent browser headers for a session.
@@ -1256,6 +1373,14 @@ func getAnonymousTokenDirect() (string, error) {
 	return body.Token, nil
 }
 
+// defaultModelID 返回模型注册表中的默认模型ID
+func defaultModelID() string {
+	if model, ok := config.GetDefaultModel(); ok {
+		return model.ID
+	}
+	return ""
+}
+
 // 从文件读取仪表板 HTML
 func loadDashboardHTML() (string, error) {
 	content, err := os.ReadFile("assets/dashboard.html")
@@ -1299,8 +1424,67 @@ func main() {
 		utils.LogWarn("无法加载浏览器指纹文件", "file", "assets/fingerprints.json", "error", err)
 	}
 
-	// 初始化Token缓存
-	tokenCache = &TokenCache{}
+	// 初始化匿名token池，启用匿名token时在后台预先获取
+	anonTokenConfig := DefaultAnonTokenPoolConfig()
+	anonTokenConfig.Size = appConfig.AnonTokenPoolSize
+	anonTokenConfig.TTL = appConfig.AnonTokenTTL
+	anonTokenConfig.MaxUses = appConfig.AnonTokenMaxUses
+	anonTokenConfig.RefillConcurrency = appConfig.AnonTokenConcurrency
+	anonTokens = NewAnonTokenPool(anonTokenConfig, getAnonymousTokenDirect)
+	if appConfig.AnonTokenEnabled {
+		anonTokens.Refill()
+	}
+
+	// 初始化防 SSRF 的远程文件获取器
+	remoteFetcher = NewSafeFetcher(FetchPolicy{
+		AllowCIDRs:   appConfig.FetchAllowCIDRs,
+		DenyCIDRs:    appConfig.FetchDenyCIDRs,
+		MaxRedirects: appConfig.FetchMaxRedirects,
+		MaxBodySize:  appConfig.FetchMaxBodySize,
+	})
+
+	// 初始化上游重试策略
+	upstreamRetryPolicy = RetryPolicy{
+		MaxAttempts:  appConfig.RetryMaxAttempts,
+		BaseDelay:    appConfig.RetryBaseDelay,
+		MaxDelay:     appConfig.RetryMaxDelay,
+		Budget:       appConfig.RetryBudget,
+		StatusCodes:  appConfig.RetryStatusCodes,
+		BodyPatterns: appConfig.RetryBodyPatterns,
+	}
+
+	// 初始化上游流超时
+	upstreamStreamTimeouts = StreamTimeouts{
+		FirstByte: appConfig.FirstByteTimeout,
+		Idle:      appConfig.StreamIdleTimeout,
+		Thinking:  appConfig.ThinkingTimeout,
+	}
+
+	// 初始化上游熔断器
+	upstreamBreakers = nil
+	if appConfig.BreakerEnabled {
+		upstreamBreakers = breaker.NewGroup(breaker.Config{
+			Window:         appConfig.BreakerWindow,
+			MinRequests:    appConfig.BreakerMinRequests,
+			ErrorRate:      appConfig.BreakerErrorRate,
+			SlowCall:       appConfig.BreakerSlowCall,
+			SlowRate:       appConfig.BreakerSlowRate,
+			OpenTimeout:    appConfig.BreakerOpenTimeout,
+			HalfOpenProbes: appConfig.BreakerProbes,
+		})
+	}
+
+	// 初始化上游 token 池
+	upstreamTokenPool = nil
+	if len(appConfig.UpstreamTokens) > 0 {
+		upstreamTokenPool = tokenpool.New(appConfig.UpstreamTokens, tokenpool.Strategy(appConfig.TokenPoolStrategy), appConfig.TokenCooldown)
+		debugLog("上游 token 池已加载 %d 个 token，选择策略 %s", upstreamTokenPool.Len(), appConfig.TokenPoolStrategy)
+	}
+
+	// 初始化上传缓存
+	if appConfig.UploadCacheTTL > 0 {
+		uploadCache = NewUploadCache(appConfig.UploadCacheTTL, appConfig.UploadCacheMaxMemory)
+	}
 
 	// 初始化统计信息
 	stats = &types.RequestStats{
@@ -1325,7 +1509,7 @@ func main() {
 
 	utils.LogInfo("服务器配置",
 		"port", appConfig.Port,
-		"model", DefaultModelName,
+		"model", defaultModelID(),
 		"upstream", appConfig.UpstreamUrl,
 		"debug", appConfig.DebugMode,
 		"anon_token", appConfig.AnonTokenEnabled,
@@ -1658,155 +1842,6 @@ func calculateBackoffDelay(attempt int, baseDelay time.Duration, maxDelay time.D
 	return delay
 }
 
-// callUpstreamWithRetry 调用上游API并处理重试，改进资源管理和超时控制
-func callUpstreamWithRetry(ctx context.Context, upstreamReq types.UpstreamRequest, chatID string, authToken string, sessionID string) (*http.Response, context.CancelFunc, error) {
-	var lastErr error
-	maxRetries := 5 // 增加到5次重试
-	baseDelay := 100 * time.Millisecond
-	maxDelay := 10 * time.Second
-
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		// 检查context是否已取消
-		select {
-		case <-ctx.Done():
-			return nil, nil, ctx.Err()
-		default:
-		}
-
-		debugLog("开始第 %d/%d 次尝试调用上游API", attempt+1, maxRetries)
-
-		// 每次重试都创建新的context，避免context污染
-		resp, cancel, err := callUpstreamWithHeaders(ctx, upstreamReq, chatID, authToken, sessionID)
-
-		// 检查是否需要重试（包括网络错误）
-		if err != nil {
-			debugLog("上游调用失败 (尝试 %d/%d): %v", attempt+1, maxRetries, err)
-			if cancel != nil {
-				cancel() // 立即取消context以释放资源
-			}
-
-			// 判断是否为可重试的错误
-			if isRetryableError(err, 0, nil) {
-				lastErr = err
-				if attempt < maxRetries-1 {
-					delay := calculateBackoffDelay(attempt, baseDelay, maxDelay)
-					debugLog("网络错误，等待 %v 后重试", delay)
-					// time.Sleep(delay)
-					select {
-					case <-time.After(delay):
-					case <-ctx.Done():
-						return nil, nil, ctx.Err()
-					}
-
-					// 如果是超时或认证错误，可能需要刷新token
-					if strings.Contains(err.Error(), "timeout") || strings.Contains(err.Error(), "deadline") {
-						debugLog("检测到超时错误，检查是否需要刷新token")
-						if appConfig.AnonTokenEnabled {
-							if newToken, tokenErr := getAnonymousTokenDirect(); tokenErr == nil {
-								authToken = newToken
-								debugLog("成功刷新匿名token")
-								// 重新生成签名将在下次调用callUpstreamWithHeaders时自动完成
-							}
-						}
-					}
-					continue
-				}
-			} else {
-				// 不可重试的错误，直接返回
-				debugLog("不可重试的错误，停止重试: %v", err)
-				return nil, nil, err
-			}
-		}
-
-		// 如果请求成功，检查响应状态码
-		if resp != nil {
-			// 读取一些响应体用于错误分析（如果需要）
-			var bodyBytes []byte
-			if resp.StatusCode != http.StatusOK {
-				// 尝试读取响应体用于错误分析
-				bodyBytes, _ = io.ReadAll(io.LimitReader(resp.Body, 1024)) // 最多读1KB用于分析
-				// 重新包装响应体，以便后续处理
-				resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(bodyBytes), resp.Body))
-			}
-
-			// 检查状态码
-			if resp.StatusCode == http.StatusOK {
-				debugLog("上游调用成功 (尝试 %d/%d): %d", attempt+1, maxRetries, resp.StatusCode)
-				return resp, cancel, nil // 成功，直接返回
-			}
-
-			// 检查是否为可重试的HTTP错误
-			if isRetryableError(nil, resp.StatusCode, bodyBytes) {
-								lastErr = fmt.Errorf("上游API返回可重试的状态码 %d", resp.StatusCode)
-				debugLog("收到可重试的HTTP状态码 %d (尝试 %d/%d)，错误详情: %s", resp.StatusCode, attempt+1, maxRetries, string(bodyBytes))
-
-				// 特殊处理401错误
-				if resp.StatusCode == http.StatusUnauthorized {
-					debugLog("收到401错误，尝试刷新token和重新生成签名")
-					// 标记token为失效
-					if tokenCache != nil {
-						tokenCache.InvalidateToken()
-					}
-					// 如果启用了匿名token，尝试获取新的
-					if appConfig.AnonTokenEnabled {
-						if newToken, tokenErr := getAnonymousTokenDirect(); tokenErr == nil {
-							authToken = newToken
-							debugLog("成功获取新的匿名token，下次重试将使用新token和新签名")
-							// 注意：签名会在下次调用callUpstreamWithHeaders时自动重新生成
-						} else {
-							debugLog("刷新匿名token失败: %v", tokenErr)
-						}
-					}
-				}
-
-				// 关闭当前响应
-				cleanupResponse(resp, cancel)
-
-				// 如果不是最后一次尝试，等待后重试
-				if attempt < maxRetries-1 {
-					// 对于429限流，使用更长的基础延迟
-					if resp.StatusCode == http.StatusTooManyRequests {
-						delay := calculateBackoffDelay(attempt, 1*time.Second, 180*time.Second)
-						debugLog("限流错误，等待 %v 后重试", delay)
-						select {
-						case <-time.After(delay):
-						case <-ctx.Done():
-							return nil, nil, ctx.Err()
-						}
-					} else {
-						delay := calculateBackoffDelay(attempt, baseDelay, maxDelay)
-						debugLog("等待 %v 后重试", delay)
-						select {
-						case <-time.After(delay):
-						case <-ctx.Done():
-							return nil, nil, ctx.Err()
-						}
-					}
-					continue
-				}
-			} else {
-				// 不可重试的状态码，直接返回
-				debugLog("收到不可重试的状态码 %d，停止重试", resp.StatusCode)
-				return resp, cancel, nil
-			}
-		}
-
-		// 如果是最后一次尝试，返回错误
-		if attempt == maxRetries-1 {
-			if resp != nil {
-				lastErr = fmt.Errorf("上游API在 %d 次尝试后仍然失败，最后状态码: %d", maxRetries, resp.StatusCode)
-			} else if lastErr != nil {
-				lastErr = fmt.Errorf("上游API在 %d 次尝试后仍然失败: %w", maxRetries, lastErr)
-			} else {
-				lastErr = fmt.Errorf("上游API在 %d 次尝试后仍然失败", maxRetries)
-			}
-			return nil, nil, lastErr
-		}
-	}
-
-	return nil, nil, fmt.Errorf("上游API在 %d 次尝试后仍然失败", maxRetries)
-}
-
 // cleanupResponse 清理HTTP响应和相关资源，改进连接复用
 func cleanupResponse(resp *http.Response, cancel context.CancelFunc) {
 	if resp.Body != nil {
@@ -1,10 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"strings"
 	"time"
 
+	"z2api/config"
 	"z2api/internal/signature"
 	"z2api/types"
 	"z2api/utils"
@@ -13,30 +14,30 @@ import (
 // MessageConverter 消息转换器，参考 Python 版本的 prepare_data 函数
 type MessageConverter struct {
 	authToken     string
-	uploader      *ImageUploader
+	uploader      *FileUploader
 	featureConfig FeatureConfig // 使用本地的 FeatureConfig 类型
 }
 
 // NewMessageConverter 创建新的消息转换器
-func NewMessageConverter(authToken string, modelID string, streaming bool) *MessageConverter {
+func NewMessageConverter(authToken string, modelConfig config.ModelConfig, streaming bool) *MessageConverter {
 	return &MessageConverter{
 		authToken:     authToken,
-		uploader:      NewImageUploader(authToken),
-		featureConfig: getModelFeatures(modelID, streaming),
+		uploader:      NewFileUploader(authToken),
+		featureConfig: getModelFeatures(modelConfig, streaming),
 	}
 }
 
 // PrepareData 准备上游请求数据
 // 参考 Python 版本的 prepare_data 函数
-func (mc *MessageConverter) PrepareData(req types.OpenAIRequest, sessionID string) (types.UpstreamRequest, map[string]string, error) {
+func (mc *MessageConverter) PrepareData(ctx context.Context, req types.OpenAIRequest, sessionID string) (types.UpstreamRequest, map[string]string, error) {
 	// 生成会话相关ID
 	chatID := utils.GenerateUUID()
 	msgID := utils.GenerateUUID()
 
 	// 转换消息并处理图片
-	processedMessages, files, err := mc.processMessages(req.Messages)
+	processedMessages, files, err := mc.processMessages(ctx, req.Messages)
 	if err != nil {
-		return types.UpstreamRequest{}, nil, fmt.Errorf("处理消息失败: %w", err)
+		return types.UpstreamRequest{}, nil, err
 	}
 
 	// 构建上游请求
@@ -58,7 +59,7 @@ func (mc *MessageConverter) PrepareData(req types.OpenAIRequest, sessionID strin
 
 	// 如果有图片文件，添加到请求中
 	if len(files) > 0 {
-		upstreamReq.Params["files"] = files
+		upstreamReq.Files = files
 		debugLog("添加 %d 个文件到请求中", len(files))
 	}
 
@@ -68,14 +69,16 @@ func (mc *MessageConverter) PrepareData(req types.OpenAIRequest, sessionID strin
 	return upstreamReq, params, nil
 }
 
-// processMessages 处理消息列表，转换多模态内容并上传图片（使用统一的多模态处理器）
-func (mc *MessageConverter) processMessages(messages []types.Message) ([]types.UpstreamMessage, []map[string]interface{}, error) {
+// processMessages 处理消息列表，转换多模态内容并上传文件（使用统一的多模态处理器）
+func (mc *MessageConverter) processMessages(ctx context.Context, messages []types.Message) ([]types.UpstreamMessage, []types.UpstreamFile, error) {
 	var processedMessages []types.UpstreamMessage
-	var files []map[string]interface{}
+	var files []types.UpstreamFile
 
 	// 创建多模态处理器
 	processor := utils.NewMultimodalProcessor("")
 	processor.EnableDebugLog = appConfig.DebugMode
+	processor.FileResolver = fileStore.ResolveUpstream
+	callNames := make(map[string]string)
 
 	for _, msg := range messages {
 		// 使用统一处理器处理内容
@@ -85,27 +88,17 @@ func (mc *MessageConverter) processMessages(messages []types.Message) ([]types.U
 		if err == nil {
 			textContent = result.Text
 
-			// 处理图片文件上传
-			for _, imageURL := range result.Images {
-				fileID, uploadErr := mc.uploadImage(imageURL)
-				if uploadErr != nil {
-					debugLog("上传图片失败: %v", uploadErr)
-					continue
-				}
-				files = append(files, map[string]interface{}{
-					"type": "image",
-					"id":   fileID,
-				})
-			}
-
-			// 处理其他已有文件ID的文件
+			// 已有文件ID的文件直接引用，其余文件上传，失败时直接返回错误
 			for _, file := range result.Files {
 				if file.FileID != "" {
-					files = append(files, map[string]interface{}{
-						"type": file.Type,
-						"id":   file.FileID,
-					})
+					files = append(files, types.UpstreamFile{Type: file.Type, ID: file.FileID, Name: file.Name, MimeType: file.MimeType, Size: file.Size})
+					continue
 				}
+				uploaded, uploadErr := mc.uploader.Upload(ctx, file)
+				if uploadErr != nil {
+					return nil, nil, uploadErr
+				}
+				files = append(files, uploaded)
 			}
 		} else {
 			// 如果处理失败，尝试将内容转换为字符串
@@ -117,54 +110,16 @@ func (mc *MessageConverter) processMessages(messages []types.Message) ([]types.U
 		}
 
 		// 添加处理后的消息
-		processedMessages = append(processedMessages, types.UpstreamMessage{
+		upstreamMsg := types.UpstreamMessage{
 			Role:             normalizeRole(msg.Role),
 			Content:          textContent,
 			ReasoningContent: msg.ReasoningContent,
-		})
-	}
-
-	return processedMessages, files, nil
-}
-
-// processMultimodalContent 处理多模态内容（已被processMessages方法替代，保留作为向后兼容）
-func (mc *MessageConverter) processMultimodalContent(msg types.Message) (string, []map[string]interface{}, error) {
-	processor := utils.NewMultimodalProcessor("")
-	result, err := processor.ProcessContent(msg.Content)
-
-	if err != nil {
-		return "", nil, err
-	}
-
-	var files []map[string]interface{}
-
-	// 处理图片上传
-	for _, imageURL := range result.Images {
-		fileID, uploadErr := mc.uploadImage(imageURL)
-		if uploadErr != nil {
-			debugLog("上传图片失败: %v", uploadErr)
-			continue
 		}
-		files = append(files, map[string]interface{}{
-			"type": "image",
-			"id":   fileID,
-		})
-	}
-
-	return result.Text, files, nil
-}
-
-// uploadImage 上传图片并返回文件ID
-func (mc *MessageConverter) uploadImage(url string) (string, error) {
-	if strings.HasPrefix(url, "data:image/") {
-		// Base64 编码的图片
-		return mc.uploader.UploadBase64Image(url)
-	} else if strings.HasPrefix(url, "http") {
-		// URL 图片
-		return mc.uploader.UploadImageFromURL(url)
+		attachToolHistory(&upstreamMsg, msg, callNames)
+		processedMessages = append(processedMessages, upstreamMsg)
 	}
 
-	return "", fmt.Errorf("不支持的图片URL格式: %s", url)
+	return processedMessages, files, nil
 }
 
 // buildRequestParams 构建请求参数
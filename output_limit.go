@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+
+	"z2api/internal/tokenizer"
+	"z2api/types"
+)
+
+// tokenBudget 按 max_tokens 限制输出，回答与思考内容分别计数（未经校准的估算值），按模型校准后与上限比较
+type tokenBudget struct {
+	model            string
+	limit            int
+	includeReasoning bool // 思考内容是否计入限制
+	completion       int
+	reasoning        int
+}
+
+// newTokenBudget 创建输出 token 预算，limit 不大于 0 时返回 nil
+func newTokenBudget(model string, limit int, includeReasoning bool) *tokenBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &tokenBudget{model: model, limit: limit, includeReasoning: includeReasoning}
+}
+
+// outputTokenLimit 返回请求的最大输出 token 数：max_tokens 与 max_completion_tokens 中较小的一个，均未设置时返回 0
+func outputTokenLimit(req types.OpenAIRequest) int {
+	limit := 0
+	for _, v := range []*int{req.MaxTokens, req.MaxCompletionTokens} {
+		if v != nil && *v > 0 && (limit == 0 || *v < limit) {
+			limit = *v
+		}
+	}
+	return limit
+}
+
+// newRequestTokenBudget 按上游请求的输出 token 上限与 MAX_TOKENS_INCLUDE_REASONING 创建预算
+func newRequestTokenBudget(upstreamReq types.UpstreamRequest) *tokenBudget {
+	return newTokenBudget(upstreamReq.Model, upstreamReq.MaxTokens, countReasoningTokens())
+}
+
+// countReasoningTokens 思考内容是否计入 max_tokens
+func countReasoningTokens() bool {
+	return appConfig != nil && appConfig.CountReasoningTokens
+}
+
+// Completion 计入回答文本，返回不超出限制的部分；超出限制时第二个返回值为 true
+func (b *tokenBudget) Completion(text string) (string, bool) {
+	if b == nil {
+		return text, false
+	}
+	return b.take(&b.completion, text)
+}
+
+// Reasoning 计入思考内容；思考内容不计入限制时原样返回
+func (b *tokenBudget) Reasoning(text string) (string, bool) {
+	if b == nil {
+		return text, false
+	}
+	if !b.includeReasoning {
+		b.reasoning += tokenizer.Estimate(text)
+		return text, false
+	}
+	return b.take(&b.reasoning, text)
+}
+
+// used 返回已计入限制的 token 数
+func (b *tokenBudget) used() int {
+	estimated := b.completion
+	if b.includeReasoning {
+		estimated += b.reasoning
+	}
+	return tokenizer.Apply(b.model, estimated)
+}
+
+// take 计入文本，超出限制时逐个片段计入，在超出的片段前截断
+func (b *tokenBudget) take(counter *int, text string) (string, bool) {
+	estimated := tokenizer.Estimate(text)
+	*counter += estimated
+	if b.used() <= b.limit {
+		return text, false
+	}
+	*counter -= estimated
+
+	offset := 0
+	for _, piece := range tokenizer.Segment(text) {
+		*counter++
+		if b.used() > b.limit {
+			*counter--
+			return text[:offset], true
+		}
+		offset += len(piece)
+	}
+	return text, false
+}
+
+// truncationTarget 由需要报告输出因 max_tokens 截断的流式处理器实现
+type truncationTarget interface {
+	MarkTruncated()
+}
+
+// outputLimitHandler 包装阶段处理器，在回答中匹配到停止序列或输出达到 max_tokens 时
+// 截断输出、结束响应并取消上游请求
+type outputLimitHandler struct {
+	upstreamPhaseHandler
+	target  upstreamPhaseHandler // 未经包装的处理器，用于报告停止序列与截断
+	stop    *stopSequenceMatcher
+	budget  *tokenBudget
+	cancel  context.CancelFunc
+	stopped bool
+}
+
+// withOutputLimits 请求设置了停止序列或输出 token 上限时包装阶段处理器，否则原样返回。
+// target 为未经包装的处理器，cancel 用于提前结束上游请求
+func withOutputLimits(h, target upstreamPhaseHandler, upstreamReq types.UpstreamRequest, cancel context.CancelFunc) upstreamPhaseHandler {
+	stop := newStopSequenceMatcher(upstreamReq.StopSequences)
+	budget := newRequestTokenBudget(upstreamReq)
+	if stop == nil && budget == nil {
+		return h
+	}
+	return &outputLimitHandler{upstreamPhaseHandler: h, target: target, stop: stop, budget: budget, cancel: cancel}
+}
+
+// ProcessThinkingPhase 计入思考内容，思考内容计入限制时同样可能截断。
+// 与非流式聚合一样按处理标签后的文本计数，截断时交给被包装处理器的是处理后的文本，再次处理不会改变其内容
+func (h *outputLimitHandler) ProcessThinkingPhase(data *types.UpstreamData) {
+	if h.stopped {
+		return
+	}
+	text, exceeded := h.budget.Reasoning(thinkingDelta(data))
+	if !exceeded {
+		h.upstreamPhaseHandler.ProcessThinkingPhase(data)
+		return
+	}
+	if text != "" {
+		truncated := *data
+		truncated.Data.DeltaContent = text
+		h.upstreamPhaseHandler.ProcessThinkingPhase(&truncated)
+	}
+	h.finish("length")
+}
+
+// ProcessAnswerPhase 在回答中匹配停止序列并计入 token
+func (h *outputLimitHandler) ProcessAnswerPhase(data *types.UpstreamData) {
+	if h.stopped {
+		return
+	}
+	content := data.Data.DeltaContent
+	if data.Data.EditContent != "" {
+		content = processAnswerContent(data.Data.DeltaContent, data.Data.EditContent)
+	}
+	h.feed(content)
+}
+
+// ProcessToolCallPhase 工具调用前先输出暂存的回答
+func (h *outputLimitHandler) ProcessToolCallPhase(data *types.UpstreamData) {
+	if h.stopped || h.flush() {
+		return
+	}
+	h.upstreamPhaseHandler.ProcessToolCallPhase(data)
+}
+
+// ProcessOtherPhase 其他阶段中的文本同样属于回答，流结束时先输出暂存的回答
+func (h *outputLimitHandler) ProcessOtherPhase(data *types.UpstreamData) {
+	if h.stopped {
+		return
+	}
+	if data.Data.DeltaContent != "" {
+		if h.feed(data.Data.DeltaContent) {
+			return
+		}
+		filtered := *data
+		filtered.Data.DeltaContent = ""
+		data = &filtered
+	}
+	if (data.Data.Phase == "done" || data.Data.Done) && h.flush() {
+		return
+	}
+	h.upstreamPhaseHandler.ProcessOtherPhase(data)
+}
+
+// ProcessDonePhase 输出暂存的回答后结束
+func (h *outputLimitHandler) ProcessDonePhase(data *types.UpstreamData) {
+	if h.stopped {
+		return
+	}
+	if !h.upstreamPhaseHandler.IsFinished() && h.flush() {
+		return
+	}
+	h.upstreamPhaseHandler.ProcessDonePhase(data)
+}
+
+// IsFinished 提前结束后视为已结束
+func (h *outputLimitHandler) IsFinished() bool {
+	return h.stopped || h.upstreamPhaseHandler.IsFinished()
+}
+
+// feed 处理一段回答文本，匹配到停止序列或达到 token 上限时结束响应并返回 true
+func (h *outputLimitHandler) feed(content string) bool {
+	text, matched := content, false
+	if h.stop != nil {
+		text, matched = h.stop.Feed(content)
+	}
+	if h.write(text) {
+		return true
+	}
+	if matched {
+		debugLog("匹配到停止序列 %q，结束响应并取消上游请求", h.stop.Matched())
+		if t, ok := h.target.(stopSequenceTarget); ok {
+			t.SetStopSequence(h.stop.Matched())
+		}
+		h.finish("stop")
+	}
+	return matched
+}
+
+// flush 输出停止序列匹配暂存的文本，达到 token 上限时结束响应并返回 true
+func (h *outputLimitHandler) flush() bool {
+	if h.stop == nil {
+		return false
+	}
+	return h.write(h.stop.Flush())
+}
+
+// write 计入 token 后以回答阶段的形式把文本交给被包装的处理器，达到 token 上限时结束响应并返回 true
+func (h *outputLimitHandler) write(text string) bool {
+	text, exceeded := h.budget.Completion(text)
+	if text != "" {
+		var data types.UpstreamData
+		data.Data.Phase = "answer"
+		data.Data.DeltaContent = text
+		h.upstreamPhaseHandler.ProcessAnswerPhase(&data)
+	}
+	if exceeded {
+		h.finish("length")
+	}
+	return exceeded
+}
+
+// finish 提前结束响应并取消上游请求，reason 为 length 时报告输出被截断
+func (h *outputLimitHandler) finish(reason string) {
+	if reason == "length" {
+		debugLog("输出达到 max_tokens 上限 %d，结束响应并取消上游请求", h.budget.limit)
+		if t, ok := h.target.(truncationTarget); ok {
+			t.MarkTruncated()
+		}
+	}
+	h.upstreamPhaseHandler.ProcessDonePhase(nil)
+	h.stopped = true
+	if h.cancel != nil {
+		h.cancel()
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestTokenBudget 测试按 token 上限截断回答与思考内容
+func TestTokenBudget(t *testing.T) {
+	tests := []struct {
+		name             string
+		limit            int
+		includeReasoning bool
+		reasoning        []string
+		completion       []string
+		want             string
+		exceeded         bool
+	}{
+		{"未超出", 4, false, nil, []string{"hello", " world"}, "hello world", false},
+		{"英文截断", 2, false, nil, []string{"hello world", " again and"}, "hello world", true},
+		{"中文截断", 2, false, nil, []string{"你好", "世界再见"}, "你好世界", true},
+		{"思考内容不计入", 1, false, []string{"很长很长的思考"}, []string{"你好"}, "你好", false},
+		{"思考内容计入", 2, true, []string{"思考"}, []string{"你好世界"}, "你好", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBudget("", tt.limit, tt.includeReasoning)
+			for _, text := range tt.reasoning {
+				b.Reasoning(text)
+			}
+			var sb strings.Builder
+			exceeded := false
+			for _, text := range tt.completion {
+				var out string
+				out, exceeded = b.Completion(text)
+				sb.WriteString(out)
+				if exceeded {
+					break
+				}
+			}
+			if got := sb.String(); got != tt.want || exceeded != tt.exceeded {
+				t.Errorf("输出 = %q (exceeded=%v), 期望 %q (exceeded=%v)", got, exceeded, tt.want, tt.exceeded)
+			}
+		})
+	}
+}
+
+// TestOutputLimitHandler 测试流式响应达到 max_tokens 时截断、以 length 结束并取消上游请求
+func TestOutputLimitHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	cancelled := false
+	upstreamReq := types.UpstreamRequest{MaxTokens: 2}
+	handler := withOutputHandling(NewGinStreamHandler(c, "glm-4.5"), upstreamReq, func() { cancelled = true })
+
+	lines := []string{
+		`data: {"data":{"phase":"answer","delta_content":"第一段"}}`,
+		`data: {"data":{"phase":"answer","delta_content":"第二段"}}`,
+		`data: {"data":{"phase":"answer","delta_content":"第三段"}}`,
+	}
+	for _, line := range lines {
+		processUpstreamLine(handler, line)
+	}
+
+	if !handler.IsFinished() || !cancelled {
+		t.Fatalf("达到 max_tokens 后应结束并取消上游请求 (finished=%v, cancelled=%v)", handler.IsFinished(), cancelled)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"content":"第一段"`) || strings.Contains(body, "第二") || strings.Contains(body, "第三") {
+		t.Errorf("输出应在 max_tokens 处截断:\n%s", body)
+	}
+	if !strings.Contains(body, `"finish_reason":"length"`) || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("期望以 finish_reason length 与 [DONE] 结束:\n%s", body)
+	}
+}
+
+// TestGinStreamAggregatorTokenLimit 测试非流式聚合在 max_tokens 处截断
+func TestGinStreamAggregatorTokenLimit(t *testing.T) {
+	a := NewGinStreamAggregator()
+	a.SetTokenLimit("", 1, false)
+
+	lines := []string{
+		`data: {"data":{"phase":"thinking","delta_content":"很长的思考过程"}}`,
+		`data: {"data":{"phase":"answer","delta_content":"回答"}}`,
+		`data: {"data":{"phase":"answer","delta_content":"超出部分"}}`,
+	}
+	if !a.ProcessLine(lines[0]) || !a.ProcessLine(lines[1]) {
+		t.Fatal("未达到上限时应继续聚合")
+	}
+	if a.ProcessLine(lines[2]) {
+		t.Fatal("达到上限后应停止聚合")
+	}
+	a.Finish()
+
+	if got := a.Content.String(); got != "回答" || !a.Truncated {
+		t.Errorf("内容 = %q (Truncated=%v), 期望 %q 且被截断", got, a.Truncated, "回答")
+	}
+}
+
+// thinkingRecorder 记录交给处理器的思考内容与用量统计
+type thinkingRecorder struct {
+	upstreamOutputProbe
+	reasoning strings.Builder
+	tracker   *usageTracker
+}
+
+// ProcessThinkingPhase 按输出时的处理方式记录思考内容
+func (r *thinkingRecorder) ProcessThinkingPhase(data *types.UpstreamData) {
+	r.reasoning.WriteString(processThinkingContent(data.Data.DeltaContent))
+}
+
+// MarkTruncated 截断后结束
+func (r *thinkingRecorder) MarkTruncated() {
+	r.finished = true
+}
+
+// SetUsageTracker 记录用量统计
+func (r *thinkingRecorder) SetUsageTracker(tracker *usageTracker) {
+	r.tracker = tracker
+}
+
+// TestThinkingTokenLimitConsistent 测试思考内容计入 max_tokens 时，流式与非流式响应按处理标签后的文本计数，在同一位置截断并统计相同的思考 token 数
+func TestThinkingTokenLimitConsistent(t *testing.T) {
+	oldConfig := appConfig
+	appConfig = &types.Config{CountReasoningTokens: true}
+	defer func() { appConfig = oldConfig }()
+
+	lines := []string{
+		`data: {"data":{"phase":"thinking","delta_content":"<details type=\"reasoning\" done=\"false\">\n> first step\n> second step"}}`,
+		`data: {"data":{"phase":"thinking","delta_content":"\n> third step\n> fourth step\n> fifth step"}}`,
+		`data: {"data":{"phase":"thinking","delta_content":"\n> sixth step</details>"}}`,
+		`data: {"data":{"phase":"answer","delta_content":"answer"}}`,
+	}
+
+	tests := []struct {
+		limit     int
+		truncated bool
+	}{
+		{16, true},
+		{24, true},
+		{34, true},
+		{100, false},
+	}
+
+	for _, tt := range tests {
+		limit := tt.limit
+		upstreamReq := types.UpstreamRequest{MaxTokens: limit}
+
+		recorder := &thinkingRecorder{}
+		recorder.tools = NewStreamToolCollector("", "")
+		h := withOutputHandling(recorder, upstreamReq, func() {})
+		for _, line := range lines {
+			if !processUpstreamLine(h, line) || h.IsFinished() {
+				break
+			}
+		}
+
+		aggregator := NewGinStreamAggregator()
+		aggregator.SetTokenLimit("", limit, true)
+		for _, line := range lines {
+			if !aggregator.ProcessLine(line) {
+				break
+			}
+		}
+		aggregator.Finish()
+
+		if got, want := recorder.reasoning.String(), aggregator.ReasoningContent.String(); got != want {
+			t.Errorf("max_tokens=%d: 流式思考内容 = %q, 非流式 = %q", limit, got, want)
+		}
+		if recorder.finished != tt.truncated || aggregator.Truncated != tt.truncated {
+			t.Errorf("max_tokens=%d: 截断状态 流式=%v, 非流式=%v, 期望 %v", limit, recorder.finished, aggregator.Truncated, tt.truncated)
+		}
+		streamed := recorder.tracker.Usage().CompletionTokensDetails.ReasoningTokens
+		aggregated := aggregatedUsage(upstreamReq, aggregator).CompletionTokensDetails.ReasoningTokens
+		if streamed != aggregated {
+			t.Errorf("max_tokens=%d: 流式思考 token = %d, 非流式 = %d", limit, streamed, aggregated)
+		}
+	}
+}
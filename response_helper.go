@@ -4,6 +4,7 @@ import (
 	"sort"
 	"strings"
 	"time"
+	"z2api/internal/toolhandler"
 	"z2api/types"
 	"z2api/utils"
 
@@ -131,6 +132,11 @@ func processThinkingContent(content string) string {
 	return content
 }
 
+// thinkingDelta 返回思考增量经过标签处理后的文本，流式与非流式响应统一按此文本计入用量与 max_tokens
+func thinkingDelta(data *types.UpstreamData) string {
+	return processThinkingContent(data.Data.DeltaContent)
+}
+
 // processAnswerContent 处理回答内容中的特殊标签
 func processAnswerContent(content string, editContent string) string {
 	// 优先使用edit_content
@@ -152,6 +158,19 @@ func processAnswerContent(content string, editContent string) string {
 	return content
 }
 
+// thinkTagReplacer 移除思考内容中的 <think> 标签
+var thinkTagReplacer = strings.NewReplacer("<think>", "", "</think>", "")
+
+// stripThinkingMarkup 清理上游思考内容中的 details/summary 标记，仅保留纯文本
+// 用于 Anthropic thinking 块、Responses reasoning 摘要等不需要标签的协议
+func stripThinkingMarkup(s string) string {
+	s = processThinkingContent(s)
+	s = summaryRegex.ReplaceAllString(s, "")
+	s = detailsRegex.ReplaceAllString(s, "")
+	s = thinkingStripReplacer.Replace(s)
+	return thinkTagReplacer.Replace(s)
+}
+
 // ToolCallManager 管理工具调用的状态
 type ToolCallManager struct {
 	calls map[int]*types.ToolCall
@@ -207,3 +226,105 @@ func (m *ToolCallManager) HasCalls() bool {
 func (m *ToolCallManager) Clear() {
 	m.calls = make(map[int]*types.ToolCall)
 }
+
+// StreamToolCollector 从 SSEToolHandler 输出的 OpenAI 格式块中收集工具调用
+// 供需要在结束时统一输出工具调用的非 OpenAI 协议流式处理器使用
+type StreamToolCollector struct {
+	sseToolHandler *toolhandler.SSEToolHandler
+	toolCallMgr    *ToolCallManager // 原生 tool_calls（向后兼容）
+	calls          []types.ToolCall // 按出现顺序记录的工具调用
+	validator      *toolArgsValidator
+}
+
+// NewStreamToolCollector 创建工具调用收集器
+func NewStreamToolCollector(id, model string) *StreamToolCollector {
+	return &StreamToolCollector{
+		sseToolHandler: toolhandler.NewSSEToolHandler(id, model, debugLog),
+		toolCallMgr:    NewToolCallManager(),
+	}
+}
+
+// ProcessToolCallPhase 处理工具调用阶段
+func (tc *StreamToolCollector) ProcessToolCallPhase(data *types.UpstreamData) {
+	tc.collect(tc.sseToolHandler.ProcessToolCallPhase(data))
+
+	if len(data.Data.ToolCalls) > 0 {
+		tc.toolCallMgr.AddToolCalls(data.Data.ToolCalls)
+	}
+}
+
+// ProcessOtherPhase 处理其他阶段
+// handled 表示该数据属于工具调用流程，finished 表示工具调用已结束
+func (tc *StreamToolCollector) ProcessOtherPhase(data *types.UpstreamData) (handled bool, finished bool) {
+	chunks := tc.sseToolHandler.ProcessOtherPhase(data)
+	return len(chunks) > 0, tc.collect(chunks)
+}
+
+// HasCalls 是否收集到工具调用
+func (tc *StreamToolCollector) HasCalls() bool {
+	return len(tc.calls) > 0 || tc.toolCallMgr.HasCalls()
+}
+
+// Calls 返回规范化后的全部工具调用
+func (tc *StreamToolCollector) Calls() []types.ToolCall {
+	for _, call := range tc.toolCallMgr.GetSortedCalls() {
+		tc.upsert(call)
+	}
+	tc.toolCallMgr.Clear()
+	return normalizeToolCalls(tc.calls)
+}
+
+// SetToolValidator 设置输出前使用的参数校验器
+func (tc *StreamToolCollector) SetToolValidator(v *toolArgsValidator) {
+	tc.validator = v
+}
+
+// ValidatedCalls 返回经过参数校验与修复的全部工具调用
+func (tc *StreamToolCollector) ValidatedCalls() ([]types.ToolCall, error) {
+	return tc.validator.Check(tc.Calls())
+}
+
+// AddCalls 添加在流外解析出的工具调用（如工具调用模拟）
+func (tc *StreamToolCollector) AddCalls(calls []types.ToolCall) {
+	for _, call := range calls {
+		tc.upsert(call)
+	}
+}
+
+// collect 解析工具调用块，返回是否包含工具调用完成信号
+func (tc *StreamToolCollector) collect(chunks []string) bool {
+	finished := false
+	for _, chunk := range chunks {
+		var parsed types.OpenAIResponse
+		if err := sonicStream.UnmarshalFromString(strings.TrimPrefix(chunk, "data: "), &parsed); err != nil {
+			debugLog("解析工具调用块失败: %v", err)
+			continue
+		}
+		for _, choice := range parsed.Choices {
+			for _, call := range choice.Delta.ToolCalls {
+				tc.upsert(call)
+			}
+			if choice.FinishReason == "tool_calls" {
+				finished = true
+			}
+		}
+	}
+	return finished
+}
+
+// upsert 按ID合并工具调用，后到的参数覆盖之前的参数（SSEToolHandler 每次发送完整参数）
+func (tc *StreamToolCollector) upsert(call types.ToolCall) {
+	for i := range tc.calls {
+		if tc.calls[i].ID == call.ID {
+			if call.Function.Name != "" {
+				tc.calls[i].Function.Name = call.Function.Name
+			}
+			if call.Function.Arguments != "" {
+				tc.calls[i].Function.Arguments = call.Function.Arguments
+			}
+			return
+		}
+	}
+	call.Index = len(tc.calls)
+	tc.calls = append(tc.calls, call)
+}
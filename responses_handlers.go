@@ -0,0 +1,790 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"z2api/errors"
+	"z2api/types"
+	"z2api/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// GinHandleResponses OpenAI Responses API (/v1/responses)
+// 将 input 项转换为 OpenAI 消息后复用同一条上游管线，输出类型化的 output 项
+func GinHandleResponses(c *gin.Context) {
+	startTime := time.Now()
+
+	// 使用 context 超时控制
+	ctx := c.Request.Context()
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	c.Set("start_time", startTime)
+	c.Set("user_agent", c.GetHeader("User-Agent"))
+	c.Set("debug_mode", appConfig.DebugMode)
+
+	// 更新监控指标
+	totalRequests.Add(1)
+	currentConcurrency.Add(1)
+	defer currentConcurrency.Add(-1)
+
+	if extractAPIKey(c) != appConfig.DefaultKey {
+		utils.ErrorResponse(c, errors.ErrInvalidAPIKey.WithParam("api_key"))
+		recordError(c, startTime, errors.ErrInvalidAPIKey.StatusCode, "invalid_api_key")
+		return
+	}
+
+	var req types.ResponsesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok && len(validationErrors) > 0 {
+			e := validationErrors[0]
+			utils.ValidationErrorWithParam(c, getValidationErrorMessage(e), e.Field())
+			recordError(c, startTime, http.StatusBadRequest, "validation_error")
+			return
+		}
+
+		utils.ErrorResponse(c, errors.ErrInvalidJSON.WithDetails(err.Error()))
+		recordError(c, startTime, http.StatusBadRequest, "invalid_request_error")
+		return
+	}
+
+	debugLog("Responses 请求解析成功 - 模型: %s, 流式: %v", req.Model, req.Stream)
+
+	openAIReq, err := convertResponsesRequest(req)
+	if err != nil {
+		utils.ErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusBadRequest, "validation_error")
+		return
+	}
+
+	modelConfig, err := resolveModelConfig(openAIReq.Model)
+	if err != nil {
+		utils.ErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusNotFound, "model_not_found")
+		return
+	}
+	c.Set("model_name", modelConfig.Name)
+
+	setDefaultParams(&openAIReq, modelConfig)
+
+	if err := validateBusinessRules(&openAIReq); err != nil {
+		utils.ErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusBadRequest, "validation_error")
+		return
+	}
+
+	// 生成会话ID
+	sessionID := openAIReq.User
+	if sessionID == "" {
+		sessionID = c.ClientIP()
+	}
+	c.Set("session_id", sessionID)
+
+	chatID := utils.GenerateChatID()
+	msgID := utils.GenerateMessageID()
+
+	authToken, err := getRequestAuthToken(timeoutCtx, sessionID, openAIReq.Messages)
+	if err != nil {
+		apiErr := errors.WrapError(err)
+		setPoolRetryAfter(c, apiErr)
+		utils.ErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+
+	upstreamReq, err := buildUpstreamRequest(timeoutCtx, openAIReq, chatID, msgID, modelConfig, authToken)
+	if err != nil {
+		apiErr := errors.WrapError(err)
+		utils.ErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+
+	// 显式的 reasoning 配置优先于默认的特性推断
+	if req.Reasoning != nil && req.Reasoning.Effort != "" {
+		upstreamReq.Features["enable_thinking"] = req.Reasoning.Effort != "minimal" && modelConfig.Capabilities.Thinking
+	}
+
+	if req.Stream {
+		handleResponsesStreamResponse(timeoutCtx, c, upstreamReq, req, chatID, authToken, modelConfig.Name, sessionID)
+	} else {
+		handleResponsesNonStreamResponse(timeoutCtx, c, upstreamReq, req, chatID, authToken, modelConfig.Name, sessionID)
+	}
+}
+
+// handleResponsesStreamResponse 以 Responses API 事件格式输出流式响应
+func handleResponsesStreamResponse(ctx context.Context, c *gin.Context, upstreamReq types.UpstreamRequest, req types.ResponsesRequest, chatID string, authToken string, modelName string, sessionID string) {
+	startTime := c.GetTime("start_time")
+	debugLog("开始处理 Responses 流式响应 (chat_id=%s, model=%s)", chatID, upstreamReq.Model)
+
+	body, cancel, err := openValidatedStream(ctx, c, upstreamReq, chatID, authToken, sessionID)
+	if err != nil {
+		apiErr := errors.WrapError(err)
+		utils.ErrorResponse(c, apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+	defer func() {
+		cancel()
+		body.Close()
+	}()
+
+	SetSSEHeaders(c)
+
+	handler := NewResponsesStreamHandler(c, modelName, req)
+	handler.Start()
+
+	if err := streamUpstreamPhases(ctx, c, body, withOutputHandling(handler, upstreamReq, cancel)); err != nil {
+		debugLog("Responses 流式响应处理错误: %v", err)
+		apiErr := errors.WrapError(err)
+		handler.FailStream(apiErr)
+		recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		return
+	}
+
+	recordUsage(c, handler.usage)
+	recordSuccess(c, startTime, modelName, true)
+	debugLog("Responses 流式响应处理完成")
+}
+
+// handleResponsesNonStreamResponse 聚合上游响应并返回 response 对象
+func handleResponsesNonStreamResponse(ctx context.Context, c *gin.Context, upstreamReq types.UpstreamRequest, req types.ResponsesRequest, chatID string, authToken string, modelName string, sessionID string) {
+	startTime := c.GetTime("start_time")
+	debugLog("开始处理 Responses 非流式响应 (chat_id=%s, model=%s)", chatID, upstreamReq.Model)
+
+	aggregator, err := collectUpstreamResponse(ctx, c, upstreamReq, chatID, authToken, sessionID)
+	if err != nil {
+		if apiErr, ok := err.(errors.APIError); ok {
+			utils.ErrorResponse(c, apiErr)
+			recordError(c, startTime, apiErr.StatusCode, apiErr.Type)
+		}
+		return
+	}
+
+	content, reasoningContent, toolCalls, usage := aggregator.GetResult()
+	recordUsage(c, usage)
+
+	output := make([]types.ResponsesOutputItem, 0, 2+len(toolCalls))
+	if reasoning := strings.TrimSpace(stripThinkingMarkup(reasoningContent)); reasoning != "" {
+		output = append(output, newResponsesReasoningItem(generateResponsesItemID("rs"), reasoning))
+	}
+	if content != "" {
+		output = append(output, newResponsesMessageItem(generateResponsesItemID("msg"), content))
+	}
+	for _, call := range normalizeToolCalls(toolCalls) {
+		output = append(output, newResponsesFunctionCallItem(generateResponsesItemID("fc"), call))
+	}
+
+	resp := types.ResponsesResponse{
+		ID:           generateResponsesItemID("resp"),
+		Object:       "response",
+		CreatedAt:    time.Now().Unix(),
+		Status:       "completed",
+		Model:        modelName,
+		Instructions: req.Instructions,
+		Output:       output,
+		Usage:        toResponsesUsage(usage),
+		Metadata:     req.Metadata,
+	}
+	if aggregator.Truncated && len(toolCalls) == 0 {
+		markResponsesIncomplete(&resp)
+	}
+	c.JSON(http.StatusOK, resp)
+
+	recordSuccess(c, startTime, modelName, false)
+	debugLog("Responses 非流式响应完成")
+}
+
+// convertResponsesRequest 将 Responses 请求转换为内部使用的 OpenAI 请求
+func convertResponsesRequest(req types.ResponsesRequest) (types.OpenAIRequest, error) {
+	openAIReq := types.OpenAIRequest{
+		Model:             req.Model,
+		Stream:            req.Stream,
+		Temperature:       req.Temperature,
+		TopP:              req.TopP,
+		MaxTokens:         req.MaxOutputTokens,
+		ParallelToolCalls: req.ParallelToolCalls,
+		User:              req.User,
+		Store:             req.Store,
+	}
+
+	if req.Instructions != "" {
+		openAIReq.Messages = append(openAIReq.Messages, types.Message{Role: "system", Content: req.Instructions})
+	}
+
+	items, err := decodeResponsesInput(req.Input)
+	if err != nil {
+		return openAIReq, errors.NewValidationErrorWithParam("input 格式无效: "+err.Error(), "input")
+	}
+
+	for _, item := range items {
+		switch item.Type {
+		case "", "message":
+			msg, err := convertResponsesMessageItem(item)
+			if err != nil {
+				return openAIReq, err
+			}
+			openAIReq.Messages = append(openAIReq.Messages, msg)
+		case "function_call":
+			call := types.ToolCall{
+				ID:   item.CallID,
+				Type: "function",
+				Function: types.ToolCallFunction{
+					Name:      item.Name,
+					Arguments: item.Arguments,
+				},
+			}
+			// 连续的 function_call 合并到同一条助手消息中
+			last := len(openAIReq.Messages) - 1
+			if last >= 0 && openAIReq.Messages[last].Role == "assistant" && len(openAIReq.Messages[last].ToolCalls) > 0 {
+				call.Index = len(openAIReq.Messages[last].ToolCalls)
+				openAIReq.Messages[last].ToolCalls = append(openAIReq.Messages[last].ToolCalls, call)
+			} else {
+				openAIReq.Messages = append(openAIReq.Messages, types.Message{
+					Role:      "assistant",
+					Content:   "",
+					ToolCalls: []types.ToolCall{call},
+				})
+			}
+		case "function_call_output":
+			openAIReq.Messages = append(openAIReq.Messages, types.Message{
+				Role:       "tool",
+				Content:    responsesOutputText(item.Output),
+				ToolCallID: item.CallID,
+			})
+		default:
+			debugLog("忽略不支持的 Responses 输入项类型: %s", item.Type)
+		}
+	}
+
+	if len(openAIReq.Messages) == 0 {
+		return openAIReq, errors.NewValidationErrorWithParam("input不能为空", "input")
+	}
+
+	for _, tool := range req.Tools {
+		if tool.Type != "function" {
+			debugLog("忽略不支持的 Responses 工具类型: %s", tool.Type)
+			continue
+		}
+		openAIReq.Tools = append(openAIReq.Tools, types.Tool{
+			Type: "function",
+			Function: types.ToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+				Strict:      tool.Strict,
+			},
+		})
+	}
+
+	// tool_choice 对象形式为扁平的 {"type":"function","name":...}
+	switch choice := req.ToolChoice.(type) {
+	case string:
+		openAIReq.ToolChoice = choice
+	case map[string]interface{}:
+		if name, ok := choice["name"].(string); ok && name != "" {
+			openAIReq.ToolChoice = map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": name},
+			}
+		}
+	}
+
+	return openAIReq, nil
+}
+
+// decodeResponsesInput 将 string 或数组形式的 input 解码为输入项
+func decodeResponsesInput(input interface{}) ([]types.ResponsesInputItem, error) {
+	switch v := input.(type) {
+	case string:
+		return []types.ResponsesInputItem{{Type: "message", Role: "user", Content: v}}, nil
+	default:
+		raw, err := sonicInternal.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var items []types.ResponsesInputItem
+		if err := sonicInternal.Unmarshal(raw, &items); err != nil {
+			return nil, err
+		}
+		return items, nil
+	}
+}
+
+// convertResponsesMessageItem 转换 message 输入项，包含图片时保留为多模态内容
+func convertResponsesMessageItem(item types.ResponsesInputItem) (types.Message, error) {
+	role := item.Role
+	if role == "" {
+		role = "user"
+	}
+	msg := types.Message{Role: role}
+
+	if text, ok := item.Content.(string); ok {
+		msg.Content = text
+		return msg, nil
+	}
+
+	raw, err := sonicInternal.Marshal(item.Content)
+	if err != nil {
+		return msg, errors.NewValidationErrorWithParam("content 格式无效: "+err.Error(), "input")
+	}
+	var parts []types.ResponsesContentPart
+	if err := sonicInternal.Unmarshal(raw, &parts); err != nil {
+		return msg, errors.NewValidationErrorWithParam("content 格式无效: "+err.Error(), "input")
+	}
+
+	var contentParts []types.ContentPart
+	hasImage := false
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text", "text":
+			contentParts = append(contentParts, types.ContentPart{Type: "text", Text: part.Text})
+		case "input_image":
+			if part.ImageURL != "" {
+				contentParts = append(contentParts, types.ContentPart{
+					Type:     "image_url",
+					ImageURL: &types.ImageURL{URL: part.ImageURL, Detail: part.Detail},
+				})
+				hasImage = true
+			}
+		default:
+			debugLog("忽略不支持的 Responses 内容类型: %s", part.Type)
+		}
+	}
+
+	if hasImage {
+		msg.Content = contentParts
+		return msg, nil
+	}
+
+	texts := make([]string, 0, len(contentParts))
+	for _, part := range contentParts {
+		texts = append(texts, part.Text)
+	}
+	msg.Content = strings.Join(texts, "\n")
+	return msg, nil
+}
+
+// responsesOutputText 将 function_call_output 的结果转换为文本
+func responsesOutputText(output interface{}) string {
+	switch v := output.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		raw, err := sonicInternal.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(raw)
+	}
+}
+
+// generateResponsesItemID 生成带前缀的 Responses 对象ID（resp、rs、msg、fc）
+func generateResponsesItemID(prefix string) string {
+	return prefix + "_" + strings.ReplaceAll(utils.GenerateUUID(), "-", "")
+}
+
+// toResponsesUsage 转换用量结构
+func toResponsesUsage(usage *types.Usage) *types.ResponsesUsage {
+	if usage == nil {
+		return nil
+	}
+	resp := &types.ResponsesUsage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+		TotalTokens:  usage.TotalTokens,
+	}
+	if usage.CompletionTokensDetails != nil {
+		resp.OutputTokensDetails = &types.ResponsesOutputTokensDetails{ReasoningTokens: usage.CompletionTokensDetails.ReasoningTokens}
+	}
+	return resp
+}
+
+// newResponsesReasoningItem 创建 reasoning 输出项
+func newResponsesReasoningItem(id, text string) types.ResponsesOutputItem {
+	summary := []types.ResponsesSummaryPart{}
+	if text != "" {
+		summary = append(summary, types.ResponsesSummaryPart{Type: "summary_text", Text: text})
+	}
+	return types.ResponsesOutputItem{Type: "reasoning", ID: id, Summary: &summary}
+}
+
+// newResponsesMessageItem 创建 message 输出项
+func newResponsesMessageItem(id, text string) types.ResponsesOutputItem {
+	return types.ResponsesOutputItem{
+		Type:    "message",
+		ID:      id,
+		Status:  "completed",
+		Role:    "assistant",
+		Content: []types.ResponsesContentPart{newResponsesOutputText(text)},
+	}
+}
+
+// newResponsesOutputText 创建 output_text 内容部分
+func newResponsesOutputText(text string) types.ResponsesContentPart {
+	return types.ResponsesContentPart{Type: "output_text", Text: text, Annotations: []interface{}{}}
+}
+
+// newResponsesFunctionCallItem 创建 function_call 输出项
+func newResponsesFunctionCallItem(id string, call types.ToolCall) types.ResponsesOutputItem {
+	arguments := call.Function.Arguments
+	return types.ResponsesOutputItem{
+		Type:      "function_call",
+		ID:        id,
+		Status:    "completed",
+		CallID:    call.ID,
+		Name:      call.Function.Name,
+		Arguments: &arguments,
+	}
+}
+
+// ResponsesStreamHandler 将上游阶段转换为 Responses API 流式事件
+type ResponsesStreamHandler struct {
+	ctx        *gin.Context
+	model      string
+	request    types.ResponsesRequest
+	responseID string
+	createdAt  int64
+	sequence   int
+	output     []types.ResponsesOutputItem // 已完成的输出项
+	tools      *StreamToolCollector        // 工具调用在结束时作为 function_call 项输出
+	usage      *types.Usage
+	openItem   string // 当前打开的输出项类型：reasoning、message，空表示无
+	openItemID string
+	openText   strings.Builder
+	truncated  bool // 输出因 max_output_tokens 被截断
+	tracker    *usageTracker
+	sentFinish bool
+}
+
+// NewResponsesStreamHandler 创建 Responses 流式处理器
+func NewResponsesStreamHandler(c *gin.Context, model string, req types.ResponsesRequest) *ResponsesStreamHandler {
+	responseID := generateResponsesItemID("resp")
+	return &ResponsesStreamHandler{
+		ctx:        c,
+		model:      model,
+		request:    req,
+		responseID: responseID,
+		createdAt:  time.Now().Unix(),
+		tools:      NewStreamToolCollector(responseID, model),
+	}
+}
+
+// snapshot 生成当前状态的 response 对象
+func (h *ResponsesStreamHandler) snapshot(status string) types.ResponsesResponse {
+	output := h.output
+	if output == nil {
+		output = []types.ResponsesOutputItem{}
+	}
+	return types.ResponsesResponse{
+		ID:           h.responseID,
+		Object:       "response",
+		CreatedAt:    h.createdAt,
+		Status:       status,
+		Model:        h.model,
+		Instructions: h.request.Instructions,
+		Output:       output,
+		Usage:        toResponsesUsage(h.usage),
+		Metadata:     h.request.Metadata,
+	}
+}
+
+// Start 发送 response.created 与 response.in_progress 事件
+func (h *ResponsesStreamHandler) Start() {
+	h.writeEvent("response.created", gin.H{"response": h.snapshot("in_progress")})
+	h.writeEvent("response.in_progress", gin.H{"response": h.snapshot("in_progress")})
+}
+
+// writeEvent 写入一个带事件名和序号的 SSE 事件
+func (h *ResponsesStreamHandler) writeEvent(event string, payload gin.H) {
+	payload["type"] = event
+	payload["sequence_number"] = h.sequence
+	h.sequence++
+
+	data, err := sonicStream.Marshal(payload)
+	if err != nil {
+		debugLog("序列化 Responses 事件失败: %v", err)
+		return
+	}
+	h.ctx.Writer.WriteString("event: " + event + "\ndata: " + string(data) + "\n\n")
+	h.ctx.Writer.Flush()
+}
+
+// ensureItem 确保指定类型的输出项处于打开状态，必要时关闭上一个输出项
+func (h *ResponsesStreamHandler) ensureItem(itemType string) {
+	if h.openItem == itemType {
+		return
+	}
+	h.closeItem()
+
+	h.openItem = itemType
+	h.openText.Reset()
+	outputIndex := len(h.output)
+
+	if itemType == "reasoning" {
+		h.openItemID = generateResponsesItemID("rs")
+		h.writeEvent("response.output_item.added", gin.H{
+			"output_index": outputIndex,
+			"item":         newResponsesReasoningItem(h.openItemID, ""),
+		})
+		h.writeEvent("response.reasoning_summary_part.added", gin.H{
+			"item_id":       h.openItemID,
+			"output_index":  outputIndex,
+			"summary_index": 0,
+			"part":          types.ResponsesSummaryPart{Type: "summary_text"},
+		})
+		return
+	}
+
+	h.openItemID = generateResponsesItemID("msg")
+	h.writeEvent("response.output_item.added", gin.H{
+		"output_index": outputIndex,
+		"item": gin.H{
+			"type":    "message",
+			"id":      h.openItemID,
+			"status":  "in_progress",
+			"role":    "assistant",
+			"content": []interface{}{},
+		},
+	})
+	h.writeEvent("response.content_part.added", gin.H{
+		"item_id":       h.openItemID,
+		"output_index":  outputIndex,
+		"content_index": 0,
+		"part":          newResponsesOutputText(""),
+	})
+}
+
+// closeItem 关闭当前打开的输出项
+func (h *ResponsesStreamHandler) closeItem() {
+	if h.openItem == "" {
+		return
+	}
+	outputIndex := len(h.output)
+	text := h.openText.String()
+
+	var item types.ResponsesOutputItem
+	if h.openItem == "reasoning" {
+		h.writeEvent("response.reasoning_summary_text.done", gin.H{
+			"item_id":       h.openItemID,
+			"output_index":  outputIndex,
+			"summary_index": 0,
+			"text":          text,
+		})
+		h.writeEvent("response.reasoning_summary_part.done", gin.H{
+			"item_id":       h.openItemID,
+			"output_index":  outputIndex,
+			"summary_index": 0,
+			"part":          types.ResponsesSummaryPart{Type: "summary_text", Text: text},
+		})
+		item = newResponsesReasoningItem(h.openItemID, text)
+	} else {
+		h.writeEvent("response.output_text.done", gin.H{
+			"item_id":       h.openItemID,
+			"output_index":  outputIndex,
+			"content_index": 0,
+			"text":          text,
+		})
+		h.writeEvent("response.content_part.done", gin.H{
+			"item_id":       h.openItemID,
+			"output_index":  outputIndex,
+			"content_index": 0,
+			"part":          newResponsesOutputText(text),
+		})
+		item = newResponsesMessageItem(h.openItemID, text)
+	}
+
+	h.writeEvent("response.output_item.done", gin.H{
+		"output_index": outputIndex,
+		"item":         item,
+	})
+	h.output = append(h.output, item)
+	h.openItem = ""
+	h.openItemID = ""
+}
+
+// writeDelta 在指定类型的输出项中写入增量
+func (h *ResponsesStreamHandler) writeDelta(itemType string, text string) {
+	if text == "" {
+		return
+	}
+	h.ensureItem(itemType)
+	h.openText.WriteString(text)
+
+	if itemType == "reasoning" {
+		h.writeEvent("response.reasoning_summary_text.delta", gin.H{
+			"item_id":       h.openItemID,
+			"output_index":  len(h.output),
+			"summary_index": 0,
+			"delta":         text,
+		})
+		return
+	}
+
+	h.writeEvent("response.output_text.delta", gin.H{
+		"item_id":       h.openItemID,
+		"output_index":  len(h.output),
+		"content_index": 0,
+		"delta":         text,
+	})
+}
+
+// ProcessThinkingPhase 处理思考阶段，输出推理摘要增量
+func (h *ResponsesStreamHandler) ProcessThinkingPhase(data *types.UpstreamData) {
+	h.writeDelta("reasoning", stripThinkingMarkup(data.Data.DeltaContent))
+}
+
+// ProcessAnswerPhase 处理回答阶段，输出文本增量
+func (h *ResponsesStreamHandler) ProcessAnswerPhase(data *types.UpstreamData) {
+	content := data.Data.DeltaContent
+	if data.Data.EditContent != "" {
+		content = processAnswerContent(data.Data.DeltaContent, data.Data.EditContent)
+	}
+	h.writeDelta("message", content)
+}
+
+// ProcessToolCallPhase 处理工具调用阶段，工具调用在结束时统一输出
+func (h *ResponsesStreamHandler) ProcessToolCallPhase(data *types.UpstreamData) {
+	h.tools.ProcessToolCallPhase(data)
+}
+
+// SetToolValidator 设置输出 function_call 项前使用的参数校验器
+func (h *ResponsesStreamHandler) SetToolValidator(v *toolArgsValidator) {
+	h.tools.SetToolValidator(v)
+}
+
+// EmitToolCalls 记录模拟解析出的工具调用，在结束时输出为 function_call 项
+func (h *ResponsesStreamHandler) EmitToolCalls(calls []types.ToolCall) {
+	h.tools.AddCalls(calls)
+}
+
+// ProcessOtherPhase 处理其他阶段（工具调用结束、用量等）
+func (h *ResponsesStreamHandler) ProcessOtherPhase(data *types.UpstreamData) {
+	if data.Data.Usage.TotalTokens > 0 {
+		usage := data.Data.Usage
+		h.usage = &usage
+	}
+
+	handled, finished := h.tools.ProcessOtherPhase(data)
+	if finished {
+		h.finish()
+		return
+	}
+	if handled {
+		return
+	}
+
+	h.writeDelta("message", data.Data.DeltaContent)
+
+	if data.Data.Phase == "done" || data.Data.Done {
+		h.ProcessDonePhase(data)
+	}
+}
+
+// ProcessDonePhase 处理完成阶段
+func (h *ResponsesStreamHandler) ProcessDonePhase(data *types.UpstreamData) {
+	if data != nil && data.Data.Usage.TotalTokens > 0 {
+		usage := data.Data.Usage
+		h.usage = &usage
+	}
+	h.finish()
+}
+
+// IsFinished 是否已发送 response.completed
+func (h *ResponsesStreamHandler) IsFinished() bool {
+	return h.sentFinish
+}
+
+// MarkTruncated 标记输出因 max_output_tokens 被截断，结束时发送 response.incomplete
+func (h *ResponsesStreamHandler) MarkTruncated() {
+	h.truncated = true
+}
+
+// SetUsageTracker 设置用量统计，结束时以其结果报告 usage
+func (h *ResponsesStreamHandler) SetUsageTracker(tracker *usageTracker) {
+	h.tracker = tracker
+}
+
+// markResponsesIncomplete 将响应标记为因 max_output_tokens 未完成
+func markResponsesIncomplete(resp *types.ResponsesResponse) {
+	resp.Status = "incomplete"
+	resp.IncompleteDetails = &types.ResponsesIncompleteDetails{Reason: "max_output_tokens"}
+}
+
+// FailStream 以 response.failed 事件结束流式响应，用于已开始输出后发生的错误
+func (h *ResponsesStreamHandler) FailStream(apiErr errors.APIError) {
+	if h.sentFinish {
+		return
+	}
+	h.closeItem()
+	failed := h.snapshot("failed")
+	failed.Error = &types.ResponsesError{Code: apiErr.Type, Message: apiErr.Message + ": " + apiErr.Details}
+	h.writeEvent("response.failed", gin.H{"response": failed})
+	h.sentFinish = true
+}
+
+// finish 关闭输出项、输出 function_call 项并发送 response.completed（截断时为 response.incomplete）
+func (h *ResponsesStreamHandler) finish() {
+	if h.sentFinish {
+		return
+	}
+	h.closeItem()
+	if h.tracker != nil {
+		h.usage = h.tracker.Usage()
+	}
+
+	calls, err := h.tools.ValidatedCalls()
+	if err != nil {
+		debugLog("Responses 流式响应工具调用校验失败: %v", err)
+		h.FailStream(errors.WrapError(err))
+		return
+	}
+	for _, call := range calls {
+		itemID := generateResponsesItemID("fc")
+		outputIndex := len(h.output)
+		empty := ""
+
+		added := newResponsesFunctionCallItem(itemID, call)
+		added.Status = "in_progress"
+		added.Arguments = &empty
+		h.writeEvent("response.output_item.added", gin.H{
+			"output_index": outputIndex,
+			"item":         added,
+		})
+		h.writeEvent("response.function_call_arguments.delta", gin.H{
+			"item_id":      itemID,
+			"output_index": outputIndex,
+			"delta":        call.Function.Arguments,
+		})
+		h.writeEvent("response.function_call_arguments.done", gin.H{
+			"item_id":      itemID,
+			"output_index": outputIndex,
+			"arguments":    call.Function.Arguments,
+		})
+
+		item := newResponsesFunctionCallItem(itemID, call)
+		h.writeEvent("response.output_item.done", gin.H{
+			"output_index": outputIndex,
+			"item":         item,
+		})
+		h.output = append(h.output, item)
+	}
+
+	if h.truncated && len(calls) == 0 {
+		incomplete := h.snapshot("incomplete")
+		markResponsesIncomplete(&incomplete)
+		h.writeEvent("response.incomplete", gin.H{"response": incomplete})
+		h.sentFinish = true
+		return
+	}
+	h.writeEvent("response.completed", gin.H{"response": h.snapshot("completed")})
+	h.sentFinish = true
+}
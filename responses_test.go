@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestConvertResponsesRequest 测试 Responses 输入项到 OpenAI 消息的转换
+func TestConvertResponsesRequest(t *testing.T) {
+	req := types.ResponsesRequest{
+		Model:        "glm-4.5",
+		Instructions: "你是一个助手",
+		Input: []interface{}{
+			map[string]interface{}{"role": "user", "content": []interface{}{
+				map[string]interface{}{"type": "input_text", "text": "北京天气如何？"},
+			}},
+			map[string]interface{}{"type": "function_call", "call_id": "call_1", "name": "get_weather", "arguments": `{"city":"北京"}`},
+			map[string]interface{}{"type": "function_call", "call_id": "call_2", "name": "get_time", "arguments": `{}`},
+			map[string]interface{}{"type": "function_call_output", "call_id": "call_1", "output": "晴"},
+		},
+		ToolChoice: map[string]interface{}{"type": "function", "name": "get_weather"},
+		Tools: []types.ResponsesTool{
+			{Type: "function", Name: "get_weather", Parameters: map[string]interface{}{"type": "object"}},
+			{Type: "web_search"},
+		},
+	}
+
+	got, err := convertResponsesRequest(req)
+	if err != nil {
+		t.Fatalf("转换失败: %v", err)
+	}
+
+	wantRoles := []string{"system", "user", "assistant", "tool"}
+	if len(got.Messages) != len(wantRoles) {
+		t.Fatalf("期望 %d 条消息, 实际 %d 条", len(wantRoles), len(got.Messages))
+	}
+	for i, role := range wantRoles {
+		if got.Messages[i].Role != role {
+			t.Errorf("消息 %d 期望角色 %s, 实际 %s", i, role, got.Messages[i].Role)
+		}
+	}
+	if got.Messages[1].Content != "北京天气如何？" {
+		t.Errorf("用户内容转换错误: %v", got.Messages[1].Content)
+	}
+	if len(got.Messages[2].ToolCalls) != 2 {
+		t.Errorf("连续的 function_call 应合并为一条助手消息: %+v", got.Messages[2].ToolCalls)
+	}
+	if got.Messages[3].ToolCallID != "call_1" {
+		t.Errorf("function_call_output 应保留 call_id: %+v", got.Messages[3])
+	}
+	if len(got.Tools) != 1 {
+		t.Errorf("应忽略非 function 工具: %+v", got.Tools)
+	}
+	choice, ok := got.ToolChoice.(map[string]interface{})
+	if !ok || choice["function"].(map[string]interface{})["name"] != "get_weather" {
+		t.Errorf("tool_choice 转换错误: %v", got.ToolChoice)
+	}
+}
+
+// TestResponsesStreamHandlerEvents 测试流式事件类型
+func TestResponsesStreamHandlerEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	handler := NewResponsesStreamHandler(c, "glm-4.5", types.ResponsesRequest{})
+	handler.Start()
+
+	thinking := &types.UpstreamData{}
+	thinking.Data.Phase = "thinking"
+	thinking.Data.DeltaContent = "思考中"
+	dispatchUpstreamPhase(handler, thinking)
+
+	answer := &types.UpstreamData{}
+	answer.Data.Phase = "answer"
+	answer.Data.DeltaContent = "你好"
+	dispatchUpstreamPhase(handler, answer)
+
+	done := &types.UpstreamData{}
+	done.Data.Phase = "done"
+	done.Data.Done = true
+	dispatchUpstreamPhase(handler, done)
+
+	body := w.Body.String()
+	events := []string{
+		"event: response.created",
+		"event: response.reasoning_summary_text.delta",
+		"event: response.output_text.delta",
+		"event: response.output_text.done",
+		"event: response.completed",
+	}
+	last := -1
+	for _, event := range events {
+		idx := strings.Index(body, event)
+		if idx <= last {
+			t.Fatalf("事件 %q 缺失或顺序错误:\n%s", event, body)
+		}
+		last = idx
+	}
+	if len(handler.output) != 2 || handler.output[0].Type != "reasoning" || handler.output[1].Type != "message" {
+		t.Errorf("输出项错误: %+v", handler.output)
+	}
+}
@@ -5,8 +5,18 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	apierrors "z2api/errors"
+	"z2api/internal/breaker"
+	"z2api/internal/tokenpool"
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
 )
 
 // TestIsRetryableError 测试判断错误是否可重试的函数
@@ -356,6 +366,386 @@ func TestIsRetryableErrorWithNetError(t *testing.T) {
 	}
 }
 
+// TestRetryAfterDelay 测试解析 Retry-After 响应头
+func TestRetryAfterDelay(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{"缺失", "", 0},
+		{"秒数", "3", 3 * time.Second},
+		{"负数", "-1", 0},
+		{"HTTP日期", now.Add(5 * time.Second).Format(http.TimeFormat), 5 * time.Second},
+		{"过去的日期", now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"无效值", "soon", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryAfterDelay(tt.header, now); got != tt.want {
+				t.Errorf("retryAfterDelay(%q) = %v, 期望 %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCallUpstreamWithRetry 测试按重试策略调用上游：可重试的状态码与响应体、尝试次数上限与等待预算
+func TestCallUpstreamWithRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		responses    []int
+		body         string
+		retryAfter   string
+		policy       RetryPolicy
+		wantStatus   int
+		wantAttempts int
+	}{
+		{"重试后成功", []int{503, 429, 200}, "", "", RetryPolicy{MaxAttempts: 3, StatusCodes: []int{429, 503}}, 200, 3},
+		{"尝试次数用尽返回最后的响应", []int{503, 503, 503}, "", "", RetryPolicy{MaxAttempts: 2, StatusCodes: []int{503}}, 503, 2},
+		{"不可重试的状态码", []int{404, 200}, "", "", RetryPolicy{MaxAttempts: 3, StatusCodes: []int{503}}, 404, 1},
+		{"响应体匹配时重试", []int{400, 200}, `{"error":"System Busy"}`, "", RetryPolicy{MaxAttempts: 3, BodyPatterns: []string{"system busy"}}, 200, 2},
+		{"Retry-After 超出等待预算", []int{429, 200}, "", "2", RetryPolicy{MaxAttempts: 3, StatusCodes: []int{429}, Budget: time.Second}, 429, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.responses[min(calls, len(tt.responses)-1)]
+				calls++
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(status)
+				w.Write([]byte(tt.body))
+			}))
+			defer upstream.Close()
+
+			oldConfig := appConfig
+			appConfig = &types.Config{UpstreamToken: "upstream-token", UpstreamUrl: upstream.URL + "/api/chat/completions"}
+			defer func() { appConfig = oldConfig }()
+
+			upstreamReq := types.UpstreamRequest{Messages: []types.UpstreamMessage{{Role: "user", Content: "你好"}}}
+			resp, cancel, attempts, _, err := callUpstreamWithRetry(context.Background(), tt.policy, upstreamReq, "chat-1", "upstream-token", "session-1")
+			if err != nil {
+				t.Fatalf("callUpstreamWithRetry() 错误: %v", err)
+			}
+			defer cleanupResponse(resp, cancel)
+
+			if resp.StatusCode != tt.wantStatus || attempts != tt.wantAttempts {
+				t.Errorf("状态码 = %d, 尝试次数 = %d, 期望 %d 与 %d", resp.StatusCode, attempts, tt.wantStatus, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+// TestCallUpstreamWithRetryBreaker 测试熔断器打开后不再请求上游，直接返回 ErrUpstreamUnavailable
+func TestCallUpstreamWithRetryBreaker(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	oldConfig, oldBreakers := appConfig, upstreamBreakers
+	appConfig = &types.Config{UpstreamToken: "upstream-token", UpstreamUrl: upstream.URL + "/api/chat/completions"}
+	upstreamBreakers = breaker.NewGroup(breaker.Config{Window: time.Minute, MinRequests: 2, ErrorRate: 0.5, OpenTimeout: time.Minute, HalfOpenProbes: 1})
+	defer func() { appConfig, upstreamBreakers = oldConfig, oldBreakers }()
+
+	upstreamReq := types.UpstreamRequest{Messages: []types.UpstreamMessage{{Role: "user", Content: "你好"}}}
+	policy := RetryPolicy{MaxAttempts: 5, StatusCodes: []int{http.StatusBadGateway}}
+	_, _, attempts, _, err := callUpstreamWithRetry(context.Background(), policy, upstreamReq, "chat-1", "upstream-token", "session-1")
+
+	var apiErr apierrors.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("熔断后应返回 ErrUpstreamUnavailable, 实际 %v", err)
+	}
+	if calls != 2 || attempts != 2 {
+		t.Errorf("熔断后不应继续请求上游: 上游收到 %d 次请求, 尝试次数 %d, 期望均为 2", calls, attempts)
+	}
+	if status := upstreamBreakerStatuses(); len(status) != 1 || status[0].State != "open" || upstreamAvailability(status) != "unavailable" {
+		t.Errorf("熔断器状态 = %+v, 期望 open", status)
+	}
+}
+
+// TestUpstreamBreakerSharedByAnonTokens 测试不同会话的匿名 token 共用一个熔断器，上游异常时跨会话累计熔断；
+// 配置的账号 token 使用各自的熔断器
+func TestUpstreamBreakerSharedByAnonTokens(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	oldConfig, oldBreakers := appConfig, upstreamBreakers
+	appConfig = &types.Config{UpstreamToken: "account-token", UpstreamUrl: upstream.URL + "/api/chat/completions"}
+	upstreamBreakers = breaker.NewGroup(breaker.Config{Window: time.Minute, MinRequests: 3, ErrorRate: 0.5, OpenTimeout: time.Minute, HalfOpenProbes: 1})
+	defer func() { appConfig, upstreamBreakers = oldConfig, oldBreakers }()
+
+	upstreamReq := types.UpstreamRequest{Messages: []types.UpstreamMessage{{Role: "user", Content: "你好"}}}
+	policy := RetryPolicy{MaxAttempts: 1}
+	// 每个会话各自的匿名 token 只请求一次，单独统计时都达不到熔断下限
+	for _, token := range []string{"anon-alice", "anon-bob", "anon-carol"} {
+		resp, cancel, _, _, _ := callUpstreamWithRetry(context.Background(), policy, upstreamReq, "chat-1", token, token)
+		cleanupResponse(resp, cancel)
+	}
+
+	_, _, _, _, err := callUpstreamWithRetry(context.Background(), policy, upstreamReq, "chat-1", "anon-dave", "anon-dave")
+	var apiErr apierrors.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable || calls != 3 {
+		t.Fatalf("匿名 token 共用的熔断器应已打开: 上游收到 %d 次请求, 错误 %v", calls, err)
+	}
+
+	resp, cancel, _, _, err := callUpstreamWithRetry(context.Background(), policy, upstreamReq, "chat-1", "account-token", "session-1")
+	if err != nil || calls != 4 {
+		t.Fatalf("账号 token 应使用独立的熔断器: 上游收到 %d 次请求, 错误 %v", calls, err)
+	}
+	cleanupResponse(resp, cancel)
+
+	statuses := upstreamBreakerStatuses()
+	if len(statuses) != 2 {
+		t.Fatalf("期望 2 个熔断器（匿名共用 1 个、账号 1 个）, 实际 %+v", statuses)
+	}
+	for _, status := range statuses {
+		if strings.HasSuffix(status.Key, "#anon") != (status.State == "open") {
+			t.Errorf("熔断器 %s 状态 %s, 期望只有匿名共用的熔断器打开", status.Key, status.State)
+		}
+	}
+}
+
+// TestUpstreamBreakerStreamStall 测试 200 响应在响应体关闭时才计入熔断器：
+// 读完的流计为成功，发送响应头后停滞、被看门狗取消的流计为失败并可触发熔断
+func TestUpstreamBreakerStreamStall(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if calls.Add(1) == 1 {
+			w.Write([]byte(`data: {"data":{"phase":"done","done":true}}` + "\n\n"))
+			return
+		}
+		// 发送响应头后不再输出，直到请求被取消
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	oldConfig, oldBreakers, oldTimeouts := appConfig, upstreamBreakers, upstreamStreamTimeouts
+	appConfig = &types.Config{UpstreamToken: "upstream-token", UpstreamUrl: upstream.URL + "/api/chat/completions"}
+	upstreamBreakers = breaker.NewGroup(breaker.Config{Window: time.Minute, MinRequests: 3, ErrorRate: 0.5, OpenTimeout: time.Minute, HalfOpenProbes: 1})
+	upstreamStreamTimeouts = StreamTimeouts{FirstByte: 30 * time.Millisecond}
+	defer func() { appConfig, upstreamBreakers, upstreamStreamTimeouts = oldConfig, oldBreakers, oldTimeouts }()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	upstreamReq := types.UpstreamRequest{Messages: []types.UpstreamMessage{{Role: "user", Content: "你好"}}}
+	tests := []struct {
+		name         string
+		wantErr      bool
+		wantRequests int
+		wantFailures int
+		wantState    string
+	}{
+		{"正常读完", false, 1, 0, "closed"},
+		{"首次停滞", true, 2, 1, "closed"},
+		{"再次停滞", true, 3, 2, "open"},
+	}
+
+	for _, tt := range tests {
+		resp, cancel, err := openUpstreamStream(context.Background(), c, upstreamReq, "chat-1", "upstream-token", "session-1")
+		if err != nil {
+			t.Fatalf("%s: openUpstreamStream() 错误: %v", tt.name, err)
+		}
+		if status := upstreamBreakerStatuses(); len(status) != 1 || status[0].Requests != tt.wantRequests-1 {
+			t.Errorf("%s: 收到响应头时不应计入熔断器, 实际 %+v", tt.name, status)
+		}
+
+		_, err = io.ReadAll(resp.Body)
+		var apiErr apierrors.APIError
+		if stalled := errors.As(err, &apiErr) && apiErr.Type == "upstream_timeout"; stalled != tt.wantErr {
+			t.Errorf("%s: 读取错误 = %v, 期望停滞 %v", tt.name, err, tt.wantErr)
+		}
+		cleanupResponse(resp, cancel)
+
+		// 熔断后窗口内的统计被清空，只比较状态
+		status := upstreamBreakerStatuses()
+		if len(status) != 1 || status[0].State != tt.wantState || (tt.wantState == "closed" && (status[0].Requests != tt.wantRequests || status[0].Failures != tt.wantFailures)) {
+			t.Errorf("%s: 熔断器状态 = %+v, 期望请求 %d 次、失败 %d 次、状态 %s", tt.name, status, tt.wantRequests, tt.wantFailures, tt.wantState)
+		}
+	}
+}
+
+// TestCallUpstreamWithRetryTokenPool 测试池中的 token 收到 429 后进入冷却并换用其他 token 重试，
+// 成功响应关闭后结束进行中计数
+func TestCallUpstreamWithRetryTokenPool(t *testing.T) {
+	var used []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		used = append(used, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") == "Bearer limited-token" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	oldConfig, oldPool := appConfig, upstreamTokenPool
+	appConfig = &types.Config{UpstreamUrl: upstream.URL + "/api/chat/completions"}
+	upstreamTokenPool = tokenpool.New([]string{"limited-token", "healthy-token"}, tokenpool.RoundRobin, time.Minute)
+	defer func() { appConfig, upstreamTokenPool = oldConfig, oldPool }()
+
+	authToken, _ := getAuthToken(context.Background(), "session-1")
+	upstreamReq := types.UpstreamRequest{Messages: []types.UpstreamMessage{{Role: "user", Content: "你好"}}}
+	policy := RetryPolicy{MaxAttempts: 3, StatusCodes: []int{http.StatusTooManyRequests}}
+	resp, cancel, attempts, usedToken, err := callUpstreamWithRetry(context.Background(), policy, upstreamReq, "chat-1", authToken, "session-1")
+	if err != nil {
+		t.Fatalf("callUpstreamWithRetry() 错误: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || attempts != 2 || len(used) != 2 || used[1] != "Bearer healthy-token" || usedToken != "healthy-token" {
+		t.Fatalf("应换用 healthy-token 重试成功: 状态码 %d, 尝试次数 %d, 使用的 token %v", resp.StatusCode, attempts, used)
+	}
+
+	stats := upstreamTokenStats()
+	if stats[0].State != "cooldown" || stats[0].Failures != 1 || stats[1].Successes != 1 || stats[1].InFlight != 1 {
+		t.Errorf("token 统计 = %+v, 期望 limited-token 冷却且 healthy-token 有 1 个进行中的成功请求", stats)
+	}
+	cleanupResponse(resp, cancel)
+	if stats := upstreamTokenStats(); stats[1].InFlight != 0 {
+		t.Errorf("响应关闭后进行中计数应为 0, 实际 %d", stats[1].InFlight)
+	}
+	if token, _ := getAuthToken(context.Background(), "session-1"); token != "healthy-token" {
+		t.Errorf("冷却期间 getAuthToken 应跳过 limited-token, 实际 %s", token)
+	}
+}
+
+// TestCallUpstreamWithRetryTokenPoolFiles 测试请求包含已上传的文件时不换用 token：
+// 429 沿用原 token 重试，401 不再重试
+func TestCallUpstreamWithRetryTokenPoolFiles(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantAttempts int
+	}{
+		{"429 沿用原 token 重试", http.StatusTooManyRequests, 3},
+		{"401 不再重试", http.StatusUnauthorized, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var used []string
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				used = append(used, r.Header.Get("Authorization"))
+				w.WriteHeader(tt.status)
+			}))
+			defer upstream.Close()
+
+			oldConfig, oldPool := appConfig, upstreamTokenPool
+			appConfig = &types.Config{UpstreamUrl: upstream.URL + "/api/chat/completions"}
+			upstreamTokenPool = tokenpool.New([]string{"owner-token", "other-token"}, tokenpool.RoundRobin, time.Minute)
+			defer func() { appConfig, upstreamTokenPool = oldConfig, oldPool }()
+
+			upstreamReq := types.UpstreamRequest{
+				Messages: []types.UpstreamMessage{{Role: "user", Content: "描述这张图片"}},
+				Files:    []types.UpstreamFile{{Type: "image", ID: "file-1"}},
+			}
+			policy := RetryPolicy{MaxAttempts: 3, StatusCodes: []int{http.StatusUnauthorized, http.StatusTooManyRequests}}
+			resp, cancel, attempts, usedToken, _ := callUpstreamWithRetry(context.Background(), policy, upstreamReq, "chat-1", "owner-token", "session-1")
+			if resp != nil {
+				cleanupResponse(resp, cancel)
+			}
+
+			if attempts != tt.wantAttempts || usedToken != "owner-token" {
+				t.Errorf("尝试次数 %d, 最后使用的 token %s, 期望 %d 次且始终使用 owner-token", attempts, usedToken, tt.wantAttempts)
+			}
+			for _, auth := range used {
+				if auth != "Bearer owner-token" {
+					t.Errorf("文件归属于 owner-token，不应换用其他 token, 实际使用 %v", used)
+					break
+				}
+			}
+		})
+	}
+}
+
+// TestOpenUpstreamStreamKeepsSwappedToken 测试同一请求的纠正重试沿用重试中换用的 token，而不是已进入冷却的 token
+func TestOpenUpstreamStreamKeepsSwappedToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var used []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		used = append(used, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") == "Bearer limited-token" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	oldConfig, oldPool, oldPolicy := appConfig, upstreamTokenPool, upstreamRetryPolicy
+	appConfig = &types.Config{UpstreamUrl: upstream.URL + "/api/chat/completions"}
+	upstreamTokenPool = tokenpool.New([]string{"limited-token", "healthy-token"}, tokenpool.RoundRobin, time.Minute)
+	upstreamRetryPolicy = RetryPolicy{MaxAttempts: 3, StatusCodes: []int{http.StatusTooManyRequests}}
+	defer func() { appConfig, upstreamTokenPool, upstreamRetryPolicy = oldConfig, oldPool, oldPolicy }()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	upstreamReq := types.UpstreamRequest{Messages: []types.UpstreamMessage{{Role: "user", Content: "你好"}}}
+	for range 2 {
+		resp, cancel, err := openUpstreamStream(context.Background(), c, upstreamReq, "chat-1", "limited-token", "session-1")
+		if err != nil {
+			t.Fatalf("openUpstreamStream() 错误: %v", err)
+		}
+		cleanupResponse(resp, cancel)
+	}
+
+	if len(used) != 3 || used[2] != "Bearer healthy-token" {
+		t.Errorf("第二次调用应直接使用换用后的 healthy-token, 实际使用 %v", used)
+	}
+}
+
+// TestGetAuthTokenPoolExhausted 测试 token 池全部冷却且未配置回退 token 时返回 503 与 Retry-After，不再以空 token 请求上游
+func TestGetAuthTokenPoolExhausted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oldConfig, oldPool := appConfig, upstreamTokenPool
+	defer func() { appConfig, upstreamTokenPool = oldConfig, oldPool }()
+	upstreamTokenPool = tokenpool.New([]string{"pool-token"}, tokenpool.RoundRobin, time.Minute)
+	upstreamTokenPool.Report("pool-token", false, http.StatusTooManyRequests, 0, 90*time.Second)
+
+	tests := []struct {
+		name      string
+		config    types.Config
+		wantToken string
+	}{
+		{"无回退 token", types.Config{}, ""},
+		{"回退到 UPSTREAM_TOKEN", types.Config{UpstreamToken: "fallback-token"}, "fallback-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appConfig = &tt.config
+			token, err := getAuthToken(context.Background(), "session-1")
+			if tt.wantToken != "" {
+				if err != nil || token != tt.wantToken {
+					t.Errorf("getAuthToken() = %q, %v, 期望 %q", token, err, tt.wantToken)
+				}
+				return
+			}
+
+			apiErr, ok := err.(apierrors.APIError)
+			if !ok || apiErr.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("期望 503 错误, 实际 %q, %v", token, err)
+			}
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			setPoolRetryAfter(c, apiErr)
+			if got := w.Header().Get("Retry-After"); got != "90" {
+				t.Errorf("Retry-After = %q, 期望 90", got)
+			}
+		})
+	}
+}
+
 // BenchmarkIsRetryableError 性能测试
 func BenchmarkIsRetryableError(b *testing.B) {
 	err := errors.New("connection reset")
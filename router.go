@@ -32,7 +32,17 @@ func setupRouter() *gin.Engine {
 	v1 := router.Group("/v1")
 	{
 		v1.GET("/models", GinHandleModels)
+		v1.GET("/models/:id", GinHandleModel)
 		v1.POST("/chat/completions", GinHandleChatCompletions)
+		v1.POST("/completions", GinHandleCompletions)
+		v1.POST("/messages", GinHandleAnthropicMessages)
+		v1.POST("/messages/count_tokens", GinHandleAnthropicCountTokens)
+		v1.POST("/responses", GinHandleResponses)
+		v1.POST("/tokenize", GinHandleTokenize)
+		v1.POST("/files", GinHandleFileUpload)
+		v1.GET("/files", GinHandleListFiles)
+		v1.GET("/files/:id", GinHandleRetrieveFile)
+		v1.DELETE("/files/:id", GinHandleDeleteFile)
 	}
 
 	// 健康检查和监控端点
@@ -56,8 +66,8 @@ func setupCORS() gin.HandlerFunc {
 	config := cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Accept", "X-Request-ID"},
-		ExposeHeaders:    []string{"Content-Length", "X-Request-ID"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Accept", "X-Request-ID", "x-api-key", "anthropic-version", "anthropic-beta"},
+		ExposeHeaders:    []string{"Content-Length", "X-Request-ID", toolChoiceRetriesHeader, structuredOutputRetriesHeader, upstreamAttemptsHeader},
 		AllowCredentials: false,
 		MaxAge:           12 * time.Hour,
 	}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"z2api/errors"
+)
+
+// defaultDeniedCIDRs 默认禁止访问的网段：本机、私有网络、链路本地、运营商NAT、组播及保留地址
+var defaultDeniedCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// FetchPolicy 远程文件获取策略
+type FetchPolicy struct {
+	AllowCIDRs   []*net.IPNet // 允许访问的网段，优先于禁止列表（用于放行内部文件服务器）
+	DenyCIDRs    []*net.IPNet // 禁止访问的网段
+	MaxRedirects int          // 最大重定向次数
+	MaxBodySize  int64        // 响应体大小上限（字节）
+}
+
+// parseCIDRList 解析逗号分隔的 CIDR 列表，单个IP视为 /32 或 /128
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 CIDR %q: %w", item, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// DefaultFetchPolicy 返回默认的获取策略
+func DefaultFetchPolicy() FetchPolicy {
+	deny, _ := parseCIDRList(strings.Join(defaultDeniedCIDRs, ","))
+	return FetchPolicy{
+		DenyCIDRs:    deny,
+		MaxRedirects: 3,
+		MaxBodySize:  20 << 20,
+	}
+}
+
+// checkIP 检查IP是否允许访问，不允许时返回原因
+func (p FetchPolicy) checkIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, allowed := range p.AllowCIDRs {
+		if allowed.Contains(ip) {
+			return ""
+		}
+	}
+	for _, denied := range p.DenyCIDRs {
+		if denied.Contains(ip) {
+			return fmt.Sprintf("地址 %s 属于禁止访问的网段 %s", ip, denied)
+		}
+	}
+	return ""
+}
+
+// blockedFetchError 被策略拦截的获取错误，在连接或重定向阶段产生
+type blockedFetchError struct {
+	apiErr errors.APIError
+}
+
+func (e *blockedFetchError) Error() string {
+	return e.apiErr.Details
+}
+
+// SafeFetcher 防 SSRF 的远程文件获取器
+// 在建立连接时检查 DNS 解析后的实际IP（每次重定向都会重新连接并检查），
+// 同时限制重定向次数与响应体大小，并可要求内容必须为图片
+type SafeFetcher struct {
+	policy FetchPolicy
+	client *http.Client
+}
+
+// NewSafeFetcher 创建防 SSRF 的远程文件获取器
+func NewSafeFetcher(policy FetchPolicy) *SafeFetcher {
+	f := &SafeFetcher{policy: policy}
+
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return &blockedFetchError{errors.ErrURLBlocked.WithDetails(fmt.Sprintf("无法识别的地址 %s", host))}
+			}
+			if reason := policy.checkIP(ip); reason != "" {
+				return &blockedFetchError{errors.ErrURLBlocked.WithDetails(reason)}
+			}
+			return nil
+		},
+	}
+
+	f.client = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:                 nil, // 不经过代理，确保检查的是实际连接的地址
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 15 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > policy.MaxRedirects {
+				return &blockedFetchError{errors.ErrTooManyRedirects.WithDetails(
+					fmt.Sprintf("重定向次数超过上限 %d", policy.MaxRedirects))}
+			}
+			if err := checkFetchURL(req.URL); err != nil {
+				return &blockedFetchError{err.(errors.APIError)}
+			}
+			return nil
+		},
+	}
+	return f
+}
+
+// remoteFetcher 全局远程文件获取器，启动时按配置的策略重新初始化
+var remoteFetcher = NewSafeFetcher(DefaultFetchPolicy())
+
+// checkFetchURL 检查URL的协议与主机
+func checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.ErrURLBlocked.WithDetails(fmt.Sprintf("不支持的协议 %q，仅支持 http 与 https", u.Scheme))
+	}
+	if u.Hostname() == "" {
+		return errors.ErrURLBlocked.WithDetails("URL 缺少主机名")
+	}
+	if u.User != nil {
+		return errors.ErrURLBlocked.WithDetails("URL 不能包含用户信息")
+	}
+	return nil
+}
+
+// FetchResult 远程文件获取结果
+type FetchResult struct {
+	StatusCode int // 200 或 304
+	Header     http.Header
+	Data       []byte
+	FinalURL   *url.URL
+}
+
+// Fetch 获取远程文件。maxBytes 与策略中的上限取较小值；expectImage 为 true 时按内容嗅探拒绝非图片；
+// header 中的条件请求头会原样发送，远端返回 304 时 Data 为空
+func (f *SafeFetcher) Fetch(ctx context.Context, rawURL string, header http.Header, maxBytes int64, expectImage bool) (*FetchResult, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.ErrFileFetchFailed.WithDetails(fmt.Sprintf("无效的文件URL: %v", err))
+	}
+	if err := checkFetchURL(u); err != nil {
+		return nil, err
+	}
+	if maxBytes <= 0 || (f.policy.MaxBodySize > 0 && f.policy.MaxBodySize < maxBytes) {
+		maxBytes = f.policy.MaxBodySize
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.ErrFileFetchFailed.WithDetails(fmt.Sprintf("无效的文件URL: %v", err))
+	}
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		var blocked *blockedFetchError
+		if stderrors.As(err, &blocked) {
+			debugLog("远程文件获取被拦截: %s (%s)", rawURL, blocked.apiErr.Details)
+			return nil, blocked.apiErr
+		}
+		debugLog("下载文件失败: %v", err)
+		return nil, errors.ErrFileFetchFailed.WithDetails(fmt.Sprintf("下载文件失败: %v", err))
+	}
+	defer resp.Body.Close()
+
+	result := &FetchResult{StatusCode: resp.StatusCode, Header: resp.Header, FinalURL: resp.Request.URL}
+	if resp.StatusCode == http.StatusNotModified {
+		return result, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.ErrFileFetchFailed.WithDetails(fmt.Sprintf("下载文件失败，状态码: %d", resp.StatusCode))
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, fileTooLargeError("远程", resp.ContentLength, maxBytes)
+	}
+
+	// 先读取文件头做内容嗅探，避免下载完整的非图片内容
+	head := make([]byte, 512)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, errors.ErrFileFetchFailed.WithDetails(fmt.Sprintf("读取文件数据失败: %v", err))
+	}
+	head = head[:n]
+	if expectImage {
+		sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+		if !strings.HasPrefix(sniffed, "image/") {
+			return nil, errors.ErrUnsupportedFileType.WithDetails(fmt.Sprintf("远程内容不是图片（识别为 %s）", sniffed))
+		}
+	}
+
+	rest, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes-int64(len(head))+1))
+	if err != nil {
+		debugLog("读取文件数据失败: %v", err)
+		return nil, errors.ErrFileFetchFailed.WithDetails(fmt.Sprintf("读取文件数据失败: %v", err))
+	}
+	result.Data = append(head, rest...)
+	if int64(len(result.Data)) > maxBytes {
+		return nil, fileTooLargeError("远程", int64(len(result.Data)), maxBytes)
+	}
+	if len(result.Data) == 0 {
+		return nil, errors.ErrFileFetchFailed.WithDetails("下载的文件为空")
+	}
+	return result, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"z2api/errors"
+)
+
+// newLoopbackFetcher 创建放行本机地址的获取器，用于访问 httptest 服务
+func newLoopbackFetcher(t *testing.T) *SafeFetcher {
+	t.Helper()
+	policy := DefaultFetchPolicy()
+	allow, err := parseCIDRList("127.0.0.1,::1")
+	if err != nil {
+		t.Fatalf("解析 CIDR 失败: %v", err)
+	}
+	policy.AllowCIDRs = allow
+	policy.MaxBodySize = 1 << 10
+	return NewSafeFetcher(policy)
+}
+
+// TestSafeFetcher 测试内网地址拦截、重定向限制、图片嗅探与大小限制
+func TestSafeFetcher(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			w.Write(png)
+		case "/page.html":
+			w.Write([]byte("<html><body>not an image</body></html>"))
+		case "/large.png":
+			w.Write(append(png, bytes.Repeat([]byte{0}, 2<<10)...))
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/internal":
+			http.Redirect(w, r, "http://10.0.0.1/secret", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	fetcher := newLoopbackFetcher(t)
+
+	result, err := fetcher.Fetch(ctx, server.URL+"/image.png", nil, 0, true)
+	if err != nil || !bytes.Equal(result.Data, png) {
+		t.Fatalf("获取图片失败: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		f      *SafeFetcher
+		url    string
+		status int
+	}{
+		{"默认策略拦截本机地址", remoteFetcher, server.URL + "/image.png", http.StatusBadRequest},
+		{"不支持的协议", fetcher, "file:///etc/passwd", http.StatusBadRequest},
+		{"重定向到内网地址", fetcher, server.URL + "/internal", http.StatusBadRequest},
+		{"重定向次数超限", fetcher, server.URL + "/loop", http.StatusBadRequest},
+		{"非图片内容", fetcher, server.URL + "/page.html", http.StatusUnsupportedMediaType},
+		{"超过大小上限", fetcher, server.URL + "/large.png", http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.f.Fetch(ctx, tt.url, nil, 0, true)
+			apiErr, ok := err.(errors.APIError)
+			if !ok {
+				t.Fatalf("期望 APIError，实际 %T: %v", err, err)
+			}
+			if apiErr.StatusCode != tt.status {
+				t.Errorf("状态码 = %d, want %d (%s)", apiErr.StatusCode, tt.status, apiErr.Details)
+			}
+		})
+	}
+}
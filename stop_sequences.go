@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+
+	"z2api/errors"
+)
+
+// maxStopSequences stop 最多允许的停止序列数
+const maxStopSequences = 4
+
+// parseStopSequences 解析 string 或 []string 形式的 stop，忽略空字符串
+func parseStopSequences(stop interface{}) ([]string, error) {
+	var sequences []string
+	switch v := stop.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		sequences = []string{v}
+	case []string:
+		sequences = v
+	case []interface{}:
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, errors.NewValidationErrorWithParam("stop 仅支持字符串或字符串数组", "stop")
+			}
+			sequences = append(sequences, s)
+		}
+	default:
+		return nil, errors.NewValidationErrorWithParam("stop 仅支持字符串或字符串数组", "stop")
+	}
+
+	if len(sequences) > maxStopSequences {
+		return nil, errors.NewValidationErrorWithParam("stop 最多支持 4 个停止序列", "stop")
+	}
+	result := make([]string, 0, len(sequences))
+	for _, s := range sequences {
+		if s != "" {
+			result = append(result, s)
+		}
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return result, nil
+}
+
+// stopSequenceMatcher 在流式文本中查找停止序列，停止序列可能被拆分到多段文本中
+type stopSequenceMatcher struct {
+	sequences []string
+	pending   string // 末尾可能是停止序列开头的文本，等待后续文本确认
+	matched   string // 已匹配的停止序列
+}
+
+// newStopSequenceMatcher 创建停止序列匹配器，没有停止序列时返回 nil
+func newStopSequenceMatcher(sequences []string) *stopSequenceMatcher {
+	if len(sequences) == 0 {
+		return nil
+	}
+	return &stopSequenceMatcher{sequences: sequences}
+}
+
+// Feed 输入一段文本，返回可以立即输出的文本；匹配到停止序列时返回匹配位置之前的文本与 true，之后的输入全部丢弃
+func (m *stopSequenceMatcher) Feed(text string) (string, bool) {
+	if m.matched != "" {
+		return "", true
+	}
+	buf := m.pending + text
+
+	index := -1
+	for _, seq := range m.sequences {
+		if i := strings.Index(buf, seq); i >= 0 && (index < 0 || i < index) {
+			index = i
+			m.matched = seq
+		}
+	}
+	if index >= 0 {
+		m.pending = ""
+		return buf[:index], true
+	}
+
+	hold := m.partialSuffix(buf)
+	m.pending = buf[len(buf)-hold:]
+	return buf[:len(buf)-hold], false
+}
+
+// partialSuffix 返回文本末尾可能是某个停止序列开头的最长长度
+func (m *stopSequenceMatcher) partialSuffix(buf string) int {
+	longest := 0
+	for _, seq := range m.sequences {
+		for n := min(len(seq)-1, len(buf)); n > longest; n-- {
+			if strings.HasSuffix(buf, seq[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// Flush 文本结束时返回暂存的文本
+func (m *stopSequenceMatcher) Flush() string {
+	pending := m.pending
+	m.pending = ""
+	return pending
+}
+
+// Matched 返回已匹配的停止序列，未匹配时返回空字符串
+func (m *stopSequenceMatcher) Matched() string {
+	return m.matched
+}
+
+// stopSequenceTarget 由需要报告匹配到的停止序列的流式处理器实现（如 Anthropic 的 stop_sequence）
+type stopSequenceTarget interface {
+	SetStopSequence(sequence string)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestStopSequenceMatcher 测试停止序列被拆分到多段文本中时的匹配
+func TestStopSequenceMatcher(t *testing.T) {
+	tests := []struct {
+		name      string
+		sequences []string
+		chunks    []string
+		want      string
+		matched   string
+	}{
+		{"未匹配", []string{"###"}, []string{"a#b", "#c"}, "a#b#c", ""},
+		{"单段内匹配", []string{"###"}, []string{"答案###后续"}, "答案", "###"},
+		{"跨段匹配", []string{"\n\nQ:"}, []string{"答案\n", "\nQ", ":下一个问题"}, "答案", "\n\nQ:"},
+		{"末尾部分匹配后不匹配", []string{"END"}, []string{"THE EN", "TRY"}, "THE ENTRY", ""},
+		{"匹配后丢弃后续文本", []string{"END"}, []string{"THE EN", "D", "ING"}, "THE ", "END"},
+		{"取最早的匹配", []string{"b", "abc"}, []string{"xab", "c"}, "xa", "b"},
+		{"多字节字符", []string{"结束"}, []string{"回答结", "果。结", "束了"}, "回答结果。", "结束"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newStopSequenceMatcher(tt.sequences)
+			var sb strings.Builder
+			for _, chunk := range tt.chunks {
+				text, _ := m.Feed(chunk)
+				sb.WriteString(text)
+			}
+			sb.WriteString(m.Flush())
+			if got := sb.String(); got != tt.want {
+				t.Errorf("输出 = %q, 期望 %q", got, tt.want)
+			}
+			if m.Matched() != tt.matched {
+				t.Errorf("匹配 = %q, 期望 %q", m.Matched(), tt.matched)
+			}
+		})
+	}
+}
+
+// TestStopSequenceHandler 测试流式响应在停止序列处截断、以 stop 结束并取消上游请求
+func TestStopSequenceHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	cancelled := false
+	upstreamReq := types.UpstreamRequest{StopSequences: []string{"\nQ:"}}
+	handler := withOutputHandling(NewGinStreamHandler(c, "glm-4.5"), upstreamReq, func() { cancelled = true })
+
+	lines := []string{
+		`data: {"data":{"phase":"answer","delta_content":"A: 42\n"}}`,
+		`data: {"data":{"phase":"answer","delta_content":"Q: 下一个"}}`,
+		`data: {"data":{"phase":"answer","delta_content":"不应输出"}}`,
+	}
+	for _, line := range lines {
+		processUpstreamLine(handler, line)
+	}
+
+	if !handler.IsFinished() || !cancelled {
+		t.Fatalf("匹配停止序列后应结束并取消上游请求 (finished=%v, cancelled=%v)", handler.IsFinished(), cancelled)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"content":"A: 42"`) || strings.Contains(body, "Q:") || strings.Contains(body, "不应输出") {
+		t.Errorf("输出应在停止序列前截断:\n%s", body)
+	}
+	if !strings.Contains(body, `"finish_reason":"stop"`) || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("期望以 finish_reason stop 与 [DONE] 结束:\n%s", body)
+	}
+}
+
+// TestGinStreamAggregatorStopSequences 测试非流式聚合在停止序列处截断
+func TestGinStreamAggregatorStopSequences(t *testing.T) {
+	a := NewGinStreamAggregator()
+	a.SetStopSequences([]string{"###"})
+
+	lines := []string{
+		`data: {"data":{"phase":"answer","delta_content":"第一部分#"}}`,
+		`data: {"data":{"phase":"answer","delta_content":"## 第二部分"}}`,
+	}
+	if !a.ProcessLine(lines[0]) {
+		t.Fatal("未匹配时应继续聚合")
+	}
+	if a.ProcessLine(lines[1]) {
+		t.Fatal("匹配停止序列后应停止聚合")
+	}
+	a.Finish()
+
+	if got := a.Content.String(); got != "第一部分" {
+		t.Errorf("内容 = %q, 期望 %q", got, "第一部分")
+	}
+	if a.StopSequence != "###" {
+		t.Errorf("StopSequence = %q, 期望 ###", a.StopSequence)
+	}
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"strings"
 	"time"
 
+	"z2api/errors"
 	"z2api/internal/toolhandler"
 	"z2api/types"
+	"z2api/utils"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,7 +22,12 @@ type GinStreamHandler struct {
 	model           string
 	toolCallMgr     *ToolCallManager
 	sseToolHandler  *toolhandler.SSEToolHandler // 新增：SSE工具处理器
+	deferredTools   *StreamToolCollector        // 需要校验参数时，工具调用在结束时统一输出
 	inThinkingPhase bool
+	truncated       bool          // 输出因 max_tokens 被截断
+	usageTracker    *usageTracker // 统计输出用量，上游未返回 usage 时据此估算
+	upstreamUsage   *types.Usage  // 上游在流中返回的 usage
+	includeUsage    bool          // 结束前输出 usage 块（stream_options.include_usage）
 	sentFinish      bool
 }
 
@@ -89,18 +97,33 @@ func (h *GinStreamHandler) ProcessAnswerPhase(data *types.UpstreamData) {
 	}
 }
 
+// SetToolValidator 设置参数校验器，工具调用改为在结束时校验后统一输出
+func (h *GinStreamHandler) SetToolValidator(v *toolArgsValidator) {
+	if v == nil {
+		h.deferredTools = nil
+		return
+	}
+	h.deferredTools = NewStreamToolCollector(h.ctx.GetString("RequestID"), h.model)
+	h.deferredTools.SetToolValidator(v)
+}
+
 // ProcessToolCallPhase 处理工具调用阶段
 func (h *GinStreamHandler) ProcessToolCallPhase(data *types.UpstreamData) {
-	// 使用新的SSEToolHandler处理工具调用
-	chunks := h.sseToolHandler.ProcessToolCallPhase(data)
-	for _, chunk := range chunks {
-		h.ctx.Writer.WriteString(chunk + "\n\n")
-		h.ctx.Writer.Flush()
-	}
+	h.observeUsage(data)
+	if h.deferredTools != nil {
+		h.deferredTools.ProcessToolCallPhase(data)
+	} else {
+		// 使用新的SSEToolHandler处理工具调用
+		chunks := h.sseToolHandler.ProcessToolCallPhase(data)
+		for _, chunk := range chunks {
+			h.ctx.Writer.WriteString(chunk + "\n\n")
+			h.ctx.Writer.Flush()
+		}
 
-	// 如果有原生的tool_calls（向后兼容）
-	if len(data.Data.ToolCalls) > 0 {
-		h.toolCallMgr.AddToolCalls(data.Data.ToolCalls)
+		// 如果有原生的tool_calls（向后兼容）
+		if len(data.Data.ToolCalls) > 0 {
+			h.toolCallMgr.AddToolCalls(data.Data.ToolCalls)
+		}
 	}
 
 	// 处理工具调用相关的文本内容
@@ -114,6 +137,21 @@ func (h *GinStreamHandler) ProcessToolCallPhase(data *types.UpstreamData) {
 
 // ProcessOtherPhase 处理其他阶段
 func (h *GinStreamHandler) ProcessOtherPhase(data *types.UpstreamData) {
+	h.observeUsage(data)
+	if h.deferredTools != nil {
+		handled, finished := h.deferredTools.ProcessOtherPhase(data)
+		if finished {
+			h.finishDeferredTools(data)
+			return
+		}
+		if handled {
+			return
+		}
+		if (data.Data.Phase == "done" || data.Data.Done) && !h.flushDeferredTools() {
+			return
+		}
+	}
+
 	// 使用新的SSEToolHandler处理other阶段（可能包含工具调用结束信号）
 	chunks := h.sseToolHandler.ProcessOtherPhase(data)
 	hasToolFinish := false
@@ -126,9 +164,9 @@ func (h *GinStreamHandler) ProcessOtherPhase(data *types.UpstreamData) {
 		}
 	}
 
-	// 如果SSEToolHandler已经处理了工具调用结束，标记为已完成
+	// 如果SSEToolHandler已经处理了工具调用结束，结束响应流
 	if hasToolFinish {
-		h.sentFinish = true
+		h.finishStream()
 		return
 	}
 
@@ -141,8 +179,8 @@ func (h *GinStreamHandler) ProcessOtherPhase(data *types.UpstreamData) {
 	content := data.Data.DeltaContent
 	var usage *types.Usage
 
-	// 提取使用统计
-	if data.Data.Usage.TotalTokens > 0 {
+	// 提取使用统计，客户端要求单独的 usage 块时只在结束前输出
+	if data.Data.Usage.TotalTokens > 0 && !h.includeUsage {
 		usage = &data.Data.Usage
 	}
 
@@ -163,8 +201,140 @@ func (h *GinStreamHandler) ProcessOtherPhase(data *types.UpstreamData) {
 	}
 }
 
+// EmitToolCalls 输出模拟解析出的工具调用
+func (h *GinStreamHandler) EmitToolCalls(calls []types.ToolCall) {
+	if h.deferredTools != nil {
+		h.deferredTools.AddCalls(calls)
+		return
+	}
+	h.toolCallMgr.AddToolCalls(calls)
+	chunk := createToolCallChunk(calls, h.model, "")
+	if jsonData, err := sonicStream.Marshal(chunk); err == nil {
+		h.WriteSSEData(string(jsonData))
+	}
+}
+
+// MarkTruncated 标记输出因 max_tokens 被截断，结束原因为 length
+func (h *GinStreamHandler) MarkTruncated() {
+	h.truncated = true
+}
+
+// SetUsageTracker 设置用量统计
+func (h *GinStreamHandler) SetUsageTracker(tracker *usageTracker) {
+	h.usageTracker = tracker
+}
+
+// SetIncludeUsage 设置是否在 [DONE] 之前输出 usage 块
+func (h *GinStreamHandler) SetIncludeUsage(include bool) {
+	h.includeUsage = include
+}
+
+// observeUsage 记录上游在流中返回的 usage
+func (h *GinStreamHandler) observeUsage(data *types.UpstreamData) {
+	if data != nil && data.Data.Usage.TotalTokens > 0 {
+		usage := data.Data.Usage
+		h.upstreamUsage = &usage
+	}
+}
+
+// Usage 返回本次响应的用量：优先使用上游返回的 usage，未返回时使用本地估算值；
+// 未设置用量统计时只返回上游的 usage，可能为 nil
+func (h *GinStreamHandler) Usage() *types.Usage {
+	upstream := h.upstreamUsage
+	if upstream == nil {
+		upstream = h.sseToolHandler.Usage()
+	}
+	if h.usageTracker == nil {
+		return upstream
+	}
+	h.usageTracker.Observe(upstream)
+	return h.usageTracker.Usage()
+}
+
+// finishStream 结束响应流：按需输出 choices 为空的 usage 块，然后发送 [DONE]
+func (h *GinStreamHandler) finishStream() {
+	if h.includeUsage {
+		if usage := h.Usage(); usage != nil {
+			chunk := types.OpenAIResponse{
+				ID:      utils.GenerateChatCompletionID(),
+				Object:  "chat.completion.chunk",
+				Created: time.Now().Unix(),
+				Model:   h.model,
+				Choices: []types.Choice{},
+				Usage:   usage,
+			}
+			if jsonData, err := sonicStream.Marshal(chunk); err == nil {
+				h.WriteSSEData(string(jsonData))
+			}
+		}
+	}
+
+	h.WriteSSEData("[DONE]")
+	h.sentFinish = true
+}
+
+// flushDeferredTools 校验并输出暂存的工具调用。校验失败时输出错误并结束流，返回 false
+func (h *GinStreamHandler) flushDeferredTools() bool {
+	if h.deferredTools == nil || !h.deferredTools.HasCalls() {
+		return true
+	}
+
+	calls, err := h.deferredTools.ValidatedCalls()
+	h.deferredTools = NewStreamToolCollector(h.ctx.GetString("RequestID"), h.model)
+	if err != nil {
+		debugLog("流式响应工具调用校验失败: %v", err)
+		h.FailStream(errors.WrapError(err))
+		return false
+	}
+
+	h.toolCallMgr.AddToolCalls(calls)
+	chunk := createToolCallChunk(calls, h.model, "")
+	if jsonData, err := sonicStream.Marshal(chunk); err == nil {
+		h.WriteSSEData(string(jsonData))
+	}
+	return true
+}
+
+// finishDeferredTools 上游工具调用结束时输出校验后的工具调用与结束块
+func (h *GinStreamHandler) finishDeferredTools(data *types.UpstreamData) {
+	if !h.flushDeferredTools() {
+		return
+	}
+
+	var usage *types.Usage
+	if data.Data.Usage.TotalTokens > 0 && !h.includeUsage {
+		usage = &data.Data.Usage
+	}
+	finishChunk := createChatCompletionChunk("", h.model, PhaseDone, usage, "tool_calls")
+	if jsonData, err := sonicStream.Marshal(finishChunk); err == nil {
+		h.WriteSSEData(string(jsonData))
+	}
+	h.finishStream()
+}
+
 // ProcessPhase 根据阶段处理数据
 func (h *GinStreamHandler) ProcessPhase(data *types.UpstreamData) {
+	dispatchUpstreamPhase(h, data)
+}
+
+// IsFinished 是否已发送结束信号
+func (h *GinStreamHandler) IsFinished() bool {
+	return h.sentFinish
+}
+
+// upstreamPhaseHandler 上游SSE阶段处理接口
+// 不同的下游协议（OpenAI、Anthropic等）各自实现，共享同一套阶段分发逻辑
+type upstreamPhaseHandler interface {
+	ProcessThinkingPhase(data *types.UpstreamData)
+	ProcessAnswerPhase(data *types.UpstreamData)
+	ProcessToolCallPhase(data *types.UpstreamData)
+	ProcessOtherPhase(data *types.UpstreamData)
+	ProcessDonePhase(data *types.UpstreamData)
+	IsFinished() bool
+}
+
+// dispatchUpstreamPhase 根据上游阶段分发数据到对应的处理方法
+func dispatchUpstreamPhase(h upstreamPhaseHandler, data *types.UpstreamData) {
 	if data == nil {
 		return
 	}
@@ -188,11 +358,45 @@ func (h *GinStreamHandler) ProcessPhase(data *types.UpstreamData) {
 	}
 }
 
+// withOutputHandling 为流式阶段处理器启用输出侧处理：参数校验、response_format、工具调用模拟、tool_choice、用量统计、停止序列与 max_tokens。
+// response_format 与 tool_choice 处理位于工具调用模拟之内，只处理分离工具调用后的回答文本，tool_choice 为 none 时模拟解析出的工具调用也会被丢弃；
+// 停止序列与 max_tokens 位于最外层，只有未被截断的原始回答才会交给其他处理并计入用量，截断后调用 cancel 提前结束上游请求
+func withOutputHandling(h upstreamPhaseHandler, upstreamReq types.UpstreamRequest, cancel context.CancelFunc) upstreamPhaseHandler {
+	if target, ok := h.(toolValidationTarget); ok {
+		target.SetToolValidator(requestToolValidator(upstreamReq))
+	}
+	tracker := newUsageTracker(upstreamReq)
+	if target, ok := h.(usageTarget); ok {
+		target.SetUsageTracker(tracker)
+	}
+	raw := h
+
+	h = withStructuredOutput(h, upstreamReq)
+	h = withToolEmulation(withToolChoice(h, upstreamReq), upstreamReq)
+	return withOutputLimits(withUsageTracking(h, tracker), raw, upstreamReq, cancel)
+}
+
+// FailStream 以错误块结束流式响应，用于已开始输出后发生的错误
+func (h *GinStreamHandler) FailStream(apiErr errors.APIError) {
+	if h.sentFinish {
+		return
+	}
+	if jsonData, err := sonicStream.Marshal(utils.ErrorBody(apiErr, h.ctx.GetBool("debug_mode"))); err == nil {
+		h.WriteSSEData(string(jsonData))
+	}
+	h.WriteSSEData("[DONE]")
+	h.sentFinish = true
+}
+
 // ProcessDonePhase 处理完成阶段
 func (h *GinStreamHandler) ProcessDonePhase(data *types.UpstreamData) {
 	if h.sentFinish {
 		return
 	}
+	h.observeUsage(data)
+	if !h.flushDeferredTools() {
+		return
+	}
 
 	// 如果在思考阶段结束，不再单独发送闭合标签
 	// 闭合标签应该已经在思考内容中包含
@@ -204,6 +408,8 @@ func (h *GinStreamHandler) ProcessDonePhase(data *types.UpstreamData) {
 	finishReason := "stop"
 	if h.toolCallMgr.HasCalls() {
 		finishReason = "tool_calls"
+	} else if h.truncated {
+		finishReason = "length"
 	}
 
 	finishChunk := createChatCompletionChunk("", h.model, PhaseDone, nil, finishReason)
@@ -212,8 +418,7 @@ func (h *GinStreamHandler) ProcessDonePhase(data *types.UpstreamData) {
 	}
 
 	// 发送最终的[DONE]信号
-	h.WriteSSEData("[DONE]")
-	h.sentFinish = true
+	h.finishStream()
 }
 
 // HandleGinStreamResponse 使用 Gin Context 处理完整的流式响应
@@ -305,6 +510,11 @@ type GinStreamAggregator struct {
 	Usage            *types.Usage
 	Error            error
 	ErrorDetail      string
+	StopSequence     string // 匹配到的停止序列
+	Truncated        bool   // 输出因 max_tokens 被截断
+	Phase            string // 最近一个上游事件所处的阶段
+	stopMatcher      *stopSequenceMatcher
+	budget           *tokenBudget
 }
 
 // NewGinStreamAggregator 创建 Gin 流聚合器
@@ -335,27 +545,32 @@ func (a *GinStreamAggregator) ProcessLine(line string) bool {
 		}
 
 		// 根据阶段聚合数据
+		a.Phase = upstreamData.Data.Phase
 		switch upstreamData.Data.Phase {
 		case "thinking":
 			if upstreamData.Data.DeltaContent != "" {
-				content := processThinkingContent(upstreamData.Data.DeltaContent)
+				content, exceeded := a.budget.Reasoning(thinkingDelta(&upstreamData))
 				a.ReasoningContent.WriteString(content)
+				if exceeded {
+					a.markTruncated()
+					return false
+				}
 			}
 		case "answer":
 			content := upstreamData.Data.DeltaContent
 			if upstreamData.Data.EditContent != "" {
 				content = processAnswerContent(content, upstreamData.Data.EditContent)
 			}
-			if content != "" {
-				a.Content.WriteString(content)
+			if content != "" && !a.writeContent(content) {
+				return false
 			}
 		case "tool_call":
 			if len(upstreamData.Data.ToolCalls) > 0 {
 				a.ToolCallMgr.AddToolCalls(upstreamData.Data.ToolCalls)
 			}
 		case "other":
-			if upstreamData.Data.DeltaContent != "" {
-				a.Content.WriteString(upstreamData.Data.DeltaContent)
+			if upstreamData.Data.DeltaContent != "" && !a.writeContent(upstreamData.Data.DeltaContent) {
+				return false
 			}
 			if upstreamData.Data.Usage.TotalTokens > 0 {
 				a.Usage = &upstreamData.Data.Usage
@@ -374,6 +589,66 @@ func (a *GinStreamAggregator) ProcessLine(line string) bool {
 	return true // 继续处理
 }
 
+// SetStopSequences 设置停止序列，回答中匹配到停止序列时截断并结束聚合
+func (a *GinStreamAggregator) SetStopSequences(sequences []string) {
+	a.stopMatcher = newStopSequenceMatcher(sequences)
+}
+
+// SetTokenLimit 设置最大输出 token 数，输出达到上限时截断并结束聚合；includeReasoning 为 true 时思考内容计入上限
+func (a *GinStreamAggregator) SetTokenLimit(model string, limit int, includeReasoning bool) {
+	a.budget = newTokenBudget(model, limit, includeReasoning)
+}
+
+// writeContent 追加回答文本，匹配到停止序列或达到 token 上限时返回 false
+func (a *GinStreamAggregator) writeContent(content string) bool {
+	if a.stopMatcher == nil {
+		return a.appendContent(content)
+	}
+	text, matched := a.stopMatcher.Feed(content)
+	if !a.appendContent(text) {
+		return false
+	}
+	if matched {
+		a.StopSequence = a.stopMatcher.Matched()
+		debugLog("匹配到停止序列 %q，停止聚合", a.StopSequence)
+	}
+	return !matched
+}
+
+// appendContent 计入 token 后追加回答文本，达到 token 上限时截断并返回 false
+func (a *GinStreamAggregator) appendContent(text string) bool {
+	text, exceeded := a.budget.Completion(text)
+	a.Content.WriteString(text)
+	if exceeded {
+		a.markTruncated()
+	}
+	return !exceeded
+}
+
+// markTruncated 标记输出因 max_tokens 被截断
+func (a *GinStreamAggregator) markTruncated() {
+	a.Truncated = true
+	debugLog("输出达到 max_tokens 上限 %d，停止聚合", a.budget.limit)
+}
+
+// Finish 聚合结束时写入停止序列匹配暂存的文本
+func (a *GinStreamAggregator) Finish() {
+	if a.stopMatcher != nil && !a.Truncated {
+		a.appendContent(a.stopMatcher.Flush())
+	}
+}
+
+// ApplyToolEmulation 从聚合的回答文本中分离模拟的工具调用
+func (a *GinStreamAggregator) ApplyToolEmulation(tools []types.Tool) {
+	cleaned, calls := extractEmulatedToolCalls(a.Content.String(), tools)
+	if len(calls) == 0 {
+		return
+	}
+	a.Content.Reset()
+	a.Content.WriteString(cleaned)
+	a.ToolCallMgr.AddToolCalls(calls)
+}
+
 // GetResult 获取聚合结果
 func (a *GinStreamAggregator) GetResult() (string, string, []types.ToolCall, *types.Usage) {
 	// 修复未闭合的think标签
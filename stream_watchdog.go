@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"z2api/errors"
+	"z2api/types"
+)
+
+// StreamTimeouts 上游流的分阶段超时，0 表示不限制
+// 上游发送响应头后停止输出时，请求不再占用并发名额直到整体超时，而是按以下限制提前结束
+type StreamTimeouts struct {
+	FirstByte time.Duration // 收到响应头后等待第一个字节的上限
+	Idle      time.Duration // 相邻两次收到数据的最大间隔
+	Thinking  time.Duration // 思考阶段的最长持续时间
+}
+
+// DefaultStreamTimeouts 返回默认的上游流超时
+func DefaultStreamTimeouts() StreamTimeouts {
+	return StreamTimeouts{
+		FirstByte: 60 * time.Second,
+		Idle:      60 * time.Second,
+		Thinking:  3 * time.Minute,
+	}
+}
+
+// upstreamStreamTimeouts 全局上游流超时，启动时按配置重新初始化
+var upstreamStreamTimeouts = DefaultStreamTimeouts()
+
+// streamWatchdog 监视上游流的活动，超过限制时取消上游请求并记录原因
+// 收到数据只更新时间，由定时器触发时重新计算截止时间，避免每次读取都重置定时器
+type streamWatchdog struct {
+	mu            sync.Mutex
+	timeouts      StreamTimeouts
+	cancel        context.CancelFunc
+	timer         *time.Timer
+	start         time.Time
+	lastActivity  time.Time // 最近一次收到数据的时间，零值表示尚未收到数据
+	thinkingSince time.Time // 进入思考阶段的时间，零值表示不在思考阶段
+	err           error
+	stopped       bool
+}
+
+// newStreamWatchdog 创建并启动看门狗，超过限制时调用 cancel 取消上游请求
+func newStreamWatchdog(timeouts StreamTimeouts, cancel context.CancelFunc) *streamWatchdog {
+	w := &streamWatchdog{timeouts: timeouts, cancel: cancel, start: time.Now()}
+	w.mu.Lock()
+	w.armLocked(w.start)
+	w.mu.Unlock()
+	return w
+}
+
+// deadlineLocked 返回最近的截止时间与超过时报告的错误，零值表示不限制
+func (w *streamWatchdog) deadlineLocked() (time.Time, error) {
+	var deadline time.Time
+	var err error
+	if w.lastActivity.IsZero() {
+		if w.timeouts.FirstByte > 0 {
+			deadline = w.start.Add(w.timeouts.FirstByte)
+			err = errors.ErrUpstreamStalled.WithDetails(fmt.Sprintf("上游在 %v 内未返回任何数据", w.timeouts.FirstByte))
+		}
+	} else if w.timeouts.Idle > 0 {
+		deadline = w.lastActivity.Add(w.timeouts.Idle)
+		err = errors.ErrUpstreamStalled.WithDetails(fmt.Sprintf("上游超过 %v 未返回新数据", w.timeouts.Idle))
+	}
+	if w.timeouts.Thinking > 0 && !w.thinkingSince.IsZero() {
+		if t := w.thinkingSince.Add(w.timeouts.Thinking); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+			err = errors.ErrUpstreamStalled.WithDetails(fmt.Sprintf("思考阶段超过 %v", w.timeouts.Thinking))
+		}
+	}
+	return deadline, err
+}
+
+// armLocked 按最近的截止时间设置定时器
+func (w *streamWatchdog) armLocked(now time.Time) {
+	deadline, _ := w.deadlineLocked()
+	if deadline.IsZero() {
+		return
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(deadline.Sub(now), w.fire)
+	} else {
+		w.timer.Reset(deadline.Sub(now))
+	}
+}
+
+// fire 定时器触发：截止时间已过则取消上游请求，否则按新的截止时间重新设置定时器
+func (w *streamWatchdog) fire() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped || w.err != nil {
+		return
+	}
+
+	now := time.Now()
+	deadline, err := w.deadlineLocked()
+	if deadline.IsZero() {
+		return
+	}
+	if now.Before(deadline) {
+		w.timer.Reset(deadline.Sub(now))
+		return
+	}
+	debugLog("上游流停滞，取消上游请求: %v", err)
+	w.err = err
+	w.cancel()
+}
+
+// Touch 记录收到数据
+func (w *streamWatchdog) Touch() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	first := w.lastActivity.IsZero()
+	w.lastActivity = now
+	if first && !w.stopped {
+		// 收到首个字节后改按空闲时间计算，截止时间可能早于当前定时器
+		w.armLocked(now)
+	}
+}
+
+// Phase 记录上游当前所处的阶段，进入思考阶段时开始计算思考时长
+func (w *streamWatchdog) Phase(phase string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if phase != "thinking" {
+		w.thinkingSince = time.Time{}
+		return
+	}
+	if w.thinkingSince.IsZero() && !w.stopped {
+		now := time.Now()
+		w.thinkingSince = now
+		// 思考时长的截止时间可能早于当前定时器
+		w.armLocked(now)
+	}
+}
+
+// Err 返回看门狗取消上游请求的原因（errors.APIError），未触发时返回 nil
+func (w *streamWatchdog) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Stop 停止看门狗
+func (w *streamWatchdog) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// watchedBody 受看门狗监视的上游响应体：读取到数据时更新活动时间，
+// 看门狗取消请求后读取返回其记录的 errors.APIError，而不是 context canceled
+type watchedBody struct {
+	io.ReadCloser
+	watchdog *streamWatchdog
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.watchdog.Touch()
+	}
+	if err != nil && err != io.EOF {
+		if wdErr := b.watchdog.Err(); wdErr != nil {
+			return n, wdErr
+		}
+	}
+	return n, err
+}
+
+func (b *watchedBody) Close() error {
+	b.watchdog.Stop()
+	if b.watchdog.Err() != nil {
+		markUpstreamFailed(b.ReadCloser)
+	}
+	return b.ReadCloser.Close()
+}
+
+// watchUpstreamBody 为上游响应体启用看门狗，cancel 用于取消上游请求
+func watchUpstreamBody(body io.ReadCloser, timeouts StreamTimeouts, cancel context.CancelFunc) io.ReadCloser {
+	if timeouts == (StreamTimeouts{}) {
+		return body
+	}
+	return &watchedBody{ReadCloser: body, watchdog: newStreamWatchdog(timeouts, cancel)}
+}
+
+// bodyWatchdog 返回响应体的看门狗，未启用时返回 nil
+func bodyWatchdog(body io.Reader) *streamWatchdog {
+	if b, ok := body.(*watchedBody); ok {
+		return b.watchdog
+	}
+	return nil
+}
+
+// watchdogPhaseHandler 包装阶段处理器，将上游阶段告知看门狗以限制思考时长
+type watchdogPhaseHandler struct {
+	upstreamPhaseHandler
+	watchdog *streamWatchdog
+}
+
+// withStreamWatchdog 响应体启用了看门狗时包装阶段处理器，否则原样返回
+func withStreamWatchdog(h upstreamPhaseHandler, body io.Reader) upstreamPhaseHandler {
+	if w := bodyWatchdog(body); w != nil {
+		return &watchdogPhaseHandler{upstreamPhaseHandler: h, watchdog: w}
+	}
+	return h
+}
+
+func (h *watchdogPhaseHandler) ProcessThinkingPhase(data *types.UpstreamData) {
+	h.watchdog.Phase("thinking")
+	h.upstreamPhaseHandler.ProcessThinkingPhase(data)
+}
+
+func (h *watchdogPhaseHandler) ProcessAnswerPhase(data *types.UpstreamData) {
+	h.watchdog.Phase("answer")
+	h.upstreamPhaseHandler.ProcessAnswerPhase(data)
+}
+
+func (h *watchdogPhaseHandler) ProcessToolCallPhase(data *types.UpstreamData) {
+	h.watchdog.Phase("tool_call")
+	h.upstreamPhaseHandler.ProcessToolCallPhase(data)
+}
+
+func (h *watchdogPhaseHandler) ProcessOtherPhase(data *types.UpstreamData) {
+	h.watchdog.Phase("other")
+	h.upstreamPhaseHandler.ProcessOtherPhase(data)
+}
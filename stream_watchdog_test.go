@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"z2api/errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newStalledBody 返回受看门狗监视的管道响应体，看门狗取消请求时以 context canceled 关闭管道，模拟取消上游请求
+func newStalledBody(timeouts StreamTimeouts) (io.ReadCloser, *io.PipeWriter) {
+	pr, pw := io.Pipe()
+	cancel := func() { pw.CloseWithError(context.Canceled) }
+	return watchUpstreamBody(pr, timeouts, cancel), pw
+}
+
+// TestStreamWatchdog 测试上游流在首字节、空闲与思考阶段超过限制时被取消并返回 upstream_timeout 错误
+func TestStreamWatchdog(t *testing.T) {
+	const limit = 30 * time.Millisecond
+	tests := []struct {
+		name     string
+		timeouts StreamTimeouts
+		// feed 向上游写入数据，返回后停止写入
+		feed    func(w *io.PipeWriter, wd *streamWatchdog)
+		wantMsg string
+	}{
+		{
+			name:     "首字节超时",
+			timeouts: StreamTimeouts{FirstByte: limit},
+			feed:     func(w *io.PipeWriter, wd *streamWatchdog) {},
+			wantMsg:  "未返回任何数据",
+		},
+		{
+			name:     "空闲超时",
+			timeouts: StreamTimeouts{FirstByte: time.Minute, Idle: limit},
+			feed: func(w *io.PipeWriter, wd *streamWatchdog) {
+				// 持续输出数据期间不应触发空闲超时
+				for range 5 {
+					w.Write([]byte("data: {}\n"))
+					time.Sleep(limit / 3)
+				}
+			},
+			wantMsg: "未返回新数据",
+		},
+		{
+			name:     "思考阶段超时",
+			timeouts: StreamTimeouts{Idle: time.Minute, Thinking: limit},
+			feed: func(w *io.PipeWriter, wd *streamWatchdog) {
+				wd.Phase("thinking")
+				// 思考阶段持续输出数据也会在达到思考时长上限后被取消
+				for range 10 {
+					if _, err := w.Write([]byte("data: {}\n")); err != nil {
+						return
+					}
+					time.Sleep(limit / 3)
+				}
+			},
+			wantMsg: "思考阶段超过",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, pw := newStalledBody(tt.timeouts)
+			defer body.Close()
+			go tt.feed(pw, bodyWatchdog(body))
+
+			start := time.Now()
+			_, err := io.ReadAll(body)
+			elapsed := time.Since(start)
+
+			apiErr, ok := err.(errors.APIError)
+			if !ok || apiErr.Type != "upstream_timeout" {
+				t.Fatalf("期望 upstream_timeout 错误, 实际 %v", err)
+			}
+			if !strings.Contains(apiErr.Details, tt.wantMsg) {
+				t.Errorf("错误详情 = %q, 期望包含 %q", apiErr.Details, tt.wantMsg)
+			}
+			if elapsed > 2*time.Second {
+				t.Errorf("看门狗触发过晚: %v", elapsed)
+			}
+		})
+	}
+}
+
+// TestStreamWatchdogPhaseReset 测试离开思考阶段后不再计算思考时长
+func TestStreamWatchdogPhaseReset(t *testing.T) {
+	body, pw := newStalledBody(StreamTimeouts{Thinking: 30 * time.Millisecond})
+	wd := bodyWatchdog(body)
+	wd.Phase("thinking")
+	wd.Phase("answer")
+
+	go func() {
+		time.Sleep(60 * time.Millisecond)
+		pw.Write([]byte("data: {}\n"))
+		pw.Close()
+	}()
+	if _, err := io.ReadAll(body); err != nil {
+		t.Fatalf("离开思考阶段后不应触发超时, 实际 %v", err)
+	}
+	body.Close()
+}
+
+// TestWatchUpstreamBodyDisabled 测试所有限制为 0 时不启用看门狗
+func TestWatchUpstreamBodyDisabled(t *testing.T) {
+	body := io.NopCloser(strings.NewReader(""))
+	if got := watchUpstreamBody(body, StreamTimeouts{}, func() {}); got != body {
+		t.Error("所有限制为 0 时应原样返回响应体")
+	}
+}
+
+// streamRecorder 支持 CloseNotify 的 ResponseRecorder，供 gin.Context.Stream 使用
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r streamRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+// TestGinStreamStalled 测试流式响应中途停滞时以错误块与 [DONE] 结束
+func TestGinStreamStalled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(streamRecorder{w})
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+	body, pw := newStalledBody(StreamTimeouts{FirstByte: time.Minute, Idle: 30 * time.Millisecond})
+	defer body.Close()
+	go pw.Write([]byte(`data: {"data":{"phase":"answer","delta_content":"你好"}}` + "\n"))
+
+	handler := NewGinStreamHandler(c, "glm-4.5")
+	err := streamUpstreamPhases(context.Background(), c, body, handler)
+	apiErr, ok := err.(errors.APIError)
+	if !ok || apiErr.Type != "upstream_timeout" {
+		t.Fatalf("期望 upstream_timeout 错误, 实际 %v", err)
+	}
+	handler.FailStream(apiErr)
+
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	if len(events) < 3 || events[len(events)-1] != "data: [DONE]" {
+		t.Fatalf("期望以 [DONE] 结束:\n%s", w.Body.String())
+	}
+	if !strings.Contains(events[0], "你好") {
+		t.Errorf("停滞前的内容应已输出:\n%s", events[0])
+	}
+	if last := events[len(events)-2]; !strings.Contains(last, `"upstream_timeout"`) {
+		t.Errorf("[DONE] 之前应为 upstream_timeout 错误块, 实际:\n%s", last)
+	}
+}
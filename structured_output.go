@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"z2api/errors"
+	"z2api/types"
+
+	"github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// structuredOutputRetriesHeader 响应头：为满足 response_format 而重新请求上游的次数
+	structuredOutputRetriesHeader = "X-Structured-Output-Retries"
+	// maxStructuredOutputRetries 上游输出不符合 schema 时的最大重试次数
+	maxStructuredOutputRetries = 1
+	// maxFenceHeaderLength 代码块开头（```json 等）的最大长度，超过时不再视为代码块
+	maxFenceHeaderLength = 16
+)
+
+// jsonCodeFencePattern 匹配包裹 JSON 的 Markdown 代码块
+var jsonCodeFencePattern = regexp.MustCompile("(?s)```[\\w-]*[ \\t]*\\r?\\n(.*?)```")
+
+// parseResponseFormat 解析并校验 response_format，text 或未设置时返回 nil
+func parseResponseFormat(raw interface{}) (*types.ResponseFormat, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	data, err := sonicDefault.Marshal(raw)
+	if err != nil {
+		return nil, errors.NewValidationErrorWithParam("response_format 格式无效", "response_format")
+	}
+	var format types.ResponseFormat
+	if err := sonicDefault.Unmarshal(data, &format); err != nil {
+		return nil, errors.NewValidationErrorWithParam("response_format 格式无效", "response_format")
+	}
+
+	switch format.Type {
+	case "text":
+		return nil, nil
+	case "json_object":
+		return &format, nil
+	case "json_schema":
+		if format.JSONSchema == nil || format.JSONSchema.Name == "" {
+			return nil, errors.NewValidationErrorWithParam("json_schema 类型的 response_format 需要提供 json_schema.name", "response_format.json_schema")
+		}
+		return &format, nil
+	default:
+		return nil, errors.NewValidationErrorWithParam(fmt.Sprintf("不支持的 response_format 类型: %q", format.Type), "response_format.type")
+	}
+}
+
+// structuredOutputPrompt 生成要求模型按 response_format 输出 JSON 的指令
+func structuredOutputPrompt(format *types.ResponseFormat) string {
+	var sb strings.Builder
+	sb.WriteString("\n\n# 输出格式\n\n你的回答必须是一个合法的 JSON 值，直接以 JSON 开头和结尾，不要使用 Markdown 代码块，不要添加任何解释或说明文字。")
+
+	schema := format.JSONSchema
+	if schema == nil || len(schema.Schema) == 0 {
+		sb.WriteString("回答必须是一个 JSON 对象。")
+		return sb.String()
+	}
+	if schema.Description != "" {
+		sb.WriteString(fmt.Sprintf("\n\n输出内容: %s", schema.Description))
+	}
+	if data, err := sonicDefault.MarshalIndent(schema.Schema, "", "  "); err == nil {
+		sb.WriteString(fmt.Sprintf("\n\n回答必须符合以下 JSON Schema（%s），包含所有必需的属性，不要添加未定义的属性:\n```json\n%s\n```", schema.Name, data))
+	}
+	return sb.String()
+}
+
+// applyResponseFormat 在系统消息中追加输出格式指令，没有系统消息时新增一条
+func applyResponseFormat(messages []types.UpstreamMessage, format *types.ResponseFormat) []types.UpstreamMessage {
+	prompt := structuredOutputPrompt(format)
+	processed := make([]types.UpstreamMessage, 0, len(messages)+1)
+
+	hasSystem := false
+	for _, msg := range messages {
+		if msg.Role == "system" && !hasSystem {
+			msg.Content += prompt
+			hasSystem = true
+		}
+		processed = append(processed, msg)
+	}
+	if !hasSystem {
+		processed = append([]types.UpstreamMessage{{Role: "system", Content: strings.TrimSpace(prompt)}}, processed...)
+	}
+	return processed
+}
+
+// extractJSONContent 从回答中提取 JSON：去除 Markdown 代码块与前后的说明文字，找不到 JSON 时返回去除首尾空白的原文
+func extractJSONContent(content string) string {
+	text := strings.TrimSpace(content)
+	if m := jsonCodeFencePattern.FindStringSubmatch(text); m != nil {
+		text = strings.TrimSpace(m[1])
+	}
+	if sonic.ValidString(text) {
+		return text
+	}
+
+	for start := 0; start < len(text); {
+		offset := strings.IndexAny(text[start:], "{[")
+		if offset < 0 {
+			break
+		}
+		start += offset
+		if end := balancedJSONEnd(text[start:]); end > 0 && sonic.ValidString(text[start:start+end]) {
+			return text[start : start+end]
+		}
+		start++
+	}
+	return text
+}
+
+// checkStructuredOutput 提取回答中的 JSON；strict 时按 schema 校验并尝试修复，仍不符合时返回 ErrStructuredOutputInvalid
+func checkStructuredOutput(format *types.ResponseFormat, content string) (string, error) {
+	extracted := extractJSONContent(content)
+	if !format.IsStrict() {
+		return extracted, nil
+	}
+	if extracted == "" {
+		return "", errors.ErrStructuredOutputInvalid.WithDetails("回答为空")
+	}
+
+	checked, err := checkToolArguments(toolSchema{parameters: format.JSONSchema.Schema, strict: true}, extracted)
+	if err != nil {
+		return "", errors.ErrStructuredOutputInvalid.WithDetails(fmt.Sprintf("回答不符合 %s: %v", format.JSONSchema.Name, err))
+	}
+	return checked, nil
+}
+
+// needsStructuredOutputRetry 回答不符合 schema 时需要重新请求上游
+func needsStructuredOutputRetry(upstreamReq types.UpstreamRequest) bool {
+	return upstreamReq.ResponseFormat.IsStrict()
+}
+
+// enforceStructuredOutput 执行 attempt 并按 response_format 处理其返回的回答文本，返回提取出的 JSON。
+// strict 时回答不符合 schema 则追加纠正指令重试，最多 maxStructuredOutputRetries 次，并在响应头中报告重试次数；
+// 回答包含工具调用时不做处理
+func enforceStructuredOutput(c *gin.Context, upstreamReq types.UpstreamRequest, attempt func(types.UpstreamRequest) (content string, hasToolCalls bool, err error)) (string, error) {
+	format := upstreamReq.ResponseFormat
+	for retries := 0; ; retries++ {
+		content, hasToolCalls, err := attempt(upstreamReq)
+		if err != nil || format == nil || hasToolCalls {
+			return content, err
+		}
+
+		checked, err := checkStructuredOutput(format, content)
+		if err == nil || retries >= maxStructuredOutputRetries {
+			if needsStructuredOutputRetry(upstreamReq) {
+				c.Header(structuredOutputRetriesHeader, strconv.Itoa(retries))
+			}
+			return checked, err
+		}
+
+		debugLog("上游输出不符合 response_format: %v，追加纠正指令后重试", err)
+		upstreamReq = withCorrection(upstreamReq, fmt.Sprintf("你的上一次回答不符合要求的 JSON Schema（%s）。请只输出符合该 JSON Schema 的 JSON，不要使用代码块，不要添加任何说明。", errors.WrapError(err).Details))
+	}
+}
+
+// jsonFenceStripper 流式去除回答外层的 Markdown 代码块。
+// 开头的 ```json 行与结束的 ``` 会被去除，结束代码块之后的文字被丢弃
+type jsonFenceStripper struct {
+	started bool   // 已确定回答是否以代码块开头
+	fenced  bool   // 回答以代码块开头
+	closed  bool   // 代码块已结束
+	pending string // 暂存的开头或可能属于结束代码块的末尾
+}
+
+// Feed 输入一段回答文本，返回可以立即输出的文本
+func (s *jsonFenceStripper) Feed(text string) string {
+	if s.closed {
+		return ""
+	}
+	s.pending += text
+
+	if !s.started {
+		trimmed := strings.TrimLeft(s.pending, " \t\r\n")
+		if trimmed == "" {
+			return ""
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix("```", trimmed) {
+			newline := strings.IndexByte(trimmed, '\n')
+			if newline < 0 && len(trimmed) <= maxFenceHeaderLength {
+				return "" // 等待代码块开头的换行
+			}
+			if newline >= 0 && newline <= maxFenceHeaderLength {
+				trimmed = trimmed[newline+1:]
+				s.fenced = true
+			}
+		}
+		s.started = true
+		s.pending = trimmed
+	}
+
+	if s.fenced {
+		if end := strings.Index(s.pending, "```"); end >= 0 {
+			out := s.pending[:end]
+			s.pending = ""
+			s.closed = true
+			return strings.TrimRight(out, " \t\r\n")
+		}
+	}
+
+	// 末尾的空白与反引号可能属于结束代码块，暂存到下一段文本或结束时
+	cut := len(strings.TrimRight(s.pending, " \t\r\n`"))
+	out := s.pending[:cut]
+	s.pending = s.pending[cut:]
+	return out
+}
+
+// Flush 回答结束时返回暂存的文本，只剩结束代码块或空白时返回空字符串
+func (s *jsonFenceStripper) Flush() string {
+	rest := s.pending
+	s.pending = ""
+	if s.closed || !s.started || strings.Trim(rest, " \t\r\n`") == "" {
+		return ""
+	}
+	return rest
+}
+
+// structuredOutputHandler 按 response_format 包装阶段处理器：
+// strict 时暂存全部回答，结束时输出提取并修复后的 JSON；否则流式去除外层代码块
+type structuredOutputHandler struct {
+	upstreamPhaseHandler
+	format   *types.ResponseFormat
+	answer   strings.Builder
+	stripper jsonFenceStripper
+}
+
+// withStructuredOutput 请求设置了 json_object 或 json_schema 时包装阶段处理器，否则原样返回
+func withStructuredOutput(h upstreamPhaseHandler, upstreamReq types.UpstreamRequest) upstreamPhaseHandler {
+	if upstreamReq.ResponseFormat == nil {
+		return h
+	}
+	return &structuredOutputHandler{upstreamPhaseHandler: h, format: upstreamReq.ResponseFormat}
+}
+
+// ProcessAnswerPhase 暂存或过滤回答文本
+func (h *structuredOutputHandler) ProcessAnswerPhase(data *types.UpstreamData) {
+	content := data.Data.DeltaContent
+	if data.Data.EditContent != "" {
+		content = processAnswerContent(data.Data.DeltaContent, data.Data.EditContent)
+	}
+	h.feed(content)
+}
+
+// ProcessToolCallPhase 工具调用前先输出已有的回答
+func (h *structuredOutputHandler) ProcessToolCallPhase(data *types.UpstreamData) {
+	h.flush()
+	h.upstreamPhaseHandler.ProcessToolCallPhase(data)
+}
+
+// ProcessOtherPhase 其他阶段中的文本同样属于回答，流结束时先输出回答
+func (h *structuredOutputHandler) ProcessOtherPhase(data *types.UpstreamData) {
+	if data.Data.DeltaContent != "" {
+		h.feed(data.Data.DeltaContent)
+		filtered := *data
+		filtered.Data.DeltaContent = ""
+		data = &filtered
+	}
+	if data.Data.Phase == "done" || data.Data.Done {
+		h.flush()
+	}
+	h.upstreamPhaseHandler.ProcessOtherPhase(data)
+}
+
+// ProcessDonePhase 输出剩余回答后结束
+func (h *structuredOutputHandler) ProcessDonePhase(data *types.UpstreamData) {
+	if !h.IsFinished() {
+		h.flush()
+	}
+	h.upstreamPhaseHandler.ProcessDonePhase(data)
+}
+
+// EmitToolCalls 输出工具调用前先输出已有的回答
+func (h *structuredOutputHandler) EmitToolCalls(calls []types.ToolCall) {
+	h.flush()
+	if emitter, ok := h.upstreamPhaseHandler.(toolCallEmitter); ok {
+		emitter.EmitToolCalls(calls)
+	}
+}
+
+// feed 处理一段回答文本
+func (h *structuredOutputHandler) feed(content string) {
+	if h.format.IsStrict() {
+		h.answer.WriteString(content)
+		return
+	}
+	h.writeAnswer(h.stripper.Feed(content))
+}
+
+// flush 输出暂存的回答。strict 时回答已在缓冲上游输出时校验过，这里只做提取与修复
+func (h *structuredOutputHandler) flush() {
+	if !h.format.IsStrict() {
+		h.writeAnswer(h.stripper.Flush())
+		return
+	}
+	if h.answer.Len() == 0 {
+		return
+	}
+	content, err := checkStructuredOutput(h.format, h.answer.String())
+	if err != nil {
+		content = extractJSONContent(h.answer.String())
+	}
+	h.answer.Reset()
+	h.writeAnswer(content)
+}
+
+// writeAnswer 以回答阶段的形式把处理后的文本交给被包装的处理器
+func (h *structuredOutputHandler) writeAnswer(text string) {
+	if text == "" {
+		return
+	}
+	var data types.UpstreamData
+	data.Data.Phase = "answer"
+	data.Data.DeltaContent = text
+	h.upstreamPhaseHandler.ProcessAnswerPhase(&data)
+}
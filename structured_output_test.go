@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"z2api/errors"
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestParseResponseFormat 测试 response_format 的解析与校验
+func TestParseResponseFormat(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        interface{}
+		wantType   string
+		wantStrict bool
+		wantParam  string
+	}{
+		{"未设置", nil, "", false, ""},
+		{"text", map[string]interface{}{"type": "text"}, "", false, ""},
+		{"json_object", map[string]interface{}{"type": "json_object"}, "json_object", false, ""},
+		{"strict json_schema", map[string]interface{}{
+			"type": "json_schema",
+			"json_schema": map[string]interface{}{
+				"name":   "answer",
+				"strict": true,
+				"schema": map[string]interface{}{"type": "object"},
+			},
+		}, "json_schema", true, ""},
+		{"json_schema 缺少 name", map[string]interface{}{"type": "json_schema", "json_schema": map[string]interface{}{}}, "", false, "response_format.json_schema"},
+		{"未知类型", map[string]interface{}{"type": "xml"}, "", false, "response_format.type"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := parseResponseFormat(tt.raw)
+			if tt.wantParam != "" {
+				apiErr, ok := err.(errors.APIError)
+				if !ok || apiErr.Param != tt.wantParam {
+					t.Fatalf("期望 %s 错误, 实际 %v", tt.wantParam, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("意外错误: %v", err)
+			}
+			if tt.wantType == "" {
+				if format != nil {
+					t.Errorf("期望 nil, 实际 %+v", format)
+				}
+				return
+			}
+			if format == nil || format.Type != tt.wantType || format.IsStrict() != tt.wantStrict {
+				t.Errorf("解析结果 = %+v, 期望类型 %s strict=%v", format, tt.wantType, tt.wantStrict)
+			}
+		})
+	}
+}
+
+// TestExtractJSONContent 测试去除代码块与说明文字
+func TestExtractJSONContent(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{`{"a": 1}`, `{"a": 1}`},
+		{"```json\n{\"a\": 1}\n```", `{"a": 1}`},
+		{"好的，结果如下：\n```\n[1, 2]\n```\n希望有帮助", `[1, 2]`},
+		{`结果是 {"a": "}"} 。`, `{"a": "}"}`},
+		{`[注] {"a": 1}`, `{"a": 1}`},
+		{"不是 JSON", "不是 JSON"},
+	}
+	for _, tt := range tests {
+		if got := extractJSONContent(tt.content); got != tt.want {
+			t.Errorf("extractJSONContent(%q) = %q, 期望 %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+// TestJSONFenceStripper 测试流式去除代码块，代码块标记可能被拆分到多段文本中
+func TestJSONFenceStripper(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"无代码块", []string{`{"a":`, ` "x` + "`" + `y"}`}, `{"a": "x` + "`" + `y"}`},
+		{"代码块", []string{"``", "`json\n{\"a\"", ": 1}\n`", "``"}, `{"a": 1}`},
+		{"代码块后的说明", []string{"```\n[1]\n```\n", "以上是结果"}, `[1]`},
+		{"前导空白", []string{"\n\n ", `{"a": 1}`, "\n"}, `{"a": 1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s jsonFenceStripper
+			var sb strings.Builder
+			for _, chunk := range tt.chunks {
+				sb.WriteString(s.Feed(chunk))
+			}
+			sb.WriteString(s.Flush())
+			if got := sb.String(); got != tt.want {
+				t.Errorf("输出 = %q, 期望 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestEnforceStructuredOutput 测试 strict 时的校验、修复与纠正重试
+func TestEnforceStructuredOutput(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	strict := true
+	format := &types.ResponseFormat{Type: "json_schema", JSONSchema: &types.JSONSchemaFormat{
+		Name:   "weather",
+		Strict: &strict,
+		Schema: map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"temperature": map[string]interface{}{"type": "number"}},
+			"required":   []interface{}{"temperature"},
+		},
+	}}
+
+	tests := []struct {
+		name        string
+		format      *types.ResponseFormat
+		responses   []string
+		want        string
+		wantAttempt int
+		wantHeader  string
+		wantErr     bool
+	}{
+		{"非 strict 只去除代码块", &types.ResponseFormat{Type: "json_object"}, []string{"```json\n{}\n```"}, "{}", 1, "", false},
+		{"首次符合", format, []string{"```json\n{\"temperature\": 20}\n```"}, `{"temperature": 20}`, 1, "0", false},
+		{"修复类型", format, []string{`{"temperature": "20"}`}, `{"temperature":20}`, 1, "0", false},
+		{"重试后符合", format, []string{"今天很暖和", `{"temperature": 20}`}, `{"temperature": 20}`, 2, "1", false},
+		{"重试后仍不符合", format, []string{"{}", "{}"}, "", 2, "1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			upstreamReq := types.UpstreamRequest{
+				ID:             "msg-1",
+				Messages:       []types.UpstreamMessage{{Role: "user", Content: "北京天气"}},
+				ResponseFormat: tt.format,
+			}
+
+			var requests []types.UpstreamRequest
+			got, err := enforceStructuredOutput(c, upstreamReq, func(req types.UpstreamRequest) (string, bool, error) {
+				requests = append(requests, req)
+				return tt.responses[len(requests)-1], false, nil
+			})
+
+			if len(requests) != tt.wantAttempt {
+				t.Fatalf("请求上游 %d 次, 期望 %d 次", len(requests), tt.wantAttempt)
+			}
+			if header := w.Header().Get(structuredOutputRetriesHeader); header != tt.wantHeader {
+				t.Errorf("%s = %q, 期望 %q", structuredOutputRetriesHeader, header, tt.wantHeader)
+			}
+			if tt.wantErr {
+				apiErr, ok := err.(errors.APIError)
+				if !ok || apiErr.Param != "response_format" {
+					t.Errorf("期望 response_format 错误, 实际 %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("意外错误: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("回答 = %q, 期望 %q", got, tt.want)
+			}
+			if len(requests) > 1 && !strings.Contains(requests[1].Messages[0].Content, "JSON Schema") {
+				t.Errorf("重试请求应追加纠正指令: %q", requests[1].Messages[0].Content)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"z2api/errors"
+	"z2api/internal/tokenizer"
+	"z2api/types"
+	"z2api/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// GinHandleTokenize 估算文本或聊天消息的 token 数 (POST /v1/tokenize)
+// 使用内置的近似分词器，计数按模型用上游返回的 usage 校准，不请求上游
+func GinHandleTokenize(c *gin.Context) {
+	startTime := time.Now()
+	c.Set("start_time", startTime)
+	c.Set("user_agent", c.GetHeader("User-Agent"))
+	c.Set("debug_mode", appConfig.DebugMode)
+
+	if extractAPIKey(c) != appConfig.DefaultKey {
+		utils.ErrorResponse(c, errors.ErrInvalidAPIKey.WithParam("api_key"))
+		recordError(c, startTime, errors.ErrInvalidAPIKey.StatusCode, "invalid_api_key")
+		return
+	}
+
+	var req types.TokenizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok && len(validationErrors) > 0 {
+			e := validationErrors[0]
+			utils.ValidationErrorWithParam(c, getValidationErrorMessage(e), e.Field())
+			recordError(c, startTime, http.StatusBadRequest, "validation_error")
+			return
+		}
+
+		utils.ErrorResponse(c, errors.ErrInvalidJSON.WithDetails(err.Error()))
+		recordError(c, startTime, http.StatusBadRequest, "invalid_request_error")
+		return
+	}
+
+	modelConfig, err := resolveModelConfig(req.Model)
+	if err != nil {
+		utils.ErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusNotFound, "model_not_found")
+		return
+	}
+
+	resp := types.TokenizeResponse{Object: "tokenize", Model: modelConfig.ID}
+	switch {
+	case req.Input != nil:
+		texts, err := tokenizeInputTexts(req.Input)
+		if err != nil {
+			utils.ErrorResponse(c, errors.WrapError(err))
+			recordError(c, startTime, http.StatusBadRequest, "validation_error")
+			return
+		}
+		resp.Tokens = []string{}
+		estimated := 0
+		for _, text := range texts {
+			pieces := tokenizer.Segment(text)
+			resp.Tokens = append(resp.Tokens, pieces...)
+			estimated += len(pieces)
+		}
+		resp.Count = tokenizer.Apply(modelConfig.UpstreamID, estimated)
+	case len(req.Messages) > 0:
+		resp.Count = requestPromptTokens(modelConfig.UpstreamID, types.OpenAIRequest{Messages: req.Messages, Tools: req.Tools})
+	default:
+		utils.ErrorResponse(c, errors.NewValidationErrorWithParam("input 与 messages 至少需要提供一个", "input"))
+		recordError(c, startTime, http.StatusBadRequest, "validation_error")
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// GinHandleAnthropicCountTokens 估算 Anthropic Messages 请求的输入 token 数 (POST /v1/messages/count_tokens)
+func GinHandleAnthropicCountTokens(c *gin.Context) {
+	startTime := time.Now()
+	c.Set("start_time", startTime)
+	c.Set("user_agent", c.GetHeader("User-Agent"))
+	c.Set("debug_mode", appConfig.DebugMode)
+
+	if extractAPIKey(c) != appConfig.DefaultKey {
+		anthropicErrorResponse(c, errors.ErrInvalidAPIKey)
+		recordError(c, startTime, errors.ErrInvalidAPIKey.StatusCode, "invalid_api_key")
+		return
+	}
+
+	var req types.AnthropicCountTokensRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok && len(validationErrors) > 0 {
+			e := validationErrors[0]
+			anthropicErrorResponse(c, errors.NewValidationErrorWithParam(getValidationErrorMessage(e), e.Field()))
+			recordError(c, startTime, http.StatusBadRequest, "validation_error")
+			return
+		}
+
+		anthropicErrorResponse(c, errors.ErrInvalidJSON.WithDetails(err.Error()))
+		recordError(c, startTime, http.StatusBadRequest, "invalid_request_error")
+		return
+	}
+
+	openAIReq, err := convertAnthropicRequest(types.AnthropicRequest{
+		Model:      req.Model,
+		Messages:   req.Messages,
+		System:     req.System,
+		MaxTokens:  1,
+		Tools:      req.Tools,
+		ToolChoice: req.ToolChoice,
+		Thinking:   req.Thinking,
+	})
+	if err != nil {
+		anthropicErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusBadRequest, "validation_error")
+		return
+	}
+
+	modelConfig, err := resolveModelConfig(openAIReq.Model)
+	if err != nil {
+		anthropicErrorResponse(c, errors.WrapError(err))
+		recordError(c, startTime, http.StatusNotFound, "model_not_found")
+		return
+	}
+
+	c.JSON(http.StatusOK, types.AnthropicCountTokensResponse{
+		InputTokens: requestPromptTokens(modelConfig.UpstreamID, openAIReq),
+	})
+}
+
+// tokenizeInputTexts 解析 string 或 []string 形式的 input
+func tokenizeInputTexts(input interface{}) ([]string, error) {
+	switch v := input.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		texts := make([]string, 0, len(v))
+		for _, item := range v {
+			text, ok := item.(string)
+			if !ok {
+				return nil, errors.NewValidationErrorWithParam("input 仅支持字符串或字符串数组", "input")
+			}
+			texts = append(texts, text)
+		}
+		return texts, nil
+	}
+	return nil, errors.NewValidationErrorWithParam("input 仅支持字符串或字符串数组", "input")
+}
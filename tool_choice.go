@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"z2api/errors"
+	"z2api/types"
+	"z2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// toolChoiceRetriesHeader 响应头：为满足 tool_choice 而重新请求上游的次数
+	toolChoiceRetriesHeader = "X-Tool-Choice-Retries"
+	// maxToolChoiceRetries 上游输出不满足 tool_choice 时的最大重试次数
+	maxToolChoiceRetries = 1
+)
+
+// toolChoiceRequiresCall tool_choice 为 required 或指定函数时，回答必须包含工具调用
+func toolChoiceRequiresCall(choice *types.ToolChoice) bool {
+	return choice != nil && (choice.Type == "required" || choice.Type == "function")
+}
+
+// toolChoiceForbidsCall tool_choice 为 none 时回答不允许包含工具调用
+func toolChoiceForbidsCall(choice *types.ToolChoice) bool {
+	return choice != nil && choice.Type == "none"
+}
+
+// checkToolChoice 检查工具调用是否满足 tool_choice，满足时返回空字符串，否则返回原因
+func checkToolChoice(choice *types.ToolChoice, calls []types.ToolCall) string {
+	if !toolChoiceRequiresCall(choice) {
+		return ""
+	}
+	if len(calls) == 0 {
+		return "回答中没有工具调用"
+	}
+	if choice.Type == "function" && choice.Function != nil && choice.Function.Name != "" {
+		for _, call := range calls {
+			if call.Function.Name != choice.Function.Name {
+				return fmt.Sprintf("调用了未指定的函数 %s", call.Function.Name)
+			}
+		}
+	}
+	return ""
+}
+
+// toolChoiceCorrection 生成 tool_choice 未满足时的纠正指令
+func toolChoiceCorrection(choice *types.ToolChoice) string {
+	if choice.Type == "function" && choice.Function != nil && choice.Function.Name != "" {
+		return fmt.Sprintf("你的上一次回答没有按要求调用工具。你必须调用 %s 函数且只调用该函数，不要直接回答。", choice.Function.Name)
+	}
+	return "你的上一次回答没有按要求调用工具。你必须调用提供的工具函数，不要直接回答。"
+}
+
+// withCorrection 返回追加了纠正指令的上游请求副本，并使用新的消息ID
+func withCorrection(upstreamReq types.UpstreamRequest, instruction string) types.UpstreamRequest {
+	// 复制消息切片，避免修改上一次请求使用的消息
+	messages := make([]types.UpstreamMessage, len(upstreamReq.Messages), len(upstreamReq.Messages)+1)
+	copy(messages, upstreamReq.Messages)
+	if n := len(messages); n > 0 && messages[n-1].Role == "user" {
+		messages[n-1].Content += "\n\n" + instruction
+	} else {
+		messages = append(messages, types.UpstreamMessage{Role: "user", Content: instruction})
+	}
+
+	upstreamReq.Messages = messages
+	upstreamReq.ID = utils.GenerateMessageID()
+	return upstreamReq
+}
+
+// needsToolOutputRetry 输出的工具调用可能需要重新请求上游：tool_choice 要求工具调用，或参数校验失败时配置为重新请求
+func needsToolOutputRetry(upstreamReq types.UpstreamRequest) bool {
+	return toolChoiceRequiresCall(upstreamReq.ToolChoiceObject) || requestToolValidator(upstreamReq).Reprompt()
+}
+
+// enforceToolOutput 执行 attempt 并校验其返回的工具调用：是否满足 tool_choice、参数是否符合 schema。
+// 不满足时追加纠正指令重试，最多 maxToolChoiceRetries 次，可能重试时在响应头中报告重试次数。
+// 返回经过参数修复的工具调用；重试后仍不满足时返回 ErrToolChoiceNotSatisfied 或 ErrToolArgumentsInvalid
+func enforceToolOutput(c *gin.Context, upstreamReq types.UpstreamRequest, attempt func(types.UpstreamRequest) ([]types.ToolCall, error)) ([]types.ToolCall, error) {
+	choice := upstreamReq.ToolChoiceObject
+	validator := requestToolValidator(upstreamReq)
+	for retries := 0; ; retries++ {
+		calls, err := attempt(upstreamReq)
+		if err != nil {
+			return nil, err
+		}
+
+		var failure error
+		var instruction string
+		if violation := checkToolChoice(choice, calls); violation != "" {
+			failure = errors.ErrToolChoiceNotSatisfied.WithDetails(fmt.Sprintf("重试 %d 次后%s", retries, violation))
+			instruction = toolChoiceCorrection(choice)
+		} else if calls, err = validator.Check(calls); err != nil {
+			failure = err
+			if validator.Reprompt() {
+				instruction = fmt.Sprintf("你的上一次工具调用参数不符合函数的参数定义（%s）。请严格按照参数定义重新调用。", errors.WrapError(err).Details)
+			}
+		}
+
+		if failure == nil || instruction == "" || retries >= maxToolChoiceRetries {
+			if needsToolOutputRetry(upstreamReq) {
+				c.Header(toolChoiceRetriesHeader, strconv.Itoa(retries))
+			}
+			return calls, failure
+		}
+
+		debugLog("上游输出的工具调用不满足要求: %v，追加纠正指令后重试", failure)
+		upstreamReq = withCorrection(upstreamReq, instruction)
+	}
+}
+
+// openValidatedStream 打开上游流式响应。
+// 工具调用或 strict response_format 的回答不满足要求时可能需要重试（见 needsToolOutputRetry、needsStructuredOutputRetry），
+// 此时无法边读边输出：先缓冲完整的上游输出并校验，不满足时重试；校验通过后返回缓冲的输出，由调用方像读取上游一样交给流式处理器
+func openValidatedStream(ctx context.Context, c *gin.Context, upstreamReq types.UpstreamRequest, chatID, authToken, sessionID string) (io.ReadCloser, context.CancelFunc, error) {
+	if !needsToolOutputRetry(upstreamReq) && !needsStructuredOutputRetry(upstreamReq) {
+		resp, cancel, err := openUpstreamStream(ctx, c, upstreamReq, chatID, authToken, sessionID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return resp.Body, cancel, nil
+	}
+
+	var buffered []byte
+	_, err := enforceStructuredOutput(c, upstreamReq, func(req types.UpstreamRequest) (string, bool, error) {
+		var probe *upstreamOutputProbe
+		calls, err := enforceToolOutput(c, req, func(req types.UpstreamRequest) ([]types.ToolCall, error) {
+			var err error
+			buffered, probe, err = bufferUpstreamStream(ctx, c, req, chatID, authToken, sessionID)
+			if err != nil {
+				return nil, err
+			}
+			return probe.tools.Calls(), nil
+		})
+		if err != nil {
+			return "", false, err
+		}
+		return probe.answer.String(), len(calls) > 0, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.NopCloser(bytes.NewReader(buffered)), func() {}, nil
+}
+
+// bufferUpstreamStream 读取完整的上游SSE输出，返回原始数据与记录了其中回答、工具调用的探测器
+func bufferUpstreamStream(ctx context.Context, c *gin.Context, upstreamReq types.UpstreamRequest, chatID, authToken, sessionID string) ([]byte, *upstreamOutputProbe, error) {
+	resp, cancel, err := openUpstreamStream(ctx, c, upstreamReq, chatID, authToken, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		cancel()
+		resp.Body.Close()
+	}()
+
+	probe := &upstreamOutputProbe{tools: NewStreamToolCollector(chatID, upstreamReq.Model)}
+	handler := withOutputLimits(withToolEmulation(probe, upstreamReq), probe, upstreamReq, cancel)
+
+	handler = withStreamWatchdog(handler, resp.Body)
+
+	var buf bytes.Buffer
+	bufReader := bufio.NewReader(resp.Body)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-c.Request.Context().Done():
+			return nil, nil, c.Request.Context().Err()
+		default:
+		}
+
+		line, err := bufReader.ReadString('\n')
+		buf.WriteString(line)
+		if int64(buf.Len()) > MaxResponseSize {
+			return nil, nil, errors.ErrContentTooLong
+		}
+		if errors.IsAPIError(err) {
+			return nil, nil, err
+		}
+		if err != nil || !processUpstreamLine(handler, line) {
+			break
+		}
+	}
+	if !handler.IsFinished() {
+		handler.ProcessDonePhase(nil)
+	}
+
+	return buf.Bytes(), probe, nil
+}
+
+// upstreamOutputProbe 缓冲上游输出时记录回答与工具调用的阶段处理器，不向客户端输出任何内容
+type upstreamOutputProbe struct {
+	tools    *StreamToolCollector
+	answer   strings.Builder
+	finished bool
+}
+
+// ProcessThinkingPhase 思考内容不需要校验
+func (p *upstreamOutputProbe) ProcessThinkingPhase(data *types.UpstreamData) {}
+
+// ProcessAnswerPhase 记录回答，模拟的工具调用已由 toolEmulationHandler 分离
+func (p *upstreamOutputProbe) ProcessAnswerPhase(data *types.UpstreamData) {
+	content := data.Data.DeltaContent
+	if data.Data.EditContent != "" {
+		content = processAnswerContent(data.Data.DeltaContent, data.Data.EditContent)
+	}
+	p.answer.WriteString(content)
+}
+
+// ProcessToolCallPhase 收集工具调用
+func (p *upstreamOutputProbe) ProcessToolCallPhase(data *types.UpstreamData) {
+	p.tools.ProcessToolCallPhase(data)
+}
+
+// ProcessOtherPhase 收集工具调用结束信号中的工具调用，其中的文本同样属于回答
+func (p *upstreamOutputProbe) ProcessOtherPhase(data *types.UpstreamData) {
+	if handled, _ := p.tools.ProcessOtherPhase(data); !handled {
+		p.answer.WriteString(data.Data.DeltaContent)
+	}
+}
+
+// ProcessDonePhase 标记结束
+func (p *upstreamOutputProbe) ProcessDonePhase(data *types.UpstreamData) {
+	p.finished = true
+}
+
+// IsFinished 是否已结束
+func (p *upstreamOutputProbe) IsFinished() bool {
+	return p.finished
+}
+
+// EmitToolCalls 收集模拟解析出的工具调用
+func (p *upstreamOutputProbe) EmitToolCalls(calls []types.ToolCall) {
+	p.tools.AddCalls(calls)
+}
+
+// toolChoiceNoneHandler tool_choice 为 none 时包装阶段处理器，丢弃上游仍然返回的工具调用
+type toolChoiceNoneHandler struct {
+	upstreamPhaseHandler
+}
+
+// withToolChoice 根据 tool_choice 包装阶段处理器，无需处理时原样返回
+func withToolChoice(h upstreamPhaseHandler, upstreamReq types.UpstreamRequest) upstreamPhaseHandler {
+	if toolChoiceForbidsCall(upstreamReq.ToolChoiceObject) {
+		return toolChoiceNoneHandler{h}
+	}
+	return h
+}
+
+// ProcessToolCallPhase 丢弃工具调用
+func (h toolChoiceNoneHandler) ProcessToolCallPhase(data *types.UpstreamData) {
+	debugLog("tool_choice=none，丢弃上游返回的工具调用")
+}
+
+// ProcessOtherPhase 去掉 edit_content 中的工具调用块与结束信号后交给被包装的处理器，结束原因因此保持为 stop
+func (h toolChoiceNoneHandler) ProcessOtherPhase(data *types.UpstreamData) {
+	if data.Data.EditContent != "" {
+		debugLog("tool_choice=none，丢弃其他阶段中的工具调用")
+		stripped := *data
+		stripped.Data.EditContent = ""
+		stripped.Data.ToolCalls = nil
+		data = &stripped
+	}
+	h.upstreamPhaseHandler.ProcessOtherPhase(data)
+}
+
+// EmitToolCalls 丢弃模拟解析出的工具调用
+func (h toolChoiceNoneHandler) EmitToolCalls(calls []types.ToolCall) {
+	debugLog("tool_choice=none，丢弃 %d 个模拟工具调用", len(calls))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"z2api/errors"
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestEnforceToolOutput 测试 tool_choice 校验、纠正重试与重试次数响应头
+func TestEnforceToolOutput(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	weather := types.ToolCall{Function: types.ToolCallFunction{Name: "get_weather", Arguments: "{}"}}
+	search := types.ToolCall{Function: types.ToolCallFunction{Name: "search", Arguments: "{}"}}
+	named := &types.ToolChoice{Type: "function", Function: &types.ToolChoiceFunction{Name: "get_weather"}}
+
+	tests := []struct {
+		name        string
+		choice      *types.ToolChoice
+		responses   [][]types.ToolCall // 每次请求上游返回的工具调用
+		wantAttempt int
+		wantHeader  string
+		wantErr     bool
+	}{
+		{"auto 不校验", &types.ToolChoice{Type: "auto"}, [][]types.ToolCall{nil}, 1, "", false},
+		{"required 首次满足", &types.ToolChoice{Type: "required"}, [][]types.ToolCall{{search}}, 1, "0", false},
+		{"required 重试后满足", &types.ToolChoice{Type: "required"}, [][]types.ToolCall{nil, {weather}}, 2, "1", false},
+		{"指定函数调用了其他函数", named, [][]types.ToolCall{{search}, {weather}}, 2, "1", false},
+		{"重试后仍不满足", named, [][]types.ToolCall{nil, {search}}, 2, "1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			upstreamReq := types.UpstreamRequest{
+				ID:               "msg-1",
+				Messages:         []types.UpstreamMessage{{Role: "user", Content: "北京天气如何？"}},
+				ToolChoiceObject: tt.choice,
+			}
+
+			var requests []types.UpstreamRequest
+			_, err := enforceToolOutput(c, upstreamReq, func(req types.UpstreamRequest) ([]types.ToolCall, error) {
+				requests = append(requests, req)
+				return tt.responses[len(requests)-1], nil
+			})
+
+			if len(requests) != tt.wantAttempt {
+				t.Fatalf("请求上游 %d 次, 期望 %d 次", len(requests), tt.wantAttempt)
+			}
+			if got := w.Header().Get(toolChoiceRetriesHeader); got != tt.wantHeader {
+				t.Errorf("%s = %q, 期望 %q", toolChoiceRetriesHeader, got, tt.wantHeader)
+			}
+			if tt.wantErr {
+				apiErr, ok := err.(errors.APIError)
+				if !ok || apiErr.Param != "tool_choice" {
+					t.Errorf("期望 tool_choice 错误, 实际 %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("意外错误: %v", err)
+			}
+
+			if len(requests) > 1 {
+				retry := requests[1]
+				if retry.ID == upstreamReq.ID || !strings.Contains(retry.Messages[0].Content, "你必须调用") {
+					t.Errorf("重试请求应使用新的消息ID并追加纠正指令: %+v", retry)
+				}
+				if upstreamReq.Messages[0].Content != "北京天气如何？" {
+					t.Errorf("原请求的消息被修改: %q", upstreamReq.Messages[0].Content)
+				}
+			}
+		})
+	}
+}
+
+// TestGinStreamToolChoiceNone 测试 tool_choice 为 none 时流式响应丢弃上游返回的工具调用，结束原因为 stop
+func TestGinStreamToolChoiceNone(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	block := `<glm_block >{"type":"tool_call","data":{"metadata":{"id":"call_1","name":"get_weather","arguments":"{\"city\":\"北京\"}"}}}</glm_block>`
+	phases := []struct {
+		phase, delta, edit string
+	}{
+		{"answer", "好的", ""},
+		{"tool_call", "", block},
+		{"other", "", block + `null,`},
+		{"other", "", `"status": "completed"`},
+		{"done", "", ""},
+	}
+	var lines []string
+	for _, p := range phases {
+		var data types.UpstreamData
+		data.Data.Phase = p.phase
+		data.Data.DeltaContent = p.delta
+		data.Data.EditContent = p.edit
+		data.Data.Done = p.phase == "done"
+		jsonData, err := sonicStream.MarshalToString(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, "data: "+jsonData)
+	}
+
+	// 模拟工具从回答文本中解析出的工具调用同样被丢弃
+	emulated := `data: {"data":{"phase":"answer","delta_content":"{\"tool_calls\":[{\"function\":{\"name\":\"get_weather\",\"arguments\":{\"city\":\"北京\"}}}]}"}}`
+
+	tests := []struct {
+		name        string
+		upstreamReq types.UpstreamRequest
+		lines       []string
+	}{
+		{"原生工具", types.UpstreamRequest{Tools: emulationTestTools}, lines},
+		{"模拟工具", types.UpstreamRequest{EmulatedTools: emulationTestTools}, append([]string{emulated}, lines...)},
+		{"未声明工具", types.UpstreamRequest{}, lines},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			upstreamReq := tt.upstreamReq
+			upstreamReq.ToolChoiceObject = &types.ToolChoice{Type: "none"}
+
+			handler := NewGinStreamHandler(c, "glm-4.5")
+			h := withOutputHandling(handler, upstreamReq, nil)
+			for _, line := range tt.lines {
+				processUpstreamLine(h, line)
+			}
+
+			body := w.Body.String()
+			if strings.Contains(body, "tool_calls") || strings.Contains(body, "get_weather") {
+				t.Errorf("tool_choice=none 时不应输出工具调用:\n%s", body)
+			}
+			if !strings.Contains(body, "好的") {
+				t.Errorf("回答内容应正常输出:\n%s", body)
+			}
+			if !strings.Contains(body, `"finish_reason":"stop"`) || !strings.HasSuffix(strings.TrimSpace(body), "data: [DONE]") {
+				t.Errorf("应以 finish_reason stop 与 [DONE] 结束:\n%s", body)
+			}
+		})
+	}
+}
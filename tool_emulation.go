@@ -0,0 +1,559 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"z2api/config"
+	"z2api/types"
+	"z2api/utils"
+)
+
+// 工具调用模拟：模型不支持原生工具调用时，将工具定义注入系统提示词，
+// 并从回答文本中解析 {"tool_calls": [...]} 形式的 JSON，转换为标准的工具调用。
+// 移植自 docs/参考/工具/tools.py
+
+const (
+	// toolEmulationDefaultSystem 请求中没有系统消息时使用的系统提示词
+	toolEmulationDefaultSystem = "你是一个有用的助手。"
+	// maxHeldToolText 流式解析时为判断工具调用而暂存的文本上限，超出后按普通文本输出
+	maxHeldToolText = 64 << 10
+)
+
+// toolCallJSONKey 工具调用 JSON 的键，模拟的工具调用必须以该键开头
+const toolCallJSONKey = `"tool_calls"`
+
+// naturalToolCallPattern 匹配自然语言形式的函数调用：调用函数: name 参数: {...}
+var naturalToolCallPattern = regexp.MustCompile(`(?s)调用函数\s*[：:]\s*([\w\-\.]+)\s*(?:参数|arguments)[：:]\s*(\{.*?\})`)
+
+// needsToolEmulation 模型不支持原生工具调用且请求中有工具定义或工具调用历史时需要模拟
+func needsToolEmulation(req types.OpenAIRequest, modelConfig config.ModelConfig) bool {
+	if modelConfig.Capabilities.Tools {
+		return false
+	}
+	if len(req.Tools) > 0 {
+		return true
+	}
+	for _, msg := range req.Messages {
+		if msg.Role == "tool" || len(msg.ToolCalls) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// generateToolPrompt 生成注入系统提示词的工具说明
+func generateToolPrompt(tools []types.Tool) string {
+	var definitions []string
+	for _, tool := range tools {
+		if tool.Type != "function" {
+			continue
+		}
+
+		fn := tool.Function
+		lines := []string{"## " + fn.Name, "**Purpose**: " + fn.Description}
+
+		properties, _ := fn.Parameters["properties"].(map[string]interface{})
+		if len(properties) > 0 {
+			required := make(map[string]bool)
+			if list, ok := fn.Parameters["required"].([]interface{}); ok {
+				for _, name := range list {
+					if s, ok := name.(string); ok {
+						required[s] = true
+					}
+				}
+			}
+
+			// 参数按名称排序，保证相同工具生成相同的提示词
+			names := make([]string, 0, len(properties))
+			for name := range properties {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			lines = append(lines, "**Parameters**:")
+			for _, name := range names {
+				details, _ := properties[name].(map[string]interface{})
+				paramType, _ := details["type"].(string)
+				if paramType == "" {
+					paramType = "any"
+				}
+				paramDesc, _ := details["description"].(string)
+				flag := "*Optional*"
+				if required[name] {
+					flag = "**Required**"
+				}
+				lines = append(lines, fmt.Sprintf("- `%s` (%s) - %s: %s", name, paramType, flag, paramDesc))
+			}
+		}
+
+		definitions = append(definitions, strings.Join(lines, "\n"))
+	}
+
+	if len(definitions) == 0 {
+		return ""
+	}
+
+	return "\n\n# AVAILABLE FUNCTIONS\n" + strings.Join(definitions, "\n\n---\n") + "\n\n# USAGE INSTRUCTIONS\n" +
+		"When you need to execute a function, respond ONLY with a JSON object containing tool_calls:\n" +
+		"```json\n" +
+		"{\n" +
+		"  \"tool_calls\": [\n" +
+		"    {\n" +
+		"      \"id\": \"call_xxx\",\n" +
+		"      \"type\": \"function\",\n" +
+		"      \"function\": {\n" +
+		"        \"name\": \"function_name\",\n" +
+		"        \"arguments\": \"{\\\"param1\\\": \\\"value1\\\"}\"\n" +
+		"      }\n" +
+		"    }\n" +
+		"  ]\n" +
+		"}\n" +
+		"```\n" +
+		"Important: No explanatory text before or after the JSON. The 'arguments' field must be a JSON string, not an object.\n"
+}
+
+// applyToolEmulation 将工具说明注入上游消息，并把工具调用历史转换为模型可理解的文本。
+// tool_choice 为 none 时不注入工具说明，但仍转换历史
+func applyToolEmulation(messages []types.UpstreamMessage, tools []types.Tool, choice *types.ToolChoice) []types.UpstreamMessage {
+	processed := make([]types.UpstreamMessage, 0, len(messages)+1)
+
+	prompt := ""
+	if choice == nil || choice.Type != "none" {
+		prompt = generateToolPrompt(tools)
+	}
+	if prompt != "" {
+		hasSystem := false
+		for _, msg := range messages {
+			if msg.Role == "system" {
+				hasSystem = true
+				break
+			}
+		}
+		if !hasSystem {
+			processed = append(processed, types.UpstreamMessage{Role: "system", Content: toolEmulationDefaultSystem + prompt})
+		}
+	}
+
+	for _, msg := range messages {
+		switch {
+		case msg.Role == "system" && prompt != "":
+			msg.Content += prompt
+		case msg.Role == "tool":
+			// 工具结果以用户消息的形式提供，模型据此继续回答
+			name := msg.Name
+			if name == "" {
+				name = "unknown"
+			}
+			content := fmt.Sprintf("工具 %s 返回结果:\n```json\n%s\n```", name, msg.Content)
+			if strings.TrimSpace(msg.Content) == "" {
+				content = fmt.Sprintf("工具 %s 执行完成", name)
+			}
+			msg = types.UpstreamMessage{Role: "user", Content: content}
+		case len(msg.ToolCalls) > 0:
+			// 之前的工具调用以约定的 JSON 格式写回助手消息，保持与提示词一致
+			msg.Content = strings.TrimSpace(msg.Content + "\n\n" + formatToolCallJSON(msg.ToolCalls))
+			msg.ToolCalls = nil
+		}
+		processed = append(processed, msg)
+	}
+
+	// 在最后一条用户消息后追加工具选择提示
+	if prompt != "" && choice != nil && len(processed) > 0 && processed[len(processed)-1].Role == "user" {
+		last := &processed[len(processed)-1]
+		switch {
+		case choice.Type == "required" || choice.Type == "auto":
+			last.Content += "\n\n请根据需要使用提供的工具函数。"
+		case choice.Type == "function" && choice.Function != nil && choice.Function.Name != "":
+			last.Content += fmt.Sprintf("\n\n请使用 %s 函数来处理这个请求。", choice.Function.Name)
+		}
+	}
+
+	return processed
+}
+
+// formatToolCallJSON 将工具调用格式化为提示词约定的 JSON 代码块
+func formatToolCallJSON(calls []types.ToolCall) string {
+	encoded, err := sonicInternal.Marshal(map[string]interface{}{"tool_calls": calls})
+	if err != nil {
+		return ""
+	}
+	return "```json\n" + string(encoded) + "\n```"
+}
+
+// emulatedToolCall 模型输出的工具调用 JSON，兼容 name/arguments 直接位于调用对象上的写法
+type emulatedToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string      `json:"name"`
+		Arguments interface{} `json:"arguments"`
+	} `json:"function"`
+	Name      string      `json:"name"`
+	Arguments interface{} `json:"arguments"`
+}
+
+// parseToolCallJSON 解析 {"tool_calls": [...]} 形式的 JSON，返回函数名已知的工具调用
+// names 为空时接受任意函数名；调用ID统一重新生成，避免模型照抄示例中的ID
+func parseToolCallJSON(s string, names map[string]bool) ([]types.ToolCall, bool) {
+	var parsed struct {
+		ToolCalls []emulatedToolCall `json:"tool_calls"`
+	}
+	if err := sonicStream.UnmarshalFromString(s, &parsed); err != nil || len(parsed.ToolCalls) == 0 {
+		return nil, false
+	}
+
+	calls := make([]types.ToolCall, 0, len(parsed.ToolCalls))
+	for _, raw := range parsed.ToolCalls {
+		name, arguments := raw.Function.Name, raw.Function.Arguments
+		if name == "" {
+			name, arguments = raw.Name, raw.Arguments
+		}
+		if name == "" || (len(names) > 0 && !names[name]) {
+			debugLog("忽略模拟工具调用中的未知函数: %q", name)
+			continue
+		}
+		calls = append(calls, types.ToolCall{
+			Index: len(calls),
+			ID:    utils.GenerateToolCallID(),
+			Type:  "function",
+			Function: types.ToolCallFunction{
+				Name:      name,
+				Arguments: toolArgumentsString(arguments),
+			},
+		})
+	}
+	return calls, len(calls) > 0
+}
+
+// toolArgumentsString 将参数统一转换为 JSON 字符串
+func toolArgumentsString(arguments interface{}) string {
+	switch v := arguments.(type) {
+	case nil:
+		return "{}"
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return "{}"
+		}
+		return v
+	default:
+		encoded, err := sonicInternal.Marshal(v)
+		if err != nil {
+			return "{}"
+		}
+		return string(encoded)
+	}
+}
+
+// toolEmulationParser 从流式回答文本中分离工具调用 JSON
+// 遇到 '{' 或 ``` 时暂存后续文本，确认是工具调用后丢弃该段并记录调用，否则原样输出
+type toolEmulationParser struct {
+	names     map[string]bool
+	held      string // 暂存的候选文本
+	skipFence bool   // 正在输出一个已确认不是工具调用的代码块，直到其结束标记
+	calls     []types.ToolCall
+	total     int // 已解析的工具调用数，用于设置 Index
+}
+
+// newToolEmulationParser 创建工具调用解析器，只接受 tools 中定义的函数
+func newToolEmulationParser(tools []types.Tool) *toolEmulationParser {
+	names := make(map[string]bool, len(tools))
+	for _, tool := range tools {
+		names[tool.Function.Name] = true
+	}
+	return &toolEmulationParser{names: names}
+}
+
+// Feed 输入一段回答文本，返回可以立即输出的文本
+func (p *toolEmulationParser) Feed(text string) string {
+	p.held += text
+	var out strings.Builder
+
+	for p.held != "" {
+		if p.skipFence {
+			end := strings.Index(p.held, "```")
+			if end < 0 {
+				// 保留可能被截断的结束标记
+				keep := trailingBackticks(p.held)
+				out.WriteString(p.held[:len(p.held)-keep])
+				p.held = p.held[len(p.held)-keep:]
+				break
+			}
+			out.WriteString(p.held[:end+3])
+			p.held = p.held[end+3:]
+			p.skipFence = false
+			continue
+		}
+
+		start := strings.IndexAny(p.held, "{`")
+		if start < 0 {
+			out.WriteString(p.held)
+			p.held = ""
+			break
+		}
+		out.WriteString(p.held[:start])
+		p.held = p.held[start:]
+
+		consumed, emit, wait := p.scanCandidate()
+		if wait {
+			if len(p.held) > maxHeldToolText {
+				out.WriteString(p.held)
+				p.held = ""
+			}
+			break
+		}
+		out.WriteString(emit)
+		p.held = p.held[consumed:]
+	}
+
+	return out.String()
+}
+
+// Flush 流结束时调用，返回剩余的文本
+func (p *toolEmulationParser) Flush() string {
+	held := p.held
+	p.held = ""
+
+	// 未闭合的代码块去掉开头的标记行后再尝试解析
+	candidate := strings.TrimSpace(held)
+	if strings.HasPrefix(candidate, "```") {
+		_, candidate, _ = strings.Cut(candidate, "\n")
+		candidate = strings.TrimRight(candidate, "` \t\r\n")
+	}
+	if calls, ok := parseToolCallJSON(candidate, p.names); ok {
+		p.record(calls)
+		return ""
+	}
+	return held
+}
+
+// TakeCalls 返回并清空已解析的工具调用
+func (p *toolEmulationParser) TakeCalls() []types.ToolCall {
+	calls := p.calls
+	p.calls = nil
+	return calls
+}
+
+// record 记录解析出的工具调用，Index 在整个回答中递增
+func (p *toolEmulationParser) record(calls []types.ToolCall) {
+	for _, call := range calls {
+		call.Index = p.total
+		p.total++
+		p.calls = append(p.calls, call)
+	}
+}
+
+// scanCandidate 检查以 '{' 或 '`' 开头的暂存文本。
+// 返回消费的字节数与需要输出的文本；wait 为 true 表示需要更多文本才能判断
+func (p *toolEmulationParser) scanCandidate() (consumed int, emit string, wait bool) {
+	held := p.held
+
+	if held[0] == '`' {
+		if len(held) < 3 {
+			if strings.HasPrefix("```", held) {
+				return 0, "", true
+			}
+			return 1, held[:1], false
+		}
+		if !strings.HasPrefix(held, "```") {
+			return 1, held[:1], false
+		}
+
+		// 代码块：先根据内容开头判断是否可能是工具调用
+		newline := strings.IndexByte(held, '\n')
+		if newline < 0 {
+			return 0, "", true
+		}
+		body := strings.TrimLeft(held[newline+1:], " \t\r\n")
+		if !couldBeToolCallJSON(body) {
+			p.skipFence = true
+			return newline + 1, held[:newline+1], false
+		}
+		end := strings.Index(held[newline+1:], "```")
+		if end < 0 {
+			return 0, "", true
+		}
+		blockEnd := newline + 1 + end + 3
+		if calls, ok := parseToolCallJSON(held[newline+1:newline+1+end], p.names); ok {
+			p.record(calls)
+			return blockEnd, "", false
+		}
+		return blockEnd, held[:blockEnd], false
+	}
+
+	// JSON 对象：第一个键必须是 tool_calls
+	if !couldBeToolCallJSON(held) {
+		return 1, held[:1], false
+	}
+	end := balancedJSONEnd(held)
+	if end < 0 {
+		return 0, "", true
+	}
+	if calls, ok := parseToolCallJSON(held[:end], p.names); ok {
+		p.record(calls)
+		return end, "", false
+	}
+	return 1, held[:1], false
+}
+
+// couldBeToolCallJSON 判断文本是否可能是以 tool_calls 为第一个键的 JSON 对象（允许文本尚不完整）
+func couldBeToolCallJSON(s string) bool {
+	if s == "" {
+		return true
+	}
+	if s[0] != '{' {
+		return false
+	}
+	rest := strings.TrimLeft(s[1:], " \t\r\n")
+	if len(rest) >= len(toolCallJSONKey) {
+		return strings.HasPrefix(rest, toolCallJSONKey)
+	}
+	return strings.HasPrefix(toolCallJSONKey, rest)
+}
+
+// balancedJSONEnd 按括号平衡查找以 '{' 或 '[' 开头的 JSON 值的结束位置，未结束时返回 -1
+func balancedJSONEnd(s string) int {
+	depth := 0
+	inString := false
+	escaped := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && inString:
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// trailingBackticks 返回文本末尾连续反引号的数量（最多 2 个）
+func trailingBackticks(s string) int {
+	n := 0
+	for n < 2 && n < len(s) && s[len(s)-1-n] == '`' {
+		n++
+	}
+	return n
+}
+
+// extractEmulatedToolCalls 从完整回答中分离工具调用，返回去除工具调用 JSON 后的文本。
+// JSON 形式未解析到调用时，回退到自然语言形式（调用函数: name 参数: {...}）
+func extractEmulatedToolCalls(text string, tools []types.Tool) (string, []types.ToolCall) {
+	parser := newToolEmulationParser(tools)
+	cleaned := parser.Feed(text) + parser.Flush()
+	if calls := parser.TakeCalls(); len(calls) > 0 {
+		return strings.TrimSpace(cleaned), calls
+	}
+
+	if match := naturalToolCallPattern.FindStringSubmatchIndex(text); match != nil {
+		name, arguments := text[match[2]:match[3]], text[match[4]:match[5]]
+		if parser.names[name] && sonicInternal.Valid([]byte(arguments)) {
+			call := types.ToolCall{
+				ID:       utils.GenerateToolCallID(),
+				Type:     "function",
+				Function: types.ToolCallFunction{Name: name, Arguments: arguments},
+			}
+			return strings.TrimSpace(text[:match[0]] + text[match[1]:]), []types.ToolCall{call}
+		}
+	}
+	return text, nil
+}
+
+// toolCallEmitter 由支持输出模拟工具调用的流式处理器实现
+type toolCallEmitter interface {
+	EmitToolCalls(calls []types.ToolCall)
+}
+
+// toolEmulationHandler 包装流式阶段处理器，从回答文本中分离模拟的工具调用
+type toolEmulationHandler struct {
+	upstreamPhaseHandler
+	emitter toolCallEmitter
+	parser  *toolEmulationParser
+}
+
+// withToolEmulation 请求启用了工具模拟时包装阶段处理器，否则原样返回
+func withToolEmulation(h upstreamPhaseHandler, upstreamReq types.UpstreamRequest) upstreamPhaseHandler {
+	if len(upstreamReq.EmulatedTools) == 0 {
+		return h
+	}
+	emitter, ok := h.(toolCallEmitter)
+	if !ok {
+		return h
+	}
+	return &toolEmulationHandler{
+		upstreamPhaseHandler: h,
+		emitter:              emitter,
+		parser:               newToolEmulationParser(upstreamReq.EmulatedTools),
+	}
+}
+
+// ProcessAnswerPhase 过滤回答文本中的工具调用 JSON
+func (h *toolEmulationHandler) ProcessAnswerPhase(data *types.UpstreamData) {
+	content := data.Data.DeltaContent
+	if data.Data.EditContent != "" {
+		content = processAnswerContent(data.Data.DeltaContent, data.Data.EditContent)
+	}
+	h.writeAnswer(h.parser.Feed(content))
+	h.emitCalls()
+}
+
+// ProcessOtherPhase 过滤其他阶段中的文本，流结束时先输出剩余文本与工具调用
+func (h *toolEmulationHandler) ProcessOtherPhase(data *types.UpstreamData) {
+	if data.Data.DeltaContent != "" {
+		h.writeAnswer(h.parser.Feed(data.Data.DeltaContent))
+		h.emitCalls()
+		filtered := *data
+		filtered.Data.DeltaContent = ""
+		data = &filtered
+	}
+	if data.Data.Phase == "done" || data.Data.Done {
+		h.flush()
+	}
+	h.upstreamPhaseHandler.ProcessOtherPhase(data)
+}
+
+// ProcessDonePhase 输出剩余文本与工具调用后结束
+func (h *toolEmulationHandler) ProcessDonePhase(data *types.UpstreamData) {
+	if !h.IsFinished() {
+		h.flush()
+	}
+	h.upstreamPhaseHandler.ProcessDonePhase(data)
+}
+
+// flush 输出暂存的文本与工具调用
+func (h *toolEmulationHandler) flush() {
+	h.writeAnswer(h.parser.Flush())
+	h.emitCalls()
+}
+
+// writeAnswer 以回答阶段的形式把过滤后的文本交给被包装的处理器
+func (h *toolEmulationHandler) writeAnswer(text string) {
+	if text == "" {
+		return
+	}
+	var data types.UpstreamData
+	data.Data.Phase = "answer"
+	data.Data.DeltaContent = text
+	h.upstreamPhaseHandler.ProcessAnswerPhase(&data)
+}
+
+// emitCalls 输出已解析的工具调用
+func (h *toolEmulationHandler) emitCalls() {
+	if calls := h.parser.TakeCalls(); len(calls) > 0 {
+		debugLog("模拟工具调用: 解析到 %d 个工具调用", len(calls))
+		h.emitter.EmitToolCalls(calls)
+	}
+}
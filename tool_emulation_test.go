@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"z2api/types"
+)
+
+// emulationTestTools 测试用的工具定义
+var emulationTestTools = []types.Tool{{
+	Type: "function",
+	Function: types.ToolFunction{
+		Name:        "get_weather",
+		Description: "查询城市天气",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"city": map[string]interface{}{"type": "string", "description": "城市名"},
+			},
+			"required": []interface{}{"city"},
+		},
+	},
+}}
+
+// TestApplyToolEmulation 测试工具说明注入与工具调用历史的文本化
+func TestApplyToolEmulation(t *testing.T) {
+	messages := []types.UpstreamMessage{
+		{Role: "user", Content: "北京天气如何？"},
+		{Role: "assistant", ToolCalls: []types.ToolCall{{
+			ID: "call_bj", Type: "function",
+			Function: types.ToolCallFunction{Name: "get_weather", Arguments: `{"city":"北京"}`},
+		}}},
+		{Role: "tool", ToolCallID: "call_bj", Name: "get_weather", Content: "晴"},
+		{Role: "user", Content: "上海呢？"},
+	}
+
+	got := applyToolEmulation(messages, emulationTestTools, &types.ToolChoice{Type: "auto"})
+	if len(got) != 5 {
+		t.Fatalf("期望 5 条消息, 实际 %d 条", len(got))
+	}
+	if got[0].Role != "system" || !strings.Contains(got[0].Content, "## get_weather") ||
+		!strings.Contains(got[0].Content, "`city` (string) - **Required**") {
+		t.Errorf("系统提示词缺少工具说明: %q", got[0].Content)
+	}
+	if got[2].Role != "assistant" || len(got[2].ToolCalls) != 0 || !strings.Contains(got[2].Content, `"tool_calls"`) {
+		t.Errorf("助手工具调用应转换为 JSON 文本: %+v", got[2])
+	}
+	if got[3].Role != "user" || !strings.Contains(got[3].Content, "工具 get_weather 返回结果") || got[3].ToolCallID != "" {
+		t.Errorf("工具结果应转换为用户消息: %+v", got[3])
+	}
+	if !strings.HasSuffix(got[4].Content, "请根据需要使用提供的工具函数。") {
+		t.Errorf("最后一条用户消息缺少工具选择提示: %q", got[4].Content)
+	}
+
+	none := applyToolEmulation(messages, emulationTestTools, &types.ToolChoice{Type: "none"})
+	if len(none) != 4 || none[0].Role != "user" {
+		t.Errorf("tool_choice=none 时不应注入工具说明: %+v", none)
+	}
+}
+
+// TestToolEmulationParser 测试从分块的回答文本中分离工具调用
+func TestToolEmulationParser(t *testing.T) {
+	call := `{"tool_calls":[{"id":"call_xxx","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"上海\"}"}}]}`
+
+	tests := []struct {
+		name      string
+		chunks    []string
+		wantText  string
+		wantCalls int
+	}{
+		{"纯JSON", []string{call[:5], call[5:40], call[40:]}, "", 1},
+		{"前后有文本", []string{"好的，", "我来查询。\n{\"tool", call[6:], "\n稍等"}, "好的，我来查询。\n\n稍等", 1},
+		{"代码块", []string{"``", "`json\n" + call[:20], call[20:] + "\n`", "``"}, "", 1},
+		{"参数为对象", []string{`{"tool_calls":[{"function":{"name":"get_weather","arguments":{"city":"上海"}}}]}`}, "", 1},
+		{"普通代码块", []string{"示例：\n```go\nfunc f() {}\n", "```\n完毕"}, "示例：\n```go\nfunc f() {}\n```\n完毕", 0},
+		{"普通JSON", []string{`结果 {"city": "上海"}`}, `结果 {"city": "上海"}`, 0},
+		{"未知函数", []string{strings.Replace(call, "get_weather", "rm_rf", 1)}, strings.Replace(call, "get_weather", "rm_rf", 1), 0},
+		{"未闭合", []string{`{"tool_calls": [`}, `{"tool_calls": [`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := newToolEmulationParser(emulationTestTools)
+			var text strings.Builder
+			for _, chunk := range tt.chunks {
+				text.WriteString(parser.Feed(chunk))
+			}
+			text.WriteString(parser.Flush())
+			calls := parser.TakeCalls()
+
+			if text.String() != tt.wantText {
+				t.Errorf("文本 = %q, 期望 %q", text.String(), tt.wantText)
+			}
+			if len(calls) != tt.wantCalls {
+				t.Fatalf("工具调用数 = %d, 期望 %d", len(calls), tt.wantCalls)
+			}
+			for _, c := range calls {
+				if c.Function.Name != "get_weather" || c.Function.Arguments != `{"city":"上海"}` || c.ID == "call_xxx" {
+					t.Errorf("工具调用 = %+v", c)
+				}
+			}
+		})
+	}
+}
+
+// TestExtractEmulatedToolCalls 测试非流式回答的工具调用提取与自然语言回退
+func TestExtractEmulatedToolCalls(t *testing.T) {
+	text, calls := extractEmulatedToolCalls("我需要查询。\n调用函数: get_weather 参数: {\"city\": \"北京\"}", emulationTestTools)
+	if len(calls) != 1 || calls[0].Function.Name != "get_weather" || calls[0].Function.Arguments != `{"city": "北京"}` {
+		t.Fatalf("自然语言工具调用 = %+v", calls)
+	}
+	if text != "我需要查询。" {
+		t.Errorf("剩余文本 = %q", text)
+	}
+
+	if _, calls := extractEmulatedToolCalls("调用函数: unknown 参数: {}", emulationTestTools); len(calls) != 0 {
+		t.Errorf("未知函数不应转换为工具调用: %+v", calls)
+	}
+}
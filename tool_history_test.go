@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestToolHistoryRoundTrip 测试多轮工具调用历史：绑定请求、转换为上游消息并序列化后，调用ID与函数名保持对应
+func TestToolHistoryRoundTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	body := `{"model":"glm-4.6","messages":[
+		{"role":"user","content":"北京和上海天气如何？"},
+		{"role":"assistant","content":null,"tool_calls":[
+			{"id":"call_bj","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"北京\"}"}},
+			{"id":"call_sh","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"上海\"}"}}]},
+		{"role":"tool","tool_call_id":"call_bj","content":"晴"},
+		{"role":"tool","tool_call_id":"call_sh","name":"get_weather","content":[{"type":"text","text":"小雨"}]},
+		{"role":"tool","tool_call_id":"call_empty","content":""}
+	]}`
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	var req types.OpenAIRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		t.Fatalf("content 为 null 的工具调用消息应通过校验: %v", err)
+	}
+	if err := validateBusinessRules(&req); err != nil {
+		t.Fatalf("业务校验失败: %v", err)
+	}
+
+	converted := convertMultimodalMessages(req.Messages)
+	encoded, err := sonicDefault.Marshal(types.UpstreamRequest{Messages: converted.Messages})
+	if err != nil {
+		t.Fatalf("序列化失败: %v", err)
+	}
+	var upstream types.UpstreamRequest
+	if err := sonicDefault.Unmarshal(encoded, &upstream); err != nil {
+		t.Fatalf("反序列化失败: %v", err)
+	}
+
+	msgs := upstream.Messages
+	if len(msgs) != 5 {
+		t.Fatalf("期望 5 条上游消息, 实际 %d 条: %s", len(msgs), encoded)
+	}
+	calls := msgs[1].ToolCalls
+	if len(calls) != 2 || calls[0].ID != "call_bj" || calls[1].ID != "call_sh" || calls[1].Function.Arguments != `{"city":"上海"}` {
+		t.Errorf("助手工具调用 = %+v", calls)
+	}
+	wantResults := []struct{ id, name, content string }{
+		{"call_bj", "get_weather", "晴"},
+		{"call_sh", "get_weather", "小雨"},
+		{"call_empty", "", ""},
+	}
+	for i, want := range wantResults {
+		got := msgs[2+i]
+		if got.Role != "tool" || got.ToolCallID != want.id || got.Name != want.name || got.Content != want.content {
+			t.Errorf("工具结果 %d = %+v, want %+v", i, got, want)
+		}
+	}
+
+	// 缺少 tool_call_id 的工具结果无法对应到调用
+	req.Messages = append(req.Messages, types.Message{Role: "tool", Content: "孤立结果"})
+	if err := validateBusinessRules(&req); err == nil {
+		t.Error("缺少 tool_call_id 的 tool 消息应被拒绝")
+	}
+}
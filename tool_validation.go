@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"z2api/errors"
+	"z2api/internal/jsonschema"
+	"z2api/types"
+)
+
+// TOOL_ARGS_INVALID_ACTION 的取值
+const (
+	toolArgsActionError    = "error"    // 返回校验错误
+	toolArgsActionReprompt = "reprompt" // 附带校验错误重新请求上游
+	toolArgsActionIgnore   = "ignore"   // 只记录日志，原样返回参数
+)
+
+// maxReportedSchemaErrors 错误信息中最多列出的校验错误数
+const maxReportedSchemaErrors = 5
+
+// toolSchema 工具声明的参数 schema
+type toolSchema struct {
+	parameters map[string]interface{}
+	strict     bool
+}
+
+// toolArgsValidator 按工具声明的参数 schema 校验工具调用参数，strict 工具先尝试修复
+type toolArgsValidator struct {
+	schemas map[string]toolSchema
+	action  string
+}
+
+// newToolArgsValidator 创建参数校验器，所有工具都没有声明参数 schema 时返回 nil
+func newToolArgsValidator(tools []types.Tool) *toolArgsValidator {
+	schemas := make(map[string]toolSchema)
+	for _, tool := range tools {
+		parameters := tool.Function.Parameters
+		if len(parameters) == 0 {
+			parameters = tool.Parameters
+		}
+		if len(parameters) == 0 {
+			continue
+		}
+		schemas[tool.Function.Name] = toolSchema{
+			parameters: parameters,
+			strict:     (tool.Function.Strict != nil && *tool.Function.Strict) || (tool.Strict != nil && *tool.Strict),
+		}
+	}
+	if len(schemas) == 0 {
+		return nil
+	}
+
+	action := toolArgsActionError
+	if appConfig != nil && appConfig.ToolArgsInvalidAction != "" {
+		action = appConfig.ToolArgsInvalidAction
+	}
+	return &toolArgsValidator{schemas: schemas, action: action}
+}
+
+// toolValidationTarget 由支持在输出前校验工具调用参数的流式处理器实现
+type toolValidationTarget interface {
+	SetToolValidator(v *toolArgsValidator)
+}
+
+// requestToolValidator 返回上游请求中工具（原生或模拟）的参数校验器
+func requestToolValidator(upstreamReq types.UpstreamRequest) *toolArgsValidator {
+	if len(upstreamReq.EmulatedTools) > 0 {
+		return newToolArgsValidator(upstreamReq.EmulatedTools)
+	}
+	return newToolArgsValidator(upstreamReq.Tools)
+}
+
+// Reprompt 参数不符合 schema 时是否重新请求上游
+func (v *toolArgsValidator) Reprompt() bool {
+	return v != nil && v.action == toolArgsActionReprompt
+}
+
+// Check 校验工具调用参数，返回（可能经过修复的）工具调用，不修改传入的切片。
+// 参数仍不符合 schema 时返回 ErrToolArgumentsInvalid；配置为 ignore 时只记录日志
+func (v *toolArgsValidator) Check(calls []types.ToolCall) ([]types.ToolCall, error) {
+	if v == nil || len(calls) == 0 {
+		return calls, nil
+	}
+
+	result := make([]types.ToolCall, len(calls))
+	copy(result, calls)
+	for i := range result {
+		fn := &result[i].Function
+		schema, ok := v.schemas[fn.Name]
+		if !ok {
+			continue
+		}
+
+		arguments, err := checkToolArguments(schema, fn.Arguments)
+		if err != nil {
+			if v.action == toolArgsActionIgnore {
+				debugLog("工具 %s 的参数不符合 schema（已忽略）: %v", fn.Name, err)
+				continue
+			}
+			return nil, errors.ErrToolArgumentsInvalid.WithDetails(fmt.Sprintf("工具 %s 的参数不符合 schema: %v", fn.Name, err))
+		}
+		fn.Arguments = arguments
+	}
+	return result, nil
+}
+
+// checkToolArguments 按 schema 校验参数字符串，strict 工具不符合时尝试一次修复
+func checkToolArguments(schema toolSchema, arguments string) (string, error) {
+	if strings.TrimSpace(arguments) == "" {
+		arguments = "{}"
+	}
+	var value interface{}
+	if err := sonicStream.UnmarshalFromString(arguments, &value); err != nil {
+		return "", fmt.Errorf("参数不是有效的 JSON: %v", err)
+	}
+
+	schemaErrors := jsonschema.Validate(schema.parameters, value)
+	if len(schemaErrors) == 0 {
+		return arguments, nil
+	}
+
+	if schema.strict {
+		repaired := jsonschema.Repair(schema.parameters, value)
+		if len(jsonschema.Validate(schema.parameters, repaired)) == 0 {
+			if encoded, err := sonicInternal.Marshal(repaired); err == nil {
+				debugLog("已修复工具调用参数: %s -> %s", arguments, encoded)
+				return string(encoded), nil
+			}
+		}
+	}
+	return "", formatSchemaErrors(schemaErrors)
+}
+
+// formatSchemaErrors 将校验错误合并为一个错误
+func formatSchemaErrors(schemaErrors []jsonschema.Error) error {
+	messages := make([]string, 0, maxReportedSchemaErrors+1)
+	for i, e := range schemaErrors {
+		if i == maxReportedSchemaErrors {
+			messages = append(messages, fmt.Sprintf("等 %d 个错误", len(schemaErrors)))
+			break
+		}
+		messages = append(messages, e.Error())
+	}
+	return fmt.Errorf("%s", strings.Join(messages, "; "))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"z2api/errors"
+	"z2api/types"
+)
+
+// TestToolArgsValidator 测试工具调用参数校验：strict 工具修复参数，非 strict 工具返回错误
+func TestToolArgsValidator(t *testing.T) {
+	parameters := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"city": map[string]interface{}{"type": "string"},
+			"days": map[string]interface{}{"type": "integer"},
+		},
+		"required": []interface{}{"city"},
+	}
+	strict := true
+	validator := newToolArgsValidator([]types.Tool{
+		{Type: "function", Function: types.ToolFunction{Name: "strict_weather", Parameters: parameters, Strict: &strict}},
+		{Type: "function", Function: types.ToolFunction{Name: "weather", Parameters: parameters}},
+		{Type: "function", Function: types.ToolFunction{Name: "no_schema"}},
+	})
+
+	tests := []struct {
+		name      string
+		call      string
+		arguments string
+		want      string
+		wantErr   bool
+	}{
+		{"符合 schema 原样返回", "weather", `{"city": "北京"}`, `{"city": "北京"}`, false},
+		{"strict 工具修复类型", "strict_weather", `{"city": "北京", "days": "3"}`, `{"city":"北京","days":3}`, false},
+		{"非 strict 工具不修复", "weather", `{"city": "北京", "days": "3"}`, "", true},
+		{"strict 工具无法修复", "strict_weather", `{"days": 3}`, "", true},
+		{"无效 JSON", "weather", `{"city": `, "", true},
+		{"未声明 schema 的工具不校验", "no_schema", `{"any": 1}`, `{"any": 1}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := []types.ToolCall{{ID: "call_1", Function: types.ToolCallFunction{Name: tt.call, Arguments: tt.arguments}}}
+			checked, err := validator.Check(calls)
+			if tt.wantErr {
+				apiErr, ok := err.(errors.APIError)
+				if !ok || apiErr.Param != "tools" {
+					t.Fatalf("期望参数校验错误, 实际 %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("意外错误: %v", err)
+			}
+			var got, want interface{}
+			sonicStream.UnmarshalFromString(checked[0].Function.Arguments, &got)
+			sonicStream.UnmarshalFromString(tt.want, &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("参数 = %s, 期望 %s", checked[0].Function.Arguments, tt.want)
+			}
+			if calls[0].Function.Arguments != tt.arguments {
+				t.Errorf("传入的工具调用被修改: %s", calls[0].Function.Arguments)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package types
+
+// ============================================
+// Anthropic Messages API 相关类型
+// ============================================
+
+// AnthropicRequest Anthropic Messages 请求结构
+type AnthropicRequest struct {
+	Model         string               `json:"model" binding:"required"`
+	Messages      []AnthropicMessage   `json:"messages" binding:"required,min=1"`
+	System        interface{}          `json:"system,omitempty"` // string 或 []AnthropicContentBlock
+	MaxTokens     int                  `json:"max_tokens" binding:"required,gte=1,lte=240000"`
+	Metadata      *AnthropicMetadata   `json:"metadata,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty" binding:"omitempty,max=4"`
+	Stream        bool                 `json:"stream,omitempty"`
+	Temperature   *float64             `json:"temperature,omitempty" binding:"omitempty,gte=0,lte=1"`
+	TopP          *float64             `json:"top_p,omitempty" binding:"omitempty,gte=0,lte=1"`
+	TopK          *int                 `json:"top_k,omitempty" binding:"omitempty,gte=1"`
+	Tools         []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *AnthropicToolChoice `json:"tool_choice,omitempty"`
+	Thinking      *AnthropicThinking   `json:"thinking,omitempty"`
+}
+
+// AnthropicMessage Anthropic 消息结构
+type AnthropicMessage struct {
+	Role    string      `json:"role" binding:"required,oneof=user assistant"`
+	Content interface{} `json:"content" binding:"required"` // string 或 []AnthropicContentBlock
+}
+
+// AnthropicContentBlock Anthropic 内容块（text、image、tool_use、tool_result、thinking）
+type AnthropicContentBlock struct {
+	Type      string                `json:"type"`
+	Text      string                `json:"text,omitempty"`
+	Source    *AnthropicImageSource `json:"source,omitempty"`
+	ID        string                `json:"id,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Input     interface{}           `json:"input,omitempty"`
+	ToolUseID string                `json:"tool_use_id,omitempty"`
+	Content   interface{}           `json:"content,omitempty"` // tool_result: string 或 []AnthropicContentBlock
+	IsError   bool                  `json:"is_error,omitempty"`
+	Thinking  string                `json:"thinking,omitempty"`
+	Signature string                `json:"signature,omitempty"`
+}
+
+// AnthropicImageSource 图片来源
+type AnthropicImageSource struct {
+	Type      string `json:"type"` // base64 或 url
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// AnthropicMetadata 请求元数据
+type AnthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+// AnthropicTool 工具定义
+type AnthropicTool struct {
+	Name        string                 `json:"name" binding:"required,max=64"`
+	Description string                 `json:"description,omitempty"`
+	InputSchema map[string]interface{} `json:"input_schema"`
+}
+
+// AnthropicToolChoice 工具选择（auto、any、tool、none）
+type AnthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+// AnthropicThinking 扩展思考配置
+type AnthropicThinking struct {
+	Type         string `json:"type"` // enabled 或 disabled
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// AnthropicResponse Anthropic Messages 响应结构
+type AnthropicResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   string                  `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+// AnthropicUsage Anthropic 用量结构
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicCountTokensRequest Anthropic count_tokens 请求结构（/v1/messages/count_tokens）
+type AnthropicCountTokensRequest struct {
+	Model      string               `json:"model" binding:"required"`
+	Messages   []AnthropicMessage   `json:"messages" binding:"required,min=1"`
+	System     interface{}          `json:"system,omitempty"` // string 或 []AnthropicContentBlock
+	Tools      []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice *AnthropicToolChoice `json:"tool_choice,omitempty"`
+	Thinking   *AnthropicThinking   `json:"thinking,omitempty"`
+}
+
+// AnthropicCountTokensResponse Anthropic count_tokens 响应结构
+type AnthropicCountTokensResponse struct {
+	InputTokens int `json:"input_tokens"`
+}
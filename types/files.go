@@ -0,0 +1,31 @@
+package types
+
+// ============================================
+// Files API 相关类型
+// ============================================
+
+// FileObject OpenAI 兼容的文件对象
+type FileObject struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	Status    string `json:"status"`
+	MimeType  string `json:"mime_type,omitempty"`
+}
+
+// FileListResponse 文件列表响应
+type FileListResponse struct {
+	Object  string       `json:"object"`
+	Data    []FileObject `json:"data"`
+	HasMore bool         `json:"has_more"`
+}
+
+// FileDeleteResponse 文件删除响应
+type FileDeleteResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
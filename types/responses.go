@@ -0,0 +1,120 @@
+package types
+
+// ============================================
+// OpenAI Responses API 相关类型
+// ============================================
+
+// ResponsesRequest Responses API 请求结构
+type ResponsesRequest struct {
+	Model             string              `json:"model" binding:"required"`
+	Input             interface{}         `json:"input" binding:"required"` // string 或 []ResponsesInputItem
+	Instructions      string              `json:"instructions,omitempty"`
+	Stream            bool                `json:"stream,omitempty"`
+	Temperature       *float64            `json:"temperature,omitempty" binding:"omitempty,gte=0,lte=2"`
+	TopP              *float64            `json:"top_p,omitempty" binding:"omitempty,gte=0,lte=1"`
+	MaxOutputTokens   *int                `json:"max_output_tokens,omitempty" binding:"omitempty,gte=1,lte=240000"`
+	Tools             []ResponsesTool     `json:"tools,omitempty" binding:"omitempty,max=20"`
+	ToolChoice        interface{}         `json:"tool_choice,omitempty"` // string 或 {"type":"function","name":...}
+	ParallelToolCalls *bool               `json:"parallel_tool_calls,omitempty"`
+	Reasoning         *ResponsesReasoning `json:"reasoning,omitempty"`
+	User              string              `json:"user,omitempty" binding:"omitempty,max=100"`
+	Metadata          map[string]string   `json:"metadata,omitempty"`
+	Store             *bool               `json:"store,omitempty"`
+}
+
+// ResponsesInputItem 输入项（message、function_call、function_call_output、reasoning）
+type ResponsesInputItem struct {
+	Type      string                 `json:"type,omitempty"` // 省略时视为 message
+	ID        string                 `json:"id,omitempty"`
+	Role      string                 `json:"role,omitempty"`
+	Content   interface{}            `json:"content,omitempty"` // string 或 []ResponsesContentPart
+	CallID    string                 `json:"call_id,omitempty"`
+	Name      string                 `json:"name,omitempty"`
+	Arguments string                 `json:"arguments,omitempty"`
+	Output    interface{}            `json:"output,omitempty"` // function_call_output 的结果
+	Summary   []ResponsesSummaryPart `json:"summary,omitempty"`
+	Status    string                 `json:"status,omitempty"`
+}
+
+// ResponsesContentPart 输入/输出内容部分（input_text、input_image、output_text）
+type ResponsesContentPart struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	ImageURL    string        `json:"image_url,omitempty"`
+	Detail      string        `json:"detail,omitempty"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+// ResponsesSummaryPart 推理摘要部分
+type ResponsesSummaryPart struct {
+	Type string `json:"type"` // summary_text
+	Text string `json:"text"`
+}
+
+// ResponsesTool 工具定义（Responses API 使用扁平结构）
+type ResponsesTool struct {
+	Type        string                 `json:"type" binding:"required"`
+	Name        string                 `json:"name,omitempty" binding:"omitempty,max=64"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	Strict      *bool                  `json:"strict,omitempty"`
+}
+
+// ResponsesReasoning 推理配置
+type ResponsesReasoning struct {
+	Effort  string `json:"effort,omitempty"`
+	Summary string `json:"summary,omitempty"`
+}
+
+// ResponsesResponse Responses API 响应结构
+type ResponsesResponse struct {
+	ID           string                `json:"id"`
+	Object       string                `json:"object"`
+	CreatedAt    int64                 `json:"created_at"`
+	Status       string                `json:"status"`
+	Model        string                `json:"model"`
+	Instructions string                `json:"instructions,omitempty"`
+	Output       []ResponsesOutputItem `json:"output"`
+	Usage        *ResponsesUsage       `json:"usage,omitempty"`
+	Metadata     map[string]string     `json:"metadata,omitempty"`
+	Error        *ResponsesError       `json:"error,omitempty"` // status 为 failed 时的错误
+
+	IncompleteDetails *ResponsesIncompleteDetails `json:"incomplete_details,omitempty"` // status 为 incomplete 时的原因
+}
+
+// ResponsesIncompleteDetails Responses API 响应未完成的原因
+type ResponsesIncompleteDetails struct {
+	Reason string `json:"reason"` // max_output_tokens
+}
+
+// ResponsesError Responses API 响应中的错误
+type ResponsesError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ResponsesOutputItem 输出项（reasoning、message、function_call）
+type ResponsesOutputItem struct {
+	Type      string                  `json:"type"`
+	ID        string                  `json:"id"`
+	Status    string                  `json:"status,omitempty"`
+	Role      string                  `json:"role,omitempty"`
+	Content   []ResponsesContentPart  `json:"content,omitempty"`
+	Summary   *[]ResponsesSummaryPart `json:"summary,omitempty"` // reasoning 项必须输出 summary 数组
+	CallID    string                  `json:"call_id,omitempty"`
+	Name      string                  `json:"name,omitempty"`
+	Arguments *string                 `json:"arguments,omitempty"`
+}
+
+// ResponsesUsage Responses API 用量结构
+type ResponsesUsage struct {
+	InputTokens         int                           `json:"input_tokens"`
+	OutputTokens        int                           `json:"output_tokens"`
+	TotalTokens         int                           `json:"total_tokens"`
+	OutputTokensDetails *ResponsesOutputTokensDetails `json:"output_tokens_details,omitempty"`
+}
+
+// ResponsesOutputTokensDetails 输出 token 的明细
+type ResponsesOutputTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
+}
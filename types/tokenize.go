@@ -0,0 +1,17 @@
+package types
+
+// TokenizeRequest 分词请求结构（/v1/tokenize），input 与 messages 至少提供一个
+type TokenizeRequest struct {
+	Model    string      `json:"model" binding:"required"`
+	Input    interface{} `json:"input,omitempty"`    // string 或 []string
+	Messages []Message   `json:"messages,omitempty"` // 按聊天请求的提示词计数
+	Tools    []Tool      `json:"tools,omitempty"`
+}
+
+// TokenizeResponse 分词响应结构
+type TokenizeResponse struct {
+	Object string   `json:"object"` // 固定为 tokenize
+	Model  string   `json:"model"`
+	Count  int      `json:"count"`            // 按模型校准后的 token 数
+	Tokens []string `json:"tokens,omitempty"` // input 的近似切分
+}
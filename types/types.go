@@ -2,6 +2,7 @@
 package types
 
 import (
+	"net"
 	"sync"
 	"time"
 )
@@ -12,9 +13,10 @@ import (
 
 // OpenAIRequest OpenAI 请求结构
 type OpenAIRequest struct {
-	Model             string                 `json:"model" binding:"required,oneof=glm-4.5 glm-4.5-thinking glm-4.5-search glm-4.5v glm-4.5-air glm-4.6 gpt-4 gpt-4-turbo gpt-3.5-turbo claude-3-opus claude-3-sonnet claude-3-haiku deepseek-chat deepseek-coder"`
+	Model             string                 `json:"model" binding:"required"` // 模型ID或别名，由 models.json 注册表校验
 	Messages          []Message              `json:"messages" binding:"required,min=1,max=50"`
 	Stream            bool                   `json:"stream,omitempty"`
+	StreamOptions     *StreamOptions         `json:"stream_options,omitempty"` // 流式选项，仅在 stream 为 true 时有效
 	Temperature       *float64               `json:"temperature,omitempty" binding:"omitempty,gte=0,lte=2"`       // 使用指针表示可选
 	MaxTokens         *int                   `json:"max_tokens,omitempty" binding:"omitempty,gte=1,lte=240000"`        // 使用指针表示可选
 	TopP              *float64               `json:"top_p,omitempty" binding:"omitempty,gte=0,lte=1"`             // 使用指针表示可选
@@ -49,6 +51,11 @@ type OpenAIRequest struct {
 	ToolChoiceObject *ToolChoice `json:"-"` // 内部使用的解析后的ToolChoice对象
 }
 
+// StreamOptions 流式响应选项
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage,omitempty"` // 在 [DONE] 之前额外输出一个 choices 为空、包含完整 usage 的块
+}
+
 // OpenAIResponse OpenAI 响应结构
 type OpenAIResponse struct {
 	ID      string   `json:"id"`
@@ -77,9 +84,50 @@ type Delta struct {
 
 // Usage 用量结构
 type Usage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens            int                      `json:"prompt_tokens"`
+	CompletionTokens        int                      `json:"completion_tokens"`
+	TotalTokens             int                      `json:"total_tokens"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+}
+
+// CompletionTokensDetails 输出 token 的明细
+type CompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"` // 思考内容的 token 数
+}
+
+// CompletionRequest 旧版文本补全请求结构 (/v1/completions)
+type CompletionRequest struct {
+	Model            string      `json:"model" binding:"required"`
+	Prompt           interface{} `json:"prompt" binding:"required"` // string 或 []string
+	Suffix           string      `json:"suffix,omitempty"`
+	MaxTokens        *int        `json:"max_tokens,omitempty" binding:"omitempty,gte=1,lte=240000"`
+	Temperature      *float64    `json:"temperature,omitempty" binding:"omitempty,gte=0,lte=2"`
+	TopP             *float64    `json:"top_p,omitempty" binding:"omitempty,gte=0,lte=1"`
+	Stream           bool        `json:"stream,omitempty"`
+	Echo             bool        `json:"echo,omitempty"`
+	Stop             interface{} `json:"stop,omitempty"` // string or []string
+	PresencePenalty  *float64    `json:"presence_penalty,omitempty" binding:"omitempty,gte=-2,lte=2"`
+	FrequencyPenalty *float64    `json:"frequency_penalty,omitempty" binding:"omitempty,gte=-2,lte=2"`
+	Seed             *int        `json:"seed,omitempty" binding:"omitempty,gte=0"`
+	User             string      `json:"user,omitempty" binding:"omitempty,max=100"`
+}
+
+// CompletionResponse 旧版文本补全响应结构
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+// CompletionChoice 文本补全选择结构
+type CompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason string      `json:"finish_reason,omitempty"`
 }
 
 // ============================================
@@ -89,9 +137,11 @@ type Usage struct {
 // Message 消息结构（支持多模态内容）
 type Message struct {
 	Role             string      `json:"role" binding:"required,oneof=system user assistant developer tool"`
-	Content          interface{} `json:"content" binding:"required"` // 支持 string 或 []ContentPart
+	Content          interface{} `json:"content" binding:"required_without=ToolCalls"` // 支持 string 或 []ContentPart，带工具调用的助手消息可为 null
 	ReasoningContent string      `json:"reasoning_content,omitempty" binding:"omitempty,max=10000"`
 	ToolCalls        []ToolCall  `json:"tool_calls,omitempty" binding:"omitempty,max=10"`
+	ToolCallID       string      `json:"tool_call_id,omitempty" binding:"omitempty,max=256"` // tool 消息对应的工具调用ID
+	Name             string      `json:"name,omitempty" binding:"omitempty,max=64"`          // tool 消息对应的函数名
 }
 
 // ContentPart 内容部分结构（用于多模态消息）
@@ -102,6 +152,7 @@ type ContentPart struct {
 	VideoURL    *VideoURL    `json:"video_url,omitempty"`
 	DocumentURL *DocumentURL `json:"document_url,omitempty"`
 	AudioURL    *AudioURL    `json:"audio_url,omitempty"`
+	File        *FileRef     `json:"file,omitempty"`
 	// 兼容性字段
 	URL      string `json:"url,omitempty" binding:"omitempty,url"`       // 保持向后兼容
 	AltText  string `json:"alt_text,omitempty" binding:"omitempty,max=500"`  // 替代文本
@@ -130,6 +181,13 @@ type AudioURL struct {
 	URL string `json:"url" binding:"required,url"`
 }
 
+// FileRef 文件内容引用，file_id 引用已上传的文件，file_data 为 data URL 形式的内联文件
+type FileRef struct {
+	FileID   string `json:"file_id,omitempty"`
+	FileData string `json:"file_data,omitempty"`
+	Filename string `json:"filename,omitempty"`
+}
+
 // ============================================
 // 工具调用相关类型
 // ============================================
@@ -182,15 +240,37 @@ type ToolChoiceFunction struct {
 	Name string `json:"name"`
 }
 
+// ResponseFormat 解析后的 response_format
+type ResponseFormat struct {
+	Type       string            `json:"type"` // text, json_object, json_schema
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat response_format 为 json_schema 时的 schema 定义
+type JSONSchemaFormat struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Schema      map[string]interface{} `json:"schema,omitempty"`
+	Strict      *bool                  `json:"strict,omitempty"`
+}
+
+// IsStrict 是否要求输出严格符合 schema
+func (f *ResponseFormat) IsStrict() bool {
+	return f != nil && f.JSONSchema != nil && f.JSONSchema.Strict != nil && *f.JSONSchema.Strict && len(f.JSONSchema.Schema) > 0
+}
+
 // ============================================
 // 上游请求/响应相关类型
 // ============================================
 
 // UpstreamMessage 上游消息结构（简化格式，仅支持字符串内容）
 type UpstreamMessage struct {
-	Role             string `json:"role"`
-	Content          string `json:"content"`
-	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Role             string     `json:"role"`
+	Content          string     `json:"content"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`    // 助手消息发起的工具调用
+	ToolCallID       string     `json:"tool_call_id,omitempty"` // tool 消息对应的工具调用ID
+	Name             string     `json:"name,omitempty"`         // tool 消息对应的函数名
 }
 
 // UpstreamRequest 上游请求结构
@@ -213,6 +293,23 @@ type UpstreamRequest struct {
 	Variables   map[string]string `json:"variables,omitempty"`
 	Tools       []Tool            `json:"tools,omitempty"`
 	ToolChoice  interface{}       `json:"tool_choice,omitempty"`
+	Files       []UpstreamFile    `json:"files,omitempty"`
+
+	EmulatedTools    []Tool          `json:"-"` // 模型不支持原生工具调用时，通过提示词模拟的工具
+	ToolChoiceObject *ToolChoice     `json:"-"` // 需要在输出侧校验的 tool_choice
+	ResponseFormat   *ResponseFormat `json:"-"` // 需要在输出侧处理的 response_format（json_object、json_schema）
+	StopSequences    []string        `json:"-"` // 需要在输出侧匹配的停止序列
+	MaxTokens        int             `json:"-"` // 需要在输出侧限制的最大输出 token 数，0 表示不限制
+	IncludeUsage     bool            `json:"-"` // 流式响应结束前是否输出 usage 块（stream_options.include_usage）
+}
+
+// UpstreamFile 上游请求中引用的已上传文件
+type UpstreamFile struct {
+	Type     string `json:"type"` // image, audio, video, document
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	MimeType string `json:"mime_type,omitempty"`
+	Size     int64  `json:"size,omitempty"`
 }
 
 // UpstreamData 上游SSE响应结构
@@ -252,10 +349,22 @@ type ModelsResponse struct {
 
 // Model 模型结构
 type Model struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
+	ID           string             `json:"id"`
+	Object       string             `json:"object"`
+	Created      int64              `json:"created"`
+	OwnedBy      string             `json:"owned_by"`
+	Name         string             `json:"name,omitempty"`
+	Root         string             `json:"root,omitempty"` // 别名指向的模型ID
+	Capabilities *ModelCapabilities `json:"capabilities,omitempty"`
+}
+
+// ModelCapabilities 模型能力，供客户端在运行时发现模型支持的功能
+type ModelCapabilities struct {
+	Vision        bool `json:"vision"`
+	Tools         bool `json:"tools"`
+	Thinking      bool `json:"thinking"`
+	Search        bool `json:"search"`
+	ContextLength int  `json:"context_length,omitempty"`
 }
 
 // ============================================
@@ -296,6 +405,7 @@ type RequestStats struct {
 	FastestResponse      float64
 	SlowestResponse      float64
 	ModelUsage           map[string]int64
+	UpstreamRetries      int64 // 上游请求的累计重试次数
 	Mutex                sync.RWMutex // 改为公开字段
 }
 
@@ -325,6 +435,40 @@ type Config struct {
 	ThinkTagsMode         string
 	AnonTokenEnabled      bool
 	MaxConcurrentRequests int
+	UploadCacheTTL        time.Duration // 上传缓存条目有效期，0 表示禁用缓存
+	UploadCacheMaxMemory  int64         // 上传缓存内存上限（字节）
+	FetchAllowCIDRs       []*net.IPNet  // 远程文件获取允许的网段（优先于禁止列表）
+	FetchDenyCIDRs        []*net.IPNet  // 远程文件获取禁止的网段（含默认的内网网段）
+	FetchMaxRedirects     int           // 远程文件获取的最大重定向次数
+	FetchMaxBodySize      int64         // 远程文件获取的响应体上限（字节）
+	ImageNormalize        bool          // 上传前规范化图片（缩放、去除EXIF、重新编码）
+	ImageMaxDimension     int           // 模型未配置时图片长边的上限（像素）
+	ToolArgsInvalidAction string        // 工具调用参数不符合 schema 时的处理方式：error、reprompt、ignore
+	CountReasoningTokens  bool          // 思考内容是否计入 max_tokens
+	RetryMaxAttempts      int           // 上游请求最大尝试次数（含首次请求），1 表示不重试
+	RetryBaseDelay        time.Duration // 重试指数退避的基础延迟
+	RetryMaxDelay         time.Duration // 重试单次退避延迟的上限
+	RetryBudget           time.Duration // 单个请求累计等待重试的时间上限，0 表示不限制
+	RetryStatusCodes      []int         // 可重试的上游状态码
+	RetryBodyPatterns     []string      // 上游错误响应体包含其中任一文本时可重试
+	BreakerEnabled        bool          // 启用上游熔断器
+	BreakerWindow         time.Duration // 熔断器统计失败率的滚动窗口
+	BreakerMinRequests    int           // 窗口内请求数达到该值后才判断是否熔断
+	BreakerErrorRate      float64       // 触发熔断的失败率（0-1）
+	BreakerSlowCall       time.Duration // 慢调用的耗时阈值，0 表示不按耗时熔断
+	BreakerSlowRate       float64       // 触发熔断的慢调用比例（0-1）
+	BreakerOpenTimeout    time.Duration // 熔断持续多久后进入 half-open
+	BreakerProbes         int           // half-open 状态放行的探测请求数
+	UpstreamTokens        []string      // 上游 token 池中的账号 token
+	TokenPoolStrategy     string        // token 池选择策略：round-robin、least-in-flight
+	TokenCooldown         time.Duration // token 收到 401 或 429 后暂停使用的时间
+	AnonTokenPoolSize     int           // 预先获取的空闲匿名 token 数，0 表示不预先获取
+	AnonTokenTTL          time.Duration // 每个匿名 token 的有效期
+	AnonTokenMaxUses      int           // 每个匿名 token 最多服务的请求数，0 表示不限制
+	AnonTokenConcurrency  int           // 获取匿名 token 的最大并发数
+	FirstByteTimeout      time.Duration // 收到上游响应头后等待第一个字节的上限，0 表示不限制
+	StreamIdleTimeout     time.Duration // 上游流相邻两次数据的最大间隔，0 表示不限制
+	ThinkingTimeout       time.Duration // 上游思考阶段的最长持续时间，0 表示不限制
 }
 
 // ============================================
@@ -388,6 +532,7 @@ type StatsUpdate struct {
 	Duration    float64
 	UserAgent   string
 	Method      string
+	Retries     int64 // 本次请求重试上游的次数
 }
 
 // Float64Ptr 返回float64值的指针
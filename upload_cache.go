@@ -0,0 +1,210 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"sync"
+	"time"
+
+	"z2api/internal/signature"
+	"z2api/internal/tokenpool"
+	"z2api/types"
+	"z2api/utils"
+)
+
+// uploadCacheEntryOverhead 每个缓存条目除字符串外的估算内存开销（字节）
+const uploadCacheEntryOverhead = 256
+
+// 上传缓存监控指标
+var (
+	uploadCacheHits   = expvar.NewInt("upload_cache_hits")
+	uploadCacheMisses = expvar.NewInt("upload_cache_misses")
+)
+
+// cachedUpload 缓存中的上游文件及其来源URL的校验信息
+type cachedUpload struct {
+	File         types.UpstreamFile
+	ETag         string
+	LastModified string
+}
+
+// uploadCacheEntry 缓存条目
+type uploadCacheEntry struct {
+	key       string
+	owner     string // 所属上游 token 的摘要
+	value     cachedUpload
+	expiresAt time.Time
+	size      int64
+	elem      *list.Element
+}
+
+// UploadCache 已上传文件的内容寻址缓存
+// 按内容哈希（以及带 ETag/Last-Modified 的来源URL）映射到上游文件ID。
+// 上游文件归属于上传时使用的 token，因此条目按 token 隔离，并在 TTL 或 token 过期时淘汰；
+// 内存占用由 ResourceGuard 限制，超出时按最近最少使用淘汰
+type UploadCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	guard   *utils.ResourceGuard
+	entries map[string]*uploadCacheEntry
+	lru     *list.List // 队首为最近使用
+}
+
+// NewUploadCache 创建上传缓存
+func NewUploadCache(ttl time.Duration, maxMemory int64) *UploadCache {
+	return &UploadCache{
+		ttl:     ttl,
+		guard:   utils.NewResourceGuard(maxMemory),
+		entries: make(map[string]*uploadCacheEntry),
+		lru:     list.New(),
+	}
+}
+
+// contentHash 计算文件内容的 SHA-256 摘要
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenExpiry 从 JWT 的 exp 字段解析 token 过期时间，无法解析时返回零值
+func tokenExpiry(token string) time.Time {
+	payload, err := signature.DecodeJWT(token)
+	if err != nil || payload.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(payload.Exp, 0)
+}
+
+// GetContent 按内容哈希查找上游文件
+func (uc *UploadCache) GetContent(token, hash string) (types.UpstreamFile, bool) {
+	value, ok := uc.get(tokenpool.Fingerprint(token) + "|sha256:" + hash)
+	return value.File, ok
+}
+
+// PutContent 按内容哈希缓存上游文件
+func (uc *UploadCache) PutContent(token, hash string, file types.UpstreamFile) {
+	uc.put(token, "sha256:"+hash, cachedUpload{File: file})
+}
+
+// GetURL 按来源URL查找上游文件及其校验信息
+func (uc *UploadCache) GetURL(token, url string) (cachedUpload, bool) {
+	return uc.get(tokenpool.Fingerprint(token) + "|url:" + url)
+}
+
+// PutURL 按来源URL缓存上游文件，仅在来源提供 ETag 或 Last-Modified 时缓存
+func (uc *UploadCache) PutURL(token, url string, value cachedUpload) {
+	if value.ETag == "" && value.LastModified == "" {
+		return
+	}
+	uc.put(token, "url:"+url, value)
+}
+
+// EvictToken 淘汰属于指定 token 的全部条目
+func (uc *UploadCache) EvictToken(token string) {
+	owner := tokenpool.Fingerprint(token)
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	evicted := 0
+	for _, entry := range uc.entries {
+		if entry.owner == owner {
+			uc.removeLocked(entry)
+			evicted++
+		}
+	}
+	if evicted > 0 {
+		debugLog("上传缓存已淘汰失效 token 的 %d 个条目", evicted)
+	}
+}
+
+// Len 返回缓存条目数
+func (uc *UploadCache) Len() int {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return len(uc.entries)
+}
+
+// get 查找未过期的条目并标记为最近使用
+func (uc *UploadCache) get(key string) (cachedUpload, bool) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	entry, ok := uc.entries[key]
+	if !ok {
+		uploadCacheMisses.Add(1)
+		return cachedUpload{}, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		uc.removeLocked(entry)
+		uploadCacheMisses.Add(1)
+		return cachedUpload{}, false
+	}
+
+	uc.lru.MoveToFront(entry.elem)
+	uploadCacheHits.Add(1)
+	return entry.value, true
+}
+
+// put 写入条目，过期时间取缓存 TTL 与 token 过期时间中较早者
+func (uc *UploadCache) put(token, key string, value cachedUpload) {
+	now := time.Now()
+	expiresAt := now.Add(uc.ttl)
+	if exp := tokenExpiry(token); !exp.IsZero() && exp.Before(expiresAt) {
+		expiresAt = exp
+	}
+	if !expiresAt.After(now) {
+		return
+	}
+
+	owner := tokenpool.Fingerprint(token)
+	entry := &uploadCacheEntry{
+		key:       owner + "|" + key,
+		owner:     owner,
+		value:     value,
+		expiresAt: expiresAt,
+	}
+	entry.size = int64(uploadCacheEntryOverhead + 2*len(entry.key) + len(value.File.ID) + len(value.File.Name) +
+		len(value.File.MimeType) + len(value.ETag) + len(value.LastModified))
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	if old, ok := uc.entries[entry.key]; ok {
+		uc.removeLocked(old)
+	}
+
+	// 内存不足时先清理过期条目，再按最近最少使用淘汰
+	if !uc.guard.TryAllocate(entry.size) {
+		uc.evictExpiredLocked(now)
+		for !uc.guard.TryAllocate(entry.size) {
+			oldest := uc.lru.Back()
+			if oldest == nil {
+				debugLog("上传缓存条目超过内存上限，跳过缓存: %s", key)
+				return
+			}
+			uc.removeLocked(oldest.Value.(*uploadCacheEntry))
+		}
+	}
+
+	entry.elem = uc.lru.PushFront(entry)
+	uc.entries[entry.key] = entry
+}
+
+// evictExpiredLocked 清理全部过期条目，调用方需持有锁
+func (uc *UploadCache) evictExpiredLocked(now time.Time) {
+	for _, entry := range uc.entries {
+		if now.After(entry.expiresAt) {
+			uc.removeLocked(entry)
+		}
+	}
+}
+
+// removeLocked 删除条目并释放内存配额，调用方需持有锁
+func (uc *UploadCache) removeLocked(entry *uploadCacheEntry) {
+	delete(uc.entries, entry.key)
+	uc.lru.Remove(entry.elem)
+	uc.guard.Release(entry.size)
+}
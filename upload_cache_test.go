@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"z2api/types"
+	"z2api/utils"
+)
+
+// TestUploadCacheReuse 测试相同内容与未变化的远程文件不会重复上传
+func TestUploadCacheReuse(t *testing.T) {
+	var uploads, downloads, notModified atomic.Int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(testPDF)
+	}))
+	defer source.Close()
+
+	uploader := newTestUploader(t, func(w http.ResponseWriter, r *http.Request) {
+		uploads.Add(1)
+		w.Write([]byte(`{"id":"file-1"}`))
+	})
+	uploader.cache = NewUploadCache(time.Hour, 1<<20)
+	uploader.fetcher = newLoopbackFetcher(t)
+
+	ctx := context.Background()
+	inline := utils.ProcessedFile{Type: "document", URL: dataURL("application/pdf", testPDF)}
+	remote := utils.ProcessedFile{Type: "document", URL: source.URL + "/report.pdf"}
+	for _, file := range []utils.ProcessedFile{inline, inline, remote, remote} {
+		uploaded, err := uploader.Upload(ctx, file)
+		if err != nil {
+			t.Fatalf("上传失败: %v", err)
+		}
+		if uploaded.ID != "file-1" {
+			t.Errorf("fileID = %q", uploaded.ID)
+		}
+	}
+
+	if uploads.Load() != 1 {
+		t.Errorf("上游上传次数 = %d, want 1", uploads.Load())
+	}
+	if downloads.Load() != 1 || notModified.Load() != 1 {
+		t.Errorf("下载 %d 次, 304 %d 次, want 1/1", downloads.Load(), notModified.Load())
+	}
+
+	// 其他 token 不能复用该 token 上传的文件
+	if _, ok := uploader.cache.GetContent("other-token", contentHash(testPDF)); ok {
+		t.Error("不同 token 不应命中缓存")
+	}
+	uploader.cache.EvictToken("test-token")
+	if uploader.cache.Len() != 0 {
+		t.Errorf("淘汰 token 后仍有 %d 个条目", uploader.cache.Len())
+	}
+}
+
+// TestUploadCacheMemoryBound 测试超过内存上限时按最近最少使用淘汰
+func TestUploadCacheMemoryBound(t *testing.T) {
+	cache := NewUploadCache(time.Hour, 3*uploadCacheEntryOverhead)
+	for _, hash := range []string{"a", "b", "c", "d"} {
+		cache.PutContent("token", hash, types.UpstreamFile{ID: "file-" + hash})
+		cache.GetContent("token", "a") // 保持 a 为最近使用
+	}
+
+	if _, ok := cache.GetContent("token", "a"); !ok {
+		t.Error("最近使用的条目不应被淘汰")
+	}
+	if _, ok := cache.GetContent("token", "b"); ok {
+		t.Error("最久未使用的条目应被淘汰")
+	}
+	if used, max := cache.guard.GetCurrentUsage(), cache.guard.GetMaxUsage(); used > max {
+		t.Errorf("内存占用 %d 超过上限 %d", used, max)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	stderrors "errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"z2api/internal/breaker"
+	"z2api/internal/tokenpool"
+)
+
+// upstreamBreakers 按上游地址与凭证维护的熔断器，启动时按配置重新初始化，为 nil 时不熔断
+var upstreamBreakers = breaker.NewGroup(breaker.DefaultConfig())
+
+// upstreamBreakerKey 返回熔断器的键，不包含凭证原文：
+// 配置的账号 token（UPSTREAM_TOKEN 与 token 池）为上游地址与凭证摘要（与 token 池统计中的 id 一致）；
+// 匿名 token 按会话绑定且会轮换，单个 token 的请求数难以达到熔断下限，因此共用上游地址级别的熔断器
+func upstreamBreakerKey(authToken string) string {
+	if !isAccountToken(authToken) {
+		return appConfig.UpstreamUrl + "#anon"
+	}
+	return appConfig.UpstreamUrl + "#" + tokenpool.Fingerprint(authToken)
+}
+
+// isAccountToken 判断 token 是否为配置的账号 token（UPSTREAM_TOKEN 或 token 池中的 token），否则视为匿名 token
+func isAccountToken(authToken string) bool {
+	if authToken != "" && authToken == appConfig.UpstreamToken {
+		return true
+	}
+	return upstreamTokenPool != nil && upstreamTokenPool.Contains(authToken)
+}
+
+// upstreamBreaker 返回凭证对应的熔断器，未启用熔断时返回 nil
+func upstreamBreaker(authToken string) *breaker.Breaker {
+	if upstreamBreakers == nil {
+		return nil
+	}
+	return upstreamBreakers.Get(upstreamBreakerKey(authToken))
+}
+
+// isUpstreamFailure 判断一次上游调用对熔断器而言是否失败：网络错误、超时、429 与 5xx。
+// 其他 4xx 表示请求本身的问题，不代表上游不可用
+func isUpstreamFailure(err error, statusCode int) bool {
+	return err != nil || statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// breakerBody 包装上游 200 响应体，关闭时将整个流的结果与耗时计入熔断器：
+// 读取出错或看门狗判定停滞记为失败；客户端取消且未读完时无法判断结果，不计入统计
+type breakerBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	breaker *breaker.Breaker
+	start   time.Time
+	mu      sync.Mutex
+	failed  bool
+	eof     bool
+	once    sync.Once
+}
+
+// trackStreamBreaker 让响应体在关闭时向熔断器报告结果，cb 为 nil 时原样返回
+func trackStreamBreaker(ctx context.Context, cb *breaker.Breaker, start time.Time, body io.ReadCloser) io.ReadCloser {
+	if cb == nil {
+		return body
+	}
+	return &breakerBody{ReadCloser: body, ctx: ctx, breaker: cb, start: start}
+}
+
+func (b *breakerBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.mu.Lock()
+		if err == io.EOF {
+			b.eof = true
+		} else if !stderrors.Is(err, context.Canceled) {
+			// 取消由客户端断开、看门狗或提前结束（停止序列、max_tokens）引起，由关闭时分别判断
+			b.failed = true
+		}
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+// MarkFailed 记录上游流停滞，关闭时计为失败
+func (b *breakerBody) MarkFailed() {
+	b.mu.Lock()
+	b.failed = true
+	b.mu.Unlock()
+}
+
+func (b *breakerBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.mu.Lock()
+		failed, eof := b.failed, b.eof
+		b.mu.Unlock()
+		switch {
+		case failed:
+			b.breaker.Done(false, time.Since(b.start))
+		case !eof && b.ctx.Err() != nil:
+			b.breaker.Abort()
+		default:
+			b.breaker.Done(true, time.Since(b.start))
+		}
+	})
+	return err
+}
+
+// markUpstreamFailed 响应体计入熔断器时将本次上游流记为失败
+func markUpstreamFailed(body io.Reader) {
+	if b, ok := body.(interface{ MarkFailed() }); ok {
+		b.MarkFailed()
+	}
+}
+
+// upstreamBreakerStatuses 返回所有熔断器的状态，未启用熔断时返回空列表
+func upstreamBreakerStatuses() []breaker.Status {
+	if upstreamBreakers == nil {
+		return []breaker.Status{}
+	}
+	return upstreamBreakers.Statuses()
+}
+
+// upstreamAvailability 汇总熔断器状态：全部 closed 为 available，全部 open 为 unavailable，否则为 degraded
+func upstreamAvailability(statuses []breaker.Status) string {
+	open := 0
+	for _, status := range statuses {
+		if status.State != breaker.Closed.String() {
+			open++
+		}
+	}
+	switch {
+	case open == 0:
+		return "available"
+	case open == len(statuses):
+		return "unavailable"
+	default:
+		return "degraded"
+	}
+}
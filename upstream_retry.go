@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"z2api/errors"
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// upstreamAttemptsHeader 响应头：本次请求调用上游的总次数（含重试）
+	upstreamAttemptsHeader = "X-Upstream-Attempts"
+	// upstreamAttemptsKey、upstreamRetriesKey gin 上下文中记录上游调用次数与重试次数的键
+	upstreamAttemptsKey = "upstream_attempts"
+	upstreamRetriesKey  = "upstream_retries"
+	// upstreamTokenKey gin 上下文中记录重试换用后的上游 token 的键
+	upstreamTokenKey = "upstream_token"
+)
+
+// RetryPolicy 上游请求的重试策略
+// 重试只发生在打开上游响应时，此时尚未向客户端输出任何内容
+type RetryPolicy struct {
+	MaxAttempts  int           // 最大尝试次数（含首次请求），1 表示不重试
+	BaseDelay    time.Duration // 指数退避的基础延迟
+	MaxDelay     time.Duration // 单次退避延迟的上限
+	Budget       time.Duration // 单个请求累计等待重试的时间上限，0 表示不限制
+	StatusCodes  []int         // 可重试的上游状态码
+	BodyPatterns []string      // 上游非 200 响应体包含其中任一文本时可重试（不区分大小写）
+}
+
+// DefaultRetryPolicy 返回默认的重试策略
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  3,
+		BaseDelay:    100 * time.Millisecond,
+		MaxDelay:     10 * time.Second,
+		Budget:       30 * time.Second,
+		StatusCodes:  []int{http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		BodyPatterns: []string{"系统繁忙", "system busy", "rate limit", "too many requests", "temporarily unavailable"},
+	}
+}
+
+// upstreamRetryPolicy 全局上游重试策略，启动时按配置重新初始化
+var upstreamRetryPolicy = DefaultRetryPolicy()
+
+// parseStatusCodeList 解析逗号分隔的 HTTP 状态码列表
+func parseStatusCodeList(list string) ([]int, error) {
+	var codes []int
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("无效的状态码 %q", item)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// parsePatternList 解析逗号分隔的文本列表，忽略空项
+func parsePatternList(list string) []string {
+	var patterns []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			patterns = append(patterns, item)
+		}
+	}
+	return patterns
+}
+
+// Retryable 判断一次失败的上游调用是否可重试：网络错误按 isRetryableError 判断，HTTP 响应按状态码与响应体判断
+func (p RetryPolicy) Retryable(err error, statusCode int, body []byte) bool {
+	if err != nil {
+		return isRetryableError(err, 0, nil)
+	}
+	if statusCode == http.StatusOK {
+		return false
+	}
+	if slices.Contains(p.StatusCodes, statusCode) {
+		return true
+	}
+
+	lower := strings.ToLower(string(body))
+	for _, pattern := range p.BodyPatterns {
+		if strings.Contains(lower, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay 返回第 attempt 次重试（从 0 开始）前的等待时间：指数退避，上游要求的 Retry-After 更长时以其为准
+func (p RetryPolicy) Delay(attempt int, retryAfter time.Duration) time.Duration {
+	return max(calculateBackoffDelay(attempt, p.BaseDelay, p.MaxDelay), retryAfter)
+}
+
+// retryAfterDelay 解析 Retry-After 响应头（秒数或 HTTP 日期），缺失或无效时返回 0
+func retryAfterDelay(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// callUpstreamWithRetry 按重试策略调用上游API，返回响应、实际调用次数与最后一次调用使用的 token
+// 每次调用的结果计入熔断器与 token 池，熔断器打开时返回 errors.ErrUpstreamUnavailable；
+// 200 响应在响应体关闭时才计入熔断器，耗时按整个流计算，流中途停滞或读取出错记为失败；
+// 池中的 token 收到 401 或 429 后进入冷却，重试时换用池中其他 token，401 时换用新的匿名 token；
+// 请求包含已上传的文件时不换用 token：文件归属于上传时使用的 token，换用后上游无法访问；
+// 重试次数或等待预算用尽时返回最后一次的响应（可能不是 200）或错误，由调用方报告
+func callUpstreamWithRetry(ctx context.Context, policy RetryPolicy, upstreamReq types.UpstreamRequest, chatID string, authToken string, sessionID string) (*http.Response, context.CancelFunc, int, string, error) {
+	maxAttempts := max(policy.MaxAttempts, 1)
+	var waited time.Duration
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, attempt - 1, authToken, err
+		}
+
+		// 熔断器打开时直接失败，不再等待上游超时
+		cb := upstreamBreaker(authToken)
+		if cb != nil && !cb.Allow() {
+			debugLog("上游熔断器处于 %s 状态，拒绝请求", cb.State())
+			return nil, nil, attempt - 1, authToken, errors.ErrUpstreamUnavailable.WithDetails("上游服务暂不可用（已熔断），请稍后重试")
+		}
+
+		debugLog("开始第 %d/%d 次尝试调用上游API", attempt, maxAttempts)
+		endToken := beginPoolToken(authToken)
+		start := time.Now()
+		resp, cancel, err := callUpstreamWithHeaders(ctx, upstreamReq, chatID, authToken, sessionID)
+		latency := time.Since(start)
+
+		statusCode := 0
+		if err == nil {
+			statusCode = resp.StatusCode
+		}
+		if cb != nil {
+			switch {
+			case err != nil && ctx.Err() != nil:
+				cb.Abort() // 客户端取消，不代表上游异常
+			case err == nil && statusCode == http.StatusOK:
+				// 200 响应在响应体关闭时计入，流中途停滞或读取出错同样记为失败
+			default:
+				cb.Done(!isUpstreamFailure(err, statusCode), latency)
+			}
+		}
+
+		var bodyBytes []byte
+		var retryAfter time.Duration
+		if err == nil {
+			if statusCode == http.StatusOK {
+				debugLog("上游调用成功 (尝试 %d/%d): %d", attempt, maxAttempts, statusCode)
+				reportPoolToken(ctx, authToken, nil, statusCode, latency, 0)
+				// 流式响应读完关闭后才结束 token 的进行中计数
+				resp.Body = trackStreamBreaker(ctx, cb, start, &releaseOnClose{ReadCloser: resp.Body, release: endToken})
+				return resp, cancel, attempt, authToken, nil
+			}
+			// 读取部分响应体用于判断是否可重试，并重新包装以便调用方读取完整的错误信息
+			bodyBytes, _ = io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(bodyBytes), resp.Body), resp.Body}
+			retryAfter = retryAfterDelay(resp.Header.Get("Retry-After"), time.Now())
+		}
+		reportPoolToken(ctx, authToken, err, statusCode, latency, retryAfter)
+		endToken()
+
+		if !policy.Retryable(err, statusCode, bodyBytes) {
+			debugLog("上游调用失败且不可重试 (尝试 %d/%d): 状态码 %d, 错误: %v", attempt, maxAttempts, statusCode, err)
+			return resp, cancel, attempt, authToken, err
+		}
+		if statusCode == http.StatusUnauthorized && len(upstreamReq.Files) > 0 {
+			// token 已失效，但文件归属于该 token，换用其他 token 后上游无法访问文件，不再重试
+			debugLog("上游返回 401 且请求包含已上传的文件，不换用 token 重试")
+			invalidateAnonToken(authToken)
+			return resp, cancel, attempt, authToken, err
+		}
+		if attempt >= maxAttempts {
+			debugLog("上游调用在 %d 次尝试后仍然失败: 状态码 %d, 错误: %v", attempt, statusCode, err)
+			if err != nil && attempt > 1 {
+				err = fmt.Errorf("上游API在 %d 次尝试后仍然失败: %w", attempt, err)
+			}
+			return resp, cancel, attempt, authToken, err
+		}
+
+		delay := policy.Delay(attempt-1, retryAfter)
+		if policy.Budget > 0 && waited+delay > policy.Budget {
+			debugLog("重试等待预算已用尽 (已等待 %v，本次需等待 %v，预算 %v)，停止重试", waited, delay, policy.Budget)
+			return resp, cancel, attempt, authToken, err
+		}
+		waited += delay
+
+		if resp != nil {
+			debugLog("收到可重试的HTTP状态码 %d (尝试 %d/%d)，错误详情: %s", statusCode, attempt, maxAttempts, string(bodyBytes))
+			switch {
+			case len(upstreamReq.Files) > 0:
+				// 文件归属于上传时使用的 token，沿用该 token 等待后重试（401 已在上面返回）
+			case isPoolTokenRejected(authToken, statusCode):
+				// token 已进入冷却，换用池中其他 token；池中没有可用的 token 时 401 仍按原方式刷新
+				if token, ok := pickPoolToken(); ok {
+					authToken = token
+				} else if statusCode == http.StatusUnauthorized {
+					authToken = refreshUpstreamToken(ctx, authToken, sessionID)
+				}
+			case statusCode == http.StatusUnauthorized:
+				authToken = refreshUpstreamToken(ctx, authToken, sessionID)
+			}
+			cleanupResponse(resp, cancel)
+		} else {
+			debugLog("上游调用失败 (尝试 %d/%d): %v", attempt, maxAttempts, err)
+		}
+
+		debugLog("等待 %v 后重试", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, attempt, authToken, ctx.Err()
+		}
+	}
+}
+
+// invalidateAnonToken 上游返回 401 时使匿名 token 失效，会话下次请求换用新的 token
+func invalidateAnonToken(authToken string) {
+	if anonTokens != nil {
+		anonTokens.InvalidateToken(authToken)
+	}
+}
+
+// refreshUpstreamToken 上游返回 401 时使匿名 token 失效，启用匿名 token 时为会话绑定新的 token；获取失败时沿用原 token
+func refreshUpstreamToken(ctx context.Context, authToken, sessionID string) string {
+	invalidateAnonToken(authToken)
+	if !appConfig.AnonTokenEnabled {
+		return authToken
+	}
+	newToken, err := getAnonymousToken(ctx, sessionID)
+	if err != nil {
+		debugLog("刷新匿名token失败: %v", err)
+		return authToken
+	}
+	debugLog("成功获取新的匿名token，下次重试将使用新token和新签名")
+	return newToken
+}
+
+// recordUpstreamToken 记录重试后实际使用的上游 token，同一请求后续的纠正重试沿用该 token
+func recordUpstreamToken(c *gin.Context, authToken string) {
+	c.Set(upstreamTokenKey, authToken)
+}
+
+// currentUpstreamToken 返回本次请求当前应使用的上游 token：之前的调用换用过 token 时返回换用后的 token
+func currentUpstreamToken(c *gin.Context, authToken string) string {
+	if token := c.GetString(upstreamTokenKey); token != "" {
+		return token
+	}
+	return authToken
+}
+
+// recordUpstreamAttempts 累计本次请求调用上游的次数与重试次数，并写入响应头
+func recordUpstreamAttempts(c *gin.Context, attempts int) {
+	if attempts <= 0 {
+		return
+	}
+	total := c.GetInt(upstreamAttemptsKey) + attempts
+	c.Set(upstreamAttemptsKey, total)
+	c.Set(upstreamRetriesKey, c.GetInt(upstreamRetriesKey)+attempts-1)
+	c.Header(upstreamAttemptsHeader, strconv.Itoa(total))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"z2api/errors"
+	"z2api/internal/tokenpool"
+
+	"github.com/gin-gonic/gin"
+)
+
+// upstreamTokenPool 上游账号 token 池，启动时按配置初始化，为 nil 时使用 UPSTREAM_TOKEN 或匿名 token
+var upstreamTokenPool *tokenpool.Pool
+
+// pickPoolToken 从 token 池中选择一个可用的 token；未配置 token 池或全部不可用时第二个返回值为 false
+func pickPoolToken() (string, bool) {
+	if upstreamTokenPool == nil {
+		return "", false
+	}
+	token, ok := upstreamTokenPool.Pick()
+	if !ok {
+		debugLog("token 池中没有可用的 token（全部冷却或过期）")
+	}
+	return token, ok
+}
+
+// setPoolRetryAfter 获取 token 失败返回 503 时，按 token 池中最早结束冷却的时间设置 Retry-After 响应头，没有 token 会恢复时不设置
+func setPoolRetryAfter(c *gin.Context, apiErr errors.APIError) {
+	if upstreamTokenPool == nil || apiErr.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	next := upstreamTokenPool.NextAvailable()
+	if wait := time.Until(next); !next.IsZero() && wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+}
+
+// beginPoolToken 记录 token 开始一次上游调用，返回结束时调用的函数；不属于 token 池时返回空操作
+func beginPoolToken(authToken string) func() {
+	if upstreamTokenPool == nil || !upstreamTokenPool.Contains(authToken) {
+		return func() {}
+	}
+	upstreamTokenPool.Begin(authToken)
+	var once sync.Once
+	return func() { once.Do(func() { upstreamTokenPool.End(authToken) }) }
+}
+
+// reportPoolToken 记录一次上游调用对 token 的结果，客户端取消的调用不计入
+func reportPoolToken(ctx context.Context, authToken string, err error, statusCode int, latency, retryAfter time.Duration) {
+	if upstreamTokenPool == nil || (err != nil && ctx.Err() != nil) {
+		return
+	}
+	upstreamTokenPool.Report(authToken, err == nil && statusCode == http.StatusOK, statusCode, latency, retryAfter)
+}
+
+// isPoolTokenRejected 判断上游是否因 token 本身拒绝请求（401 或 429），此时应换用池中其他 token 重试
+func isPoolTokenRejected(authToken string, statusCode int) bool {
+	return (statusCode == http.StatusUnauthorized || statusCode == http.StatusTooManyRequests) &&
+		upstreamTokenPool != nil && upstreamTokenPool.Contains(authToken)
+}
+
+// upstreamTokenStats 返回 token 池中每个 token 的统计，未配置 token 池时返回空列表
+func upstreamTokenStats() []tokenpool.Stats {
+	if upstreamTokenPool == nil {
+		return []tokenpool.Stats{}
+	}
+	return upstreamTokenPool.Stats()
+}
+
+// releaseOnClose 包装响应体，关闭时执行 release（只执行一次），用于在流式响应读完后结束 token 的进行中计数
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"z2api/internal/tokenizer"
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// messageOverheadTokens 每条消息的角色标记等额外 token 数
+	messageOverheadTokens = 3
+	// replyPrimingTokens 助手回复的起始标记 token 数
+	replyPrimingTokens = 3
+	// usageTokensKey gin 上下文中记录本次请求 token 总数的键
+	usageTokensKey = "usage_tokens"
+)
+
+// estimatePromptTokens 估算上游请求提示词的 token 数（未经校准），包括消息、工具调用与工具定义
+func estimatePromptTokens(upstreamReq types.UpstreamRequest) int {
+	estimated := replyPrimingTokens
+	for _, msg := range upstreamReq.Messages {
+		estimated += messageOverheadTokens + tokenizer.Estimate(msg.Role) + tokenizer.Estimate(msg.Content) + tokenizer.Estimate(msg.ReasoningContent)
+		for _, call := range msg.ToolCalls {
+			estimated += tokenizer.Estimate(call.Function.Name) + tokenizer.Estimate(call.Function.Arguments)
+		}
+	}
+	if len(upstreamReq.Tools) > 0 {
+		if data, err := sonicInternal.Marshal(upstreamReq.Tools); err == nil {
+			estimated += tokenizer.Estimate(string(data))
+		}
+	}
+	return estimated
+}
+
+// requestPromptTokens 估算聊天请求提示词按模型校准后的 token 数，图片等非文本内容不计入
+func requestPromptTokens(model string, req types.OpenAIRequest) int {
+	upstreamReq := types.UpstreamRequest{Model: model, Tools: req.Tools}
+	for _, msg := range req.Messages {
+		upstreamReq.Messages = append(upstreamReq.Messages, types.UpstreamMessage{
+			Role:             msg.Role,
+			Content:          extractTextContent(msg.Content),
+			ReasoningContent: msg.ReasoningContent,
+			ToolCalls:        msg.ToolCalls,
+		})
+	}
+	return tokenizer.Apply(model, estimatePromptTokens(upstreamReq))
+}
+
+// usageTracker 统计输出给客户端的回答与思考内容，上游未返回 usage 时据此估算，
+// 上游返回 usage 时用其校准分词估算并补充思考内容的 token 数
+type usageTracker struct {
+	model      string
+	prompt     int // 以下均为未经校准的估算值
+	completion int
+	reasoning  int
+	upstream   *types.Usage
+	calibrated bool
+}
+
+// newUsageTracker 创建用量统计，并估算上游请求提示词的 token 数
+func newUsageTracker(upstreamReq types.UpstreamRequest) *usageTracker {
+	return &usageTracker{model: upstreamReq.Model, prompt: estimatePromptTokens(upstreamReq)}
+}
+
+// AddCompletion 计入回答文本
+func (u *usageTracker) AddCompletion(text string) {
+	u.completion += tokenizer.Estimate(text)
+}
+
+// AddReasoning 计入思考内容
+func (u *usageTracker) AddReasoning(text string) {
+	u.reasoning += tokenizer.Estimate(text)
+}
+
+// AddToolCalls 计入工具调用的函数名与参数
+func (u *usageTracker) AddToolCalls(calls []types.ToolCall) {
+	for _, call := range calls {
+		u.AddCompletion(call.Function.Name)
+		u.AddCompletion(call.Function.Arguments)
+	}
+}
+
+// Observe 记录上游返回的 usage，忽略空的 usage
+func (u *usageTracker) Observe(usage *types.Usage) {
+	if usage != nil && usage.TotalTokens > 0 {
+		observed := *usage
+		u.upstream = &observed
+	}
+}
+
+// Usage 返回最终的 usage：优先使用上游返回的 usage（缺少思考内容明细时补充估算值），否则返回本地估算值
+func (u *usageTracker) Usage() *types.Usage {
+	reasoning := tokenizer.Apply(u.model, u.reasoning)
+	if u.upstream == nil {
+		prompt := tokenizer.Apply(u.model, u.prompt)
+		completion := tokenizer.Apply(u.model, u.completion) + reasoning
+		return &types.Usage{
+			PromptTokens:            prompt,
+			CompletionTokens:        completion,
+			TotalTokens:             prompt + completion,
+			CompletionTokensDetails: &types.CompletionTokensDetails{ReasoningTokens: reasoning},
+		}
+	}
+
+	if !u.calibrated {
+		tokenizer.Calibrate(u.model, u.prompt+u.completion+u.reasoning, u.upstream.TotalTokens)
+		u.calibrated = true
+	}
+	usage := *u.upstream
+	if usage.CompletionTokensDetails == nil {
+		usage.CompletionTokensDetails = &types.CompletionTokensDetails{ReasoningTokens: min(reasoning, usage.CompletionTokens)}
+	}
+	return &usage
+}
+
+// aggregatedUsage 返回非流式聚合结果的 usage：上游返回时补充思考内容明细并校准分词估算，否则按聚合结果估算
+func aggregatedUsage(upstreamReq types.UpstreamRequest, aggregator *GinStreamAggregator) *types.Usage {
+	tracker := newUsageTracker(upstreamReq)
+	tracker.AddCompletion(aggregator.Content.String())
+	tracker.AddReasoning(aggregator.ReasoningContent.String())
+	tracker.AddToolCalls(aggregator.ToolCallMgr.GetSortedCalls())
+	tracker.Observe(aggregator.Usage)
+	return tracker.Usage()
+}
+
+// usageTarget 由需要在结束时报告 usage 的流式处理器实现
+type usageTarget interface {
+	SetUsageTracker(tracker *usageTracker)
+}
+
+// usageTrackingHandler 包装阶段处理器，统计交给被包装处理器的文本并记录上游返回的 usage
+type usageTrackingHandler struct {
+	upstreamPhaseHandler
+	tracker *usageTracker
+}
+
+// withUsageTracking 统计经过阶段处理器的输出
+func withUsageTracking(h upstreamPhaseHandler, tracker *usageTracker) upstreamPhaseHandler {
+	return &usageTrackingHandler{upstreamPhaseHandler: h, tracker: tracker}
+}
+
+// ProcessThinkingPhase 计入思考内容
+func (h *usageTrackingHandler) ProcessThinkingPhase(data *types.UpstreamData) {
+	h.tracker.AddReasoning(thinkingDelta(data))
+	h.upstreamPhaseHandler.ProcessThinkingPhase(data)
+}
+
+// ProcessAnswerPhase 计入回答文本
+func (h *usageTrackingHandler) ProcessAnswerPhase(data *types.UpstreamData) {
+	content := data.Data.DeltaContent
+	if data.Data.EditContent != "" {
+		content = processAnswerContent(data.Data.DeltaContent, data.Data.EditContent)
+	}
+	h.tracker.AddCompletion(content)
+	h.upstreamPhaseHandler.ProcessAnswerPhase(data)
+}
+
+// ProcessToolCallPhase 计入工具调用
+func (h *usageTrackingHandler) ProcessToolCallPhase(data *types.UpstreamData) {
+	if len(data.Data.ToolCalls) > 0 {
+		h.tracker.AddToolCalls(data.Data.ToolCalls)
+	} else {
+		h.tracker.AddCompletion(data.Data.EditContent + data.Data.DeltaContent)
+	}
+	h.tracker.Observe(&data.Data.Usage)
+	h.upstreamPhaseHandler.ProcessToolCallPhase(data)
+}
+
+// ProcessOtherPhase 计入其他阶段中的文本并记录 usage
+func (h *usageTrackingHandler) ProcessOtherPhase(data *types.UpstreamData) {
+	h.tracker.AddCompletion(data.Data.DeltaContent)
+	h.tracker.Observe(&data.Data.Usage)
+	h.upstreamPhaseHandler.ProcessOtherPhase(data)
+}
+
+// ProcessDonePhase 记录完成阶段的 usage
+func (h *usageTrackingHandler) ProcessDonePhase(data *types.UpstreamData) {
+	if data != nil {
+		h.tracker.Observe(&data.Data.Usage)
+	}
+	h.upstreamPhaseHandler.ProcessDonePhase(data)
+}
+
+// recordUsage 记录本次请求的 token 总数，由 recordSuccess 计入统计
+func recordUsage(c *gin.Context, usage *types.Usage) {
+	if usage != nil {
+		c.Set(usageTokensKey, usage.TotalTokens)
+	}
+}
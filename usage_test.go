@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"z2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestUsageTracker 测试上游未返回 usage 时的估算与返回时的思考内容明细补充
+func TestUsageTracker(t *testing.T) {
+	upstreamReq := types.UpstreamRequest{
+		Model:    "usage-test-estimate",
+		Messages: []types.UpstreamMessage{{Role: "user", Content: "你好世界"}},
+	}
+
+	tracker := newUsageTracker(upstreamReq)
+	tracker.AddReasoning("思考一下")
+	tracker.AddCompletion("Hello world")
+	usage := tracker.Usage()
+	// 提示词：回复起始 3 + 消息开销 3 + user 1 + 你好世界 2；输出：回答 2 + 思考 2
+	if usage.PromptTokens != 9 || usage.CompletionTokens != 4 || usage.TotalTokens != 13 {
+		t.Errorf("估算 usage = %+v, 期望 prompt 9 completion 4 total 13", usage)
+	}
+	if usage.CompletionTokensDetails == nil || usage.CompletionTokensDetails.ReasoningTokens != 2 {
+		t.Errorf("期望 reasoning_tokens 为 2, 实际 %+v", usage.CompletionTokensDetails)
+	}
+
+	upstreamReq.Model = "usage-test-upstream"
+	tracker = newUsageTracker(upstreamReq)
+	tracker.AddReasoning("思考一下")
+	tracker.Observe(&types.Usage{PromptTokens: 20, CompletionTokens: 30, TotalTokens: 50})
+	usage = tracker.Usage()
+	if usage.PromptTokens != 20 || usage.CompletionTokens != 30 || usage.TotalTokens != 50 {
+		t.Errorf("应使用上游 usage, 实际 %+v", usage)
+	}
+	if usage.CompletionTokensDetails == nil || usage.CompletionTokensDetails.ReasoningTokens == 0 {
+		t.Errorf("应补充 reasoning_tokens, 实际 %+v", usage.CompletionTokensDetails)
+	}
+}
+
+// TestAnthropicStreamUsageEstimate 测试上游未返回 usage 时流式响应报告估算的用量
+func TestAnthropicStreamUsageEstimate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	upstreamReq := types.UpstreamRequest{
+		Model:    "usage-test-stream",
+		Messages: []types.UpstreamMessage{{Role: "user", Content: "你好"}},
+	}
+	handler := NewAnthropicStreamHandler(c, "glm-4.5")
+	h := withOutputHandling(handler, upstreamReq, nil)
+
+	lines := []string{
+		`data: {"data":{"phase":"answer","delta_content":"你好世界"}}`,
+		`data: {"data":{"phase":"done","done":true}}`,
+	}
+	for _, line := range lines {
+		processUpstreamLine(h, line)
+	}
+
+	if handler.usage == nil || handler.usage.CompletionTokens != 2 {
+		t.Fatalf("期望估算 completion_tokens 为 2, 实际 %+v", handler.usage)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"output_tokens":2`) {
+		t.Errorf("message_delta 应报告估算的 output_tokens:\n%s", body)
+	}
+}
+
+// TestGinStreamIncludeUsage 测试设置 stream_options.include_usage 时在 [DONE] 之前输出 usage 块
+func TestGinStreamIncludeUsage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name      string
+		done      string
+		wantUsage string
+	}{
+		{"上游返回 usage", `data: {"data":{"phase":"done","done":true,"usage":{"prompt_tokens":7,"completion_tokens":5,"total_tokens":12}}}`, `"total_tokens":12`},
+		{"本地估算", `data: {"data":{"phase":"done","done":true}}`, `"completion_tokens":2`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			upstreamReq := types.UpstreamRequest{
+				Model:        "usage-test-include",
+				Messages:     []types.UpstreamMessage{{Role: "user", Content: "你好"}},
+				IncludeUsage: true,
+			}
+			handler := NewGinStreamHandler(c, "glm-4.5")
+			handler.SetIncludeUsage(upstreamReq.IncludeUsage)
+			h := withOutputHandling(handler, upstreamReq, nil)
+			for _, line := range []string{`data: {"data":{"phase":"answer","delta_content":"你好世界"}}`, tt.done} {
+				processUpstreamLine(h, line)
+			}
+
+			events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+			if len(events) < 2 || events[len(events)-1] != "data: [DONE]" {
+				t.Fatalf("期望以 [DONE] 结束:\n%s", w.Body.String())
+			}
+			last := events[len(events)-2]
+			if !strings.Contains(last, `"choices":[]`) || !strings.Contains(last, tt.wantUsage) {
+				t.Errorf("[DONE] 之前应为 choices 为空且包含 %s 的 usage 块, 实际:\n%s", tt.wantUsage, last)
+			}
+			for _, event := range events[:len(events)-2] {
+				if strings.Contains(event, `"usage"`) {
+					t.Errorf("usage 只应出现在最后的 usage 块中:\n%s", event)
+				}
+			}
+		})
+	}
+}
@@ -11,6 +11,8 @@ type MultimodalProcessor struct {
 	// 配置选项
 	EnableDebugLog bool
 	Model          string
+	// FileResolver 将 file 内容部分中的文件ID解析为已上传的上游文件（可选）
+	FileResolver func(fileID string) (types.UpstreamFile, bool)
 }
 
 // ProcessResult 处理结果
@@ -25,9 +27,13 @@ type ProcessResult struct {
 
 // ProcessedFile 处理后的文件
 type ProcessedFile struct {
-	Type   string // 文件类型：image, video, document, audio
-	URL    string // 原始URL
-	FileID string // 上传后的文件ID（如果有）
+	Type     string // 文件类型：image, video, document, audio；file 表示按内容自动识别
+	URL      string // 原始URL（http(s) 或 data URL）
+	FileID   string // 上传后的文件ID（如果有）
+	Name     string // 原始文件名（如果有）
+	MimeType string // 客户端声明的MIME类型（如果有）
+	Size     int64  // 客户端声明的文件大小（如果有）
+	Detail   string // 图片的 detail 级别：low、high、auto（如果有）
 }
 
 // NewMultimodalProcessor 创建新的多模态处理器
@@ -97,8 +103,11 @@ func (p *MultimodalProcessor) processContentParts(parts []types.ContentPart) (*P
 				url := part.ImageURL.URL
 				result.Images = append(result.Images, url)
 				result.Files = append(result.Files, ProcessedFile{
-					Type: "image",
-					URL:  url,
+					Type:     "image",
+					URL:      url,
+					MimeType: part.MimeType,
+					Size:     part.Size,
+					Detail:   part.ImageURL.Detail,
 				})
 
 				if p.EnableDebugLog {
@@ -111,8 +120,10 @@ func (p *MultimodalProcessor) processContentParts(parts []types.ContentPart) (*P
 				url := part.VideoURL.URL
 				result.Videos = append(result.Videos, url)
 				result.Files = append(result.Files, ProcessedFile{
-					Type: "video",
-					URL:  url,
+					Type:     "video",
+					URL:      url,
+					MimeType: part.MimeType,
+					Size:     part.Size,
 				})
 
 				if p.EnableDebugLog {
@@ -125,8 +136,10 @@ func (p *MultimodalProcessor) processContentParts(parts []types.ContentPart) (*P
 				url := part.DocumentURL.URL
 				result.Documents = append(result.Documents, url)
 				result.Files = append(result.Files, ProcessedFile{
-					Type: "document",
-					URL:  url,
+					Type:     "document",
+					URL:      url,
+					MimeType: part.MimeType,
+					Size:     part.Size,
 				})
 
 				if p.EnableDebugLog {
@@ -139,8 +152,10 @@ func (p *MultimodalProcessor) processContentParts(parts []types.ContentPart) (*P
 				url := part.AudioURL.URL
 				result.Audios = append(result.Audios, url)
 				result.Files = append(result.Files, ProcessedFile{
-					Type: "audio",
-					URL:  url,
+					Type:     "audio",
+					URL:      url,
+					MimeType: part.MimeType,
+					Size:     part.Size,
 				})
 
 				if p.EnableDebugLog {
@@ -148,6 +163,14 @@ func (p *MultimodalProcessor) processContentParts(parts []types.ContentPart) (*P
 				}
 			}
 
+		case "file":
+			if part.File != nil {
+				if file, ok := p.resolveFileRef(part.File.FileID, part.File.FileData, part.File.Filename, "", part.MimeType, part.Size); ok {
+					result.Files = append(result.Files, file)
+					p.appendTypedURL(result, file)
+				}
+			}
+
 		default:
 			if p.EnableDebugLog {
 				p.logDebug("检测到未知内容类型: %s", part.Type)
@@ -185,6 +208,8 @@ func (p *MultimodalProcessor) processInterfaceArray(parts []interface{}) (*Proce
 		}
 
 		partType, _ := partMap["type"].(string)
+		mimeType, _ := partMap["mime_type"].(string)
+		size := int64Value(partMap["size"])
 
 		switch partType {
 		case "text":
@@ -198,14 +223,17 @@ func (p *MultimodalProcessor) processInterfaceArray(parts []interface{}) (*Proce
 		case "image_url":
 			if imageURL, ok := partMap["image_url"].(map[string]interface{}); ok {
 				if url, ok := imageURL["url"].(string); ok {
+					detail, _ := imageURL["detail"].(string)
 					result.Images = append(result.Images, url)
 					result.Files = append(result.Files, ProcessedFile{
-						Type: "image",
-						URL:  url,
+						Type:     "image",
+						URL:      url,
+						MimeType: mimeType,
+						Size:     size,
+						Detail:   detail,
 					})
 
 					if p.EnableDebugLog {
-						detail, _ := imageURL["detail"].(string)
 						p.logDebug("检测到图像内容: %s (detail: %s)", url, detail)
 					}
 				}
@@ -216,8 +244,10 @@ func (p *MultimodalProcessor) processInterfaceArray(parts []interface{}) (*Proce
 				if url, ok := videoURL["url"].(string); ok {
 					result.Videos = append(result.Videos, url)
 					result.Files = append(result.Files, ProcessedFile{
-						Type: "video",
-						URL:  url,
+						Type:     "video",
+						URL:      url,
+						MimeType: mimeType,
+						Size:     size,
 					})
 
 					if p.EnableDebugLog {
@@ -231,8 +261,10 @@ func (p *MultimodalProcessor) processInterfaceArray(parts []interface{}) (*Proce
 				if url, ok := docURL["url"].(string); ok {
 					result.Documents = append(result.Documents, url)
 					result.Files = append(result.Files, ProcessedFile{
-						Type: "document",
-						URL:  url,
+						Type:     "document",
+						URL:      url,
+						MimeType: mimeType,
+						Size:     size,
 					})
 
 					if p.EnableDebugLog {
@@ -246,8 +278,10 @@ func (p *MultimodalProcessor) processInterfaceArray(parts []interface{}) (*Proce
 				if url, ok := audioURL["url"].(string); ok {
 					result.Audios = append(result.Audios, url)
 					result.Files = append(result.Files, ProcessedFile{
-						Type: "audio",
-						URL:  url,
+						Type:     "audio",
+						URL:      url,
+						MimeType: mimeType,
+						Size:     size,
 					})
 
 					if p.EnableDebugLog {
@@ -257,16 +291,18 @@ func (p *MultimodalProcessor) processInterfaceArray(parts []interface{}) (*Proce
 			}
 
 		case "file":
-			// 处理通用文件类型
-			if fileID, ok := partMap["file_id"].(string); ok {
-				fileType := "document"
-				if ft, ok := partMap["file_type"].(string); ok {
-					fileType = ft
-				}
-				result.Files = append(result.Files, ProcessedFile{
-					Type:   fileType,
-					FileID: fileID,
-				})
+			// 处理通用文件类型：{"file": {"file_id"|"file_data", "filename"}}，兼容顶层 file_id
+			fileRef, _ := partMap["file"].(map[string]interface{})
+			if fileRef == nil {
+				fileRef = partMap
+			}
+			fileID, _ := fileRef["file_id"].(string)
+			fileData, _ := fileRef["file_data"].(string)
+			fileName, _ := fileRef["filename"].(string)
+			fileType, _ := partMap["file_type"].(string)
+			if file, ok := p.resolveFileRef(fileID, fileData, fileName, fileType, mimeType, size); ok {
+				result.Files = append(result.Files, file)
+				p.appendTypedURL(result, file)
 			}
 
 		default:
@@ -286,6 +322,70 @@ func (p *MultimodalProcessor) processInterfaceArray(parts []interface{}) (*Proce
 	return result, nil
 }
 
+// resolveFileRef 根据 file 内容部分构建待处理文件，file_id 优先于 file_data；
+// 配置了 FileResolver 时，已上传文件的ID会解析为对应的上游文件
+func (p *MultimodalProcessor) resolveFileRef(fileID, fileData, fileName, fileType, mimeType string, size int64) (ProcessedFile, bool) {
+	switch {
+	case fileID != "":
+		if p.FileResolver != nil {
+			if upstream, ok := p.FileResolver(fileID); ok {
+				p.logDebug("文件ID %s 解析为上游文件 %s", fileID, upstream.ID)
+				return ProcessedFile{
+					Type:     upstream.Type,
+					FileID:   upstream.ID,
+					Name:     upstream.Name,
+					MimeType: upstream.MimeType,
+					Size:     upstream.Size,
+				}, true
+			}
+		}
+		if fileType == "" {
+			fileType = "document"
+		}
+		return ProcessedFile{Type: fileType, FileID: fileID, Name: fileName}, true
+	case fileData != "":
+		return ProcessedFile{Type: "file", URL: fileData, Name: fileName, MimeType: mimeType, Size: size}, true
+	}
+	return ProcessedFile{}, false
+}
+
+// appendTypedURL 将内联文件按声明的MIME类型归入对应的URL列表
+func (p *MultimodalProcessor) appendTypedURL(result *ProcessResult, file ProcessedFile) {
+	if file.URL == "" {
+		return
+	}
+	mimeType := file.MimeType
+	if mimeType == "" && strings.HasPrefix(file.URL, "data:") {
+		mimeType = strings.SplitN(strings.TrimPrefix(file.URL, "data:"), ";", 2)[0]
+	}
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		result.Images = append(result.Images, file.URL)
+	case strings.HasPrefix(mimeType, "video/"):
+		result.Videos = append(result.Videos, file.URL)
+	case strings.HasPrefix(mimeType, "audio/"):
+		result.Audios = append(result.Audios, file.URL)
+	default:
+		result.Documents = append(result.Documents, file.URL)
+	}
+	if p.EnableDebugLog {
+		p.logDebug("检测到文件内容: %s (%s)", file.Name, mimeType)
+	}
+}
+
+// int64Value 将 JSON 数字转换为 int64
+func int64Value(v interface{}) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	}
+	return 0
+}
+
 // ExtractText 仅提取文本内容（便捷方法）
 func (p *MultimodalProcessor) ExtractText(content interface{}) string {
 	result, err := p.ProcessContent(content)
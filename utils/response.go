@@ -3,6 +3,7 @@ package utils
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -12,9 +13,11 @@ import (
 
 // ErrorResponse 统一的错误响应处理
 func ErrorResponse(c *gin.Context, err errors.APIError) {
-	// 检查是否为调试模式
-	debugMode := c.GetBool("debug_mode")
+	c.AbortWithStatusJSON(err.StatusCode, ErrorBody(err, c.GetBool("debug_mode")))
+}
 
+// ErrorBody 构造 OpenAI 格式的错误响应体，debugMode 为 true 时包含调试信息
+func ErrorBody(err errors.APIError, debugMode bool) gin.H {
 	response := gin.H{
 		"error": gin.H{
 			"message": err.Message,
@@ -36,7 +39,7 @@ func ErrorResponse(c *gin.Context, err errors.APIError) {
 		response["error"].(gin.H)["debug"] = err.Debug
 	}
 
-	c.AbortWithStatusJSON(err.StatusCode, response)
+	return response
 }
 
 // ErrorResponseWithMessage 直接使用消息创建错误响应
@@ -85,6 +88,11 @@ func GenerateChatCompletionID() string {
 	return fmt.Sprintf("chatcmpl-%d", time.Now().Unix())
 }
 
+// GenerateCompletionID 生成文本补全ID
+func GenerateCompletionID() string {
+	return fmt.Sprintf("cmpl-%d", time.Now().Unix())
+}
+
 // GenerateChatID 生成聊天会话ID
 func GenerateChatID() string {
 	now := time.Now()
@@ -111,6 +119,11 @@ func GenerateToolCallID() string {
 	return fmt.Sprintf("call_%s", GenerateShortUUID())
 }
 
+// GenerateFileID 生成文件ID
+func GenerateFileID() string {
+	return "file-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
 // GenerateRequestID 生成请求ID
 func GenerateRequestID() string {
 	return uuid.New().String()
@@ -19,30 +19,12 @@ func NewCustomValidator() *CustomValidator {
 	v := validator.New()
 
 	// 注册自定义验证规则
-	v.RegisterValidation("openai_model", validateOpenAIModel)
 	v.RegisterValidation("temperature", validateTemperature)
 	v.RegisterValidation("top_p", validateTopP)
 
 	return &CustomValidator{validator: v}
 }
 
-// validateOpenAIModel 验证模型名称
-func validateOpenAIModel(fl validator.FieldLevel) bool {
-	model := fl.Field().String()
-	validModels := []string{
-		"glm-4.5", "glm-4.5-air", "glm-4.5-thinking",
-		"glm-4.5-search", "glm-4.5v", "glm-4.6",
-		"gpt-4", "gpt-3.5-turbo", "claude-3", // 兼容映射
-	}
-
-	for _, valid := range validModels {
-		if model == valid || strings.HasPrefix(model, valid) {
-			return true
-		}
-	}
-	return false
-}
-
 // validateTemperature 验证temperature参数
 func validateTemperature(fl validator.FieldLevel) bool {
 	temp := fl.Field().Float()
@@ -82,8 +64,6 @@ func (cv *CustomValidator) formatValidationError(err error) error {
 				errorMessages = append(errorMessages, fmt.Sprintf("Field '%s' must be at least %s", e.Field(), e.Param()))
 			case "max":
 				errorMessages = append(errorMessages, fmt.Sprintf("Field '%s' must be at most %s", e.Field(), e.Param()))
-			case "openai_model":
-				errorMessages = append(errorMessages, fmt.Sprintf("Invalid model: %s", e.Value()))
 			case "temperature":
 				errorMessages = append(errorMessages, "Temperature must be between 0.0 and 2.0")
 			case "top_p":
@@ -103,7 +83,7 @@ func (cv *CustomValidator) formatValidationError(err error) error {
 // TODO: Move type definitions from main package or create shared types package
 /*
 type ValidatedOpenAIRequest struct {
-	Model       string      `json:"model" binding:"required,openai_model"`
+	Model       string      `json:"model" binding:"required"`
 	Messages    []Message   `json:"messages" binding:"required,min=1,dive"`
 	Temperature *float64    `json:"temperature,omitempty" binding:"omitempty,temperature"`
 	TopP        *float64    `json:"top_p,omitempty" binding:"omitempty,top_p"`